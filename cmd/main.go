@@ -6,7 +6,6 @@ import (
 	"fmt"
 	"os"
 	"os/signal"
-	"strconv"
 	"syscall"
 
 	"github.com/truenas/truenas-csi/pkg/driver"
@@ -18,6 +17,9 @@ var (
 	endpoint = flag.String("endpoint", "unix:///csi/csi.sock", "CSI endpoint")
 	nodeID   = flag.String("node-id", "", "Node ID")
 	mode     = flag.String("mode", "all", "Driver mode: controller, node, or all")
+	stateDir = flag.String("state-dir", "/var/lib/truenas-csi", "Host directory for node staging records and connection state")
+
+	metricsAddress = flag.String("metrics-address", "", "Address to serve Prometheus metrics on, e.g. :9809 (disabled if empty)")
 )
 
 func main() {
@@ -38,10 +40,13 @@ func main() {
 		NodeID:   *nodeID,
 		Endpoint: *endpoint,
 		Mode:     driver.DriverMode(*mode),
+		StateDir: *stateDir,
 		Logger:   logger,
+
+		MetricsAddress: *metricsAddress,
 	}
 
-	if err := loadEnvConfig(config); err != nil {
+	if err := driver.LoadEnvConfig(config); err != nil {
 		logger.Error(err, "Invalid configuration")
 		os.Exit(1)
 	}
@@ -97,44 +102,3 @@ func validateFlags() error {
 
 	return nil
 }
-
-func loadEnvConfig(config *driver.DriverConfig) error {
-	if val := os.Getenv("TRUENAS_URL"); val == "" {
-		return fmt.Errorf("TRUENAS_URL is missing")
-	} else {
-		config.TrueNASURL = val
-	}
-
-	if val := os.Getenv("TRUENAS_API_KEY"); val == "" {
-		return fmt.Errorf("TRUENAS_API_KEY is missing")
-	} else {
-		config.TrueNASAPIKey = val
-	}
-
-	if val := os.Getenv("TRUENAS_DEFAULT_POOL"); val == "" {
-		return fmt.Errorf("TRUENAS_DEFAULT_POOL is missing")
-	} else {
-		config.DefaultPool = val
-	}
-
-	// Optional: NFS server and iSCSI portal are derived from TrueNAS URL if not set
-	if val := os.Getenv("TRUENAS_NFS_SERVER"); val != "" {
-		config.NFSServer = val
-	}
-
-	if val := os.Getenv("TRUENAS_ISCSI_PORTAL"); val != "" {
-		config.ISCSIPortal = val
-	}
-
-	if val := os.Getenv("TRUENAS_ISCSI_IQN_BASE"); val != "" {
-		config.ISCSIIQNBase = val
-	}
-
-	if val := os.Getenv("TRUENAS_INSECURE_SKIP_VERIFY"); val != "" {
-		if insecure, err := strconv.ParseBool(val); err == nil {
-			config.TrueNASInsecure = insecure
-		}
-	}
-
-	return nil
-}
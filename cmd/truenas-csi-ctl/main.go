@@ -0,0 +1,297 @@
+// Command truenas-csi-ctl inspects the TrueNAS objects managed by the CSI driver.
+// It reads the same TRUENAS_* environment variables as the driver.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/truenas/truenas-csi/pkg/driver"
+	"k8s.io/klog/v2/textlogger"
+)
+
+const usage = `usage: truenas-csi-ctl [-v level] [-o table|json] <command>
+
+commands:
+  volumes list [-pool name]    Show volumes with their datasets, shares, targets and extents
+  volumes inspect <volume-id>  Show everything the driver reconstructs for a volume
+  snapshots list [-pool name]  Show snapshots of CSI volumes
+  orphans                      Find shares, targets, extents and subsystems that serve no volume
+  trash list                   Show volumes retained in the trash
+  trash restore -name <pv> ... Restore a trashed volume and print a static PV for it
+  migrate democratic-csi ...   Take over volumes provisioned by democratic-csi
+  connectivity                 Check that TrueNAS is reachable with the configured API key
+  doctor [-mode name]          Run preflight checks for TrueNAS (controller) and host tools (node)`
+
+var (
+	verbosity = flag.Int("v", 0, "Log verbosity (0 disables logging)")
+	output    = flag.String("o", "table", "Output format: table or json")
+)
+
+func main() {
+	flag.Usage = func() { fmt.Fprintln(os.Stderr, usage) }
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *output != "table" && *output != "json" {
+		fmt.Fprintln(os.Stderr, "-o must be table or json")
+		os.Exit(2)
+	}
+
+	if err := run(flag.Args()); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func run(args []string) error {
+	logger := logr.Discard()
+	if *verbosity > 0 {
+		logger = textlogger.NewLogger(textlogger.NewConfig(textlogger.Verbosity(*verbosity)))
+	}
+
+	hostname, _ := os.Hostname()
+	config := &driver.DriverConfig{
+		NodeID:   hostname,
+		Endpoint: "unix:///csi/csi.sock",
+		Mode:     driver.DriverModeController,
+		Logger:   logger,
+	}
+	if err := driver.LoadEnvConfig(config); err != nil {
+		return err
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	// These check step by step, without the validation NewDriver does
+	switch args[0] {
+	case "connectivity":
+		return runConnectivity(ctx, config)
+	case "doctor":
+		return runDoctor(ctx, config, args[1:])
+	}
+
+	d, err := driver.NewDriver(config)
+	if err != nil {
+		return err
+	}
+	defer d.Client().Close()
+
+	switch args[0] {
+	case "volumes":
+		return runVolumes(ctx, d, args[1:])
+	case "snapshots":
+		return runSnapshots(ctx, d, args[1:])
+	case "orphans":
+		return runOrphans(ctx, d)
+	case "trash":
+		return runTrashCommand(ctx, d, args[1:])
+	case "migrate":
+		return runMigrateCommand(ctx, d, args[1:])
+	default:
+		return fmt.Errorf("unknown command %q\n%s", args[0], usage)
+	}
+}
+
+func runVolumes(ctx context.Context, d *driver.Driver, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("%s", usage)
+	}
+
+	switch args[0] {
+	case "list":
+		fs := flag.NewFlagSet("volumes list", flag.ContinueOnError)
+		pool := fs.String("pool", "", "Pool to list (default: TRUENAS_DEFAULT_POOL)")
+		if err := fs.Parse(args[1:]); err != nil {
+			return err
+		}
+
+		mappings, err := d.ListVolumeMappings(ctx, *pool)
+		if err != nil {
+			return err
+		}
+		if *output == "json" {
+			return writeJSON(os.Stdout, mappings)
+		}
+
+		w := newTable()
+		fmt.Fprintln(w, "PV\tDATASET\tPROTOCOL\tCAPACITY\tNFS SHARE\tSMB SHARE\tISCSI TARGET\tISCSI EXTENT\tLUN\tNVME SUBSYSTEM\tIMPORTED")
+		for _, m := range mappings {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\t%s\t%s\t%s\t%s\t%s\t%t\n", valueOrDash(m.PVName), m.DatasetPath, m.Protocol, m.CapacityBytes,
+				objectRef(m.NFSShareID, ""), objectRef(m.SMBShareID, m.SMBShareName), objectRef(m.ISCSITargetID, m.ISCSITargetName),
+				objectRef(m.ISCSIExtentID, m.ISCSIExtentName), lunRef(m),
+				objectRef(m.NVMeSubsysID, m.NVMeSubsysName), m.Imported)
+		}
+		return w.Flush()
+
+	case "inspect":
+		if len(args) != 2 {
+			return fmt.Errorf("usage: truenas-csi-ctl volumes inspect <volume-id>")
+		}
+		inspection, err := d.InspectVolume(ctx, args[1])
+		if err != nil {
+			return err
+		}
+		// The raw objects are nested, so inspect always prints JSON
+		return writeJSON(os.Stdout, inspection)
+
+	default:
+		return fmt.Errorf("unknown volumes command %q\n%s", args[0], usage)
+	}
+}
+
+func runSnapshots(ctx context.Context, d *driver.Driver, args []string) error {
+	if len(args) == 0 || args[0] != "list" {
+		return fmt.Errorf("%s", usage)
+	}
+
+	fs := flag.NewFlagSet("snapshots list", flag.ContinueOnError)
+	pool := fs.String("pool", "", "Pool to list (default: TRUENAS_DEFAULT_POOL)")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	snapshots, err := d.ListVolumeSnapshots(ctx, *pool)
+	if err != nil {
+		return err
+	}
+	if *output == "json" {
+		return writeJSON(os.Stdout, snapshots)
+	}
+
+	w := newTable()
+	fmt.Fprintln(w, "SNAPSHOT ID\tSOURCE VOLUME\tCREATED\tUSED\tREFERENCED")
+	for _, snap := range snapshots {
+		created := "-"
+		if t := snap.CreatedAt(); !t.IsZero() {
+			created = t.Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%d\n", snap.ID, snap.Dataset, created, snap.Used, snap.Referenced)
+	}
+	return w.Flush()
+}
+
+func runOrphans(ctx context.Context, d *driver.Driver) error {
+	orphans, err := d.FindOrphans(ctx)
+	if err != nil {
+		return err
+	}
+	if *output == "json" {
+		return writeJSON(os.Stdout, orphans)
+	}
+	if len(orphans) == 0 {
+		fmt.Println("No orphaned objects found")
+		return nil
+	}
+
+	w := newTable()
+	fmt.Fprintln(w, "KIND\tID\tNAME\tREASON")
+	for _, o := range orphans {
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\n", o.Kind, o.ID, o.Name, o.Reason)
+	}
+	return w.Flush()
+}
+
+func runConnectivity(ctx context.Context, config *driver.DriverConfig) error {
+	return writeReport(driver.CheckConnectivity(ctx, config))
+}
+
+func runDoctor(ctx context.Context, config *driver.DriverConfig, args []string) error {
+	fs := flag.NewFlagSet("doctor", flag.ContinueOnError)
+	mode := fs.String("mode", "all", "Checks to run: controller (TrueNAS), node (host tools), or all")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	switch driver.DriverMode(*mode) {
+	case driver.DriverModeController, driver.DriverModeNode, driver.DriverModeAll:
+		config.Mode = driver.DriverMode(*mode)
+	default:
+		return fmt.Errorf("-mode must be one of: controller, node, all")
+	}
+
+	return writeReport(driver.RunDoctor(ctx, config))
+}
+
+// writeReport prints check results with remediation hints and returns an error if any check failed.
+func writeReport(results []driver.CheckResult) error {
+	if *output == "json" {
+		if err := writeJSON(os.Stdout, results); err != nil {
+			return err
+		}
+	} else {
+		w := newTable()
+		fmt.Fprintln(w, "CHECK\tRESULT\tDETAILS")
+		for _, r := range results {
+			fmt.Fprintf(w, "%s\t%s\t%s\n", r.Name, r.Status, r.Message)
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+
+		printedHeader := false
+		for _, r := range results {
+			if r.Status == driver.CheckPass || r.Hint == "" {
+				continue
+			}
+			if !printedHeader {
+				fmt.Println("\nRemediation:")
+				printedHeader = true
+			}
+			fmt.Printf("  %s: %s\n", r.Name, r.Hint)
+		}
+	}
+
+	if driver.HasFailures(results) {
+		return fmt.Errorf("one or more checks failed")
+	}
+	return nil
+}
+
+func newTable() *tabwriter.Writer {
+	return tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+}
+
+func writeJSON(w io.Writer, v any) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// objectRef formats a TrueNAS object ID and name, or "-" if the object is missing.
+func objectRef(id int, name string) string {
+	if id == 0 {
+		return "-"
+	}
+	if name == "" {
+		return fmt.Sprintf("%d", id)
+	}
+	return fmt.Sprintf("%d (%s)", id, name)
+}
+
+func lunRef(m driver.VolumeMapping) string {
+	if m.ISCSITargetID == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%d", m.LUN)
+}
+
+// valueOrDash returns s, or "-" if it is empty.
+func valueOrDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/truenas/truenas-csi/pkg/driver"
+)
+
+const migrateUsage = `usage:
+  truenas-csi-ctl migrate democratic-csi -source-pvs pvs.json [-apply] [-adopt=true] [-pools tank,ssd] [-storage-class name]`
+
+// migratedPVPrefix is prepended to the name of a democratic-csi PV to name its replacement
+const migratedPVPrefix = "truenas-"
+
+// runMigrateCommand maps volumes provisioned by another CSI driver to this driver
+// and writes static PersistentVolume manifests for them to stdout.
+func runMigrateCommand(ctx context.Context, d *driver.Driver, args []string) error {
+	if len(args) == 0 || args[0] != "democratic-csi" {
+		return fmt.Errorf("%s", migrateUsage)
+	}
+
+	fs := flag.NewFlagSet("migrate democratic-csi", flag.ContinueOnError)
+	apply := fs.Bool("apply", false, "Update TrueNAS; without it the migration is only planned")
+	adopt := fs.Bool("adopt", true, "Let DeleteVolume destroy migrated datasets, as democratic-csi did")
+	pools := fs.String("pools", "", "Comma-separated pools to scan (default: all pools)")
+	storageClass := fs.String("storage-class", "", "storageClassName for the emitted PersistentVolumes")
+	sourcePVsPath := fs.String("source-pvs", "", "Output of \"kubectl get pv -o json\" with the democratic-csi PVs")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	if *sourcePVsPath == "" {
+		return fmt.Errorf("-source-pvs is required\n%s", migrateUsage)
+	}
+	sourcePVs, err := readSourcePVs(*sourcePVsPath)
+	if err != nil {
+		return err
+	}
+
+	opts := &driver.MigrationOptions{
+		Apply: *apply,
+		Adopt: *adopt,
+	}
+	if *pools != "" {
+		opts.Pools = strings.Split(*pools, ",")
+	}
+
+	results, migrateErr := d.MigrateFromDemocraticCSI(ctx, opts)
+
+	// The plan goes to stderr so stdout can be piped to kubectl
+	verb := "would"
+	if *apply {
+		verb = "did"
+	}
+	migrated := 0
+	for _, r := range results {
+		if r.Skipped {
+			fmt.Fprintf(os.Stderr, "SKIP %s (%s)\n", r.PVName, r.DatasetPath)
+		} else {
+			fmt.Fprintf(os.Stderr, "MIGRATE %s (%s -> volumeHandle %s)\n", r.PVName, r.DatasetPath, r.Volume.ID)
+			for _, action := range r.Actions {
+				fmt.Fprintf(os.Stderr, "  %s %s\n", verb, action)
+			}
+		}
+		for _, warning := range r.Warnings {
+			fmt.Fprintf(os.Stderr, "  warning: %s\n", warning)
+		}
+
+		if r.Skipped || migrateErr != nil {
+			continue
+		}
+		source, ok := sourcePVs[r.PVName]
+		if !ok {
+			fmt.Fprintf(os.Stderr, "  warning: PV %s not found in %s, no manifest written\n", r.PVName, *sourcePVsPath)
+			continue
+		}
+		migrated++
+		if err := writePersistentVolume(os.Stdout, migratedPV(source, *storageClass), r.Volume); err != nil {
+			return err
+		}
+	}
+	// Manifests of a partly applied migration would bind volumes TrueNAS was not prepared for
+	if migrateErr != nil {
+		return migrateErr
+	}
+
+	fmt.Fprintf(os.Stderr, "%d democratic-csi volume(s) found, %d migratable\n", len(results), migrated)
+	if !*apply && migrated > 0 {
+		fmt.Fprintln(os.Stderr, "Dry run: re-run with -apply to update TrueNAS before applying the manifests")
+	}
+	return nil
+}
+
+// migratedPV describes the PV replacing a democratic-csi PV. It gets a new name,
+// keeps the volume mode and access modes, and is pre-bound to the same claim.
+func migratedPV(source *sourcePV, storageClass string) *staticPV {
+	pv := &staticPV{
+		Name:         migratedPVPrefix + source.Metadata.Name,
+		StorageClass: storageClass,
+		VolumeMode:   source.Spec.VolumeMode,
+		AccessModes:  source.Spec.AccessModes,
+	}
+	if len(pv.Name) > 253 {
+		pv.Name = pv.Name[:253]
+	}
+	if ref := source.Spec.ClaimRef; ref != nil {
+		pv.ClaimNamespace = ref.Namespace
+		pv.ClaimName = ref.Name
+	}
+	return pv
+}
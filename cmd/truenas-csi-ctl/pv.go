@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+
+	"github.com/truenas/truenas-csi/pkg/driver"
+)
+
+// defaultStaticPVCapacity is used for datasets without a quota, since a
+// PersistentVolume must declare a capacity.
+const defaultStaticPVCapacity = "1Gi"
+
+// staticPV describes the static PersistentVolume written for an existing volume.
+type staticPV struct {
+	Name         string
+	StorageClass string // may be empty
+	VolumeMode   string // Filesystem if empty
+	AccessModes  []string
+	// ClaimNamespace and ClaimName pre-bind the PV to a claim, if set.
+	ClaimNamespace string
+	ClaimName      string
+}
+
+// sourcePV holds the fields of an existing PersistentVolume a replacement takes over.
+type sourcePV struct {
+	Metadata struct {
+		Name string `json:"name"`
+	} `json:"metadata"`
+	Spec struct {
+		AccessModes      []string `json:"accessModes"`
+		StorageClassName string   `json:"storageClassName"`
+		VolumeMode       string   `json:"volumeMode"`
+		ClaimRef         *struct {
+			Namespace string `json:"namespace"`
+			Name      string `json:"name"`
+		} `json:"claimRef"`
+	} `json:"spec"`
+}
+
+// readSourcePVs reads the output of "kubectl get pv -o json", by PV name.
+func readSourcePVs(path string) (map[string]*sourcePV, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var list struct {
+		Items []sourcePV `json:"items"`
+	}
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	pvs := make(map[string]*sourcePV, len(list.Items))
+	for i := range list.Items {
+		pvs[list.Items[i].Metadata.Name] = &list.Items[i]
+	}
+	return pvs, nil
+}
+
+// writePersistentVolume writes a static PersistentVolume manifest for an existing volume.
+func writePersistentVolume(w io.Writer, pv *staticPV, volInfo *driver.VolumeInfo) error {
+	capacity := defaultStaticPVCapacity
+	if volInfo.CapacityBytes > 0 {
+		capacity = strconv.FormatInt(volInfo.CapacityBytes, 10)
+	}
+
+	accessModes := pv.AccessModes
+	if len(accessModes) == 0 {
+		accessModes = []string{"ReadWriteOnce"}
+		if volInfo.Protocol == driver.ProtocolNFS {
+			accessModes = []string{"ReadWriteMany"}
+		}
+	}
+
+	volumeMode := pv.VolumeMode
+	if volumeMode == "" {
+		volumeMode = "Filesystem"
+	}
+
+	attributes := map[string]string{"protocol": volInfo.Protocol}
+	for k, v := range volInfo.VolumeContext {
+		attributes[k] = v
+	}
+	keys := make([]string, 0, len(attributes))
+	for k := range attributes {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	fmt.Fprintf(w, "---\n")
+	fmt.Fprintf(w, "apiVersion: v1\n")
+	fmt.Fprintf(w, "kind: PersistentVolume\n")
+	fmt.Fprintf(w, "metadata:\n")
+	fmt.Fprintf(w, "  name: %s\n", pv.Name)
+	fmt.Fprintf(w, "spec:\n")
+	fmt.Fprintf(w, "  capacity:\n")
+	fmt.Fprintf(w, "    storage: %q\n", capacity)
+	fmt.Fprintf(w, "  accessModes:\n")
+	for _, mode := range accessModes {
+		fmt.Fprintf(w, "    - %s\n", mode)
+	}
+	fmt.Fprintf(w, "  persistentVolumeReclaimPolicy: Retain\n")
+	if pv.StorageClass != "" {
+		fmt.Fprintf(w, "  storageClassName: %s\n", pv.StorageClass)
+	}
+	fmt.Fprintf(w, "  volumeMode: %s\n", volumeMode)
+	if pv.ClaimName != "" {
+		fmt.Fprintf(w, "  claimRef:\n")
+		fmt.Fprintf(w, "    apiVersion: v1\n")
+		fmt.Fprintf(w, "    kind: PersistentVolumeClaim\n")
+		fmt.Fprintf(w, "    namespace: %s\n", pv.ClaimNamespace)
+		fmt.Fprintf(w, "    name: %s\n", pv.ClaimName)
+	}
+	fmt.Fprintf(w, "  csi:\n")
+	fmt.Fprintf(w, "    driver: %s\n", driver.DRIVER_NAME)
+	fmt.Fprintf(w, "    volumeHandle: %q\n", volInfo.ID)
+	fmt.Fprintf(w, "    volumeAttributes:\n")
+	for _, k := range keys {
+		if _, err := fmt.Fprintf(w, "      %q: %q\n", k, attributes[k]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
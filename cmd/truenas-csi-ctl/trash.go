@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/truenas/truenas-csi/pkg/driver"
+)
+
+const trashUsage = `usage:
+  truenas-csi-ctl trash list
+  truenas-csi-ctl trash restore -name <pv-name> [-volume-mode Block] [-param key=value ...] <pool/.csi-trash/dataset>`
+
+// paramFlags collects repeated -param key=value flags.
+type paramFlags map[string]string
+
+func (p paramFlags) String() string {
+	return fmt.Sprint(map[string]string(p))
+}
+
+func (p paramFlags) Set(value string) error {
+	key, val, found := strings.Cut(value, "=")
+	if !found || key == "" {
+		return fmt.Errorf("expected key=value, got %q", value)
+	}
+	p[key] = val
+	return nil
+}
+
+// runTrashCommand lists trashed volumes or restores one as a static PV.
+func runTrashCommand(ctx context.Context, d *driver.Driver, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("%s", trashUsage)
+	}
+
+	switch args[0] {
+	case "list":
+		entries, err := d.ListTrash(ctx)
+		if err != nil {
+			return err
+		}
+		if *output == "json" {
+			return writeJSON(os.Stdout, entries)
+		}
+		tw := newTable()
+		fmt.Fprintln(tw, "DATASET\tORIGINAL\tTYPE\tCAPACITY\tEXPIRES")
+		for _, e := range entries {
+			expires := "never"
+			if !e.ExpiresAt.IsZero() {
+				expires = e.ExpiresAt.Local().Format(time.RFC3339)
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%s\n", e.DatasetPath, e.OriginalPath, e.Type, e.CapacityBytes, expires)
+		}
+		return tw.Flush()
+
+	case "restore":
+		fs := flag.NewFlagSet("trash restore", flag.ContinueOnError)
+		name := fs.String("name", "", "Name of the restored volume and PersistentVolume")
+		volumeMode := fs.String("volume-mode", "Filesystem", "volumeMode of the PersistentVolume (Filesystem or Block)")
+		params := paramFlags{}
+		fs.Var(params, "param", "StorageClass-style parameter for the re-created share/target (repeatable)")
+		if err := fs.Parse(args[1:]); err != nil {
+			return err
+		}
+		if fs.NArg() != 1 || *name == "" {
+			return fmt.Errorf("%s", trashUsage)
+		}
+		if *volumeMode != "Filesystem" && *volumeMode != "Block" {
+			return fmt.Errorf("invalid -volume-mode %q (valid: Filesystem, Block)", *volumeMode)
+		}
+
+		volInfo, err := d.RestoreFromTrash(ctx, fs.Arg(0), *name, params)
+		if err != nil {
+			return err
+		}
+		return writePersistentVolume(os.Stdout, &staticPV{Name: *name, VolumeMode: *volumeMode}, volInfo)
+
+	default:
+		return fmt.Errorf("unknown trash command %q\n%s", args[0], trashUsage)
+	}
+}
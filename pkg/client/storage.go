@@ -11,11 +11,13 @@ import (
 
 // TrueNAS API method names for datasets
 const (
-	methodDatasetCreate = "pool.dataset.create"
-	methodDatasetGet    = "pool.dataset.get_instance"
-	methodDatasetQuery  = "pool.dataset.query"
-	methodDatasetDelete = "pool.dataset.delete"
-	methodDatasetUpdate = "pool.dataset.update"
+	methodDatasetCreate  = "pool.dataset.create"
+	methodDatasetGet     = "pool.dataset.get_instance"
+	methodDatasetQuery   = "pool.dataset.query"
+	methodDatasetDelete  = "pool.dataset.delete"
+	methodDatasetUpdate  = "pool.dataset.update"
+	methodDatasetRename  = "pool.dataset.rename"
+	methodDatasetPromote = "pool.dataset.promote"
 )
 
 // TrueNAS API method names for NFS shares
@@ -24,6 +26,15 @@ const (
 	methodNFSGet    = "sharing.nfs.get_instance"
 	methodNFSQuery  = "sharing.nfs.query"
 	methodNFSDelete = "sharing.nfs.delete"
+	methodNFSConfig = "nfs.config"
+)
+
+// TrueNAS API method names for SMB shares
+const (
+	methodSMBCreate = "sharing.smb.create"
+	methodSMBQuery  = "sharing.smb.query"
+	methodSMBDelete = "sharing.smb.delete"
+	methodSMBConfig = "smb.config"
 )
 
 // TrueNAS API method names for iSCSI
@@ -31,9 +42,11 @@ const (
 	methodISCSITargetCreate       = "iscsi.target.create"
 	methodISCSITargetQuery        = "iscsi.target.query"
 	methodISCSITargetDelete       = "iscsi.target.delete"
+	methodISCSITargetUpdate       = "iscsi.target.update"
 	methodISCSIExtentCreate       = "iscsi.extent.create"
 	methodISCSIExtentQuery        = "iscsi.extent.query"
 	methodISCSIExtentDelete       = "iscsi.extent.delete"
+	methodISCSIExtentUpdate       = "iscsi.extent.update"
 	methodISCSITargetExtentCreate = "iscsi.targetextent.create"
 	methodISCSITargetExtentQuery  = "iscsi.targetextent.query"
 	methodISCSITargetExtentDelete = "iscsi.targetextent.delete"
@@ -43,14 +56,35 @@ const (
 	methodISCSIInitiatorCreate    = "iscsi.initiator.create"
 	methodISCSIInitiatorQuery     = "iscsi.initiator.query"
 	methodISCSIInitiatorDelete    = "iscsi.initiator.delete"
+	methodISCSIPortalQuery        = "iscsi.portal.query"
+	methodISCSIGlobalConfig       = "iscsi.global.config"
+)
+
+// TrueNAS API method names for the NVMe-oF target (TrueNAS 25.04+)
+const (
+	methodNVMetGlobalConfig     = "nvmet.global.config"
+	methodNVMetSubsysCreate     = "nvmet.subsys.create"
+	methodNVMetSubsysQuery      = "nvmet.subsys.query"
+	methodNVMetSubsysDelete     = "nvmet.subsys.delete"
+	methodNVMetNamespaceCreate  = "nvmet.namespace.create"
+	methodNVMetNamespaceQuery   = "nvmet.namespace.query"
+	methodNVMetNamespaceDelete  = "nvmet.namespace.delete"
+	methodNVMetHostCreate       = "nvmet.host.create"
+	methodNVMetHostQuery        = "nvmet.host.query"
+	methodNVMetHostSubsysCreate = "nvmet.host_subsys.create"
+	methodNVMetPortQuery        = "nvmet.port.query"
+	methodNVMetPortSubsysCreate = "nvmet.port_subsys.create"
 )
 
 // TrueNAS API method names for snapshots
 const (
-	methodSnapshotCreate = "pool.snapshot.create"
-	methodSnapshotDelete = "pool.snapshot.delete"
-	methodSnapshotClone  = "pool.snapshot.clone"
-	methodSnapshotQuery  = "pool.snapshot.query"
+	methodSnapshotCreate   = "pool.snapshot.create"
+	methodSnapshotDelete   = "pool.snapshot.delete"
+	methodSnapshotClone    = "pool.snapshot.clone"
+	methodSnapshotQuery    = "pool.snapshot.query"
+	methodSnapshotHold     = "pool.snapshot.hold"
+	methodSnapshotRelease  = "pool.snapshot.release"
+	methodSnapshotRollback = "pool.snapshot.rollback"
 )
 
 // TrueNAS API method names for snapshot tasks (scheduled snapshots)
@@ -61,11 +95,22 @@ const (
 	methodSnapshotTaskDelete = "pool.snapshottask.delete"
 )
 
+// TrueNAS API method names for replication
+const (
+	methodReplicationRunOnetime   = "replication.run_onetime"
+	methodKeychainCredentialQuery = "keychaincredential.query"
+)
+
 // TrueNAS API method names for pools
 const (
 	methodPoolQuery = "pool.query"
 )
 
+// TrueNAS API method names for alerts
+const (
+	methodAlertList = "alert.list"
+)
+
 // TrueNAS API method names for ZFS resources
 const (
 	methodZFSResourceQuery = "zfs.resource.query"
@@ -77,6 +122,30 @@ const (
 	methodCoreGetJobs       = "core.get_jobs"
 )
 
+// TrueNAS API method names for services and the authenticated session
+const (
+	methodServiceQuery   = "service.query"
+	methodAuthMe         = "auth.me"
+	methodInterfaceQuery = "interface.query"
+)
+
+// queryMethods are the (filters, options) query methods used by this client.
+var queryMethods = []string{
+	methodDatasetQuery,
+	methodNFSQuery,
+	methodISCSITargetQuery,
+	methodISCSIExtentQuery,
+	methodISCSITargetExtentQuery,
+	methodISCSIAuthQuery,
+	methodISCSIInitiatorQuery,
+	methodISCSIPortalQuery,
+	methodSnapshotQuery,
+	methodSnapshotTaskQuery,
+	methodPoolQuery,
+	methodServiceQuery,
+	methodInterfaceQuery,
+}
+
 // Default configuration values
 const (
 	defaultISCSIPortalID = 1
@@ -84,23 +153,41 @@ const (
 
 // Dataset represents a ZFS dataset in TrueNAS.
 type Dataset struct {
-	ID              string         `json:"id"`
-	Name            string         `json:"name"`
-	Pool            string         `json:"pool"`
-	Type            string         `json:"type"`
-	Mountpoint      string         `json:"mountpoint"`
-	Used            int64          `json:"used"`
-	Available       int64          `json:"available"`
-	RefQuota        int64          `json:"refquota"`
-	RefReservation  int64          `json:"refreservation"`
-	Volsize         int64          `json:"volsize"`         // For ZVOLs (iSCSI volumes)
-	Compression     any            `json:"compression"`     // Can be string or object in TrueNAS
-	Deduplication   any            `json:"deduplication"`   // Can be string or object in TrueNAS
-	Sync            any            `json:"sync"`            // Can be string or object in TrueNAS
-	RecordSize      any            `json:"recordsize"`      // Can be string or object in TrueNAS
-	ACLMode         any            `json:"aclmode"`         // Can be string or object in TrueNAS
-	ACLType         any            `json:"acltype"`         // Can be string or object in TrueNAS
-	ExtraProperties map[string]any `json:"extra_properties,omitempty"`
+	ID              string            `json:"id"`
+	Name            string            `json:"name"`
+	Pool            string            `json:"pool"`
+	Type            string            `json:"type"`
+	Mountpoint      string            `json:"mountpoint"`
+	Used            int64             `json:"used"`
+	Referenced      int64             `json:"referenced"`
+	Available       int64             `json:"available"`
+	RefQuota        int64             `json:"refquota"`
+	RefReservation  int64             `json:"refreservation"`
+	Volsize         int64             `json:"volsize"` // For ZVOLs (iSCSI volumes)
+	Origin          string            `json:"origin"`  // Snapshot a clone was created from, empty otherwise
+	Encrypted       bool              `json:"encrypted"`
+	Locked          bool              `json:"locked"`        // Encrypted and its key is not loaded
+	Compression     any               `json:"compression"`   // Can be string or object in TrueNAS
+	Deduplication   any               `json:"deduplication"` // Can be string or object in TrueNAS
+	Sync            any               `json:"sync"`          // Can be string or object in TrueNAS
+	RecordSize      any               `json:"recordsize"`    // Can be string or object in TrueNAS
+	ACLMode         any               `json:"aclmode"`       // Can be string or object in TrueNAS
+	ACLType         any               `json:"acltype"`       // Can be string or object in TrueNAS
+	ExtraProperties map[string]any    `json:"extra_properties,omitempty"`
+	UserProperties  map[string]string `json:"user_properties,omitempty"` // ZFS user properties (namespace:key -> value)
+}
+
+// UserProperty is a ZFS user property key/value pair as accepted by pool.dataset.create.
+type UserProperty struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// UserPropertyUpdate sets or removes a ZFS user property via pool.dataset.update.
+type UserPropertyUpdate struct {
+	Key    string `json:"key"`
+	Value  string `json:"value,omitempty"`
+	Remove bool   `json:"remove,omitempty"`
 }
 
 // DatasetCreateOptions specifies options for creating a dataset.
@@ -118,8 +205,10 @@ type DatasetCreateOptions struct {
 	Volsize         int64          `json:"volsize,omitempty"` // For ZVOLs
 	Volblocksize    string         `json:"volblocksize,omitempty"`
 	Comments        string         `json:"comments,omitempty"`
+	ShareType       string         `json:"share_type,omitempty"` // GENERIC (default), SMB, ...
 	CreateAncestors bool           `json:"create_ancestors,omitempty"`
 	Properties      map[string]any `json:"properties,omitempty"`
+	UserProperties  []UserProperty `json:"user_properties,omitempty"`
 	// Encryption options
 	Encryption        bool               `json:"encryption,omitempty"`
 	EncryptionOptions *EncryptionOptions `json:"encryption_options,omitempty"`
@@ -156,6 +245,15 @@ type DatasetUpdateOptions struct {
 	RefQuotaWarning  *int64              `json:"refquota_warning,omitempty"`
 	RefQuotaCritical *int64              `json:"refquota_critical,omitempty"`
 	UserProperties   []map[string]string `json:"user_properties,omitempty"`
+	// UserPropertiesUpdate sets or removes individual user properties without
+	// touching the rest.
+	UserPropertiesUpdate []UserPropertyUpdate `json:"user_properties_update,omitempty"`
+}
+
+// DatasetRenameOptions specifies options for renaming a dataset.
+type DatasetRenameOptions struct {
+	NewName string `json:"new_name"`
+	Force   bool   `json:"force"`
 }
 
 // QueryOptions specifies standard TrueNAS query options for .query and .get_instance methods.
@@ -177,7 +275,8 @@ type DatasetQueryOptions struct {
 
 // DatasetGetExtraOptions specifies extra properties to retrieve for datasets.
 type DatasetGetExtraOptions struct {
-	Properties []string `json:"properties"`
+	Properties     []string `json:"properties"`
+	UserProperties bool     `json:"user_properties"`
 }
 
 // DatasetDeleteOptions specifies options for deleting a dataset.
@@ -200,6 +299,12 @@ type NFSShare struct {
 	Networks []string `json:"networks,omitempty"`
 }
 
+// NFSConfig represents the global NFS service configuration in TrueNAS.
+type NFSConfig struct {
+	ID     int      `json:"id"`
+	BindIP []string `json:"bindip"` // Empty means the service listens on all addresses
+}
+
 // NFSShareCreateOptions specifies options for creating an NFS share.
 type NFSShareCreateOptions struct {
 	Path            string   `json:"path"`
@@ -216,6 +321,37 @@ type NFSShareCreateOptions struct {
 	ExposeSnapshots bool     `json:"expose_snapshots,omitempty"`
 }
 
+// SMBShare represents an SMB share in TrueNAS.
+type SMBShare struct {
+	ID        int    `json:"id"`
+	Name      string `json:"name"`
+	Path      string `json:"path"`
+	Purpose   string `json:"purpose,omitempty"`
+	Comment   string `json:"comment,omitempty"`
+	ReadOnly  bool   `json:"readonly"`
+	Browsable bool   `json:"browsable"`
+	Enabled   bool   `json:"enabled"`
+}
+
+// SMBShareCreateOptions specifies options for creating an SMB share.
+type SMBShareCreateOptions struct {
+	Name      string `json:"name"`
+	Path      string `json:"path"`
+	Purpose   string `json:"purpose,omitempty"` // Share preset; DEFAULT_SHARE if empty
+	Comment   string `json:"comment,omitempty"`
+	ReadOnly  bool   `json:"readonly"`
+	Browsable bool   `json:"browsable"`
+	Enabled   bool   `json:"enabled"`
+}
+
+// SMBConfig represents the global SMB service configuration in TrueNAS.
+type SMBConfig struct {
+	ID          int      `json:"id"`
+	NetbiosName string   `json:"netbiosname"`
+	Workgroup   string   `json:"workgroup"`
+	BindIP      []string `json:"bindip"` // Empty means the service listens on all addresses
+}
+
 // ISCSITarget represents an iSCSI target in TrueNAS.
 type ISCSITarget struct {
 	ID     int                `json:"id"`
@@ -234,6 +370,12 @@ type ISCSITargetCreateOptions struct {
 	Groups []ISCSITargetGroup `json:"groups,omitempty"`
 }
 
+// ISCSITargetUpdateOptions specifies fields to change on an existing iSCSI target.
+type ISCSITargetUpdateOptions struct {
+	Name  string `json:"name,omitempty"`
+	Alias string `json:"alias,omitempty"`
+}
+
 // ISCSITargetGroup represents a portal group configuration for an iSCSI target.
 type ISCSITargetGroup struct {
 	Portal     int    `json:"portal"`
@@ -293,6 +435,12 @@ type ISCSIExtentCreateOptions struct {
 	Enabled   bool   `json:"enabled"`
 }
 
+// ISCSIExtentUpdateOptions specifies fields to change on an existing iSCSI extent.
+type ISCSIExtentUpdateOptions struct {
+	Name    string `json:"name,omitempty"`
+	Comment string `json:"comment,omitempty"`
+}
+
 // ISCSITargetExtent represents the association between an iSCSI target and extent.
 type ISCSITargetExtent struct {
 	ID     int `json:"id"`
@@ -344,6 +492,13 @@ type ISCSIPortalListen struct {
 	Port int    `json:"port"`
 }
 
+// ISCSIGlobalConfig represents the global iSCSI target configuration in TrueNAS.
+type ISCSIGlobalConfig struct {
+	ID         int    `json:"id"`
+	Basename   string `json:"basename"`
+	ListenPort int    `json:"listen_port,omitempty"`
+}
+
 // ISCSIInitiator represents an iSCSI initiator configuration in TrueNAS.
 type ISCSIInitiator struct {
 	ID         int      `json:"id"`
@@ -357,6 +512,84 @@ type ISCSIInitiatorCreateOptions struct {
 	Comment    string   `json:"comment,omitempty"`
 }
 
+// NVMetGlobalConfig represents the global NVMe-oF target configuration in TrueNAS.
+type NVMetGlobalConfig struct {
+	ID      int    `json:"id"`
+	BaseNQN string `json:"basenqn"`
+	ANA     bool   `json:"ana"`
+}
+
+// NVMetSubsys represents an NVMe-oF subsystem in TrueNAS.
+type NVMetSubsys struct {
+	ID           int    `json:"id"`
+	Name         string `json:"name"`
+	SubNQN       string `json:"subnqn"`
+	Serial       string `json:"serial,omitempty"`
+	AllowAnyHost bool   `json:"allow_any_host"`
+}
+
+// NVMetSubsysCreateOptions specifies options for creating an NVMe-oF subsystem.
+// TrueNAS derives the subsystem NQN from the global base NQN and the name.
+type NVMetSubsysCreateOptions struct {
+	Name         string `json:"name"`
+	AllowAnyHost bool   `json:"allow_any_host"`
+}
+
+// NVMetSubsysDeleteOptions specifies options for deleting an NVMe-oF subsystem.
+type NVMetSubsysDeleteOptions struct {
+	Force bool `json:"force"` // Also remove namespaces and host/port links
+}
+
+// NVMetNamespace represents a namespace (zvol or file) of an NVMe-oF subsystem.
+type NVMetNamespace struct {
+	ID         int          `json:"id"`
+	NSID       int          `json:"nsid"`
+	DeviceType string       `json:"device_type"` // ZVOL or FILE
+	DevicePath string       `json:"device_path"` // e.g. "zvol/pool/volume"
+	Enabled    bool         `json:"enabled"`
+	Subsys     *NVMetSubsys `json:"subsys,omitempty"`
+}
+
+// NVMetNamespaceCreateOptions specifies options for creating an NVMe-oF namespace.
+type NVMetNamespaceCreateOptions struct {
+	NSID       int    `json:"nsid,omitempty"` // Assigned by TrueNAS if 0
+	DeviceType string `json:"device_type"`
+	DevicePath string `json:"device_path"`
+	SubsysID   int    `json:"subsys_id"`
+	Enabled    bool   `json:"enabled"`
+}
+
+// NVMetHost represents an NVMe-oF host (initiator) allowed to connect to subsystems.
+type NVMetHost struct {
+	ID      int    `json:"id,omitempty"`
+	HostNQN string `json:"hostnqn"`
+}
+
+// NVMetHostSubsys represents the association between an NVMe-oF host and subsystem.
+type NVMetHostSubsys struct {
+	ID       int `json:"id,omitempty"`
+	HostID   int `json:"host_id"`
+	SubsysID int `json:"subsys_id"`
+}
+
+// NVMetPort represents an NVMe-oF port (transport listener) in TrueNAS.
+type NVMetPort struct {
+	ID          int    `json:"id"`
+	Index       int    `json:"index"`
+	AddrTrtype  string `json:"addr_trtype"` // TCP, RDMA or FC
+	AddrAdrfam  string `json:"addr_adrfam"` // IPV4 or IPV6
+	AddrTraddr  string `json:"addr_traddr"`
+	AddrTrsvcid any    `json:"addr_trsvcid"` // Can be int or string in TrueNAS
+	Enabled     bool   `json:"enabled"`
+}
+
+// NVMetPortSubsys represents the association between an NVMe-oF port and subsystem.
+type NVMetPortSubsys struct {
+	ID       int `json:"id,omitempty"`
+	PortID   int `json:"port_id"`
+	SubsysID int `json:"subsys_id"`
+}
+
 // Snapshot represents a ZFS snapshot in TrueNAS.
 type Snapshot struct {
 	ID         string         `json:"id"`
@@ -366,13 +599,107 @@ type Snapshot struct {
 	Used       int64          `json:"used"`
 	Referenced int64          `json:"referenced"`
 	Properties map[string]any `json:"properties,omitempty"`
+	// HoldTags holds the tags of the user holds on the snapshot, if retrieved
+	HoldTags map[string]any `json:"holds,omitempty"`
+}
+
+// PropertyInt64 returns a numeric ZFS property of the snapshot, or 0 if it was
+// not retrieved.
+func (s *Snapshot) PropertyInt64(name string) int64 {
+	return getParsedInt64(s.Properties, name)
+}
+
+// CreatedAt returns when the snapshot was taken, from the creation property or
+// CreateTime, or the zero time if neither is known.
+func (s *Snapshot) CreatedAt() time.Time {
+	if prop, ok := s.Properties["creation"].(map[string]any); ok {
+		// rawvalue holds seconds since the epoch
+		if raw, ok := prop["rawvalue"].(string); ok {
+			if sec, err := strconv.ParseInt(raw, 10, 64); err == nil && sec > 0 {
+				return time.Unix(sec, 0).UTC()
+			}
+		}
+		// Datetimes are encoded as {"$date": milliseconds}
+		if parsed, ok := prop["parsed"].(map[string]any); ok {
+			if ms, ok := parsed["$date"].(float64); ok && ms > 0 {
+				return time.UnixMilli(int64(ms)).UTC()
+			}
+		}
+	}
+	if s.CreateTime != "" {
+		if sec, err := strconv.ParseInt(s.CreateTime, 10, 64); err == nil && sec > 0 {
+			return time.Unix(sec, 0).UTC()
+		}
+		if t, err := time.Parse(time.RFC3339, s.CreateTime); err == nil {
+			return t.UTC()
+		}
+	}
+	return time.Time{}
+}
+
+// Clones returns the datasets cloned from the snapshot, if the clones property
+// was retrieved.
+func (s *Snapshot) Clones() []string {
+	if prop, ok := s.Properties["clones"].(map[string]any); ok {
+		if parsed, ok := prop["parsed"].([]any); ok {
+			clones := make([]string, 0, len(parsed))
+			for _, clone := range parsed {
+				if name, ok := clone.(string); ok && name != "" {
+					clones = append(clones, name)
+				}
+			}
+			return clones
+		}
+	}
+	value := getParsedString(s.Properties, "clones")
+	if value == "" || value == "-" {
+		return nil
+	}
+	return strings.Split(value, ",")
+}
+
+// DeferDestroy reports whether the snapshot is marked for deferred destroy, if
+// the defer_destroy property was retrieved.
+func (s *Snapshot) DeferDestroy() bool {
+	if prop, ok := s.Properties["defer_destroy"].(map[string]any); ok {
+		if parsed, ok := prop["parsed"].(bool); ok {
+			return parsed
+		}
+	}
+	return getParsedString(s.Properties, "defer_destroy") == "on"
+}
+
+// Holds returns the number of user holds on the snapshot (userrefs). ZFS does
+// not destroy a held snapshot.
+func (s *Snapshot) Holds() int64 {
+	return s.PropertyInt64("userrefs")
+}
+
+// HasHold reports whether the snapshot has a user hold with the given tag. It
+// is false if the holds were not retrieved.
+func (s *Snapshot) HasHold(tag string) bool {
+	_, ok := s.HoldTags[tag]
+	return ok
+}
+
+// SizeBytes returns the size of a volume restored from the snapshot: the
+// volsize of a zvol snapshot, otherwise the data it references.
+func (s *Snapshot) SizeBytes() int64 {
+	if volsize := s.PropertyInt64("volsize"); volsize > 0 {
+		return volsize
+	}
+	if referenced := s.PropertyInt64("referenced"); referenced > 0 {
+		return referenced
+	}
+	return s.Referenced
 }
 
 // SnapshotCreateOptions specifies options for creating a snapshot.
 type SnapshotCreateOptions struct {
-	Dataset   string `json:"dataset"`
-	Name      string `json:"name"`
-	Recursive bool   `json:"recursive"`
+	Dataset   string   `json:"dataset"`
+	Name      string   `json:"name"`
+	Recursive bool     `json:"recursive"`
+	Exclude   []string `json:"exclude,omitempty"` // Descendants left out of a recursive snapshot
 }
 
 // SnapshotDeleteOptions specifies options for deleting a snapshot.
@@ -381,6 +708,18 @@ type SnapshotDeleteOptions struct {
 	Recursive bool `json:"recursive"`
 }
 
+// SnapshotHoldOptions specifies the tag of a snapshot hold.
+type SnapshotHoldOptions struct {
+	Tag string `json:"tag"`
+}
+
+// SnapshotRollbackOptions specifies options for rolling a dataset back to a snapshot.
+type SnapshotRollbackOptions struct {
+	Recursive       bool `json:"recursive"`        // destroy newer snapshots (zfs rollback -r)
+	RecursiveClones bool `json:"recursive_clones"` // also destroy clones of those (zfs rollback -R)
+	Force           bool `json:"force"`            // unmount the filesystem if needed (zfs rollback -f)
+}
+
 // SnapshotClone specifies parameters for cloning a snapshot.
 type SnapshotClone struct {
 	Snapshot   string `json:"snapshot"`
@@ -434,16 +773,66 @@ type SnapshotTaskDeleteOptions struct {
 
 // Pool represents a ZFS storage pool in TrueNAS.
 type Pool struct {
-	ID        int    `json:"id"`
-	Name      string `json:"name"`
-	GUID      string `json:"guid"`
-	Status    string `json:"status"`
-	Healthy   bool   `json:"healthy"`
-	Size      int64  `json:"size"`
-	Allocated int64  `json:"allocated"`
-	Free      int64  `json:"free"`
-	Path      string `json:"path"`
-	Autotrim  any    `json:"autotrim"` // Can be bool or object in TrueNAS
+	ID        int       `json:"id"`
+	Name      string    `json:"name"`
+	GUID      string    `json:"guid"`
+	Status    string    `json:"status"`
+	Healthy   bool      `json:"healthy"`
+	Size      int64     `json:"size"`
+	Allocated int64     `json:"allocated"`
+	Free      int64     `json:"free"`
+	Path      string    `json:"path"`
+	Autotrim  any       `json:"autotrim"` // Can be bool or object in TrueNAS
+	Scan      *PoolScan `json:"scan"`
+}
+
+// PoolScan is the last or running scrub or resilver of a pool.
+type PoolScan struct {
+	Function string `json:"function"` // SCRUB or RESILVER
+	State    string `json:"state"`    // SCANNING, FINISHED or CANCELED
+	Errors   int64  `json:"errors"`
+}
+
+// Alert is an alert raised by TrueNAS, such as a degraded pool or a full dataset.
+type Alert struct {
+	UUID      string `json:"uuid"`
+	Klass     string `json:"klass"`
+	Level     string `json:"level"` // INFO, NOTICE, WARNING, ERROR, CRITICAL, ALERT or EMERGENCY
+	Formatted string `json:"formatted"`
+	Dismissed bool   `json:"dismissed"`
+	Args      any    `json:"args"` // Depends on the alert class: object, list or scalar
+}
+
+// Service represents a TrueNAS system service such as "nfs" or "iscsitarget".
+type Service struct {
+	ID      int    `json:"id"`
+	Service string `json:"service"`
+	Enable  bool   `json:"enable"`
+	State   string `json:"state"` // RUNNING, STOPPED, ...
+}
+
+// NetworkInterface represents a network interface in TrueNAS.
+type NetworkInterface struct {
+	ID      string           `json:"id"`
+	Name    string           `json:"name"`
+	Aliases []InterfaceAlias `json:"aliases"`
+	// FailoverVirtualAliases are the virtual IPs shared by both controllers on HA systems.
+	FailoverVirtualAliases []InterfaceAlias `json:"failover_virtual_aliases,omitempty"`
+	State                  InterfaceState   `json:"state"`
+}
+
+// InterfaceState is the runtime state of a network interface, including addresses
+// assigned by DHCP.
+type InterfaceState struct {
+	LinkState string           `json:"link_state"`
+	Aliases   []InterfaceAlias `json:"aliases"`
+}
+
+// InterfaceAlias is an address assigned to a network interface.
+type InterfaceAlias struct {
+	Type    string `json:"type"` // INET, INET6 or LINK
+	Address string `json:"address"`
+	Netmask any    `json:"netmask,omitempty"` // Prefix length; can be int or string in TrueNAS
 }
 
 // ZFSResourceQueryOptions specifies options for querying ZFS resources.
@@ -477,6 +866,43 @@ type ZFSPropSource struct {
 	Value any    `json:"value"`
 }
 
+// ReplicationRunOptions specifies a one-time replication (replication.run_onetime).
+type ReplicationRunOptions struct {
+	Direction         string   `json:"direction"` // PUSH or PULL
+	Transport         string   `json:"transport"` // LOCAL or SSH
+	SSHCredentials    int      `json:"ssh_credentials,omitempty"`
+	SourceDatasets    []string `json:"source_datasets"`
+	TargetDataset     string   `json:"target_dataset"`
+	Recursive         bool     `json:"recursive"`
+	Properties        bool     `json:"properties"`
+	PropertiesExclude []string `json:"properties_exclude,omitempty"`
+	NameRegex         string   `json:"name_regex,omitempty"`
+	RetentionPolicy   string   `json:"retention_policy"` // SOURCE, CUSTOM or NONE
+	Readonly          string   `json:"readonly"`         // SET, REQUIRE or IGNORE
+	AllowFromScratch  bool     `json:"allow_from_scratch"`
+}
+
+// Job is a TrueNAS middleware job as returned by core.get_jobs.
+type Job struct {
+	ID        int               `json:"id"`
+	Method    string            `json:"method"`
+	Arguments []json.RawMessage `json:"arguments"`
+	State     string            `json:"state"` // WAITING, RUNNING, SUCCESS, FAILED or ABORTED
+	Error     string            `json:"error"`
+	Progress  JobProgress       `json:"progress"`
+}
+
+// JobProgress is the progress a running job reports.
+type JobProgress struct {
+	Percent     float64 `json:"percent"`
+	Description string  `json:"description"`
+}
+
+// Running reports whether the job has not finished yet.
+func (j *Job) Running() bool {
+	return j.State == "WAITING" || j.State == "RUNNING"
+}
+
 // FilesystemSetpermOptions specifies options for filesystem.setperm.
 type FilesystemSetpermOptions struct {
 	Path    string                  `json:"path"`
@@ -534,7 +960,8 @@ func (c *Client) GetDataset(ctx context.Context, path string) (*Dataset, error)
 	// An empty Properties list tells TrueNAS to not return extra properties
 	options := &DatasetQueryOptions{
 		Extra: DatasetGetExtraOptions{
-			Properties: []string{"refquota", "volsize", "refreservation"},
+			Properties:     []string{"refquota", "volsize", "refreservation", "referenced", "origin"},
+			UserProperties: true,
 		},
 	}
 
@@ -558,6 +985,12 @@ func getString(m map[string]any, key string) string {
 	return ""
 }
 
+// getBool safely extracts a bool value from a map.
+func getBool(m map[string]any, key string) bool {
+	v, _ := m[key].(bool)
+	return v
+}
+
 // getParsedInt64 extracts the "parsed" field from a TrueNAS property object.
 // TrueNAS returns ZFS properties as objects like {"parsed": 1234, "rawvalue": "1234", ...}
 // This function also handles direct numeric values and various object formats.
@@ -626,10 +1059,16 @@ func parseDatasetResponse(result map[string]any) *Dataset {
 		Type:           getString(result, "type"),
 		Mountpoint:     getString(result, "mountpoint"),
 		Used:           getParsedInt64(result, "used"),
+		Referenced:     getParsedInt64(result, "referenced"),
 		Available:      getParsedInt64(result, "available"),
 		RefQuota:       refQuota,
 		RefReservation: getParsedInt64(result, "refreservation"),
 		Volsize:        volsize,
+		Encrypted:      getBool(result, "encrypted"),
+		Locked:         getBool(result, "locked"),
+	}
+	if origin := getParsedString(result, "origin"); origin != "-" {
+		dataset.Origin = origin
 	}
 
 	// Store raw property objects for fields that can vary in type
@@ -652,6 +1091,14 @@ func parseDatasetResponse(result map[string]any) *Dataset {
 		dataset.ACLType = acltype
 	}
 
+	// User properties come back as {"csi.truenas.io:foo": {"value": "bar", ...}}
+	if userProps, ok := result["user_properties"].(map[string]any); ok && len(userProps) > 0 {
+		dataset.UserProperties = make(map[string]string, len(userProps))
+		for key := range userProps {
+			dataset.UserProperties[key] = getParsedString(userProps, key)
+		}
+	}
+
 	return dataset
 }
 
@@ -667,7 +1114,8 @@ func (c *Client) ListDatasets(ctx context.Context, pool string) ([]Dataset, erro
 		"extra": map[string]any{
 			"flat":              true,
 			"retrieve_children": false,
-			"properties":        []string{"type", "used", "available", "refquota", "volsize", "refreservation"},
+			"properties":        []string{"type", "used", "referenced", "available", "refquota", "volsize", "refreservation", "origin"},
+			"user_properties":   true,
 		},
 	}
 
@@ -704,6 +1152,34 @@ func (c *Client) UpdateDataset(ctx context.Context, path string, updates *Datase
 	return nil
 }
 
+// PromoteDataset promotes a clone, so it no longer depends on its origin
+// snapshot. The origin and older snapshots move to the clone and the former
+// origin dataset becomes a clone of it.
+func (c *Client) PromoteDataset(ctx context.Context, path string) error {
+	err := c.Call(ctx, methodDatasetPromote, []any{path}, nil)
+	if err != nil {
+		return fmt.Errorf("failed to promote dataset %s: %w", path, err)
+	}
+	return nil
+}
+
+// RenameDataset renames (moves) a dataset to a new path within the same pool.
+// Snapshots and children move with it.
+func (c *Client) RenameDataset(ctx context.Context, path, newPath string) error {
+	options := &DatasetRenameOptions{
+		NewName: newPath,
+	}
+
+	err := c.Call(ctx, methodDatasetRename, []any{path, options}, nil)
+	if err != nil {
+		if IsNotFoundError(err) {
+			return fmt.Errorf("dataset %s: %w", path, ErrNotFound)
+		}
+		return fmt.Errorf("failed to rename dataset %s to %s: %w", path, newPath, err)
+	}
+	return nil
+}
+
 // CreateNFSShare creates a new NFS share with the specified options.
 func (c *Client) CreateNFSShare(ctx context.Context, options *NFSShareCreateOptions) (*NFSShare, error) {
 	var share NFSShare
@@ -746,6 +1222,29 @@ func (c *Client) GetNFSShareByPath(ctx context.Context, path string) (*NFSShare,
 	return &shares[0], nil
 }
 
+// ListNFSShares returns all NFS shares.
+func (c *Client) ListNFSShares(ctx context.Context) ([]NFSShare, error) {
+	filters := [][]any{}
+	options := &QueryOptions{}
+
+	var shares []NFSShare
+	err := c.Call(ctx, methodNFSQuery, []any{filters, options}, &shares)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list NFS shares: %w", err)
+	}
+	return shares, nil
+}
+
+// GetNFSConfig returns the global NFS service configuration.
+func (c *Client) GetNFSConfig(ctx context.Context) (*NFSConfig, error) {
+	var config NFSConfig
+	err := c.Call(ctx, methodNFSConfig, []any{}, &config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get NFS config: %w", err)
+	}
+	return &config, nil
+}
+
 // DeleteNFSShare deletes an NFS share by its ID.
 func (c *Client) DeleteNFSShare(ctx context.Context, id int) error {
 	err := c.Call(ctx, methodNFSDelete, []any{id}, nil)
@@ -755,6 +1254,69 @@ func (c *Client) DeleteNFSShare(ctx context.Context, id int) error {
 	return nil
 }
 
+// CreateSMBShare creates a new SMB share with the specified options.
+func (c *Client) CreateSMBShare(ctx context.Context, options *SMBShareCreateOptions) (*SMBShare, error) {
+	var share SMBShare
+	err := c.Call(ctx, methodSMBCreate, []any{options}, &share)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create SMB share: %w", err)
+	}
+	return &share, nil
+}
+
+// GetSMBShareByPath retrieves an SMB share by its filesystem path.
+// Returns ErrNotFound if no share exports the path.
+func (c *Client) GetSMBShareByPath(ctx context.Context, path string) (*SMBShare, error) {
+	filters := [][]any{
+		{"path", "=", path},
+	}
+	options := &QueryOptions{}
+
+	var shares []SMBShare
+	err := c.Call(ctx, methodSMBQuery, []any{filters, options}, &shares)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query SMB shares: %w", err)
+	}
+
+	if len(shares) == 0 {
+		return nil, fmt.Errorf("SMB share for path %s: %w", path, ErrNotFound)
+	}
+
+	return &shares[0], nil
+}
+
+// ListSMBShares returns all SMB shares.
+func (c *Client) ListSMBShares(ctx context.Context) ([]SMBShare, error) {
+	filters := [][]any{}
+	options := &QueryOptions{}
+
+	var shares []SMBShare
+	err := c.Call(ctx, methodSMBQuery, []any{filters, options}, &shares)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list SMB shares: %w", err)
+	}
+	return shares, nil
+}
+
+// DeleteSMBShare deletes an SMB share by its ID.
+func (c *Client) DeleteSMBShare(ctx context.Context, id int) error {
+	err := c.Call(ctx, methodSMBDelete, []any{id}, nil)
+	if err != nil {
+		return fmt.Errorf("failed to delete SMB share %d: %w", id, err)
+	}
+	return nil
+}
+
+// GetSMBConfig returns the global SMB service configuration.
+func (c *Client) GetSMBConfig(ctx context.Context) (*SMBConfig, error) {
+	var config SMBConfig
+	err := c.Call(ctx, methodSMBConfig, []any{}, &config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get SMB config: %w", err)
+	}
+	return &config, nil
+}
+
 // GetISCSITargetByName retrieves an iSCSI target by its name.
 // Returns ErrNotFound if the target does not exist.
 func (c *Client) GetISCSITargetByName(ctx context.Context, name string) (*ISCSITarget, error) {
@@ -860,6 +1422,84 @@ func (c *Client) GetISCSITargetByID(ctx context.Context, id int) (*ISCSITarget,
 	return &targets[0], nil
 }
 
+// ListISCSITargets returns all iSCSI targets.
+func (c *Client) ListISCSITargets(ctx context.Context) ([]ISCSITarget, error) {
+	filters := [][]any{}
+	options := &QueryOptions{}
+
+	var targets []ISCSITarget
+	err := c.Call(ctx, methodISCSITargetQuery, []any{filters, options}, &targets)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list iSCSI targets: %w", err)
+	}
+	return targets, nil
+}
+
+// ListISCSIExtents returns all iSCSI extents.
+func (c *Client) ListISCSIExtents(ctx context.Context) ([]ISCSIExtent, error) {
+	filters := [][]any{}
+	options := &QueryOptions{}
+
+	var extents []ISCSIExtent
+	err := c.Call(ctx, methodISCSIExtentQuery, []any{filters, options}, &extents)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list iSCSI extents: %w", err)
+	}
+	return extents, nil
+}
+
+// ListISCSITargetExtents returns all iSCSI target-extent associations.
+func (c *Client) ListISCSITargetExtents(ctx context.Context) ([]ISCSITargetExtent, error) {
+	filters := [][]any{}
+	options := &QueryOptions{}
+
+	var assocs []ISCSITargetExtent
+	err := c.Call(ctx, methodISCSITargetExtentQuery, []any{filters, options}, &assocs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list iSCSI target-extent associations: %w", err)
+	}
+	return assocs, nil
+}
+
+// ListISCSITargetExtentsByTarget returns the target-extent associations of a target,
+// i.e. the LUNs it exposes.
+func (c *Client) ListISCSITargetExtentsByTarget(ctx context.Context, targetID int) ([]ISCSITargetExtent, error) {
+	filters := [][]any{
+		{"target", "=", targetID},
+	}
+	options := &QueryOptions{}
+
+	var assocs []ISCSITargetExtent
+	err := c.Call(ctx, methodISCSITargetExtentQuery, []any{filters, options}, &assocs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list LUNs of iSCSI target %d: %w", targetID, err)
+	}
+	return assocs, nil
+}
+
+// ListISCSIPortals returns all iSCSI portals.
+func (c *Client) ListISCSIPortals(ctx context.Context) ([]ISCSIPortal, error) {
+	filters := [][]any{}
+	options := &QueryOptions{}
+
+	var portals []ISCSIPortal
+	err := c.Call(ctx, methodISCSIPortalQuery, []any{filters, options}, &portals)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list iSCSI portals: %w", err)
+	}
+	return portals, nil
+}
+
+// GetISCSIGlobalConfig returns the global iSCSI configuration, including the IQN base name.
+func (c *Client) GetISCSIGlobalConfig(ctx context.Context) (*ISCSIGlobalConfig, error) {
+	var config ISCSIGlobalConfig
+	err := c.Call(ctx, methodISCSIGlobalConfig, []any{}, &config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get iSCSI global config: %w", err)
+	}
+	return &config, nil
+}
+
 // CreateISCSITarget creates a new iSCSI target with the specified name and alias.
 func (c *Client) CreateISCSITarget(ctx context.Context, name, alias string) (*ISCSITarget, error) {
 	return c.CreateISCSITargetWithAuth(ctx, name, alias, 0, 0)
@@ -897,6 +1537,17 @@ func (c *Client) CreateISCSITargetWithAuth(ctx context.Context, name, alias stri
 	return &target, nil
 }
 
+// UpdateISCSITarget updates the name or alias of an iSCSI target.
+// Renaming a target changes its IQN; initiators must log in again.
+func (c *Client) UpdateISCSITarget(ctx context.Context, id int, opts *ISCSITargetUpdateOptions) (*ISCSITarget, error) {
+	var target ISCSITarget
+	err := c.Call(ctx, methodISCSITargetUpdate, []any{id, opts}, &target)
+	if err != nil {
+		return nil, fmt.Errorf("failed to update iSCSI target %d: %w", id, err)
+	}
+	return &target, nil
+}
+
 // CreateISCSIExtent creates a new iSCSI extent backed by a disk.
 func (c *Client) CreateISCSIExtent(ctx context.Context, name, disk string, blocksize int) (*ISCSIExtent, error) {
 	params := &ISCSIExtentCreateOptions{
@@ -915,6 +1566,16 @@ func (c *Client) CreateISCSIExtent(ctx context.Context, name, disk string, block
 	return &extent, nil
 }
 
+// UpdateISCSIExtent updates the name or comment of an iSCSI extent.
+func (c *Client) UpdateISCSIExtent(ctx context.Context, id int, opts *ISCSIExtentUpdateOptions) (*ISCSIExtent, error) {
+	var extent ISCSIExtent
+	err := c.Call(ctx, methodISCSIExtentUpdate, []any{id, opts}, &extent)
+	if err != nil {
+		return nil, fmt.Errorf("failed to update iSCSI extent %d: %w", id, err)
+	}
+	return &extent, nil
+}
+
 // CreateISCSITargetExtent associates an iSCSI extent with a target.
 func (c *Client) CreateISCSITargetExtent(ctx context.Context, targetID, extentID, lunID int) (*ISCSITargetExtent, error) {
 	params := &ISCSITargetExtentCreateOptions{
@@ -1069,26 +1730,248 @@ func (c *Client) DeleteISCSIInitiator(ctx context.Context, id int) error {
 	return nil
 }
 
-// CreateSnapshot creates a new ZFS snapshot.
-func (c *Client) CreateSnapshot(ctx context.Context, dataset, name string, recursive bool) (*Snapshot, error) {
-	params := &SnapshotCreateOptions{
-		Dataset:   dataset,
-		Name:      name,
-		Recursive: recursive,
+// GetNVMetGlobalConfig returns the global NVMe-oF target configuration, including the base NQN.
+func (c *Client) GetNVMetGlobalConfig(ctx context.Context) (*NVMetGlobalConfig, error) {
+	var config NVMetGlobalConfig
+	err := c.Call(ctx, methodNVMetGlobalConfig, []any{}, &config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get NVMe-oF global config: %w", err)
 	}
+	return &config, nil
+}
 
-	var snapshot Snapshot
-	err := c.Call(ctx, methodSnapshotCreate, []any{params}, &snapshot)
+// CreateNVMetSubsys creates a new NVMe-oF subsystem.
+func (c *Client) CreateNVMetSubsys(ctx context.Context, opts *NVMetSubsysCreateOptions) (*NVMetSubsys, error) {
+	var subsys NVMetSubsys
+	err := c.Call(ctx, methodNVMetSubsysCreate, []any{opts}, &subsys)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create snapshot: %w", err)
+		return nil, fmt.Errorf("failed to create NVMe-oF subsystem: %w", err)
 	}
-	return &snapshot, nil
+	return &subsys, nil
 }
 
-// DeleteSnapshot deletes a ZFS snapshot by name.
-func (c *Client) DeleteSnapshot(ctx context.Context, name string) error {
-	options := &SnapshotDeleteOptions{
-		Defer: false,
+// GetNVMetSubsysByName retrieves an NVMe-oF subsystem by its name.
+// Returns ErrNotFound if the subsystem does not exist.
+func (c *Client) GetNVMetSubsysByName(ctx context.Context, name string) (*NVMetSubsys, error) {
+	filters := [][]any{
+		{"name", "=", name},
+	}
+	options := &QueryOptions{}
+
+	var subsystems []NVMetSubsys
+	err := c.Call(ctx, methodNVMetSubsysQuery, []any{filters, options}, &subsystems)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query NVMe-oF subsystems: %w", err)
+	}
+
+	if len(subsystems) == 0 {
+		return nil, ErrNotFound
+	}
+
+	return &subsystems[0], nil
+}
+
+// ListNVMetSubsystems returns all NVMe-oF subsystems.
+func (c *Client) ListNVMetSubsystems(ctx context.Context) ([]NVMetSubsys, error) {
+	filters := [][]any{}
+	options := &QueryOptions{}
+
+	var subsystems []NVMetSubsys
+	err := c.Call(ctx, methodNVMetSubsysQuery, []any{filters, options}, &subsystems)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list NVMe-oF subsystems: %w", err)
+	}
+	return subsystems, nil
+}
+
+// DeleteNVMetSubsys deletes an NVMe-oF subsystem by its ID.
+func (c *Client) DeleteNVMetSubsys(ctx context.Context, id int, opts *NVMetSubsysDeleteOptions) error {
+	if opts == nil {
+		opts = &NVMetSubsysDeleteOptions{}
+	}
+
+	err := c.Call(ctx, methodNVMetSubsysDelete, []any{id, opts}, nil)
+	if err != nil {
+		return fmt.Errorf("failed to delete NVMe-oF subsystem %d: %w", id, err)
+	}
+	return nil
+}
+
+// CreateNVMetNamespace exposes a zvol as a namespace of an NVMe-oF subsystem.
+// devicePath is the zvol path relative to /dev (e.g., "zvol/pool/volume").
+func (c *Client) CreateNVMetNamespace(ctx context.Context, subsysID int, devicePath string) (*NVMetNamespace, error) {
+	params := &NVMetNamespaceCreateOptions{
+		DeviceType: "ZVOL",
+		DevicePath: devicePath,
+		SubsysID:   subsysID,
+		Enabled:    true,
+	}
+
+	var namespace NVMetNamespace
+	err := c.Call(ctx, methodNVMetNamespaceCreate, []any{params}, &namespace)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create NVMe-oF namespace: %w", err)
+	}
+	return &namespace, nil
+}
+
+// GetNVMetNamespaceByDevicePath retrieves the NVMe-oF namespace backed by a zvol
+// (e.g., "zvol/pool/volume"). Returns ErrNotFound if the zvol is not exported.
+func (c *Client) GetNVMetNamespaceByDevicePath(ctx context.Context, devicePath string) (*NVMetNamespace, error) {
+	filters := [][]any{
+		{"device_path", "=", devicePath},
+	}
+	options := &QueryOptions{}
+
+	var namespaces []NVMetNamespace
+	err := c.Call(ctx, methodNVMetNamespaceQuery, []any{filters, options}, &namespaces)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query NVMe-oF namespaces by device path: %w", err)
+	}
+
+	if len(namespaces) == 0 {
+		return nil, ErrNotFound
+	}
+
+	return &namespaces[0], nil
+}
+
+// ListNVMetNamespaces returns all NVMe-oF namespaces.
+func (c *Client) ListNVMetNamespaces(ctx context.Context) ([]NVMetNamespace, error) {
+	filters := [][]any{}
+	options := &QueryOptions{}
+
+	var namespaces []NVMetNamespace
+	err := c.Call(ctx, methodNVMetNamespaceQuery, []any{filters, options}, &namespaces)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list NVMe-oF namespaces: %w", err)
+	}
+	return namespaces, nil
+}
+
+// DeleteNVMetNamespace deletes an NVMe-oF namespace by its ID. The zvol is kept.
+func (c *Client) DeleteNVMetNamespace(ctx context.Context, id int) error {
+	err := c.Call(ctx, methodNVMetNamespaceDelete, []any{id}, nil)
+	if err != nil {
+		return fmt.Errorf("failed to delete NVMe-oF namespace %d: %w", id, err)
+	}
+	return nil
+}
+
+// GetNVMetHostByNQN retrieves an NVMe-oF host by its host NQN.
+// Returns ErrNotFound if the host does not exist.
+func (c *Client) GetNVMetHostByNQN(ctx context.Context, hostNQN string) (*NVMetHost, error) {
+	filters := [][]any{
+		{"hostnqn", "=", hostNQN},
+	}
+	options := &QueryOptions{}
+
+	var hosts []NVMetHost
+	err := c.Call(ctx, methodNVMetHostQuery, []any{filters, options}, &hosts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query NVMe-oF hosts: %w", err)
+	}
+
+	if len(hosts) == 0 {
+		return nil, ErrNotFound
+	}
+
+	return &hosts[0], nil
+}
+
+// CreateNVMetHost creates a new NVMe-oF host entry for a host NQN.
+func (c *Client) CreateNVMetHost(ctx context.Context, hostNQN string) (*NVMetHost, error) {
+	params := &NVMetHost{HostNQN: hostNQN}
+
+	var host NVMetHost
+	err := c.Call(ctx, methodNVMetHostCreate, []any{params}, &host)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create NVMe-oF host %s: %w", hostNQN, err)
+	}
+	return &host, nil
+}
+
+// CreateNVMetHostSubsys allows a host to connect to a subsystem.
+func (c *Client) CreateNVMetHostSubsys(ctx context.Context, hostID, subsysID int) (*NVMetHostSubsys, error) {
+	params := &NVMetHostSubsys{
+		HostID:   hostID,
+		SubsysID: subsysID,
+	}
+
+	var assoc NVMetHostSubsys
+	err := c.Call(ctx, methodNVMetHostSubsysCreate, []any{params}, &assoc)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create host-subsystem association: %w", err)
+	}
+	return &assoc, nil
+}
+
+// ListNVMetPorts returns all NVMe-oF ports.
+func (c *Client) ListNVMetPorts(ctx context.Context) ([]NVMetPort, error) {
+	filters := [][]any{}
+	options := &QueryOptions{}
+
+	var ports []NVMetPort
+	err := c.Call(ctx, methodNVMetPortQuery, []any{filters, options}, &ports)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list NVMe-oF ports: %w", err)
+	}
+	return ports, nil
+}
+
+// CreateNVMetPortSubsys exposes a subsystem on a port.
+func (c *Client) CreateNVMetPortSubsys(ctx context.Context, portID, subsysID int) (*NVMetPortSubsys, error) {
+	params := &NVMetPortSubsys{
+		PortID:   portID,
+		SubsysID: subsysID,
+	}
+
+	var assoc NVMetPortSubsys
+	err := c.Call(ctx, methodNVMetPortSubsysCreate, []any{params}, &assoc)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create port-subsystem association: %w", err)
+	}
+	return &assoc, nil
+}
+
+// CreateSnapshot creates a new ZFS snapshot.
+func (c *Client) CreateSnapshot(ctx context.Context, dataset, name string, recursive bool) (*Snapshot, error) {
+	params := &SnapshotCreateOptions{
+		Dataset:   dataset,
+		Name:      name,
+		Recursive: recursive,
+	}
+
+	var snapshot Snapshot
+	err := c.Call(ctx, methodSnapshotCreate, []any{params}, &snapshot)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create snapshot: %w", err)
+	}
+	return &snapshot, nil
+}
+
+// CreateRecursiveSnapshot snapshots a dataset and its descendants, except the
+// excluded ones, in a single atomic ZFS operation.
+func (c *Client) CreateRecursiveSnapshot(ctx context.Context, dataset, name string, exclude []string) (*Snapshot, error) {
+	params := &SnapshotCreateOptions{
+		Dataset:   dataset,
+		Name:      name,
+		Recursive: true,
+		Exclude:   exclude,
+	}
+
+	var snapshot Snapshot
+	err := c.Call(ctx, methodSnapshotCreate, []any{params}, &snapshot)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create recursive snapshot: %w", err)
+	}
+	return &snapshot, nil
+}
+
+// DeleteSnapshot deletes a ZFS snapshot by name.
+func (c *Client) DeleteSnapshot(ctx context.Context, name string) error {
+	options := &SnapshotDeleteOptions{
+		Defer: false,
 	}
 
 	err := c.Call(ctx, methodSnapshotDelete, []any{name, options}, nil)
@@ -1098,6 +1981,53 @@ func (c *Client) DeleteSnapshot(ctx context.Context, name string) error {
 	return nil
 }
 
+// DeleteSnapshotDeferred marks a snapshot for deferred destroy (zfs destroy -d).
+// ZFS destroys it once no clone depends on it and no hold remains.
+func (c *Client) DeleteSnapshotDeferred(ctx context.Context, name string) error {
+	options := &SnapshotDeleteOptions{
+		Defer: true,
+	}
+
+	err := c.Call(ctx, methodSnapshotDelete, []any{name, options}, nil)
+	if err != nil {
+		return fmt.Errorf("failed to defer deletion of snapshot %s: %w", name, err)
+	}
+	return nil
+}
+
+// HoldSnapshot places a user hold with the given tag on a snapshot, so it
+// cannot be destroyed until the hold is released.
+func (c *Client) HoldSnapshot(ctx context.Context, name, tag string) error {
+	err := c.Call(ctx, methodSnapshotHold, []any{name, &SnapshotHoldOptions{Tag: tag}}, nil)
+	if err != nil {
+		return fmt.Errorf("failed to hold snapshot %s: %w", name, err)
+	}
+	return nil
+}
+
+// ReleaseSnapshot releases the user hold with the given tag on a snapshot.
+// Holds with other tags are kept.
+func (c *Client) ReleaseSnapshot(ctx context.Context, name, tag string) error {
+	err := c.Call(ctx, methodSnapshotRelease, []any{name, &SnapshotHoldOptions{Tag: tag}}, nil)
+	if err != nil {
+		return fmt.Errorf("failed to release snapshot %s: %w", name, err)
+	}
+	return nil
+}
+
+// RollbackSnapshot rolls the dataset of a snapshot back to it, discarding
+// all changes made since.
+func (c *Client) RollbackSnapshot(ctx context.Context, name string, opts *SnapshotRollbackOptions) error {
+	if opts == nil {
+		opts = &SnapshotRollbackOptions{}
+	}
+	err := c.Call(ctx, methodSnapshotRollback, []any{name, opts}, nil)
+	if err != nil {
+		return fmt.Errorf("failed to roll back to snapshot %s: %w", name, err)
+	}
+	return nil
+}
+
 // CloneSnapshot clones a ZFS snapshot to a new dataset.
 func (c *Client) CloneSnapshot(ctx context.Context, snapshot, destination string) (*Dataset, error) {
 	params := SnapshotClone{
@@ -1113,12 +2043,28 @@ func (c *Client) CloneSnapshot(ctx context.Context, snapshot, destination string
 	return c.GetDataset(ctx, destination)
 }
 
+// snapshotProperties are the ZFS properties retrieved with every snapshot query,
+// so creation time and size are known without another call
+var snapshotProperties = []string{"creation", "referenced", "used", "volsize", "clones", "defer_destroy", "userrefs"}
+
+// snapshotQueryOptions returns query options that retrieve snapshotProperties
+// and the hold tags
+func snapshotQueryOptions() *QueryOptions {
+	return &QueryOptions{
+		Extra: map[string]any{
+			"retrieve_properties": true,
+			"properties":          snapshotProperties,
+			"holds":               true,
+		},
+	}
+}
+
 // ListSnapshots returns all snapshots for a given dataset.
 func (c *Client) ListSnapshots(ctx context.Context, dataset string) ([]Snapshot, error) {
 	filters := [][]any{
 		{"dataset", "=", dataset},
 	}
-	options := &QueryOptions{}
+	options := snapshotQueryOptions()
 
 	var snapshots []Snapshot
 	err := c.Call(ctx, methodSnapshotQuery, []any{filters, options}, &snapshots)
@@ -1128,6 +2074,27 @@ func (c *Client) ListSnapshots(ctx context.Context, dataset string) ([]Snapshot,
 	return snapshots, nil
 }
 
+// ListSnapshotsWithProperties returns all snapshots of a dataset with the given
+// ZFS properties (e.g. "createtxg", "written") in Properties.
+func (c *Client) ListSnapshotsWithProperties(ctx context.Context, dataset string, properties []string) ([]Snapshot, error) {
+	filters := [][]any{
+		{"dataset", "=", dataset},
+	}
+	options := &QueryOptions{
+		Extra: map[string]any{
+			"retrieve_properties": true,
+			"properties":          properties,
+		},
+	}
+
+	var snapshots []Snapshot
+	err := c.Call(ctx, methodSnapshotQuery, []any{filters, options}, &snapshots)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list snapshots of %s: %w", dataset, err)
+	}
+	return snapshots, nil
+}
+
 // FindSnapshotByName searches for a snapshot by name across all datasets.
 // The name parameter is the snapshot name (part after @), not the full snapshot ID.
 // Returns the first matching snapshot or nil if not found.
@@ -1136,7 +2103,7 @@ func (c *Client) FindSnapshotByName(ctx context.Context, name string) (*Snapshot
 	filters := [][]any{
 		{"snapshot_name", "=", name},
 	}
-	options := &QueryOptions{}
+	options := snapshotQueryOptions()
 
 	var snapshots []Snapshot
 	err := c.Call(ctx, methodSnapshotQuery, []any{filters, options}, &snapshots)
@@ -1150,11 +2117,27 @@ func (c *Client) FindSnapshotByName(ctx context.Context, name string) (*Snapshot
 	return &snapshots[0], nil
 }
 
+// FindSnapshotsByName returns the snapshots with the given name (the part after
+// @) in all datasets.
+func (c *Client) FindSnapshotsByName(ctx context.Context, name string) ([]Snapshot, error) {
+	filters := [][]any{
+		{"snapshot_name", "=", name},
+	}
+	options := snapshotQueryOptions()
+
+	var snapshots []Snapshot
+	err := c.Call(ctx, methodSnapshotQuery, []any{filters, options}, &snapshots)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find snapshots by name: %w", err)
+	}
+	return snapshots, nil
+}
+
 // ListAllSnapshots returns all snapshots across all datasets.
 func (c *Client) ListAllSnapshots(ctx context.Context) ([]Snapshot, error) {
 	// Empty filter list means return all snapshots
 	filters := [][]any{}
-	options := &QueryOptions{}
+	options := snapshotQueryOptions()
 
 	var snapshots []Snapshot
 	err := c.Call(ctx, methodSnapshotQuery, []any{filters, options}, &snapshots)
@@ -1164,6 +2147,49 @@ func (c *Client) ListAllSnapshots(ctx context.Context) ([]Snapshot, error) {
 	return snapshots, nil
 }
 
+// GetSnapshot retrieves a snapshot by its ID (dataset@name).
+// Returns ErrNotFound if the snapshot does not exist.
+func (c *Client) GetSnapshot(ctx context.Context, id string) (*Snapshot, error) {
+	filters := [][]any{
+		{"id", "=", id},
+	}
+	options := snapshotQueryOptions()
+
+	var snapshots []Snapshot
+	err := c.Call(ctx, methodSnapshotQuery, []any{filters, options}, &snapshots)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get snapshot %s: %w", id, err)
+	}
+	if len(snapshots) == 0 {
+		return nil, fmt.Errorf("snapshot %s: %w", id, ErrNotFound)
+	}
+	return &snapshots[0], nil
+}
+
+// ListSnapshotsPage returns up to limit snapshots ordered by ID, starting after
+// the snapshot ID after, of one dataset or of all datasets if dataset is empty.
+// Keying pages on the ID instead of an offset keeps them stable while
+// snapshots are created and deleted. A limit of 0 returns all.
+func (c *Client) ListSnapshotsPage(ctx context.Context, dataset, after string, limit int) ([]Snapshot, error) {
+	filters := [][]any{}
+	if dataset != "" {
+		filters = append(filters, []any{"dataset", "=", dataset})
+	}
+	if after != "" {
+		filters = append(filters, []any{"id", ">", after})
+	}
+	options := snapshotQueryOptions()
+	options.OrderBy = []string{"id"}
+	options.Limit = limit
+
+	var snapshots []Snapshot
+	err := c.Call(ctx, methodSnapshotQuery, []any{filters, options}, &snapshots)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list snapshots: %w", err)
+	}
+	return snapshots, nil
+}
+
 // CreateSnapshotTask creates a new periodic snapshot task.
 func (c *Client) CreateSnapshotTask(ctx context.Context, opts *SnapshotTaskCreateOptions) (*SnapshotTask, error) {
 	var task SnapshotTask
@@ -1222,6 +2248,16 @@ func (c *Client) ListSnapshotTasks(ctx context.Context, dataset string) ([]Snaps
 	return tasks, nil
 }
 
+// ListAllSnapshotTasks returns the periodic snapshot tasks of all datasets.
+func (c *Client) ListAllSnapshotTasks(ctx context.Context) ([]SnapshotTask, error) {
+	var tasks []SnapshotTask
+	err := c.Call(ctx, methodSnapshotTaskQuery, []any{[][]any{}, &QueryOptions{}}, &tasks)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list snapshot tasks: %w", err)
+	}
+	return tasks, nil
+}
+
 // DeleteSnapshotTask deletes a snapshot task by its ID.
 func (c *Client) DeleteSnapshotTask(ctx context.Context, id int, opts *SnapshotTaskDeleteOptions) error {
 	if opts == nil {
@@ -1266,6 +2302,101 @@ func (c *Client) ListPools(ctx context.Context) ([]Pool, error) {
 	return pools, nil
 }
 
+// ListAlerts returns the current TrueNAS alerts, including dismissed ones.
+func (c *Client) ListAlerts(ctx context.Context) ([]Alert, error) {
+	var alerts []Alert
+	err := c.Call(ctx, methodAlertList, []any{}, &alerts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list alerts: %w", err)
+	}
+	return alerts, nil
+}
+
+// GetService retrieves a system service by name (e.g. "nfs", "iscsitarget").
+// Returns ErrNotFound if the service does not exist.
+func (c *Client) GetService(ctx context.Context, name string) (*Service, error) {
+	filters := [][]any{
+		{"service", "=", name},
+	}
+	options := &QueryOptions{}
+
+	var services []Service
+	err := c.Call(ctx, methodServiceQuery, []any{filters, options}, &services)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query service %s: %w", name, err)
+	}
+
+	if len(services) == 0 {
+		return nil, ErrNotFound
+	}
+
+	return &services[0], nil
+}
+
+// ListNetworkInterfaces returns the network interfaces of the TrueNAS system.
+func (c *Client) ListNetworkInterfaces(ctx context.Context) ([]NetworkInterface, error) {
+	filters := [][]any{}
+	options := &QueryOptions{}
+
+	var interfaces []NetworkInterface
+	err := c.Call(ctx, methodInterfaceQuery, []any{filters, options}, &interfaces)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list network interfaces: %w", err)
+	}
+	return interfaces, nil
+}
+
+// GetSessionRoles returns the roles granted to the authenticated user (API key owner).
+// Returns nil if the server does not report roles.
+func (c *Client) GetSessionRoles(ctx context.Context) ([]string, error) {
+	var me map[string]any
+	err := c.Call(ctx, methodAuthMe, []any{}, &me)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query session privileges: %w", err)
+	}
+
+	privilege, ok := me["privilege"].(map[string]any)
+	if !ok {
+		return nil, nil
+	}
+
+	// Roles are a plain list or, depending on the version, an encoded set {"$set": [...]}
+	raw := privilege["roles"]
+	if set, ok := raw.(map[string]any); ok {
+		raw = set["$set"]
+	}
+	list, ok := raw.([]any)
+	if !ok {
+		return nil, nil
+	}
+
+	roles := make([]string, 0, len(list))
+	for _, r := range list {
+		if role, ok := r.(string); ok {
+			roles = append(roles, role)
+		}
+	}
+	return roles, nil
+}
+
+// CheckQueryAccess calls every query method used by the client with a filter that
+// matches nothing and returns the error of each method that failed, keyed by method.
+func (c *Client) CheckQueryAccess(ctx context.Context) map[string]error {
+	failures := make(map[string]error)
+	for _, method := range queryMethods {
+		filters := [][]any{
+			{"id", "=", -1},
+		}
+		options := &QueryOptions{}
+
+		var results []json.RawMessage
+		if err := c.Call(ctx, method, []any{filters, options}, &results); err != nil {
+			failures[method] = err
+		}
+	}
+	return failures
+}
+
 // GetAvailableSpace returns the available space in bytes for a pool or dataset.
 func (c *Client) GetAvailableSpace(ctx context.Context, poolName string) (int64, error) {
 	options := &ZFSResourceQueryOptions{
@@ -1334,14 +2465,19 @@ func (c *Client) SetDatasetPermissions(ctx context.Context, opts *FilesystemSetp
 	if err != nil {
 		return "", fmt.Errorf("filesystem.setperm failed: %w", err)
 	}
-	// TrueNAS may return job ID as string or as object {"id": 123}
+	return jobID(methodFilesystemSetperm, result)
+}
+
+// jobID extracts the job ID a job method returned.
+// TrueNAS may return job ID as string or as object {"id": 123}
+func jobID(method string, result any) (string, error) {
 	switch v := result.(type) {
 	case string:
 		return v, nil
 	case float64:
 		return strconv.FormatInt(int64(v), 10), nil
 	case nil:
-		return "", fmt.Errorf("filesystem.setperm returned nil")
+		return "", fmt.Errorf("%s returned nil", method)
 	default:
 		if m, ok := result.(map[string]any); ok {
 			if id, ok := m["id"]; ok {
@@ -1355,8 +2491,88 @@ func (c *Client) SetDatasetPermissions(ctx context.Context, opts *FilesystemSetp
 		}
 		// Return as JSON string for debugging
 		b, _ := json.Marshal(result)
-		return "", fmt.Errorf("unexpected setperm result format: %s", string(b))
+		return "", fmt.Errorf("unexpected %s result format: %s", method, string(b))
+	}
+}
+
+// RunReplication starts a one-time replication and returns its job ID.
+// Caller must poll WaitForJob until job completes.
+func (c *Client) RunReplication(ctx context.Context, opts *ReplicationRunOptions) (string, error) {
+	var result any
+	err := c.Call(ctx, methodReplicationRunOnetime, []any{opts}, &result)
+	if err != nil {
+		return "", fmt.Errorf("failed to start replication to %s: %w", opts.TargetDataset, err)
+	}
+	return jobID(methodReplicationRunOnetime, result)
+}
+
+// GetJob retrieves a job by ID.
+// Returns ErrNotFound if TrueNAS no longer knows the job.
+func (c *Client) GetJob(ctx context.Context, jobID string) (*Job, error) {
+	filters := [][]any{{"id", "=", jobID}}
+	if id, err := strconv.Atoi(jobID); err == nil {
+		filters = [][]any{{"id", "=", id}}
+	}
+
+	var jobs []Job
+	err := c.Call(ctx, methodCoreGetJobs, []any{filters, map[string]any{}}, &jobs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get job %s: %w", jobID, err)
+	}
+	if len(jobs) == 0 {
+		return nil, fmt.Errorf("job %s: %w", jobID, ErrNotFound)
+	}
+	return &jobs[0], nil
+}
+
+// LatestReplicationJob returns the most recent one-time replication into the
+// target dataset that TrueNAS still knows of, or nil if there is none.
+func (c *Client) LatestReplicationJob(ctx context.Context, targetDataset string) (*Job, error) {
+	filters := [][]any{
+		{"method", "=", methodReplicationRunOnetime},
+	}
+
+	var jobs []Job
+	err := c.Call(ctx, methodCoreGetJobs, []any{filters, map[string]any{}}, &jobs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list replication jobs: %w", err)
+	}
+
+	var latest *Job
+	for i, job := range jobs {
+		if len(job.Arguments) == 0 {
+			continue
+		}
+		var opts ReplicationRunOptions
+		if err := json.Unmarshal(job.Arguments[0], &opts); err != nil || opts.TargetDataset != targetDataset {
+			continue
+		}
+		if latest == nil || job.ID > latest.ID {
+			latest = &jobs[i]
+		}
+	}
+	return latest, nil
+}
+
+// GetSSHCredentialID returns the ID of the SSH connection (keychain credential
+// of type SSH_CREDENTIALS) with the given name.
+func (c *Client) GetSSHCredentialID(ctx context.Context, name string) (int, error) {
+	filters := [][]any{
+		{"name", "=", name},
+		{"type", "=", "SSH_CREDENTIALS"},
+	}
+
+	var credentials []struct {
+		ID int `json:"id"`
+	}
+	err := c.Call(ctx, methodKeychainCredentialQuery, []any{filters, &QueryOptions{}}, &credentials)
+	if err != nil {
+		return 0, fmt.Errorf("failed to query SSH connection %s: %w", name, err)
+	}
+	if len(credentials) == 0 {
+		return 0, fmt.Errorf("SSH connection %s: %w", name, ErrNotFound)
 	}
+	return credentials[0].ID, nil
 }
 
 // WaitForJob polls core.get_jobs until job completes or context times out.
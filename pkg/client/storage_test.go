@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"errors"
 	"testing"
+	"time"
 )
 
 // =============================================================================
@@ -109,6 +110,46 @@ func TestGetDataset_Success(t *testing.T) {
 	assertEqual(t, dataset.RefQuota, int64(50000))
 }
 
+func TestGetDataset_EncryptionAndReferenced(t *testing.T) {
+	mock := NewMockTrueNASServer()
+	defer mock.Close()
+
+	result := MockDataset("tank/secret", "secret", "tank", 3000, 8000, 50000)
+	result["referenced"] = map[string]any{"parsed": float64(2500)}
+	result["encrypted"] = true
+	result["locked"] = true
+	mock.SetResponse(methodDatasetGet, MockResponse{
+		Result: result,
+	})
+
+	client := connectTestClient(t, mock)
+
+	dataset, err := client.GetDataset(testContext(t), "tank/secret")
+
+	assertNoError(t, err)
+	assertEqual(t, dataset.Referenced, int64(2500))
+	assertTrue(t, dataset.Encrypted)
+	assertTrue(t, dataset.Locked)
+}
+
+func TestGetDataset_Origin(t *testing.T) {
+	mock := NewMockTrueNASServer()
+	defer mock.Close()
+
+	result := MockDataset("tank/clone", "clone", "tank", 3000, 8000, 50000)
+	result["origin"] = map[string]any{"parsed": "tank/vol1@csi-clone-1", "value": "tank/vol1@csi-clone-1"}
+	mock.SetResponse(methodDatasetGet, MockResponse{
+		Result: result,
+	})
+
+	client := connectTestClient(t, mock)
+
+	dataset, err := client.GetDataset(testContext(t), "tank/clone")
+
+	assertNoError(t, err)
+	assertEqual(t, dataset.Origin, "tank/vol1@csi-clone-1")
+}
+
 func TestGetDataset_NotFound(t *testing.T) {
 	mock := NewMockTrueNASServer()
 	defer mock.Close()
@@ -205,6 +246,80 @@ func TestDeleteDataset_WithOptions(t *testing.T) {
 	assertRequestMethod(t, mock, methodDatasetDelete)
 }
 
+func TestGetDataset_UserProperties(t *testing.T) {
+	mock := NewMockTrueNASServer()
+	defer mock.Close()
+
+	ds := MockDataset("tank/test", "test", "tank", 0, 0, 0)
+	ds["user_properties"] = map[string]any{
+		"csi.truenas.io:managed": map[string]any{"value": "true", "parsed": "true", "source": "LOCAL"},
+	}
+	mock.SetResponse(methodDatasetGet, MockResponse{Result: ds})
+
+	client := connectTestClient(t, mock)
+
+	dataset, err := client.GetDataset(testContext(t), "tank/test")
+
+	assertNoError(t, err)
+	assertEqual(t, dataset.UserProperties["csi.truenas.io:managed"], "true")
+}
+
+func TestRenameDataset_Success(t *testing.T) {
+	mock := NewMockTrueNASServer()
+	defer mock.Close()
+
+	mock.SetResponse(methodDatasetRename, MockResponse{
+		Result: true,
+	})
+
+	client := connectTestClient(t, mock)
+
+	err := client.RenameDataset(testContext(t), "tank/test", "tank/.csi-trash/test-1")
+
+	assertNoError(t, err)
+	assertRequestMethod(t, mock, methodDatasetRename)
+
+	params := getRequestParams[[]json.RawMessage](t, mock, methodDatasetRename)
+	assertLen(t, params, 2)
+	var opts DatasetRenameOptions
+	assertNoError(t, json.Unmarshal(params[1], &opts))
+	assertEqual(t, opts.NewName, "tank/.csi-trash/test-1")
+}
+
+func TestRenameDataset_NotFound(t *testing.T) {
+	mock := NewMockTrueNASServer()
+	defer mock.Close()
+
+	mock.SetResponse(methodDatasetRename, MockResponse{
+		Error: &RPCError{Code: -6, Message: "Dataset not found"},
+	})
+
+	client := connectTestClient(t, mock)
+
+	err := client.RenameDataset(testContext(t), "tank/missing", "tank/other")
+
+	assertError(t, err)
+	assertTrue(t, errors.Is(err, ErrNotFound))
+}
+
+func TestPromoteDataset_Success(t *testing.T) {
+	mock := NewMockTrueNASServer()
+	defer mock.Close()
+
+	mock.SetResponse(methodDatasetPromote, MockResponse{
+		Result: nil,
+	})
+
+	client := connectTestClient(t, mock)
+
+	err := client.PromoteDataset(testContext(t), "tank/clone")
+
+	assertNoError(t, err)
+	params := getRequestParams[[]string](t, mock, methodDatasetPromote)
+	assertLen(t, params, 1)
+	assertEqual(t, params[0], "tank/clone")
+}
+
 // =============================================================================
 // NFS Share Tests
 // =============================================================================
@@ -289,6 +404,26 @@ func TestGetNFSShareByPath_NotFound(t *testing.T) {
 	assertErrorContains(t, err, "not found")
 }
 
+func TestListNFSShares_Success(t *testing.T) {
+	mock := NewMockTrueNASServer()
+	defer mock.Close()
+
+	mock.SetResponse(methodNFSQuery, MockResponse{
+		Result: []NFSShare{
+			MockNFSShare(1, "/mnt/tank/vol1", "CSI volume tank/vol1", nil, nil),
+			MockNFSShare(2, "/mnt/tank/vol2", "CSI volume tank/vol2", nil, nil),
+		},
+	})
+
+	client := connectTestClient(t, mock)
+
+	shares, err := client.ListNFSShares(testContext(t))
+
+	assertNoError(t, err)
+	assertLen(t, shares, 2)
+	assertEqual(t, shares[1].Path, "/mnt/tank/vol2")
+}
+
 func TestDeleteNFSShare_Success(t *testing.T) {
 	mock := NewMockTrueNASServer()
 	defer mock.Close()
@@ -305,6 +440,101 @@ func TestDeleteNFSShare_Success(t *testing.T) {
 	assertRequestMethod(t, mock, methodNFSDelete)
 }
 
+// =============================================================================
+// SMB Share Tests
+// =============================================================================
+
+func TestCreateSMBShare_Success(t *testing.T) {
+	mock := NewMockTrueNASServer()
+	defer mock.Close()
+
+	mock.SetResponse(methodSMBCreate, MockResponse{
+		Result: SMBShare{ID: 3, Name: "csi-tank-vol1", Path: "/mnt/tank/vol1", Enabled: true},
+	})
+
+	client := connectTestClient(t, mock)
+
+	share, err := client.CreateSMBShare(testContext(t), &SMBShareCreateOptions{
+		Name:    "csi-tank-vol1",
+		Path:    "/mnt/tank/vol1",
+		Enabled: true,
+	})
+
+	assertNoError(t, err)
+	assertEqual(t, share.ID, 3)
+	assertEqual(t, share.Name, "csi-tank-vol1")
+
+	params := getRequestParams[[]SMBShareCreateOptions](t, mock, methodSMBCreate)
+	assertLen(t, params, 1)
+	assertEqual(t, params[0].Path, "/mnt/tank/vol1")
+}
+
+func TestGetSMBShareByPath_Success(t *testing.T) {
+	mock := NewMockTrueNASServer()
+	defer mock.Close()
+
+	mock.SetResponse(methodSMBQuery, MockResponse{
+		Result: []SMBShare{{ID: 4, Name: "data", Path: "/mnt/tank/data"}},
+	})
+
+	client := connectTestClient(t, mock)
+
+	share, err := client.GetSMBShareByPath(testContext(t), "/mnt/tank/data")
+
+	assertNoError(t, err)
+	assertEqual(t, share.ID, 4)
+	assertEqual(t, share.Name, "data")
+}
+
+func TestGetSMBShareByPath_NotFound(t *testing.T) {
+	mock := NewMockTrueNASServer()
+	defer mock.Close()
+
+	mock.SetResponse(methodSMBQuery, MockResponse{
+		Result: []SMBShare{},
+	})
+
+	client := connectTestClient(t, mock)
+
+	share, err := client.GetSMBShareByPath(testContext(t), "/mnt/tank/nonexistent")
+
+	assertErrorIs(t, err, ErrNotFound)
+	assertNil(t, share)
+}
+
+func TestDeleteSMBShare_Success(t *testing.T) {
+	mock := NewMockTrueNASServer()
+	defer mock.Close()
+
+	mock.SetResponse(methodSMBDelete, MockResponse{
+		Result: true,
+	})
+
+	client := connectTestClient(t, mock)
+
+	err := client.DeleteSMBShare(testContext(t), 4)
+
+	assertNoError(t, err)
+	assertRequestMethod(t, mock, methodSMBDelete)
+}
+
+func TestGetSMBConfig_Success(t *testing.T) {
+	mock := NewMockTrueNASServer()
+	defer mock.Close()
+
+	mock.SetResponse(methodSMBConfig, MockResponse{
+		Result: SMBConfig{ID: 1, NetbiosName: "truenas", BindIP: []string{"10.0.0.5"}},
+	})
+
+	client := connectTestClient(t, mock)
+
+	config, err := client.GetSMBConfig(testContext(t))
+
+	assertNoError(t, err)
+	assertEqual(t, config.NetbiosName, "truenas")
+	assertLen(t, config.BindIP, 1)
+}
+
 // =============================================================================
 // iSCSI Target Tests
 // =============================================================================
@@ -414,6 +644,46 @@ func TestGetISCSITargetByID_Success(t *testing.T) {
 	assertEqual(t, target.ID, 7)
 }
 
+func TestListISCSITargets_Success(t *testing.T) {
+	mock := NewMockTrueNASServer()
+	defer mock.Close()
+
+	mock.SetResponse(methodISCSITargetQuery, MockResponse{
+		Result: []ISCSITarget{
+			MockISCSITarget(1, "csi-tank-vol1", "CSI volume tank/vol1"),
+			MockISCSITarget(2, "csi-tank-vol2", "CSI volume tank/vol2"),
+		},
+	})
+
+	client := connectTestClient(t, mock)
+
+	targets, err := client.ListISCSITargets(testContext(t))
+
+	assertNoError(t, err)
+	assertLen(t, targets, 2)
+	assertEqual(t, targets[0].Name, "csi-tank-vol1")
+}
+
+func TestUpdateISCSITarget_Success(t *testing.T) {
+	mock := NewMockTrueNASServer()
+	defer mock.Close()
+
+	mock.SetResponse(methodISCSITargetUpdate, MockResponse{
+		Result: MockISCSITarget(3, "csi-tank-pvc-123", "renamed"),
+	})
+
+	client := connectTestClient(t, mock)
+
+	target, err := client.UpdateISCSITarget(testContext(t), 3, &ISCSITargetUpdateOptions{Name: "csi-tank-pvc-123"})
+
+	assertNoError(t, err)
+	assertEqual(t, target.Name, "csi-tank-pvc-123")
+
+	params := getRequestParams[[]json.RawMessage](t, mock, methodISCSITargetUpdate)
+	assertLen(t, params, 2)
+	assertEqual(t, string(params[0]), "3")
+}
+
 // =============================================================================
 // iSCSI Extent Tests
 // =============================================================================
@@ -516,6 +786,42 @@ func TestDeleteISCSIExtent_Success(t *testing.T) {
 	assertRequestMethod(t, mock, methodISCSIExtentDelete)
 }
 
+func TestListISCSIExtents_Success(t *testing.T) {
+	mock := NewMockTrueNASServer()
+	defer mock.Close()
+
+	mock.SetResponse(methodISCSIExtentQuery, MockResponse{
+		Result: []ISCSIExtent{
+			MockISCSIExtent(1, "tank/vol1", "zvol/tank/vol1", 512),
+		},
+	})
+
+	client := connectTestClient(t, mock)
+
+	extents, err := client.ListISCSIExtents(testContext(t))
+
+	assertNoError(t, err)
+	assertLen(t, extents, 1)
+	assertEqual(t, extents[0].Disk, "zvol/tank/vol1")
+}
+
+func TestUpdateISCSIExtent_Success(t *testing.T) {
+	mock := NewMockTrueNASServer()
+	defer mock.Close()
+
+	mock.SetResponse(methodISCSIExtentUpdate, MockResponse{
+		Result: MockISCSIExtent(5, "tank/pvc-123", "zvol/tank/pvc-123", 512),
+	})
+
+	client := connectTestClient(t, mock)
+
+	extent, err := client.UpdateISCSIExtent(testContext(t), 5, &ISCSIExtentUpdateOptions{Name: "tank/pvc-123"})
+
+	assertNoError(t, err)
+	assertEqual(t, extent.Name, "tank/pvc-123")
+	assertRequestMethod(t, mock, methodISCSIExtentUpdate)
+}
+
 // =============================================================================
 // iSCSI Target-Extent Association Tests
 // =============================================================================
@@ -559,6 +865,46 @@ func TestGetISCSITargetExtentByExtent_Success(t *testing.T) {
 	assertEqual(t, te.Extent, 7)
 }
 
+func TestListISCSITargetExtents_Success(t *testing.T) {
+	mock := NewMockTrueNASServer()
+	defer mock.Close()
+
+	mock.SetResponse(methodISCSITargetExtentQuery, MockResponse{
+		Result: []ISCSITargetExtent{
+			MockISCSITargetExtent(1, 10, 20, 0),
+			MockISCSITargetExtent(2, 11, 21, 0),
+		},
+	})
+
+	client := connectTestClient(t, mock)
+
+	assocs, err := client.ListISCSITargetExtents(testContext(t))
+
+	assertNoError(t, err)
+	assertLen(t, assocs, 2)
+	assertEqual(t, assocs[1].Extent, 21)
+}
+
+func TestListISCSITargetExtentsByTarget_Success(t *testing.T) {
+	mock := NewMockTrueNASServer()
+	defer mock.Close()
+
+	mock.SetResponse(methodISCSITargetExtentQuery, MockResponse{
+		Result: []ISCSITargetExtent{
+			MockISCSITargetExtent(1, 10, 20, 0),
+			MockISCSITargetExtent(2, 10, 21, 1),
+		},
+	})
+
+	client := connectTestClient(t, mock)
+
+	assocs, err := client.ListISCSITargetExtentsByTarget(testContext(t), 10)
+
+	assertNoError(t, err)
+	assertLen(t, assocs, 2)
+	assertEqual(t, assocs[1].LunID, 1)
+}
+
 func TestDeleteISCSITargetExtent_Success(t *testing.T) {
 	mock := NewMockTrueNASServer()
 	defer mock.Close()
@@ -758,59 +1104,285 @@ func TestDeleteISCSIInitiator_Success(t *testing.T) {
 }
 
 // =============================================================================
-// Snapshot Tests
+// NVMe-oF Tests
 // =============================================================================
 
-func TestCreateSnapshot_Success(t *testing.T) {
+func TestCreateNVMetSubsys_Success(t *testing.T) {
 	mock := NewMockTrueNASServer()
 	defer mock.Close()
 
-	mock.SetResponse(methodSnapshotCreate, MockResponse{
-		Result: MockSnapshot("tank/data@snap1", "tank/data", "snap1"),
+	mock.SetResponse(methodNVMetSubsysCreate, MockResponse{
+		Result: NVMetSubsys{ID: 3, Name: "csi-tank-vol", SubNQN: "nqn.2011-06.com.truenas:uuid:abc:csi-tank-vol", AllowAnyHost: true},
 	})
 
 	client := connectTestClient(t, mock)
 
-	snap, err := client.CreateSnapshot(testContext(t), "tank/data", "snap1", false)
+	subsys, err := client.CreateNVMetSubsys(testContext(t), &NVMetSubsysCreateOptions{Name: "csi-tank-vol", AllowAnyHost: true})
 
 	assertNoError(t, err)
-	assertNotNil(t, snap)
-	assertEqual(t, snap.ID, "tank/data@snap1")
-	assertEqual(t, snap.Dataset, "tank/data")
-	assertEqual(t, snap.Name, "snap1")
+	assertEqual(t, subsys.ID, 3)
+	assertEqual(t, subsys.SubNQN, "nqn.2011-06.com.truenas:uuid:abc:csi-tank-vol")
+
+	params := getRequestParams[[]NVMetSubsysCreateOptions](t, mock, methodNVMetSubsysCreate)
+	assertEqual(t, params[0].Name, "csi-tank-vol")
+	assertTrue(t, params[0].AllowAnyHost)
 }
 
-func TestCreateSnapshot_Recursive(t *testing.T) {
+func TestGetNVMetSubsysByName_NotFound(t *testing.T) {
 	mock := NewMockTrueNASServer()
 	defer mock.Close()
 
-	mock.SetResponse(methodSnapshotCreate, MockResponse{
-		Result: MockSnapshot("tank@recursive-snap", "tank", "recursive-snap"),
+	mock.SetResponse(methodNVMetSubsysQuery, MockResponse{
+		Result: []NVMetSubsys{},
 	})
 
 	client := connectTestClient(t, mock)
 
-	snap, err := client.CreateSnapshot(testContext(t), "tank", "recursive-snap", true)
-
-	assertNoError(t, err)
-	assertNotNil(t, snap)
+	_, err := client.GetNVMetSubsysByName(testContext(t), "missing")
 
-	// Verify recursive flag was sent
-	requests := mock.GetRequestsByMethod(methodSnapshotCreate)
-	assertLen(t, requests, 1)
-	var params []any
-	json.Unmarshal(requests[0].Params, &params)
-	opts := params[0].(map[string]any)
-	assertTrue(t, opts["recursive"].(bool))
+	assertErrorIs(t, err, ErrNotFound)
 }
 
-func TestDeleteSnapshot_Success(t *testing.T) {
+func TestListNVMetSubsystems_Success(t *testing.T) {
 	mock := NewMockTrueNASServer()
 	defer mock.Close()
 
-	mock.SetResponse(methodSnapshotDelete, MockResponse{
-		Result: true,
-	})
+	mock.SetResponse(methodNVMetSubsysQuery, MockResponse{
+		Result: []map[string]any{
+			{"id": 1, "name": "csi-tank-pvc-1", "subnqn": "nqn.2011-06.com.truenas:uuid:abc:csi-tank-pvc-1"},
+			{"id": 2, "name": "other", "subnqn": "nqn.2011-06.com.truenas:uuid:abc:other"},
+		},
+	})
+
+	client := connectTestClient(t, mock)
+
+	subsystems, err := client.ListNVMetSubsystems(testContext(t))
+
+	assertNoError(t, err)
+	assertLen(t, subsystems, 2)
+	assertEqual(t, subsystems[0].Name, "csi-tank-pvc-1")
+	assertEqual(t, subsystems[1].ID, 2)
+}
+
+func TestCreateNVMetNamespace_Success(t *testing.T) {
+	mock := NewMockTrueNASServer()
+	defer mock.Close()
+
+	mock.SetResponse(methodNVMetNamespaceCreate, MockResponse{
+		Result: NVMetNamespace{ID: 7, NSID: 1, DeviceType: "ZVOL", DevicePath: "zvol/tank/vol", Enabled: true},
+	})
+
+	client := connectTestClient(t, mock)
+
+	namespace, err := client.CreateNVMetNamespace(testContext(t), 3, "zvol/tank/vol")
+
+	assertNoError(t, err)
+	assertEqual(t, namespace.ID, 7)
+	assertEqual(t, namespace.NSID, 1)
+
+	params := getRequestParams[[]NVMetNamespaceCreateOptions](t, mock, methodNVMetNamespaceCreate)
+	assertEqual(t, params[0].SubsysID, 3)
+	assertEqual(t, params[0].DeviceType, "ZVOL")
+	assertEqual(t, params[0].DevicePath, "zvol/tank/vol")
+}
+
+func TestGetNVMetNamespaceByDevicePath_Success(t *testing.T) {
+	mock := NewMockTrueNASServer()
+	defer mock.Close()
+
+	mock.SetResponse(methodNVMetNamespaceQuery, MockResponse{
+		Result: []map[string]any{
+			{
+				"id":          7,
+				"nsid":        1,
+				"device_type": "ZVOL",
+				"device_path": "zvol/tank/vol",
+				"enabled":     true,
+				"subsys":      map[string]any{"id": 3, "name": "csi-tank-vol", "subnqn": "nqn.2011-06.com.truenas:csi-tank-vol"},
+			},
+		},
+	})
+
+	client := connectTestClient(t, mock)
+
+	namespace, err := client.GetNVMetNamespaceByDevicePath(testContext(t), "zvol/tank/vol")
+
+	assertNoError(t, err)
+	assertNotNil(t, namespace.Subsys)
+	assertEqual(t, namespace.Subsys.ID, 3)
+	assertEqual(t, namespace.Subsys.SubNQN, "nqn.2011-06.com.truenas:csi-tank-vol")
+}
+
+func TestGetNVMetNamespaceByDevicePath_NotFound(t *testing.T) {
+	mock := NewMockTrueNASServer()
+	defer mock.Close()
+
+	mock.SetResponse(methodNVMetNamespaceQuery, MockResponse{
+		Result: []NVMetNamespace{},
+	})
+
+	client := connectTestClient(t, mock)
+
+	_, err := client.GetNVMetNamespaceByDevicePath(testContext(t), "zvol/tank/missing")
+
+	assertErrorIs(t, err, ErrNotFound)
+}
+
+func TestDeleteNVMetSubsys_Force(t *testing.T) {
+	mock := NewMockTrueNASServer()
+	defer mock.Close()
+
+	mock.SetResponse(methodNVMetSubsysDelete, MockResponse{
+		Result: true,
+	})
+
+	client := connectTestClient(t, mock)
+
+	err := client.DeleteNVMetSubsys(testContext(t), 3, &NVMetSubsysDeleteOptions{Force: true})
+
+	assertNoError(t, err)
+
+	params := getRequestParams[[]any](t, mock, methodNVMetSubsysDelete)
+	assertLen(t, params, 2)
+	assertEqual(t, params[1].(map[string]any)["force"], any(true))
+}
+
+func TestGetNVMetHostByNQN_Success(t *testing.T) {
+	mock := NewMockTrueNASServer()
+	defer mock.Close()
+
+	mock.SetResponse(methodNVMetHostQuery, MockResponse{
+		Result: []NVMetHost{{ID: 2, HostNQN: "nqn.2014-08.org.nvmexpress:uuid:node1"}},
+	})
+
+	client := connectTestClient(t, mock)
+
+	host, err := client.GetNVMetHostByNQN(testContext(t), "nqn.2014-08.org.nvmexpress:uuid:node1")
+
+	assertNoError(t, err)
+	assertEqual(t, host.ID, 2)
+}
+
+func TestListNVMetPorts_Success(t *testing.T) {
+	mock := NewMockTrueNASServer()
+	defer mock.Close()
+
+	mock.SetResponse(methodNVMetPortQuery, MockResponse{
+		Result: []map[string]any{
+			{"id": 1, "index": 1, "addr_trtype": "TCP", "addr_adrfam": "IPV4", "addr_traddr": "10.0.0.5", "addr_trsvcid": 4420, "enabled": true},
+		},
+	})
+
+	client := connectTestClient(t, mock)
+
+	ports, err := client.ListNVMetPorts(testContext(t))
+
+	assertNoError(t, err)
+	assertLen(t, ports, 1)
+	assertEqual(t, ports[0].AddrTrtype, "TCP")
+	assertEqual(t, ports[0].AddrTraddr, "10.0.0.5")
+}
+
+func TestCreateNVMetPortSubsys_Success(t *testing.T) {
+	mock := NewMockTrueNASServer()
+	defer mock.Close()
+
+	mock.SetResponse(methodNVMetPortSubsysCreate, MockResponse{
+		Result: NVMetPortSubsys{ID: 5, PortID: 1, SubsysID: 3},
+	})
+
+	client := connectTestClient(t, mock)
+
+	assoc, err := client.CreateNVMetPortSubsys(testContext(t), 1, 3)
+
+	assertNoError(t, err)
+	assertEqual(t, assoc.ID, 5)
+
+	params := getRequestParams[[]NVMetPortSubsys](t, mock, methodNVMetPortSubsysCreate)
+	assertEqual(t, params[0].PortID, 1)
+	assertEqual(t, params[0].SubsysID, 3)
+}
+
+// =============================================================================
+// Snapshot Tests
+// =============================================================================
+
+func TestCreateSnapshot_Success(t *testing.T) {
+	mock := NewMockTrueNASServer()
+	defer mock.Close()
+
+	mock.SetResponse(methodSnapshotCreate, MockResponse{
+		Result: MockSnapshot("tank/data@snap1", "tank/data", "snap1"),
+	})
+
+	client := connectTestClient(t, mock)
+
+	snap, err := client.CreateSnapshot(testContext(t), "tank/data", "snap1", false)
+
+	assertNoError(t, err)
+	assertNotNil(t, snap)
+	assertEqual(t, snap.ID, "tank/data@snap1")
+	assertEqual(t, snap.Dataset, "tank/data")
+	assertEqual(t, snap.Name, "snap1")
+}
+
+func TestCreateSnapshot_Recursive(t *testing.T) {
+	mock := NewMockTrueNASServer()
+	defer mock.Close()
+
+	mock.SetResponse(methodSnapshotCreate, MockResponse{
+		Result: MockSnapshot("tank@recursive-snap", "tank", "recursive-snap"),
+	})
+
+	client := connectTestClient(t, mock)
+
+	snap, err := client.CreateSnapshot(testContext(t), "tank", "recursive-snap", true)
+
+	assertNoError(t, err)
+	assertNotNil(t, snap)
+
+	// Verify recursive flag was sent
+	requests := mock.GetRequestsByMethod(methodSnapshotCreate)
+	assertLen(t, requests, 1)
+	var params []any
+	json.Unmarshal(requests[0].Params, &params)
+	opts := params[0].(map[string]any)
+	assertTrue(t, opts["recursive"].(bool))
+}
+
+func TestCreateRecursiveSnapshot_Exclude(t *testing.T) {
+	mock := NewMockTrueNASServer()
+	defer mock.Close()
+
+	mock.SetResponse(methodSnapshotCreate, MockResponse{
+		Result: MockSnapshot("tank@group1", "tank", "group1"),
+	})
+
+	client := connectTestClient(t, mock)
+
+	snap, err := client.CreateRecursiveSnapshot(testContext(t), "tank", "group1", []string{"tank/other"})
+
+	assertNoError(t, err)
+	assertEqual(t, snap.ID, "tank@group1")
+
+	requests := mock.GetRequestsByMethod(methodSnapshotCreate)
+	assertLen(t, requests, 1)
+	var params []any
+	json.Unmarshal(requests[0].Params, &params)
+	opts := params[0].(map[string]any)
+	assertTrue(t, opts["recursive"].(bool))
+	exclude := opts["exclude"].([]any)
+	assertLen(t, exclude, 1)
+	assertEqual(t, exclude[0], any("tank/other"))
+}
+
+func TestDeleteSnapshot_Success(t *testing.T) {
+	mock := NewMockTrueNASServer()
+	defer mock.Close()
+
+	mock.SetResponse(methodSnapshotDelete, MockResponse{
+		Result: true,
+	})
 
 	client := connectTestClient(t, mock)
 
@@ -820,6 +1392,97 @@ func TestDeleteSnapshot_Success(t *testing.T) {
 	assertRequestMethod(t, mock, methodSnapshotDelete)
 }
 
+func TestDeleteSnapshotDeferred_Success(t *testing.T) {
+	mock := NewMockTrueNASServer()
+	defer mock.Close()
+
+	mock.SetResponse(methodSnapshotDelete, MockResponse{
+		Result: true,
+	})
+
+	client := connectTestClient(t, mock)
+
+	err := client.DeleteSnapshotDeferred(testContext(t), "tank/data@snap1")
+
+	assertNoError(t, err)
+	params := getRequestParams[[]json.RawMessage](t, mock, methodSnapshotDelete)
+	assertLen(t, params, 2)
+	var opts SnapshotDeleteOptions
+	assertNoError(t, json.Unmarshal(params[1], &opts))
+	assertTrue(t, opts.Defer)
+}
+
+func TestHoldSnapshot_Success(t *testing.T) {
+	mock := NewMockTrueNASServer()
+	defer mock.Close()
+
+	mock.SetResponse(methodSnapshotHold, MockResponse{Result: nil})
+	mock.SetResponse(methodSnapshotRelease, MockResponse{Result: nil})
+
+	client := connectTestClient(t, mock)
+
+	assertNoError(t, client.HoldSnapshot(testContext(t), "tank/data@snap1", "csi"))
+	params := getRequestParams[[]json.RawMessage](t, mock, methodSnapshotHold)
+	assertLen(t, params, 2)
+	assertEqual(t, string(params[0]), `"tank/data@snap1"`)
+	var opts SnapshotHoldOptions
+	assertNoError(t, json.Unmarshal(params[1], &opts))
+	assertEqual(t, opts.Tag, "csi")
+
+	assertNoError(t, client.ReleaseSnapshot(testContext(t), "tank/data@snap1", "csi"))
+	params = getRequestParams[[]json.RawMessage](t, mock, methodSnapshotRelease)
+	assertLen(t, params, 2)
+	assertEqual(t, string(params[0]), `"tank/data@snap1"`)
+	opts = SnapshotHoldOptions{}
+	assertNoError(t, json.Unmarshal(params[1], &opts))
+	assertEqual(t, opts.Tag, "csi")
+}
+
+func TestRollbackSnapshot_Success(t *testing.T) {
+	mock := NewMockTrueNASServer()
+	defer mock.Close()
+
+	mock.SetResponse(methodSnapshotRollback, MockResponse{Result: nil})
+
+	client := connectTestClient(t, mock)
+
+	err := client.RollbackSnapshot(testContext(t), "tank/data@snap1", &SnapshotRollbackOptions{Recursive: true})
+
+	assertNoError(t, err)
+	params := getRequestParams[[]json.RawMessage](t, mock, methodSnapshotRollback)
+	assertLen(t, params, 2)
+	assertEqual(t, string(params[0]), `"tank/data@snap1"`)
+	var opts SnapshotRollbackOptions
+	assertNoError(t, json.Unmarshal(params[1], &opts))
+	assertTrue(t, opts.Recursive)
+	assertFalse(t, opts.RecursiveClones)
+}
+
+func TestSnapshot_Holds(t *testing.T) {
+	snap := MockSnapshot("tank/data@snap1", "tank/data", "snap1")
+	assertEqual(t, snap.Holds(), int64(0))
+
+	snap.Properties = map[string]any{"userrefs": map[string]any{"parsed": float64(1)}}
+	assertEqual(t, snap.Holds(), int64(1))
+
+	assertFalse(t, snap.HasHold("csi"))
+	snap.HoldTags = map[string]any{"truenas": "2026-01-01T00:00:00"}
+	assertFalse(t, snap.HasHold("csi"))
+	snap.HoldTags["csi"] = "2026-01-01T00:00:00"
+	assertTrue(t, snap.HasHold("csi"))
+}
+
+func TestSnapshot_DeferDestroy(t *testing.T) {
+	snap := MockSnapshot("tank/data@snap1", "tank/data", "snap1")
+	assertFalse(t, snap.DeferDestroy())
+
+	snap.Properties = map[string]any{"defer_destroy": map[string]any{"value": "on"}}
+	assertTrue(t, snap.DeferDestroy())
+
+	snap.Properties = map[string]any{"defer_destroy": map[string]any{"parsed": false, "value": "off"}}
+	assertFalse(t, snap.DeferDestroy())
+}
+
 func TestListSnapshots_Success(t *testing.T) {
 	mock := NewMockTrueNASServer()
 	defer mock.Close()
@@ -886,6 +1549,134 @@ func TestFindSnapshotByName_Success(t *testing.T) {
 	assertEqual(t, snap.Name, "mysnap")
 }
 
+func TestListSnapshotsWithProperties_Success(t *testing.T) {
+	mock := NewMockTrueNASServer()
+	defer mock.Close()
+
+	snap := MockSnapshot("tank/vol1@snap2", "tank/vol1", "snap2")
+	snap.Properties = map[string]any{
+		"createtxg": map[string]any{"parsed": "1234", "value": "1234"},
+		"written":   map[string]any{"parsed": float64(4096)},
+	}
+	mock.SetResponse(methodSnapshotQuery, MockResponse{
+		Result: []Snapshot{snap},
+	})
+
+	client := connectTestClient(t, mock)
+
+	snaps, err := client.ListSnapshotsWithProperties(testContext(t), "tank/vol1", []string{"createtxg", "written"})
+
+	assertNoError(t, err)
+	assertLen(t, snaps, 1)
+	assertEqual(t, snaps[0].PropertyInt64("createtxg"), int64(1234))
+	assertEqual(t, snaps[0].PropertyInt64("written"), int64(4096))
+	assertEqual(t, snaps[0].PropertyInt64("referenced"), int64(0))
+
+	requests := mock.GetRequestsByMethod(methodSnapshotQuery)
+	assertLen(t, requests, 1)
+	var params []any
+	json.Unmarshal(requests[0].Params, &params)
+	extra := params[1].(map[string]any)["extra"].(map[string]any)
+	assertTrue(t, extra["retrieve_properties"].(bool))
+}
+
+func TestSnapshot_CreatedAtAndSize(t *testing.T) {
+	snap := MockSnapshot("tank/vol1@snap1", "tank/vol1", "snap1")
+	assertTrue(t, snap.CreatedAt().IsZero())
+
+	snap.Properties = map[string]any{
+		"creation":   map[string]any{"rawvalue": "1700000000", "parsed": map[string]any{"$date": float64(1700000000000)}},
+		"referenced": map[string]any{"parsed": float64(4096)},
+	}
+	assertEqual(t, snap.CreatedAt(), time.Unix(1700000000, 0).UTC())
+	assertEqual(t, snap.SizeBytes(), int64(4096))
+
+	snap.Properties["creation"] = map[string]any{"parsed": map[string]any{"$date": float64(1700000000500)}}
+	snap.Properties["volsize"] = map[string]any{"parsed": float64(1 << 30)}
+	assertEqual(t, snap.CreatedAt(), time.UnixMilli(1700000000500).UTC())
+	assertEqual(t, snap.SizeBytes(), int64(1<<30))
+}
+
+func TestGetSnapshot_NotFound(t *testing.T) {
+	mock := NewMockTrueNASServer()
+	defer mock.Close()
+
+	mock.SetResponse(methodSnapshotQuery, MockResponse{
+		Result: []Snapshot{},
+	})
+
+	client := connectTestClient(t, mock)
+
+	snap, err := client.GetSnapshot(testContext(t), "tank/vol1@missing")
+
+	assertError(t, err)
+	assertNil(t, snap)
+	assertTrue(t, IsNotFoundError(err))
+}
+
+func TestListSnapshotsPage_Request(t *testing.T) {
+	mock := NewMockTrueNASServer()
+	defer mock.Close()
+
+	mock.SetResponse(methodSnapshotQuery, MockResponse{
+		Result: []Snapshot{
+			MockSnapshot("tank/vol1@snap2", "tank/vol1", "snap2"),
+		},
+	})
+
+	client := connectTestClient(t, mock)
+
+	snaps, err := client.ListSnapshotsPage(testContext(t), "tank/vol1", "tank/vol1@snap1", 2)
+
+	assertNoError(t, err)
+	assertLen(t, snaps, 1)
+
+	requests := mock.GetRequestsByMethod(methodSnapshotQuery)
+	assertLen(t, requests, 1)
+	var params []any
+	json.Unmarshal(requests[0].Params, &params)
+	filters := params[0].([]any)
+	assertLen(t, filters, 2)
+	assertEqual(t, filters[1].([]any)[1].(string), ">")
+	assertEqual(t, filters[1].([]any)[2].(string), "tank/vol1@snap1")
+	options := params[1].(map[string]any)
+	assertEqual(t, options["order_by"].([]any)[0].(string), "id")
+	assertEqual(t, options["limit"].(float64), 2)
+}
+
+func TestSnapshot_Clones(t *testing.T) {
+	snap := MockSnapshot("tank/vol1@snap1", "tank/vol1", "snap1")
+	assertLen(t, snap.Clones(), 0)
+
+	snap.Properties = map[string]any{"clones": map[string]any{"value": "tank/a,tank/b"}}
+	assertLen(t, snap.Clones(), 2)
+	assertEqual(t, snap.Clones()[1], "tank/b")
+
+	snap.Properties = map[string]any{"clones": map[string]any{"parsed": []any{"tank/c"}, "value": "tank/c"}}
+	assertLen(t, snap.Clones(), 1)
+	assertEqual(t, snap.Clones()[0], "tank/c")
+}
+
+func TestFindSnapshotsByName_Success(t *testing.T) {
+	mock := NewMockTrueNASServer()
+	defer mock.Close()
+
+	mock.SetResponse(methodSnapshotQuery, MockResponse{
+		Result: []Snapshot{
+			MockSnapshot("tank/vol1@group1", "tank/vol1", "group1"),
+			MockSnapshot("tank/vol2@group1", "tank/vol2", "group1"),
+		},
+	})
+
+	client := connectTestClient(t, mock)
+
+	snaps, err := client.FindSnapshotsByName(testContext(t), "group1")
+
+	assertNoError(t, err)
+	assertLen(t, snaps, 2)
+	assertEqual(t, snaps[1].Dataset, "tank/vol2")
+}
+
 func TestFindSnapshotByName_NotFound(t *testing.T) {
 	mock := NewMockTrueNASServer()
 	defer mock.Close()
@@ -995,6 +1786,29 @@ func TestGetSnapshotTaskByDataset_Success(t *testing.T) {
 	assertEqual(t, task.Dataset, "tank/specific")
 }
 
+func TestListAllSnapshotTasks_Success(t *testing.T) {
+	mock := NewMockTrueNASServer()
+	defer mock.Close()
+
+	mock.SetResponse(methodSnapshotTaskQuery, MockResponse{
+		Result: []SnapshotTask{
+			MockSnapshotTask(1, "tank/pvc-a", 7, "DAY"),
+			MockSnapshotTask(2, "tank/pvc-b", 2, "WEEK"),
+		},
+	})
+
+	client := connectTestClient(t, mock)
+
+	tasks, err := client.ListAllSnapshotTasks(testContext(t))
+
+	assertNoError(t, err)
+	assertLen(t, tasks, 2)
+	assertEqual(t, tasks[1].Dataset, "tank/pvc-b")
+
+	params := getRequestParams[[]json.RawMessage](t, mock, methodSnapshotTaskQuery)
+	assertEqual(t, string(params[0]), "[]")
+}
+
 func TestDeleteSnapshotTask_Success(t *testing.T) {
 	mock := NewMockTrueNASServer()
 	defer mock.Close()
@@ -1075,6 +1889,174 @@ func TestListPools_Success(t *testing.T) {
 	assertEqual(t, pools[1].Name, "data")
 }
 
+func TestGetPool_Scan(t *testing.T) {
+	mock := NewMockTrueNASServer()
+	defer mock.Close()
+
+	pool := MockPool(1, "tank", 1000000000000, 500000000000, 500000000000)
+	pool.Status = "DEGRADED"
+	pool.Healthy = false
+	pool.Scan = &PoolScan{Function: "SCRUB", State: "FINISHED", Errors: 3}
+	mock.SetResponse(methodPoolQuery, MockResponse{
+		Result: []Pool{pool},
+	})
+
+	client := connectTestClient(t, mock)
+
+	result, err := client.GetPool(testContext(t), "tank")
+
+	assertNoError(t, err)
+	assertEqual(t, result.Status, "DEGRADED")
+	assertFalse(t, result.Healthy)
+	assertNotNil(t, result.Scan)
+	assertEqual(t, result.Scan.Function, "SCRUB")
+	assertEqual(t, result.Scan.Errors, int64(3))
+}
+
+func TestListAlerts_Success(t *testing.T) {
+	mock := NewMockTrueNASServer()
+	defer mock.Close()
+
+	mock.SetResponse(methodAlertList, MockResponse{
+		Result: []map[string]any{
+			{
+				"uuid":      "a1",
+				"klass":     "ZpoolCapacityWarning",
+				"level":     "WARNING",
+				"formatted": "Space usage for pool \"tank\" is 85%.",
+				"dismissed": false,
+				"args":      map[string]any{"volume": "tank", "capacity": 85},
+			},
+			{
+				"uuid":      "a2",
+				"klass":     "ScrubFinished",
+				"level":     "INFO",
+				"formatted": "Scrub of pool \"tank\" finished.",
+				"dismissed": true,
+				"args":      "tank",
+			},
+		},
+	})
+
+	client := connectTestClient(t, mock)
+
+	alerts, err := client.ListAlerts(testContext(t))
+
+	assertNoError(t, err)
+	assertLen(t, alerts, 2)
+	assertEqual(t, alerts[0].Klass, "ZpoolCapacityWarning")
+	assertEqual(t, alerts[0].Level, "WARNING")
+	assertFalse(t, alerts[0].Dismissed)
+	assertTrue(t, alerts[1].Dismissed)
+	assertEqual(t, alerts[1].Args, any("tank"))
+}
+
+func TestListAlerts_Error(t *testing.T) {
+	mock := NewMockTrueNASServer()
+	defer mock.Close()
+
+	mock.SetResponse(methodAlertList, MockResponse{
+		Error: &RPCError{Code: -32001, Message: "Method call error"},
+	})
+
+	client := connectTestClient(t, mock)
+
+	alerts, err := client.ListAlerts(testContext(t))
+
+	assertError(t, err)
+	assertLen(t, alerts, 0)
+	assertErrorContains(t, err, "failed to list alerts")
+}
+
+func TestRunReplication_Success(t *testing.T) {
+	mock := NewMockTrueNASServer()
+	defer mock.Close()
+
+	mock.SetResponse(methodReplicationRunOnetime, MockResponse{
+		Result: float64(42),
+	})
+
+	client := connectTestClient(t, mock)
+
+	jobID, err := client.RunReplication(testContext(t), &ReplicationRunOptions{
+		Direction:       "PUSH",
+		Transport:       "LOCAL",
+		SourceDatasets:  []string{"tank/vol1"},
+		TargetDataset:   "tank/copy",
+		NameRegex:       "^snap1$",
+		RetentionPolicy: "NONE",
+		Readonly:        "IGNORE",
+	})
+
+	assertNoError(t, err)
+	assertEqual(t, jobID, "42")
+	params := getRequestParams[[]ReplicationRunOptions](t, mock, methodReplicationRunOnetime)
+	assertLen(t, params, 1)
+	assertEqual(t, params[0].TargetDataset, "tank/copy")
+}
+
+func TestLatestReplicationJob(t *testing.T) {
+	mock := NewMockTrueNASServer()
+	defer mock.Close()
+
+	mock.SetResponse(methodCoreGetJobs, MockResponse{
+		Result: []map[string]any{
+			{"id": 41, "method": methodReplicationRunOnetime, "state": "FAILED", "arguments": []any{
+				map[string]any{"source_datasets": []string{"tank/vol1"}, "target_dataset": "tank/copy"},
+			}},
+			{"id": 42, "method": methodReplicationRunOnetime, "state": "RUNNING", "arguments": []any{
+				map[string]any{"source_datasets": []string{"tank/vol1"}, "target_dataset": "tank/copy"},
+			}, "progress": map[string]any{"percent": 37.5, "description": "Sending tank/vol1@snap"}},
+		},
+	})
+
+	client := connectTestClient(t, mock)
+
+	job, err := client.LatestReplicationJob(testContext(t), "tank/copy")
+	assertNoError(t, err)
+	assertNotNil(t, job)
+	assertEqual(t, job.ID, 42)
+	assertTrue(t, job.Running())
+	assertEqual(t, job.Progress.Percent, 37.5)
+	assertEqual(t, job.Progress.Description, "Sending tank/vol1@snap")
+
+	job, err = client.LatestReplicationJob(testContext(t), "tank/other")
+	assertNoError(t, err)
+	assertTrue(t, job == nil)
+}
+
+func TestGetJob_NotFound(t *testing.T) {
+	mock := NewMockTrueNASServer()
+	defer mock.Close()
+
+	mock.SetResponse(methodCoreGetJobs, MockResponse{
+		Result: []map[string]any{},
+	})
+
+	client := connectTestClient(t, mock)
+
+	_, err := client.GetJob(testContext(t), "42")
+	assertTrue(t, IsNotFoundError(err))
+}
+
+func TestGetSSHCredentialID(t *testing.T) {
+	mock := NewMockTrueNASServer()
+	defer mock.Close()
+
+	mock.SetResponse(methodKeychainCredentialQuery, MockResponse{
+		Result: []map[string]any{{"id": 3, "name": "backup-nas", "type": "SSH_CREDENTIALS"}},
+	})
+
+	client := connectTestClient(t, mock)
+
+	id, err := client.GetSSHCredentialID(testContext(t), "backup-nas")
+	assertNoError(t, err)
+	assertEqual(t, id, 3)
+
+	params := getRequestParams[[]any](t, mock, methodKeychainCredentialQuery)
+	assertLen(t, params, 2)
+}
+
 func TestGetAvailableSpace_Success(t *testing.T) {
 	mock := NewMockTrueNASServer()
 	defer mock.Close()
@@ -1109,6 +2091,182 @@ func TestGetAvailableSpace_NotFound(t *testing.T) {
 	assertErrorContains(t, err, "not found")
 }
 
+// =============================================================================
+// Service and Preflight Tests
+// =============================================================================
+
+func TestGetService_Success(t *testing.T) {
+	mock := NewMockTrueNASServer()
+	defer mock.Close()
+
+	mock.SetResponse(methodServiceQuery, MockResponse{
+		Result: []Service{
+			{ID: 1, Service: "nfs", Enable: true, State: "RUNNING"},
+		},
+	})
+
+	client := connectTestClient(t, mock)
+
+	service, err := client.GetService(testContext(t), "nfs")
+
+	assertNoError(t, err)
+	assertEqual(t, service.State, "RUNNING")
+	assertTrue(t, service.Enable)
+	assertRequestMethod(t, mock, methodServiceQuery)
+}
+
+func TestGetService_NotFound(t *testing.T) {
+	mock := NewMockTrueNASServer()
+	defer mock.Close()
+
+	mock.SetResponse(methodServiceQuery, MockResponse{
+		Result: []Service{},
+	})
+
+	client := connectTestClient(t, mock)
+
+	_, err := client.GetService(testContext(t), "nvmet")
+
+	assertTrue(t, errors.Is(err, ErrNotFound))
+}
+
+func TestListISCSIPortals_Success(t *testing.T) {
+	mock := NewMockTrueNASServer()
+	defer mock.Close()
+
+	mock.SetResponse(methodISCSIPortalQuery, MockResponse{
+		Result: []ISCSIPortal{
+			{ID: 1, Tag: 1, Listen: []ISCSIPortalListen{{IP: "0.0.0.0"}}},
+		},
+	})
+
+	client := connectTestClient(t, mock)
+
+	portals, err := client.ListISCSIPortals(testContext(t))
+
+	assertNoError(t, err)
+	assertLen(t, portals, 1)
+	assertEqual(t, portals[0].Listen[0].IP, "0.0.0.0")
+}
+
+func TestGetISCSIGlobalConfig_Success(t *testing.T) {
+	mock := NewMockTrueNASServer()
+	defer mock.Close()
+
+	mock.SetResponse(methodISCSIGlobalConfig, MockResponse{
+		Result: map[string]any{"id": 1, "basename": "iqn.2005-10.org.freenas.ctl", "listen_port": 3260},
+	})
+
+	client := connectTestClient(t, mock)
+
+	config, err := client.GetISCSIGlobalConfig(testContext(t))
+
+	assertNoError(t, err)
+	assertEqual(t, config.Basename, "iqn.2005-10.org.freenas.ctl")
+	assertEqual(t, config.ListenPort, 3260)
+}
+
+func TestGetNFSConfig_BindIP(t *testing.T) {
+	mock := NewMockTrueNASServer()
+	defer mock.Close()
+
+	mock.SetResponse(methodNFSConfig, MockResponse{
+		Result: map[string]any{"id": 1, "bindip": []string{"10.10.0.5"}},
+	})
+
+	client := connectTestClient(t, mock)
+
+	config, err := client.GetNFSConfig(testContext(t))
+
+	assertNoError(t, err)
+	assertLen(t, config.BindIP, 1)
+	assertEqual(t, config.BindIP[0], "10.10.0.5")
+}
+
+func TestListNetworkInterfaces_Success(t *testing.T) {
+	mock := NewMockTrueNASServer()
+	defer mock.Close()
+
+	mock.SetResponse(methodInterfaceQuery, MockResponse{
+		Result: []map[string]any{
+			{
+				"id":      "enp1s0",
+				"name":    "enp1s0",
+				"aliases": []map[string]any{{"type": "INET", "address": "192.168.1.10", "netmask": 24}},
+				"state": map[string]any{
+					"link_state": "LINK_STATE_UP",
+					"aliases": []map[string]any{
+						{"type": "LINK", "address": "00:11:22:33:44:55"},
+						{"type": "INET", "address": "192.168.1.10", "netmask": 24},
+					},
+				},
+			},
+		},
+	})
+
+	client := connectTestClient(t, mock)
+
+	interfaces, err := client.ListNetworkInterfaces(testContext(t))
+
+	assertNoError(t, err)
+	assertLen(t, interfaces, 1)
+	assertEqual(t, interfaces[0].Aliases[0].Address, "192.168.1.10")
+	assertLen(t, interfaces[0].State.Aliases, 2)
+}
+
+func TestGetSessionRoles_EncodedSet(t *testing.T) {
+	mock := NewMockTrueNASServer()
+	defer mock.Close()
+
+	mock.SetResponse(methodAuthMe, MockResponse{
+		Result: map[string]any{
+			"pw_name":   "csi",
+			"privilege": map[string]any{"roles": map[string]any{"$set": []string{"DATASET_WRITE", "SHARING_NFS_WRITE"}}},
+		},
+	})
+
+	client := connectTestClient(t, mock)
+
+	roles, err := client.GetSessionRoles(testContext(t))
+
+	assertNoError(t, err)
+	assertLen(t, roles, 2)
+	assertEqual(t, roles[1], "SHARING_NFS_WRITE")
+}
+
+func TestGetSessionRoles_NoPrivilege(t *testing.T) {
+	mock := NewMockTrueNASServer()
+	defer mock.Close()
+
+	mock.SetResponse(methodAuthMe, MockResponse{
+		Result: map[string]any{"pw_name": "root"},
+	})
+
+	client := connectTestClient(t, mock)
+
+	roles, err := client.GetSessionRoles(testContext(t))
+
+	assertNoError(t, err)
+	assertLen(t, roles, 0)
+}
+
+func TestCheckQueryAccess_Denied(t *testing.T) {
+	mock := NewMockTrueNASServer()
+	defer mock.Close()
+
+	mock.SetResponse(methodISCSIAuthQuery, MockResponse{
+		Error: &RPCError{Code: 13, Message: "Not authorized"},
+	})
+
+	client := connectTestClient(t, mock)
+
+	failures := client.CheckQueryAccess(testContext(t))
+
+	assertEqual(t, len(failures), 1)
+	_, denied := failures[methodISCSIAuthQuery]
+	assertTrue(t, denied)
+}
+
 // =============================================================================
 // Helper Function Tests
 // =============================================================================
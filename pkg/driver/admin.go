@@ -0,0 +1,407 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/truenas/truenas-csi/pkg/client"
+)
+
+// csiCommentPrefix starts the comment of every NFS share and iSCSI target alias
+// created by the controller.
+const csiCommentPrefix = "CSI volume"
+
+// VolumeMapping links a volume to its dataset and the objects exporting it.
+// Zero IDs mean the object does not exist.
+type VolumeMapping struct {
+	VolumeID string
+	// PVName is the PersistentVolume name CreateVolume recorded on the dataset.
+	// Empty for imported volumes and those created by earlier driver versions.
+	PVName          string
+	DatasetPath     string
+	Protocol        string
+	CapacityBytes   int64
+	Imported        bool
+	NFSShareID      int
+	SMBShareID      int
+	SMBShareName    string
+	ISCSITargetID   int
+	ISCSITargetName string
+	ISCSIExtentID   int
+	ISCSIExtentName string
+	LUN             int
+	NVMeSubsysID    int
+	NVMeSubsysName  string
+}
+
+// VolumeInspection holds everything the driver knows about a volume, including
+// the raw TrueNAS objects. CHAP secrets are removed.
+type VolumeInspection struct {
+	Volume            *VolumeInfo               `json:"volume"`
+	Dataset           *client.Dataset           `json:"dataset"`
+	NFSShare          *client.NFSShare          `json:"nfsShare,omitempty"`
+	ISCSIExtent       *client.ISCSIExtent       `json:"iscsiExtent,omitempty"`
+	ISCSITargetExtent *client.ISCSITargetExtent `json:"iscsiTargetExtent,omitempty"`
+	ISCSITarget       *client.ISCSITarget       `json:"iscsiTarget,omitempty"`
+	Snapshots         []client.Snapshot         `json:"snapshots"`
+	SnapshotTasks     []client.SnapshotTask     `json:"snapshotTasks"`
+}
+
+// Orphan is a share, extent or target that no longer serves a volume.
+type Orphan struct {
+	Kind   string
+	ID     int
+	Name   string
+	Reason string
+}
+
+// exportInventory indexes the NFS and iSCSI objects on TrueNAS for bulk lookups.
+type exportInventory struct {
+	sharesByPath   map[string]client.NFSShare
+	extentsByDisk  map[string]client.ISCSIExtent
+	assocsByExtent map[int]client.ISCSITargetExtent
+	targetsByID    map[int]client.ISCSITarget
+	// namespacesByDevice is empty on TrueNAS releases without NVMe-oF
+	namespacesByDevice map[string]client.NVMetNamespace
+	smbSharesByPath    map[string]client.SMBShare
+
+	shares     []client.NFSShare
+	extents    []client.ISCSIExtent
+	assocs     []client.ISCSITargetExtent
+	targets    []client.ISCSITarget
+	namespaces []client.NVMetNamespace
+	smbShares  []client.SMBShare
+}
+
+// loadExportInventory lists all NFS shares and iSCSI objects.
+func (d *Driver) loadExportInventory(ctx context.Context) (*exportInventory, error) {
+	inv := &exportInventory{
+		sharesByPath:   make(map[string]client.NFSShare),
+		extentsByDisk:  make(map[string]client.ISCSIExtent),
+		assocsByExtent: make(map[int]client.ISCSITargetExtent),
+		targetsByID:    make(map[int]client.ISCSITarget),
+
+		namespacesByDevice: make(map[string]client.NVMetNamespace),
+		smbSharesByPath:    make(map[string]client.SMBShare),
+	}
+
+	var err error
+	if inv.shares, err = d.client.ListNFSShares(ctx); err != nil {
+		return nil, err
+	}
+	if inv.extents, err = d.client.ListISCSIExtents(ctx); err != nil {
+		return nil, err
+	}
+	if inv.assocs, err = d.client.ListISCSITargetExtents(ctx); err != nil {
+		return nil, err
+	}
+	if inv.targets, err = d.client.ListISCSITargets(ctx); err != nil {
+		return nil, err
+	}
+
+	for _, share := range inv.shares {
+		inv.sharesByPath[share.Path] = share
+	}
+	for _, extent := range inv.extents {
+		inv.extentsByDisk[extent.Disk] = extent
+	}
+	for _, assoc := range inv.assocs {
+		inv.assocsByExtent[assoc.Extent] = assoc
+	}
+	for _, target := range inv.targets {
+		inv.targetsByID[target.ID] = target
+	}
+
+	if inv.namespaces, err = d.client.ListNVMetNamespaces(ctx); err != nil {
+		d.log.V(LogLevelDebug).Info("Skipping NVMe-oF namespaces", "error", err.Error())
+	} else {
+		for _, ns := range inv.namespaces {
+			inv.namespacesByDevice[ns.DevicePath] = ns
+		}
+	}
+	if inv.smbShares, err = d.client.ListSMBShares(ctx); err != nil {
+		d.log.V(LogLevelDebug).Info("Skipping SMB shares", "error", err.Error())
+	} else {
+		for _, share := range inv.smbShares {
+			inv.smbSharesByPath[share.Path] = share
+		}
+	}
+	return inv, nil
+}
+
+// listVolumeDatasets returns the datasets in a pool that are CSI volumes: direct
+// children of the pool, as created by CreateVolume, and imported datasets.
+func (d *Driver) listVolumeDatasets(ctx context.Context, pool string) ([]client.Dataset, error) {
+	datasets, err := d.client.ListDatasets(ctx, pool)
+	if err != nil {
+		return nil, err
+	}
+
+	volumes := make([]client.Dataset, 0, len(datasets))
+	for _, ds := range datasets {
+		if ds.Name == pool || isTrashPath(ds.Name) {
+			continue
+		}
+		if strings.Count(ds.Name, "/") != 1 && ds.UserProperties[PropertyImported] != "true" {
+			continue
+		}
+		volumes = append(volumes, ds)
+	}
+	return volumes, nil
+}
+
+// ListVolumeMappings returns the volumes in a pool (the default pool if empty)
+// together with their NFS share, iSCSI target and extent, or NVMe-oF subsystem.
+func (d *Driver) ListVolumeMappings(ctx context.Context, pool string) ([]VolumeMapping, error) {
+	if pool == "" {
+		pool = d.defaultPool
+	}
+
+	datasets, err := d.listVolumeDatasets(ctx, pool)
+	if err != nil {
+		return nil, err
+	}
+	inv, err := d.loadExportInventory(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	mappings := make([]VolumeMapping, 0, len(datasets))
+	for _, ds := range datasets {
+		m := VolumeMapping{
+			VolumeID:    ds.Name,
+			PVName:      ds.UserProperties[PropertyPVName],
+			DatasetPath: ds.Name,
+			Imported:    ds.UserProperties[PropertyImported] == "true",
+		}
+
+		if ds.Type == "VOLUME" {
+			m.Protocol = ProtocolISCSI
+			m.CapacityBytes = ds.Volsize
+			if extent, ok := inv.extentsByDisk["zvol/"+ds.Name]; ok {
+				m.ISCSIExtentID = extent.ID
+				m.ISCSIExtentName = extent.Name
+				if assoc, ok := inv.assocsByExtent[extent.ID]; ok {
+					m.LUN = assoc.LunID
+					if target, ok := inv.targetsByID[assoc.Target]; ok {
+						m.ISCSITargetID = target.ID
+						m.ISCSITargetName = target.Name
+					}
+				}
+			} else if ns, ok := inv.namespacesByDevice["zvol/"+ds.Name]; ok && ns.Subsys != nil {
+				m.Protocol = ProtocolNVMe
+				m.NVMeSubsysID = ns.Subsys.ID
+				m.NVMeSubsysName = ns.Subsys.Name
+			}
+		} else {
+			m.Protocol = ProtocolNFS
+			m.CapacityBytes = ds.RefQuota
+			mountpoint := ds.Mountpoint
+			if mountpoint == "" {
+				mountpoint = filepath.Join(DefaultMountpoint, ds.Name)
+			}
+			if share, ok := inv.sharesByPath[mountpoint]; ok {
+				m.NFSShareID = share.ID
+			} else if share, ok := inv.smbSharesByPath[mountpoint]; ok {
+				m.Protocol = ProtocolSMB
+				m.SMBShareID = share.ID
+				m.SMBShareName = share.Name
+			}
+		}
+		mappings = append(mappings, m)
+	}
+	return mappings, nil
+}
+
+// InspectVolume reconstructs a volume the way the controller does and collects
+// the raw TrueNAS objects behind it.
+func (d *Driver) InspectVolume(ctx context.Context, volumeID string) (*VolumeInspection, error) {
+	volInfo, err := d.reconstructVolumeFromTrueNAS(ctx, volumeID)
+	if err != nil {
+		return nil, err
+	}
+
+	dataset, err := d.client.GetDataset(ctx, volInfo.DatasetPath)
+	if err != nil {
+		return nil, err
+	}
+
+	inspection := &VolumeInspection{
+		Volume:  volInfo,
+		Dataset: dataset,
+	}
+
+	if dataset.Type == "VOLUME" {
+		if extent, err := d.client.GetISCSIExtentByDisk(ctx, "zvol/"+volInfo.DatasetPath); err == nil {
+			inspection.ISCSIExtent = extent
+			if assoc, err := d.client.GetISCSITargetExtentByExtent(ctx, extent.ID); err == nil {
+				inspection.ISCSITargetExtent = assoc
+				if target, err := d.client.GetISCSITargetByID(ctx, assoc.Target); err == nil {
+					if target.Auth != nil {
+						auth := *target.Auth
+						auth.Secret = ""
+						auth.PeerSecret = ""
+						target.Auth = &auth
+					}
+					inspection.ISCSITarget = target
+				}
+			}
+		}
+	} else if volInfo.NFSPath != "" {
+		if share, err := d.client.GetNFSShareByPath(ctx, volInfo.NFSPath); err == nil {
+			inspection.NFSShare = share
+		}
+	}
+
+	if inspection.Snapshots, err = d.client.ListSnapshots(ctx, volInfo.DatasetPath); err != nil {
+		return nil, err
+	}
+	if inspection.SnapshotTasks, err = d.client.ListSnapshotTasks(ctx, volInfo.DatasetPath); err != nil {
+		return nil, err
+	}
+
+	return inspection, nil
+}
+
+// ListVolumeSnapshots returns the snapshots of the volumes in a pool (the default
+// pool if empty).
+func (d *Driver) ListVolumeSnapshots(ctx context.Context, pool string) ([]client.Snapshot, error) {
+	if pool == "" {
+		pool = d.defaultPool
+	}
+
+	datasets, err := d.listVolumeDatasets(ctx, pool)
+	if err != nil {
+		return nil, err
+	}
+	volumes := make(map[string]struct{}, len(datasets))
+	for _, ds := range datasets {
+		volumes[ds.Name] = struct{}{}
+	}
+
+	all, err := d.client.ListAllSnapshots(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshots := make([]client.Snapshot, 0, len(all))
+	for _, snap := range all {
+		if _, ok := volumes[snap.Dataset]; ok {
+			snapshots = append(snapshots, snap)
+		}
+	}
+	return snapshots, nil
+}
+
+// FindOrphans returns NFS and SMB shares, iSCSI objects and NVMe-oF namespaces
+// and subsystems that point at missing datasets or are no longer connected to
+// each other. Nothing is deleted.
+func (d *Driver) FindOrphans(ctx context.Context) ([]Orphan, error) {
+	pools, err := d.client.ListPools(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	datasets := make(map[string]struct{})
+	mountpoints := make(map[string]struct{})
+	for _, pool := range pools {
+		list, err := d.client.ListDatasets(ctx, pool.Name)
+		if err != nil {
+			return nil, err
+		}
+		for i, ds := range list {
+			datasets[ds.Name] = struct{}{}
+			if ds.Type != "VOLUME" {
+				mountpoints[datasetMountpoint(ds.Name, &list[i])] = struct{}{}
+			}
+		}
+	}
+
+	inv, err := d.loadExportInventory(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var orphans []Orphan
+
+	// Only shares created by the driver; other shares may point anywhere
+	for _, share := range inv.shares {
+		if !strings.HasPrefix(share.Comment, csiCommentPrefix) {
+			continue
+		}
+		// Imported and adopted datasets may be mounted outside DefaultMountpoint
+		if _, ok := mountpoints[share.Path]; !ok {
+			orphans = append(orphans, Orphan{Kind: "nfs-share", ID: share.ID, Name: share.Path, Reason: "dataset does not exist"})
+		}
+	}
+
+	for _, share := range inv.smbShares {
+		if !strings.HasPrefix(share.Comment, csiCommentPrefix) {
+			continue
+		}
+		if _, ok := mountpoints[share.Path]; !ok {
+			orphans = append(orphans, Orphan{Kind: "smb-share", ID: share.ID, Name: share.Name, Reason: "dataset does not exist"})
+		}
+	}
+
+	for _, extent := range inv.extents {
+		if zvol, ok := strings.CutPrefix(extent.Disk, "zvol/"); ok {
+			if _, ok := datasets[zvol]; !ok {
+				orphans = append(orphans, Orphan{Kind: "iscsi-extent", ID: extent.ID, Name: extent.Name, Reason: fmt.Sprintf("zvol %s does not exist", zvol)})
+				continue
+			}
+		}
+		if _, ok := inv.assocsByExtent[extent.ID]; !ok {
+			orphans = append(orphans, Orphan{Kind: "iscsi-extent", ID: extent.ID, Name: extent.Name, Reason: "not attached to a target"})
+		}
+	}
+
+	targetsInUse := make(map[int]struct{}, len(inv.assocs))
+	for _, assoc := range inv.assocs {
+		targetsInUse[assoc.Target] = struct{}{}
+		if _, ok := inv.targetsByID[assoc.Target]; !ok {
+			orphans = append(orphans, Orphan{Kind: "iscsi-targetextent", ID: assoc.ID, Reason: fmt.Sprintf("target %d does not exist", assoc.Target)})
+		}
+	}
+	for _, target := range inv.targets {
+		if !strings.HasPrefix(target.Alias, csiCommentPrefix) {
+			continue
+		}
+		if _, ok := targetsInUse[target.ID]; !ok {
+			orphans = append(orphans, Orphan{Kind: "iscsi-target", ID: target.ID, Name: target.Name, Reason: "has no extents"})
+		}
+	}
+
+	subsysInUse := make(map[int]struct{}, len(inv.namespaces))
+	for _, ns := range inv.namespaces {
+		if ns.Subsys != nil {
+			subsysInUse[ns.Subsys.ID] = struct{}{}
+		}
+		if zvol, ok := strings.CutPrefix(ns.DevicePath, "zvol/"); ok {
+			if _, ok := datasets[zvol]; !ok {
+				orphans = append(orphans, Orphan{Kind: "nvme-namespace", ID: ns.ID, Name: ns.DevicePath, Reason: fmt.Sprintf("zvol %s does not exist", zvol)})
+			}
+		}
+	}
+	// Subsystems are only checked if the namespaces could be listed, which fails
+	// on TrueNAS releases without NVMe-oF
+	if inv.namespaces == nil {
+		return orphans, nil
+	}
+	if subsystems, err := d.client.ListNVMetSubsystems(ctx); err != nil {
+		d.log.V(LogLevelDebug).Info("Skipping NVMe-oF subsystems", "error", err.Error())
+	} else {
+		for _, subsys := range subsystems {
+			if !strings.HasPrefix(subsys.Name, "csi-") {
+				continue
+			}
+			if _, ok := subsysInUse[subsys.ID]; !ok {
+				orphans = append(orphans, Orphan{Kind: "nvme-subsystem", ID: subsys.ID, Name: subsys.Name, Reason: "has no namespaces"})
+			}
+		}
+	}
+
+	return orphans, nil
+}
@@ -0,0 +1,390 @@
+package driver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/truenas/truenas-csi/pkg/client"
+)
+
+const (
+	// paramCloneStrategy selects how a volume is created from a snapshot or volume.
+	// Supported values: "clone" (default), "promote" and "copy".
+	paramCloneStrategy = "cloneStrategy"
+
+	cloneStrategyClone   = "clone"   // ZFS clone that depends on the source snapshot
+	cloneStrategyPromote = "promote" // clone, then promote it so the source depends on it
+	cloneStrategyCopy    = "copy"    // independent copy received through local replication
+
+	// cloneSnapshotPrefix names the snapshots taken of a source volume to clone it
+	cloneSnapshotPrefix = "csi-clone-"
+
+	// paramReplicationSSHCredentials names the SSH connection on this TrueNAS
+	// that snapshots not found here are pulled from.
+	paramReplicationSSHCredentials = "replication.sshCredentials"
+)
+
+// driverProperties are the user properties the driver keeps on its datasets.
+// A copy must not take over those of its source.
+var driverProperties = []string{
+	PropertyManaged,
+	PropertyPVName,
+	PropertyDeleteStrategy,
+	PropertyTrashOrigin,
+	PropertyTrashExpiry,
+	PropertyImported,
+	PropertyAdopted,
+	PropertyExportManaged,
+	PropertyMigratedFrom,
+	PropertyCloneStrategy,
+}
+
+// volumeSnapshotNamePattern matches the names the external-snapshotter gives the
+// snapshots of VolumeSnapshots and VolumeGroupSnapshots: a prefix and the UID.
+var volumeSnapshotNamePattern = regexp.MustCompile(`^(snapshot|groupsnapshot)-[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`)
+
+// parseCloneStrategy validates a cloneStrategy value. Empty means clone.
+func parseCloneStrategy(value string) (string, error) {
+	switch strategy := strings.ToLower(strings.TrimSpace(value)); strategy {
+	case "":
+		return cloneStrategyClone, nil
+	case cloneStrategyClone, cloneStrategyPromote, cloneStrategyCopy:
+		return strategy, nil
+	default:
+		return "", fmt.Errorf("invalid %s: %s (valid: %s, %s, %s)", paramCloneStrategy, value,
+			cloneStrategyClone, cloneStrategyPromote, cloneStrategyCopy)
+	}
+}
+
+// copyPollInterval is how often the progress of a copy is checked
+const copyPollInterval = 2 * time.Second
+
+// errCopyInProgress is returned while a copy outlasts the request. The retry
+// of CreateVolume picks the copy up again.
+var errCopyInProgress = errors.New("copy is still in progress")
+
+// cloneSource is the snapshot a volume is created from
+type cloneSource struct {
+	snapshotID string
+
+	// sshCredentials is the SSH connection to the TrueNAS holding the snapshot,
+	// or 0 if it is on this one
+	sshCredentials int
+}
+
+// cloneRecorded reports whether a volume created from a content source was
+// finished: the clone strategy is recorded once the data is in place.
+func cloneRecorded(dataset *client.Dataset) bool {
+	return dataset.UserProperties[PropertyCloneStrategy] != ""
+}
+
+// cloneFromSnapshot creates the dataset at datasetPath from a snapshot.
+func (s *ControllerServer) cloneFromSnapshot(ctx context.Context, source cloneSource, datasetPath, strategy string) error {
+	if strategy == cloneStrategyCopy {
+		return s.copySnapshot(ctx, source, datasetPath)
+	}
+
+	if _, err := s.driver.Client().CloneSnapshot(ctx, source.snapshotID, datasetPath); err != nil {
+		return err
+	}
+	if strategy == cloneStrategyPromote {
+		if err := s.driver.Client().PromoteDataset(ctx, datasetPath); err != nil {
+			s.driver.Client().DeleteDataset(ctx, datasetPath, &client.DatasetDeleteOptions{Recursive: true, Force: true})
+			return err
+		}
+	}
+	return nil
+}
+
+// copySnapshot receives a full copy of a snapshot at datasetPath through a
+// replication job: local (zfs send | zfs recv on TrueNAS) for snapshots on
+// this TrueNAS, pulled over SSH for others. The copy shares no blocks with
+// the source and keeps none of its driver properties.
+func (s *ControllerServer) copySnapshot(ctx context.Context, source cloneSource, datasetPath string) error {
+	dataset, name, ok := strings.Cut(source.snapshotID, "@")
+	if !ok {
+		return fmt.Errorf("snapshot %s: %w", source.snapshotID, client.ErrNotFound)
+	}
+
+	opts := &client.ReplicationRunOptions{
+		Direction:         "PUSH",
+		Transport:         "LOCAL",
+		SourceDatasets:    []string{dataset},
+		TargetDataset:     datasetPath,
+		Properties:        true,
+		PropertiesExclude: driverProperties,
+		NameRegex:         "^" + regexp.QuoteMeta(name) + "$",
+		RetentionPolicy:   "NONE",
+		Readonly:          "IGNORE",
+		AllowFromScratch:  true,
+	}
+	if source.sshCredentials != 0 {
+		opts.Direction = "PULL"
+		opts.Transport = "SSH"
+		opts.SSHCredentials = source.sshCredentials
+	}
+
+	jobID, err := s.driver.Client().RunReplication(ctx, opts)
+	if err != nil {
+		return err
+	}
+	s.driver.Log().V(LogLevelInfo).Info("Copying snapshot", "snapshotId", source.snapshotID, "dataset", datasetPath,
+		"transport", opts.Transport, "jobId", jobID)
+
+	if err := s.waitForCopy(ctx, jobID, datasetPath); err != nil {
+		// A copy that is still running is picked up again by the retry
+		if !errors.Is(err, errCopyInProgress) {
+			s.driver.Client().DeleteDataset(ctx, datasetPath, &client.DatasetDeleteOptions{Recursive: true, Force: true})
+		}
+		return err
+	}
+	s.finishCopy(ctx, datasetPath)
+	return nil
+}
+
+// waitForCopy follows a replication job until it finishes, logging its
+// progress. If the request ends first, errCopyInProgress carries the progress.
+func (s *ControllerServer) waitForCopy(ctx context.Context, jobID, datasetPath string) error {
+	ticker := time.NewTicker(copyPollInterval)
+	defer ticker.Stop()
+
+	var job *client.Job
+	var lastPercent float64 = -1
+	for {
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%w: %s", errCopyInProgress, copyProgress(job))
+		case <-ticker.C:
+		}
+
+		var err error
+		if job, err = s.driver.Client().GetJob(ctx, jobID); err != nil {
+			if ctx.Err() != nil {
+				continue
+			}
+			return err
+		}
+		switch job.State {
+		case "SUCCESS":
+			s.driver.Log().V(LogLevelInfo).Info("Copy finished", "dataset", datasetPath, "jobId", jobID)
+			return nil
+		case "FAILED", "ABORTED":
+			return fmt.Errorf("copy to %s %s: %s", datasetPath, strings.ToLower(job.State), job.Error)
+		}
+		if job.Progress.Percent != lastPercent {
+			lastPercent = job.Progress.Percent
+			s.driver.Log().V(LogLevelInfo).Info("Copying snapshot", "dataset", datasetPath, "jobId", jobID,
+				"percent", job.Progress.Percent, "progress", job.Progress.Description)
+		}
+	}
+}
+
+// copyProgress describes how far a replication job got
+func copyProgress(job *client.Job) string {
+	if job == nil {
+		return "not started yet"
+	}
+	progress := fmt.Sprintf("%.0f%%", job.Progress.Percent)
+	if job.Progress.Description != "" {
+		progress += ": " + job.Progress.Description
+	}
+	return progress
+}
+
+// finishCopy deletes the snapshots a copy arrived with, which the volume does not need.
+func (s *ControllerServer) finishCopy(ctx context.Context, datasetPath string) {
+	snapshots, err := s.driver.Client().ListSnapshots(ctx, datasetPath)
+	if err != nil {
+		s.driver.Log().V(LogLevelDebug).Info("Failed to list snapshots of copied volume", "dataset", datasetPath, "error", err)
+		return
+	}
+	for _, snap := range snapshots {
+		if err := s.driver.Client().DeleteSnapshot(ctx, snap.ID); err != nil && !client.IsNotFoundError(err) {
+			s.driver.Log().V(LogLevelDebug).Info("Failed to delete snapshot of copied volume", "snapshotId", snap.ID, "error", err)
+		}
+	}
+}
+
+// deleteCopySnapshots deletes the snapshots taken of a source volume to copy
+// it to volumeID, which an interrupted copy leaves behind.
+func (s *ControllerServer) deleteCopySnapshots(ctx context.Context, sourceDataset, volumeID string) {
+	prefix := cloneSnapshotPrefix + strings.ReplaceAll(volumeID, "/", "-") + "-"
+	snapshots, err := s.driver.Client().ListSnapshots(ctx, sourceDataset)
+	if err != nil {
+		return
+	}
+	for _, snap := range snapshots {
+		_, name, _ := strings.Cut(snap.ID, "@")
+		if strings.HasPrefix(name, prefix) && len(snap.Clones()) == 0 {
+			s.driver.Client().DeleteSnapshot(ctx, snap.ID)
+		}
+	}
+}
+
+// resolveCloneSource finds where the snapshot a volume is created from lives
+// and the strategy that can create the volume from there. Clones cannot leave
+// their pool, so sources in other pools and on other systems are copied. A
+// snapshot that is not on this TrueNAS is pulled over the StorageClass's SSH
+// connection, if it has one.
+func (s *ControllerServer) resolveCloneSource(ctx context.Context, snapshotID, datasetPath, strategy string, parameters map[string]string) (cloneSource, string, error) {
+	source := cloneSource{snapshotID: snapshotID}
+
+	if connection := parameters[paramReplicationSSHCredentials]; connection != "" {
+		_, err := s.driver.Client().GetSnapshot(ctx, snapshotID)
+		if err != nil && !client.IsNotFoundError(err) {
+			return source, "", err
+		}
+		if err != nil {
+			if source.sshCredentials, err = s.sshCredentialID(ctx, connection); err != nil {
+				return source, "", err
+			}
+			s.driver.Log().V(LogLevelInfo).Info("Snapshot is not on this TrueNAS, pulling it over SSH", "snapshotId", snapshotID, "connection", connection)
+			return source, cloneStrategyCopy, nil
+		}
+	}
+
+	if strategy != cloneStrategyCopy && client.ExtractPoolFromPath(snapshotID) != client.ExtractPoolFromPath(datasetPath) {
+		s.driver.Log().V(LogLevelInfo).Info("Snapshot is in another pool, copying it", "snapshotId", snapshotID, "dataset", datasetPath, "cloneStrategy", strategy)
+		strategy = cloneStrategyCopy
+	}
+
+	if strategy == cloneStrategyPromote {
+		blockers, err := s.promotionBlockers(ctx, snapshotID)
+		if err != nil {
+			return source, "", err
+		}
+		if len(blockers) > 0 {
+			s.driver.Log().V(LogLevelInfo).Info("Promoting would move snapshots of VolumeSnapshots, copying instead",
+				"snapshotId", snapshotID, "dataset", datasetPath, "snapshots", blockers)
+			strategy = cloneStrategyCopy
+		}
+	}
+	return source, strategy, nil
+}
+
+// promotionBlockers returns the snapshots that promoting a clone of snapshotID
+// would move to the clone and that VolumeSnapshots may refer to.
+func (s *ControllerServer) promotionBlockers(ctx context.Context, snapshotID string) ([]string, error) {
+	dataset, _, _ := strings.Cut(snapshotID, "@")
+	snapshots, err := s.driver.Client().ListSnapshotsWithProperties(ctx, dataset, []string{"createtxg", "userrefs"})
+	if err != nil {
+		if client.IsNotFoundError(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return movedVolumeSnapshots(snapshots, snapshotID), nil
+}
+
+// movedVolumeSnapshots returns the snapshots among those of a dataset that
+// promoting a clone of origin moves, origin and all older ones, and that are
+// held or named like the snapshots of VolumeSnapshots. Moving them changes
+// their IDs, which breaks the VolumeSnapshots that refer to them.
+func movedVolumeSnapshots(snapshots []client.Snapshot, origin string) []string {
+	i := slices.IndexFunc(snapshots, func(snap client.Snapshot) bool { return snap.ID == origin })
+	if i < 0 {
+		return nil
+	}
+	originTxg := snapshots[i].PropertyInt64("createtxg")
+
+	var moved []string
+	for _, snap := range snapshots {
+		if snap.PropertyInt64("createtxg") > originTxg {
+			continue
+		}
+		_, name, _ := strings.Cut(snap.ID, "@")
+		if snap.Holds() > 0 || volumeSnapshotNamePattern.MatchString(name) {
+			moved = append(moved, snap.ID)
+		}
+	}
+	return moved
+}
+
+// sshCredentialID resolves an SSH connection given by name or ID
+func (s *ControllerServer) sshCredentialID(ctx context.Context, connection string) (int, error) {
+	if id, err := strconv.Atoi(connection); err == nil {
+		return id, nil
+	}
+	return s.driver.Client().GetSSHCredentialID(ctx, connection)
+}
+
+// recordCloneStrategy stores how a volume was created from its source, along
+// with its ownership and delete strategy. For copies it marks the copy as complete.
+func (s *ControllerServer) recordCloneStrategy(ctx context.Context, datasetPath, strategy string, parameters map[string]string) error {
+	updates := []client.UserPropertyUpdate{{Key: PropertyCloneStrategy, Value: strategy}}
+	for _, prop := range volumeProperties(parameters) {
+		updates = append(updates, client.UserPropertyUpdate{Key: prop.Key, Value: prop.Value})
+	}
+	return s.driver.Client().UpdateDataset(ctx, datasetPath, &client.DatasetUpdateOptions{UserPropertiesUpdate: updates})
+}
+
+// destroyDataset destroys a volume's dataset with its snapshots. ZFS cannot
+// destroy a snapshot a clone depends on, so clones are promoted first. The
+// snapshot the driver took to clone the volume goes with it.
+func (s *ControllerServer) destroyDataset(ctx context.Context, datasetPath string) error {
+	if err := s.releaseClones(ctx, datasetPath); err != nil {
+		return fmt.Errorf("failed to release clones of %s: %w", datasetPath, err)
+	}
+
+	// Promoting a clone changes the origin, so it is read afterwards
+	dataset, err := s.driver.Client().GetDataset(ctx, datasetPath)
+	if err != nil {
+		if client.IsNotFoundError(err) {
+			return nil
+		}
+		return err
+	}
+
+	err = s.driver.Client().DeleteDataset(ctx, datasetPath, &client.DatasetDeleteOptions{Recursive: true, Force: true})
+	if err != nil && !client.IsNotFoundError(err) {
+		return err
+	}
+
+	if _, name, ok := strings.Cut(dataset.Origin, "@"); ok && strings.HasPrefix(name, cloneSnapshotPrefix) {
+		if err := s.driver.Client().DeleteSnapshot(ctx, dataset.Origin); err != nil && !client.IsNotFoundError(err) {
+			s.driver.Log().V(LogLevelDebug).Info("Failed to delete clone snapshot", "snapshotId", dataset.Origin, "error", err)
+		}
+	}
+	return nil
+}
+
+// releaseClones promotes the clone of the newest snapshot of the dataset that
+// has clones. That snapshot and all older ones move to the clone, together
+// with the clones of those, so the dataset no longer has dependents. It fails
+// with errSnapshotsHeld if snapshots of VolumeSnapshots would move.
+func (s *ControllerServer) releaseClones(ctx context.Context, datasetPath string) error {
+	snapshots, err := s.driver.Client().ListSnapshotsWithProperties(ctx, datasetPath, []string{"createtxg", "clones", "userrefs"})
+	if err != nil {
+		if client.IsNotFoundError(err) {
+			return nil
+		}
+		return err
+	}
+
+	var newest *client.Snapshot
+	for i := range snapshots {
+		if len(snapshots[i].Clones()) == 0 {
+			continue
+		}
+		if newest == nil || snapshots[i].PropertyInt64("createtxg") > newest.PropertyInt64("createtxg") {
+			newest = &snapshots[i]
+		}
+	}
+	if newest == nil {
+		return nil
+	}
+
+	clone := newest.Clones()[0]
+	if moved := movedVolumeSnapshots(snapshots, newest.ID); len(moved) > 0 {
+		return fmt.Errorf("%w: promoting clone %s would move %v to it; delete their VolumeSnapshots or the clone first",
+			errSnapshotsHeld, clone, moved)
+	}
+	s.driver.Log().V(LogLevelInfo).Info("Promoting clone so its origin can be deleted", "dataset", datasetPath, "snapshotId", newest.ID, "clone", clone)
+	return s.driver.Client().PromoteDataset(ctx, clone)
+}
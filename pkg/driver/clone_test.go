@@ -0,0 +1,124 @@
+package driver
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/truenas/truenas-csi/pkg/client"
+)
+
+func TestParseCloneStrategy(t *testing.T) {
+	tests := []struct {
+		name     string
+		value    string
+		expected string
+		wantErr  bool
+	}{
+		{name: "empty", value: "", expected: cloneStrategyClone},
+		{name: "clone", value: "clone", expected: cloneStrategyClone},
+		{name: "promote", value: "promote", expected: cloneStrategyPromote},
+		{name: "copy mixed case", value: " Copy ", expected: cloneStrategyCopy},
+		{name: "unknown", value: "send", wantErr: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			strategy, err := parseCloneStrategy(tc.value)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("parseCloneStrategy(%q) = %q, want error", tc.value, strategy)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseCloneStrategy(%q) returned error: %v", tc.value, err)
+			}
+			if strategy != tc.expected {
+				t.Errorf("parseCloneStrategy(%q) = %q, want %q", tc.value, strategy, tc.expected)
+			}
+		})
+	}
+}
+
+func TestMovedVolumeSnapshots(t *testing.T) {
+	const (
+		volumeSnapshot = "tank/k8s/pvc-1@snapshot-0b6f1d2c-3a4e-4f5a-8b9c-0d1e2f3a4b5c"
+		groupSnapshot  = "tank/k8s/pvc-1@groupsnapshot-7c8d9e0f-1a2b-4c3d-9e4f-5a6b7c8d9e0f"
+	)
+	snapshot := func(id string, txg, holds int64) client.Snapshot {
+		return client.Snapshot{ID: id, Properties: map[string]any{"createtxg": float64(txg), "userrefs": float64(holds)}}
+	}
+
+	tests := []struct {
+		name      string
+		snapshots []client.Snapshot
+		origin    string
+		expected  []string
+	}{
+		{
+			name: "only driver and task snapshots",
+			snapshots: []client.Snapshot{
+				snapshot("tank/k8s/pvc-1@auto-2026-01-01", 10, 0),
+				snapshot("tank/k8s/pvc-1@csi-clone-tank-k8s-pvc-2-1767225600", 20, 0),
+			},
+			origin: "tank/k8s/pvc-1@csi-clone-tank-k8s-pvc-2-1767225600",
+		},
+		{
+			name: "older volume snapshot moves",
+			snapshots: []client.Snapshot{
+				snapshot(volumeSnapshot, 10, 0),
+				snapshot("tank/k8s/pvc-1@csi-clone-tank-k8s-pvc-2-1767225600", 20, 0),
+			},
+			origin:   "tank/k8s/pvc-1@csi-clone-tank-k8s-pvc-2-1767225600",
+			expected: []string{volumeSnapshot},
+		},
+		{
+			name: "newer volume snapshot stays",
+			snapshots: []client.Snapshot{
+				snapshot("tank/k8s/pvc-1@csi-clone-tank-k8s-pvc-2-1767225600", 10, 0),
+				snapshot(volumeSnapshot, 20, 1),
+			},
+			origin: "tank/k8s/pvc-1@csi-clone-tank-k8s-pvc-2-1767225600",
+		},
+		{
+			name: "origin is a volume snapshot",
+			snapshots: []client.Snapshot{
+				snapshot(volumeSnapshot, 10, 0),
+			},
+			origin:   volumeSnapshot,
+			expected: []string{volumeSnapshot},
+		},
+		{
+			name: "held and group snapshots",
+			snapshots: []client.Snapshot{
+				snapshot("tank/k8s/pvc-1@manual", 5, 1),
+				snapshot(groupSnapshot, 8, 0),
+				snapshot("tank/k8s/pvc-1@auto-2026-01-01", 10, 0),
+			},
+			origin:   "tank/k8s/pvc-1@auto-2026-01-01",
+			expected: []string{"tank/k8s/pvc-1@manual", groupSnapshot},
+		},
+		{
+			name: "name without a UID",
+			snapshots: []client.Snapshot{
+				snapshot("tank/k8s/pvc-1@snapshot-daily", 10, 0),
+			},
+			origin: "tank/k8s/pvc-1@snapshot-daily",
+		},
+		{
+			name: "origin not found",
+			snapshots: []client.Snapshot{
+				snapshot(volumeSnapshot, 10, 1),
+			},
+			origin: "tank/k8s/pvc-1@gone",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := movedVolumeSnapshots(tc.snapshots, tc.origin); !slices.Equal(got, tc.expected) {
+				t.Errorf("movedVolumeSnapshots(%s) = %v, want %v", tc.origin, got, tc.expected)
+			}
+		})
+	}
+}
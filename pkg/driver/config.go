@@ -0,0 +1,133 @@
+package driver
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// LoadEnvConfig fills the TrueNAS connection settings of config from the
+// TRUENAS_* environment variables shared by the driver and its admin tools.
+func LoadEnvConfig(config *DriverConfig) error {
+	if val := os.Getenv("TRUENAS_URL"); val == "" {
+		return fmt.Errorf("TRUENAS_URL is missing")
+	} else {
+		config.TrueNASURL = val
+	}
+
+	if val := os.Getenv("TRUENAS_API_KEY"); val == "" {
+		return fmt.Errorf("TRUENAS_API_KEY is missing")
+	} else {
+		config.TrueNASAPIKey = val
+	}
+
+	if val := os.Getenv("TRUENAS_DEFAULT_POOL"); val == "" {
+		return fmt.Errorf("TRUENAS_DEFAULT_POOL is missing")
+	} else {
+		config.DefaultPool = val
+	}
+
+	// Optional: NFS and SMB servers, iSCSI portal and NVMe/TCP address are discovered from TrueNAS if not set
+	if val := os.Getenv("TRUENAS_NFS_SERVER"); val != "" {
+		config.NFSServer = val
+	}
+
+	if val := os.Getenv("TRUENAS_SMB_SERVER"); val != "" {
+		config.SMBServer = val
+	}
+
+	if val := os.Getenv("TRUENAS_ISCSI_PORTAL"); val != "" {
+		config.ISCSIPortal = val
+	}
+
+	if val := os.Getenv("TRUENAS_NVME_PORTAL"); val != "" {
+		config.NVMePortal = val
+	}
+
+	if val := os.Getenv("TRUENAS_PREFERRED_SUBNETS"); val != "" {
+		for _, cidr := range strings.Split(val, ",") {
+			if cidr = strings.TrimSpace(cidr); cidr != "" {
+				config.PreferredSubnets = append(config.PreferredSubnets, cidr)
+			}
+		}
+	}
+
+	if val := os.Getenv("TRUENAS_ISCSI_IQN_BASE"); val != "" {
+		config.ISCSIIQNBase = val
+	}
+
+	if val := os.Getenv("TRUENAS_PREFLIGHT"); val != "" {
+		switch PreflightMode(val) {
+		case PreflightOff, PreflightWarn, PreflightStrict:
+			config.Preflight = PreflightMode(val)
+		default:
+			return fmt.Errorf("TRUENAS_PREFLIGHT must be one of: off, warn, strict")
+		}
+	}
+
+	if val := os.Getenv("TRUENAS_VOLUME_USAGE_THRESHOLD"); val != "" {
+		threshold, err := strconv.Atoi(val)
+		if err != nil || threshold < 1 || threshold > 100 {
+			return fmt.Errorf("TRUENAS_VOLUME_USAGE_THRESHOLD must be a percentage between 1 and 100")
+		}
+		config.VolumeUsageThreshold = threshold
+	}
+
+	if val := os.Getenv("TRUENAS_SNAPSHOT_DELETE_POLICY"); val != "" {
+		switch SnapshotDeletePolicy(val) {
+		case SnapshotDeleteDefer, SnapshotDeleteFail:
+			config.SnapshotDeletePolicy = SnapshotDeletePolicy(val)
+		default:
+			return fmt.Errorf("TRUENAS_SNAPSHOT_DELETE_POLICY must be one of: defer, fail")
+		}
+	}
+
+	if val := os.Getenv("TRUENAS_SNAPSHOT_SYNC"); val != "" {
+		sync, err := strconv.ParseBool(val)
+		if err != nil {
+			return fmt.Errorf("TRUENAS_SNAPSHOT_SYNC must be true or false")
+		}
+		config.SnapshotSync = sync
+	}
+
+	if val := os.Getenv("TRUENAS_VOLUME_ROLLBACK"); val != "" {
+		rollback, err := strconv.ParseBool(val)
+		if err != nil {
+			return fmt.Errorf("TRUENAS_VOLUME_ROLLBACK must be true or false")
+		}
+		config.VolumeRollback = rollback
+	}
+
+	if val := os.Getenv("TRUENAS_SNAPSHOT_METADATA"); val != "" {
+		enabled, err := strconv.ParseBool(val)
+		if err != nil {
+			return fmt.Errorf("TRUENAS_SNAPSHOT_METADATA must be true or false")
+		}
+		config.SnapshotMetadata = enabled
+	}
+
+	if val := os.Getenv("TRUENAS_INSECURE_SKIP_VERIFY"); val != "" {
+		if insecure, err := strconv.ParseBool(val); err == nil {
+			config.TrueNASInsecure = insecure
+		}
+	}
+
+	return nil
+}
+
+// applyConfigDefaults fills in the settings that have defaults when they are not set explicitly.
+func applyConfigDefaults(config *DriverConfig) {
+	if config.ISCSIIQNBase == "" {
+		config.ISCSIIQNBase = DEFAULT_IQN_BASE
+	}
+	if config.StateDir == "" {
+		config.StateDir = defaultStateDir
+	}
+	if config.VolumeUsageThreshold == 0 {
+		config.VolumeUsageThreshold = defaultVolumeUsageThreshold
+	}
+	if config.SnapshotDeletePolicy == "" {
+		config.SnapshotDeletePolicy = SnapshotDeleteDefer
+	}
+}
@@ -2,10 +2,12 @@ package driver
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
@@ -67,6 +69,10 @@ var (
 // ControllerServer implements the CSI Controller service
 type ControllerServer struct {
 	driver *Driver
+
+	// rollbacks holds the IDs of the volumes being rolled back, which must not be published
+	rollbacks sync.Map
+
 	csi.UnimplementedControllerServer
 }
 
@@ -86,26 +92,21 @@ func NewControllerServer(d *Driver) *ControllerServer {
 	}
 }
 
-// validateVolumeCapabilities checks if the requested capabilities are supported
-func (s *ControllerServer) validateVolumeCapabilities(caps []*csi.VolumeCapability) error {
-	supportedModes := s.driver.VolumeCaps()
+// validateVolumeCapabilities checks if the requested capabilities are supported by the protocol
+func (s *ControllerServer) validateVolumeCapabilities(caps []*csi.VolumeCapability, protocol *protocolDefinition) error {
 	for _, cap := range caps {
 		// Must have either block or mount capability
 		if cap.GetBlock() == nil && cap.GetMount() == nil {
 			return fmt.Errorf("either block or mount volume capability is required")
 		}
+		if cap.GetBlock() != nil && !protocol.block {
+			return fmt.Errorf("block volume capability not supported by %s (valid: %s)", protocol.name, strings.Join(protocolNamesFor(true), ", "))
+		}
 		if cap.AccessMode == nil {
 			return fmt.Errorf("access mode is required")
 		}
-		modeSupported := false
-		for _, supported := range supportedModes {
-			if cap.AccessMode.Mode == supported.Mode {
-				modeSupported = true
-				break
-			}
-		}
-		if !modeSupported {
-			return fmt.Errorf("access mode %v not supported", cap.AccessMode.Mode)
+		if !protocol.supportsAccessMode(cap.AccessMode.Mode) {
+			return fmt.Errorf("access mode %v not supported by %s", cap.AccessMode.Mode, protocol.name)
 		}
 	}
 	return nil
@@ -120,11 +121,14 @@ func (s *ControllerServer) validateStorageClassParameters(ctx context.Context, p
 		}
 	}
 
-	// Validate protocol
-	if val, ok := parameters["protocol"]; ok {
-		val = strings.ToLower(val)
-		if val != ProtocolNFS && val != ProtocolISCSI {
-			return fmt.Errorf("invalid protocol: %s (valid: nfs, iscsi)", val)
+	// Validate protocol and its parameters
+	protocol, ok := lookupProtocol(s.driver.GetProtocolFromParameters(parameters))
+	if !ok {
+		return fmt.Errorf("invalid protocol: %s (valid: %s)", parameters["protocol"], strings.Join(protocolNames(), ", "))
+	}
+	if protocol.validateParameters != nil {
+		if err := protocol.validateParameters(parameters); err != nil {
+			return err
 		}
 	}
 
@@ -135,24 +139,6 @@ func (s *ControllerServer) validateStorageClassParameters(ctx context.Context, p
 		}
 	}
 
-	// Validate volblocksize (iSCSI)
-	if val, ok := parameters["volblocksize"]; ok {
-		if _, valid := ValidVolBlockSizes[strings.ToUpper(val)]; !valid {
-			return fmt.Errorf("invalid volblocksize: %s (valid: 512, 1K, 2K, 4K, 8K, 16K, 32K, 64K, 128K)", val)
-		}
-	}
-
-	// Validate iSCSI blocksize
-	if val, ok := parameters["iscsi.blocksize"]; ok {
-		bs, err := strconv.Atoi(val)
-		if err != nil {
-			return fmt.Errorf("invalid iscsi.blocksize: %s (valid: 512, 1024, 2048, 4096)", val)
-		}
-		if _, valid := ValidISCSIBlockSizes[bs]; !valid {
-			return fmt.Errorf("invalid iscsi.blocksize: %s (valid: 512, 1024, 2048, 4096)", val)
-		}
-	}
-
 	// Validate snapshot schedule format
 	if schedule, ok := parameters["snapshot.schedule"]; ok && schedule != "" {
 		parts := strings.Fields(schedule)
@@ -169,32 +155,31 @@ func (s *ControllerServer) validateStorageClassParameters(ctx context.Context, p
 		}
 	}
 
-	// Validate NFS dataset permissions
-	if mode, ok := parameters["nfs.datasetPermissionsMode"]; ok && mode != "" {
-		if len(mode) != 4 || mode[0] != '0' {
-			return fmt.Errorf("invalid nfs.datasetPermissionsMode: %s (must be octal string e.g. 0777, 0755)", mode)
-		}
-		for _, c := range mode[1:] {
-			if c < '0' || c > '7' {
-				return fmt.Errorf("invalid nfs.datasetPermissionsMode: %s (must be octal)", mode)
-			}
+	// Validate delete strategy
+	if val, ok := parameters[paramDeleteStrategy]; ok {
+		if _, err := parseDeleteStrategy(val); err != nil {
+			return err
 		}
 	}
-	if val, ok := parameters["nfs.datasetPermissionsUser"]; ok && val != "" {
-		if _, err := strconv.Atoi(val); err != nil {
-			return fmt.Errorf("invalid nfs.datasetPermissionsUser: %s (must be numeric)", val)
+
+	// Validate clone strategy
+	if val, ok := parameters[paramCloneStrategy]; ok {
+		if _, err := parseCloneStrategy(val); err != nil {
+			return err
 		}
 	}
-	if val, ok := parameters["nfs.datasetPermissionsGroup"]; ok && val != "" {
-		if _, err := strconv.Atoi(val); err != nil {
-			return fmt.Errorf("invalid nfs.datasetPermissionsGroup: %s (must be numeric)", val)
+
+	// Validate the SSH connection snapshots on other systems are pulled over
+	if val := parameters[paramReplicationSSHCredentials]; val != "" {
+		if _, err := s.sshCredentialID(ctx, val); err != nil {
+			return fmt.Errorf("invalid %s %q: %w", paramReplicationSSHCredentials, val, err)
 		}
 	}
 
 	return nil
 }
 
-// CreateVolume creates a new volume on TrueNAS, either as an NFS share or iSCSI target.
+// CreateVolume creates a new volume on TrueNAS, exported as an NFS or SMB share, iSCSI target or NVMe-oF subsystem.
 func (s *ControllerServer) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error) {
 	ctx, cancel := withTimeout(ctx, defaultOperationTimeout)
 	defer cancel()
@@ -209,10 +194,6 @@ func (s *ControllerServer) CreateVolume(ctx context.Context, req *csi.CreateVolu
 		return nil, status.Error(codes.InvalidArgument, "volume capabilities are required")
 	}
 
-	if err := s.validateVolumeCapabilities(req.VolumeCapabilities); err != nil {
-		return nil, status.Errorf(codes.InvalidArgument, "invalid volume capabilities: %v", err)
-	}
-
 	var requiredBytes int64
 	if req.CapacityRange != nil {
 		requiredBytes = req.CapacityRange.RequiredBytes
@@ -231,7 +212,12 @@ func (s *ControllerServer) CreateVolume(ctx context.Context, req *csi.CreateVolu
 		return nil, status.Errorf(codes.InvalidArgument, "invalid storage class parameters: %v", err)
 	}
 
-	protocol := s.driver.GetProtocolFromParameters(parameters)
+	// The protocol was checked with the parameters
+	protocol, _ := lookupProtocol(s.driver.GetProtocolFromParameters(parameters))
+	if err := s.validateVolumeCapabilities(req.VolumeCapabilities, protocol); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid volume capabilities: %v", err)
+	}
+
 	pool := s.driver.GetPoolFromParameters(parameters)
 
 	volumeName := SanitizeVolumeName(req.Name)
@@ -239,7 +225,7 @@ func (s *ControllerServer) CreateVolume(ctx context.Context, req *csi.CreateVolu
 	datasetPath := pool + "/" + volumeName
 
 	existingDataset, err := s.driver.Client().GetDataset(ctx, datasetPath)
-	if err == nil && existingDataset != nil {
+	if err == nil && existingDataset != nil && (req.VolumeContentSource == nil || cloneRecorded(existingDataset)) {
 		// Volume already exists - check if compatible (idempotency)
 		var existingCapacity int64
 		if existingDataset.Type == "VOLUME" {
@@ -286,13 +272,7 @@ func (s *ControllerServer) CreateVolume(ctx context.Context, req *csi.CreateVolu
 		return s.createVolumeFromSource(ctx, req, volumeID, datasetPath, protocol, parameters)
 	}
 
-	var volInfo *VolumeInfo
-	if protocol == ProtocolISCSI {
-		volInfo, err = s.createISCSIVolume(ctx, volumeID, datasetPath, requiredBytes, parameters)
-	} else {
-		volInfo, err = s.createNFSVolume(ctx, volumeID, datasetPath, requiredBytes, parameters)
-	}
-
+	volInfo, err := protocol.newProvisioner(s).CreateVolume(ctx, volumeID, datasetPath, requiredBytes, parameters)
 	if err != nil {
 		return nil, status.Errorf(codes.Internal, "failed to create volume: %v", err)
 	}
@@ -314,8 +294,9 @@ func (s *ControllerServer) CreateVolume(ctx context.Context, req *csi.CreateVolu
 	return resp, nil
 }
 
-// createNFSVolume creates a ZFS filesystem dataset and NFS share for the volume.
-func (s *ControllerServer) createNFSVolume(ctx context.Context, volumeID, datasetPath string, capacityBytes int64, parameters map[string]string) (*VolumeInfo, error) {
+// createFilesystemDataset creates the ZFS filesystem dataset backing a file volume
+// (NFS or SMB). shareType selects the TrueNAS ACL preset; empty means GENERIC.
+func (s *ControllerServer) createFilesystemDataset(ctx context.Context, datasetPath string, capacityBytes int64, parameters map[string]string, shareType string) (*client.Dataset, error) {
 	compression := CompressionLZ4
 	if val, ok := parameters["compression"]; ok {
 		compression = strings.ToUpper(val)
@@ -327,12 +308,14 @@ func (s *ControllerServer) createNFSVolume(ctx context.Context, volumeID, datase
 	}
 
 	datasetOpts := &client.DatasetCreateOptions{
-		Name:        datasetPath,
-		Type:        "FILESYSTEM",
-		RefQuota:    capacityBytes,
-		Compression: compression,
-		Sync:        sync,
-		Properties:  make(map[string]any),
+		Name:           datasetPath,
+		Type:           "FILESYSTEM",
+		RefQuota:       capacityBytes,
+		Compression:    compression,
+		Sync:           sync,
+		ShareType:      shareType,
+		Properties:     make(map[string]any),
+		UserProperties: volumeProperties(parameters),
 	}
 
 	for key, value := range parameters {
@@ -354,6 +337,15 @@ func (s *ControllerServer) createNFSVolume(ctx context.Context, volumeID, datase
 	if err != nil {
 		return nil, fmt.Errorf("failed to create dataset: %w", err)
 	}
+	return dataset, nil
+}
+
+// createNFSVolume creates a ZFS filesystem dataset and NFS share for the volume.
+func (s *ControllerServer) createNFSVolume(ctx context.Context, volumeID, datasetPath string, capacityBytes int64, parameters map[string]string) (*VolumeInfo, error) {
+	dataset, err := s.createFilesystemDataset(ctx, datasetPath, capacityBytes, parameters, "")
+	if err != nil {
+		return nil, err
+	}
 
 	mountpoint := dataset.Mountpoint
 	if mountpoint == "" {
@@ -457,8 +449,8 @@ func (s *ControllerServer) createNFSVolume(ctx context.Context, volumeID, datase
 		},
 	}
 
-	if s.driver.NFSServer() != "" {
-		volInfo.VolumeContext["nfsServer"] = s.driver.NFSServer()
+	if server := s.driver.GetNFSServerFromParameters(parameters); server != "" {
+		volInfo.VolumeContext["nfsServer"] = server
 	}
 	volInfo.VolumeContext["nfsPath"] = mountpoint
 
@@ -485,8 +477,18 @@ func makeISCSIExtentName(volumeID string) string {
 	return volumeID
 }
 
-// createISCSIVolume creates a ZVOL with iSCSI target, extent, and optional CHAP authentication.
-func (s *ControllerServer) createISCSIVolume(ctx context.Context, volumeID, datasetPath string, capacityBytes int64, parameters map[string]string) (*VolumeInfo, error) {
+// iscsiBlocksizeFromParameters returns the extent logical block size (default 512).
+func iscsiBlocksizeFromParameters(parameters map[string]string) int {
+	if val, ok := parameters["iscsi.blocksize"]; ok {
+		if bs, err := strconv.Atoi(val); err == nil {
+			return bs
+		}
+	}
+	return 512
+}
+
+// createZvol creates the ZVOL backing a block volume (iSCSI or NVMe).
+func (s *ControllerServer) createZvol(ctx context.Context, datasetPath string, capacityBytes int64, parameters map[string]string) error {
 	compression := "LZ4"
 	if val, ok := parameters["compression"]; ok {
 		compression = strings.ToUpper(val)
@@ -498,12 +500,13 @@ func (s *ControllerServer) createISCSIVolume(ctx context.Context, volumeID, data
 	}
 
 	datasetOpts := &client.DatasetCreateOptions{
-		Name:         datasetPath,
-		Type:         "VOLUME",
-		Volsize:      capacityBytes,
-		Volblocksize: volblocksize,
-		Compression:  compression,
-		Properties:   make(map[string]any),
+		Name:           datasetPath,
+		Type:           "VOLUME",
+		Volsize:        capacityBytes,
+		Volblocksize:   volblocksize,
+		Compression:    compression,
+		Properties:     make(map[string]any),
+		UserProperties: volumeProperties(parameters),
 	}
 
 	for key, value := range parameters {
@@ -521,9 +524,28 @@ func (s *ControllerServer) createISCSIVolume(ctx context.Context, volumeID, data
 		s.driver.Log().V(LogLevelDebug).Info("Enabling encryption for ZVOL", "dataset", datasetPath, "algorithm", encOpts.Algorithm)
 	}
 
-	_, err := s.driver.Client().CreateDataset(ctx, datasetOpts)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create ZVOL: %w", err)
+	if _, err := s.driver.Client().CreateDataset(ctx, datasetOpts); err != nil {
+		return fmt.Errorf("failed to create ZVOL: %w", err)
+	}
+	return nil
+}
+
+// createISCSIVolume creates a ZVOL with iSCSI target, extent, and optional CHAP authentication.
+func (s *ControllerServer) createISCSIVolume(ctx context.Context, volumeID, datasetPath string, capacityBytes int64, parameters map[string]string) (*VolumeInfo, error) {
+	if err := s.createZvol(ctx, datasetPath, capacityBytes, parameters); err != nil {
+		return nil, err
+	}
+
+	if isSharedTargetMode(parameters) {
+		volInfo, err := s.exportSharedISCSIVolume(ctx, volumeID, datasetPath, capacityBytes, iscsiBlocksizeFromParameters(parameters), parameters)
+		if err != nil {
+			s.driver.Client().DeleteDataset(ctx, datasetPath, &client.DatasetDeleteOptions{Recursive: true, Force: true})
+			return nil, err
+		}
+		if _, err := s.createSnapshotTaskFromParameters(ctx, datasetPath, parameters); err != nil {
+			s.driver.Log().Error(err, "Failed to create snapshot task for volume", "dataset", datasetPath)
+		}
+		return volInfo, nil
 	}
 
 	// Create CHAP auth group if credentials are provided
@@ -605,12 +627,7 @@ func (s *ControllerServer) createISCSIVolume(ctx context.Context, volumeID, data
 	}
 
 	zvolPath := fmt.Sprintf("zvol/%s", datasetPath)
-	blocksize := 512
-	if val, ok := parameters["iscsi.blocksize"]; ok {
-		if bs, err := strconv.Atoi(val); err == nil {
-			blocksize = bs
-		}
-	}
+	blocksize := iscsiBlocksizeFromParameters(parameters)
 
 	extent, err := s.driver.Client().CreateISCSIExtent(ctx, makeISCSIExtentName(volumeID), zvolPath, blocksize)
 	if err != nil {
@@ -658,7 +675,7 @@ func (s *ControllerServer) createISCSIVolume(ctx context.Context, volumeID, data
 		PoolName:         pool,
 		Protocol:         "iscsi",
 		TargetIQN:        fullIQN,
-		TargetPortal:     s.driver.ISCSIPortal(),
+		TargetPortal:     s.driver.GetISCSIPortalFromParameters(parameters),
 		LUN:              0,
 		ISCSITargetID:    target.ID,
 		ISCSIExtentID:    extent.ID,
@@ -674,100 +691,74 @@ func (s *ControllerServer) createISCSIVolume(ctx context.Context, volumeID, data
 		},
 	}
 
-	volInfo.VolumeContext["targetPortal"] = s.driver.ISCSIPortal()
+	volInfo.VolumeContext["targetPortal"] = volInfo.TargetPortal
 	volInfo.VolumeContext["targetIQN"] = fullIQN
 	volInfo.VolumeContext["lun"] = "0"
 
 	return volInfo, nil
 }
 
-// createVolumeFromSource creates a volume from a snapshot or existing volume by cloning.
-func (s *ControllerServer) createVolumeFromSource(ctx context.Context, req *csi.CreateVolumeRequest, volumeID, datasetPath, protocol string, parameters map[string]string) (*csi.CreateVolumeResponse, error) {
+// createVolumeFromSource creates a volume from a snapshot or existing volume
+// with the StorageClass's clone strategy.
+func (s *ControllerServer) createVolumeFromSource(ctx context.Context, req *csi.CreateVolumeRequest, volumeID, datasetPath string, protocol *protocolDefinition, parameters map[string]string) (*csi.CreateVolumeResponse, error) {
 	s.driver.Log().V(LogLevelDebug).Info("Creating volume from content source", "volumeId", volumeID)
 	contentSource := req.VolumeContentSource
 
-	// Idempotency check: if the target dataset already exists, return it
+	// Idempotency check: a volume from a content source is complete once its
+	// clone strategy is recorded; volumes from before that was recorded have no
+	// copy job. A copy job that finished is resumed, a failed one started over.
 	existingDataset, err := s.driver.Client().GetDataset(ctx, datasetPath)
-	if err == nil && existingDataset != nil {
-		s.driver.Log().V(LogLevelDebug).Info("Volume from content source already exists", "volumeId", volumeID)
-		capacityBytes := existingDataset.RefQuota
-		if protocol == ProtocolISCSI && existingDataset.Volsize > 0 {
-			capacityBytes = existingDataset.Volsize
-		}
-		return &csi.CreateVolumeResponse{
-			Volume: &csi.Volume{
-				VolumeId:      volumeID,
-				CapacityBytes: capacityBytes,
-				VolumeContext: parameters,
-				ContentSource: contentSource,
-			},
-		}, nil
+	if err != nil {
+		existingDataset = nil
+	}
+	if existingDataset != nil && cloneRecorded(existingDataset) {
+		return existingVolumeFromSource(volumeID, existingDataset, protocol, contentSource, parameters), nil
 	}
 
-	switch {
-	case contentSource.GetSnapshot() != nil:
-		snapshot := contentSource.GetSnapshot()
-		if snapshot.SnapshotId == "" {
-			return nil, status.Error(codes.InvalidArgument, "snapshot ID is required")
-		}
-
-		s.driver.Log().V(LogLevelDebug).Info("Cloning snapshot", "snapshotId", snapshot.SnapshotId, "datasetPath", datasetPath)
-		_, err := s.driver.Client().CloneSnapshot(ctx, snapshot.SnapshotId, datasetPath)
-		if err != nil {
-			if client.IsNotFoundError(err) {
-				return nil, status.Errorf(codes.NotFound, "source snapshot %s not found", snapshot.SnapshotId)
-			}
-			return nil, status.Errorf(codes.Internal, "failed to clone snapshot: %v", err)
-		}
-
-		requiredBytes := req.CapacityRange.RequiredBytes
-		if requiredBytes > 0 {
-			updateOpts := &client.DatasetUpdateOptions{}
-			if protocol == ProtocolISCSI {
-				updateOpts.Volsize = &requiredBytes
-				updateOpts.RefReservation = &requiredBytes
-			} else {
-				updateOpts.RefQuota = &requiredBytes
-			}
-			err = s.driver.Client().UpdateDataset(ctx, datasetPath, updateOpts)
-			if err != nil {
-				return nil, status.Errorf(codes.Internal, "failed to set capacity on restored volume: %v", err)
+	job, err := s.driver.Client().LatestReplicationJob(ctx, datasetPath)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to check copy of volume: %v", err)
+	}
+	if job != nil && job.Running() {
+		return nil, status.Errorf(codes.Aborted, "copy to %s is in progress (%s)", datasetPath, copyProgress(job))
+	}
+
+	resume := false
+	if existingDataset != nil {
+		switch {
+		case job == nil:
+			s.driver.Log().V(LogLevelDebug).Info("Volume from content source already exists", "volumeId", volumeID)
+			return existingVolumeFromSource(volumeID, existingDataset, protocol, contentSource, parameters), nil
+		case job.State == "SUCCESS":
+			s.driver.Log().V(LogLevelInfo).Info("Finishing copy", "volumeId", volumeID, "dataset", datasetPath, "jobId", job.ID)
+			resume = true
+		default:
+			s.driver.Log().V(LogLevelInfo).Info("Deleting incomplete copy", "volumeId", volumeID, "dataset", datasetPath,
+				"jobId", job.ID, "state", job.State, "error", job.Error)
+			err = s.driver.Client().DeleteDataset(ctx, datasetPath, &client.DatasetDeleteOptions{Recursive: true, Force: true})
+			if err != nil && !client.IsNotFoundError(err) {
+				return nil, status.Errorf(codes.Internal, "failed to delete incomplete copy: %v", err)
 			}
 		}
+	}
 
-		dataset, err := s.driver.Client().GetDataset(ctx, datasetPath)
-		if err != nil {
-			return nil, status.Errorf(codes.Internal, "failed to get cloned dataset: %v", err)
-		}
-
-		var volInfo *VolumeInfo
-		if protocol == ProtocolISCSI {
-			volInfo, err = s.createISCSITargetForClone(ctx, volumeID, datasetPath, requiredBytes, parameters)
-		} else {
-			volInfo, err = s.createNFSShareForClone(ctx, volumeID, datasetPath, dataset, parameters)
-		}
-
-		if err != nil {
-			s.driver.Client().DeleteDataset(ctx, datasetPath, &client.DatasetDeleteOptions{Recursive: true, Force: true})
-			return nil, status.Errorf(codes.Internal, "failed to create share for clone: %v", err)
-		}
-
-		volInfo.ContentSource = contentSource
+	// The strategy was checked with the parameters
+	strategy, _ := parseCloneStrategy(parameters[paramCloneStrategy])
+	if resume {
+		strategy = cloneStrategyCopy
+		s.finishCopy(ctx, datasetPath)
+	}
 
-		capacityBytes := dataset.RefQuota
-		if protocol == ProtocolISCSI {
-			capacityBytes = requiredBytes
+	// snapshotID is the snapshot the volume is created from; tempSnapshotID is
+	// set if the driver took it of a source volume
+	var snapshotID, tempSnapshotID string
+	switch {
+	case contentSource.GetSnapshot() != nil:
+		snapshotID = contentSource.GetSnapshot().SnapshotId
+		if snapshotID == "" {
+			return nil, status.Error(codes.InvalidArgument, "snapshot ID is required")
 		}
 
-		return &csi.CreateVolumeResponse{
-			Volume: &csi.Volume{
-				VolumeId:      volumeID,
-				CapacityBytes: capacityBytes,
-				VolumeContext: parameters,
-				ContentSource: contentSource,
-			},
-		}, nil
-
 	case contentSource.GetVolume() != nil:
 		sourceVolume := contentSource.GetVolume()
 		if sourceVolume.VolumeId == "" {
@@ -778,81 +769,136 @@ func (s *ControllerServer) createVolumeFromSource(ctx context.Context, req *csi.
 		if err != nil {
 			return nil, status.Errorf(codes.NotFound, "source volume not found: %v", err)
 		}
+		if resume {
+			// The snapshot taken for the copy is the only one left behind
+			s.deleteCopySnapshots(ctx, sourceInfo.DatasetPath, volumeID)
+			break
+		}
 
 		sanitizedVolumeID := strings.ReplaceAll(volumeID, "/", "-")
-		snapshotName := fmt.Sprintf("csi-clone-%s-%d", sanitizedVolumeID, time.Now().Unix())
+		snapshotName := fmt.Sprintf("%s%s-%d", cloneSnapshotPrefix, sanitizedVolumeID, time.Now().Unix())
 		snapshot, err := s.driver.Client().CreateSnapshot(ctx, sourceInfo.DatasetPath, snapshotName, false)
 		if err != nil {
 			return nil, status.Errorf(codes.Internal, "failed to create snapshot for clone: %v", err)
 		}
+		snapshotID, tempSnapshotID = snapshot.ID, snapshot.ID
 
-		_, err = s.driver.Client().CloneSnapshot(ctx, snapshot.ID, datasetPath)
-		if err != nil {
-			s.driver.Client().DeleteSnapshot(ctx, snapshot.ID)
-			return nil, status.Errorf(codes.Internal, "failed to clone volume: %v", err)
-		}
-
-		s.driver.Client().DeleteSnapshot(ctx, snapshot.ID)
-
-		requiredBytes := req.CapacityRange.RequiredBytes
-		if requiredBytes > 0 {
-			updateOpts := &client.DatasetUpdateOptions{}
-			if protocol == ProtocolISCSI {
-				updateOpts.Volsize = &requiredBytes
-				updateOpts.RefReservation = &requiredBytes
-			} else {
-				updateOpts.RefQuota = &requiredBytes
-			}
-			err = s.driver.Client().UpdateDataset(ctx, datasetPath, updateOpts)
-			if err != nil {
-				return nil, status.Errorf(codes.Internal, "failed to set capacity on cloned volume: %v", err)
-			}
-		}
+	default:
+		return nil, status.Error(codes.InvalidArgument, "unsupported volume content source")
+	}
 
-		dataset, err := s.driver.Client().GetDataset(ctx, datasetPath)
-		if err != nil {
-			return nil, status.Errorf(codes.Internal, "failed to get cloned dataset: %v", err)
+	if !resume {
+		if err := s.cloneVolume(ctx, snapshotID, tempSnapshotID, datasetPath, &strategy, parameters); err != nil {
+			return nil, err
 		}
+	}
 
-		var volInfo *VolumeInfo
-		if protocol == ProtocolISCSI {
-			volInfo, err = s.createISCSITargetForClone(ctx, volumeID, datasetPath, requiredBytes, parameters)
+	requiredBytes := req.CapacityRange.RequiredBytes
+	if requiredBytes > 0 {
+		updateOpts := &client.DatasetUpdateOptions{}
+		if protocol.block {
+			updateOpts.Volsize = &requiredBytes
+			updateOpts.RefReservation = &requiredBytes
 		} else {
-			volInfo, err = s.createNFSShareForClone(ctx, volumeID, datasetPath, dataset, parameters)
+			updateOpts.RefQuota = &requiredBytes
 		}
-
+		err = s.driver.Client().UpdateDataset(ctx, datasetPath, updateOpts)
 		if err != nil {
-			s.driver.Client().DeleteDataset(ctx, datasetPath, &client.DatasetDeleteOptions{Recursive: true, Force: true})
-			return nil, status.Errorf(codes.Internal, "failed to create share for clone: %v", err)
+			return nil, status.Errorf(codes.Internal, "failed to set capacity on cloned volume: %v", err)
 		}
+	}
 
-		volInfo.ContentSource = contentSource
+	if err := s.recordCloneStrategy(ctx, datasetPath, strategy, parameters); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to record clone strategy on cloned volume: %v", err)
+	}
 
-		capacityBytes := dataset.RefQuota
-		if protocol == ProtocolISCSI {
-			capacityBytes = requiredBytes
+	dataset, err := s.driver.Client().GetDataset(ctx, datasetPath)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to get cloned dataset: %v", err)
+	}
+
+	volInfo, err := protocol.newProvisioner(s).ExportVolume(ctx, volumeID, datasetPath, dataset, requiredBytes, parameters)
+	if err != nil {
+		s.destroyDataset(ctx, datasetPath)
+		return nil, status.Errorf(codes.Internal, "failed to create share for clone: %v", err)
+	}
+
+	volInfo.ContentSource = contentSource
+
+	capacityBytes := dataset.RefQuota
+	if protocol.block {
+		capacityBytes = requiredBytes
+	}
+
+	return &csi.CreateVolumeResponse{
+		Volume: &csi.Volume{
+			VolumeId:      volumeID,
+			CapacityBytes: capacityBytes,
+			VolumeContext: parameters,
+			ContentSource: contentSource,
+		},
+	}, nil
+}
+
+// cloneVolume creates the dataset of a volume from a snapshot. strategy is
+// updated to the one used, which a source in another pool or on another
+// TrueNAS turns into copy. tempSnapshotID is the snapshot taken of a source
+// volume, if any.
+func (s *ControllerServer) cloneVolume(ctx context.Context, snapshotID, tempSnapshotID, datasetPath string, strategy *string, parameters map[string]string) error {
+	source, resolved, err := s.resolveCloneSource(ctx, snapshotID, datasetPath, *strategy, parameters)
+	if err != nil {
+		if tempSnapshotID != "" {
+			s.driver.Client().DeleteSnapshot(ctx, tempSnapshotID)
 		}
+		return status.Errorf(codes.Internal, "failed to resolve source snapshot %s: %v", snapshotID, err)
+	}
+	*strategy = resolved
 
-		return &csi.CreateVolumeResponse{
-			Volume: &csi.Volume{
-				VolumeId:      volumeID,
-				CapacityBytes: capacityBytes,
-				VolumeContext: parameters,
-				ContentSource: contentSource,
-			},
-		}, nil
+	s.driver.Log().V(LogLevelDebug).Info("Creating volume from snapshot", "snapshotId", snapshotID, "datasetPath", datasetPath, "cloneStrategy", resolved)
+	if err := s.cloneFromSnapshot(ctx, source, datasetPath, resolved); err != nil {
+		// A copy still running needs its snapshot; the retry cleans up after it
+		if errors.Is(err, errCopyInProgress) {
+			return status.Errorf(codes.Aborted, "copy to %s: %v", datasetPath, err)
+		}
+		if tempSnapshotID != "" {
+			s.driver.Client().DeleteSnapshot(ctx, tempSnapshotID)
+		}
+		if client.IsNotFoundError(err) {
+			return status.Errorf(codes.NotFound, "source snapshot %s not found", snapshotID)
+		}
+		return status.Errorf(codes.Internal, "failed to create volume from %s: %v", snapshotID, err)
+	}
 
-	default:
-		return nil, status.Error(codes.InvalidArgument, "unsupported volume content source")
+	// A copy does not depend on the snapshot taken for it. A clone needs it
+	// until the clone is deleted, which removes it (see destroyDataset).
+	if tempSnapshotID != "" && resolved == cloneStrategyCopy {
+		if err := s.driver.Client().DeleteSnapshot(ctx, tempSnapshotID); err != nil {
+			s.driver.Log().V(LogLevelDebug).Info("Failed to delete snapshot taken for copy", "snapshotId", tempSnapshotID, "error", err)
+		}
 	}
+	return nil
 }
 
-// createNFSShareForClone creates an NFS share for a cloned dataset.
-func (s *ControllerServer) createNFSShareForClone(ctx context.Context, volumeID, datasetPath string, dataset *client.Dataset, parameters map[string]string) (*VolumeInfo, error) {
-	mountpoint := dataset.Mountpoint
-	if mountpoint == "" {
-		mountpoint = fmt.Sprintf("/mnt/%s", datasetPath)
+// existingVolumeFromSource describes a volume from a content source that was already created
+func existingVolumeFromSource(volumeID string, dataset *client.Dataset, protocol *protocolDefinition, contentSource *csi.VolumeContentSource, parameters map[string]string) *csi.CreateVolumeResponse {
+	capacityBytes := dataset.RefQuota
+	if protocol.block && dataset.Volsize > 0 {
+		capacityBytes = dataset.Volsize
+	}
+	return &csi.CreateVolumeResponse{
+		Volume: &csi.Volume{
+			VolumeId:      volumeID,
+			CapacityBytes: capacityBytes,
+			VolumeContext: parameters,
+			ContentSource: contentSource,
+		},
 	}
+}
+
+// exportNFSVolume creates the NFS share of an existing filesystem dataset, such
+// as a clone, an imported dataset or a migrated or rolled back volume.
+func (s *ControllerServer) exportNFSVolume(ctx context.Context, volumeID, datasetPath string, dataset *client.Dataset, parameters map[string]string) (*VolumeInfo, error) {
+	mountpoint := datasetMountpoint(datasetPath, dataset)
 
 	// Set dataset permissions if requested (Democratic CSI behavior)
 	if mode, ok := parameters["nfs.datasetPermissionsMode"]; ok && mode != "" {
@@ -877,13 +923,13 @@ func (s *ControllerServer) createNFSShareForClone(ctx context.Context, volumeID,
 		if err := s.driver.Client().WaitForJob(ctx, jobID, 30*time.Second); err != nil {
 			return nil, fmt.Errorf("dataset permissions job failed: %w", err)
 		}
-		s.driver.Log().V(LogLevelDebug).Info("Set dataset permissions for clone", "path", mountpoint, "mode", mode)
+		s.driver.Log().V(LogLevelDebug).Info("Set dataset permissions", "path", mountpoint, "mode", mode)
 	}
 
 	stringPtr := func(s string) *string { return &s }
 	shareOpts := &client.NFSShareCreateOptions{
 		Path:        mountpoint,
-		Comment:     fmt.Sprintf("CSI volume clone %s", volumeID),
+		Comment:     fmt.Sprintf("CSI volume %s", volumeID),
 		Enabled:     true,
 		ReadOnly:    false,
 		MapAllUser:  stringPtr("root"),
@@ -922,26 +968,32 @@ func (s *ControllerServer) createNFSShareForClone(ctx context.Context, volumeID,
 		VolumeContext: parameters,
 	}
 
-	if s.driver.NFSServer() != "" {
-		volInfo.VolumeContext["nfsServer"] = s.driver.NFSServer()
+	if server := s.driver.GetNFSServerFromParameters(parameters); server != "" {
+		volInfo.VolumeContext["nfsServer"] = server
 	}
 	volInfo.VolumeContext["nfsPath"] = mountpoint
 
 	return volInfo, nil
 }
 
-// createISCSITargetForClone creates iSCSI target and extent for a cloned ZVOL.
-func (s *ControllerServer) createISCSITargetForClone(ctx context.Context, volumeID, datasetPath string, capacityBytes int64, parameters map[string]string) (*VolumeInfo, error) {
+// exportISCSIVolume creates the iSCSI target and extent of an existing zvol,
+// such as a clone, an imported zvol or a migrated or rolled back volume.
+func (s *ControllerServer) exportISCSIVolume(ctx context.Context, volumeID, datasetPath string, capacityBytes int64, parameters map[string]string) (*VolumeInfo, error) {
+	blocksize := iscsiBlocksizeFromParameters(parameters)
+	if isSharedTargetMode(parameters) {
+		return s.exportSharedISCSIVolume(ctx, volumeID, datasetPath, capacityBytes, blocksize, parameters)
+	}
+
 	iqnBase := s.driver.GetISCSIIQNBaseFromParameters(parameters)
 
 	targetSuffix := makeISCSITargetSuffix(volumeID)
-	target, err := s.driver.Client().CreateISCSITarget(ctx, targetSuffix, fmt.Sprintf("CSI volume clone %s", volumeID))
+	target, err := s.driver.Client().CreateISCSITarget(ctx, targetSuffix, fmt.Sprintf("CSI volume %s", volumeID))
 	if err != nil {
 		return nil, err
 	}
 
 	zvolPath := fmt.Sprintf("zvol/%s", datasetPath)
-	extent, err := s.driver.Client().CreateISCSIExtent(ctx, makeISCSIExtentName(volumeID), zvolPath, 512)
+	extent, err := s.driver.Client().CreateISCSIExtent(ctx, makeISCSIExtentName(volumeID), zvolPath, blocksize)
 	if err != nil {
 		s.driver.Client().DeleteISCSITarget(ctx, target.ID, &client.ISCSITargetDeleteOptions{Force: true})
 		return nil, err
@@ -965,7 +1017,7 @@ func (s *ControllerServer) createISCSITargetForClone(ctx context.Context, volume
 		PoolName:      pool,
 		Protocol:      "iscsi",
 		TargetIQN:     fullIQN,
-		TargetPortal:  s.driver.ISCSIPortal(),
+		TargetPortal:  s.driver.GetISCSIPortalFromParameters(parameters),
 		LUN:           0,
 		ISCSITargetID: target.ID,
 		ISCSIExtentID: extent.ID,
@@ -979,14 +1031,14 @@ func (s *ControllerServer) createISCSITargetForClone(ctx context.Context, volume
 		},
 	}
 
-	volInfo.VolumeContext["targetPortal"] = s.driver.ISCSIPortal()
+	volInfo.VolumeContext["targetPortal"] = volInfo.TargetPortal
 	volInfo.VolumeContext["targetIQN"] = fullIQN
 	volInfo.VolumeContext["lun"] = "0"
 
 	return volInfo, nil
 }
 
-// DeleteVolume deletes a volume and all its associated resources (NFS share or iSCSI target/extent).
+// DeleteVolume deletes a volume and all its associated resources (NFS/SMB share, iSCSI target/extent or NVMe-oF subsystem).
 func (s *ControllerServer) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequest) (*csi.DeleteVolumeResponse, error) {
 	ctx, cancel := withTimeout(ctx, defaultOperationTimeout)
 	defer cancel()
@@ -1007,71 +1059,72 @@ func (s *ControllerServer) DeleteVolume(ctx context.Context, req *csi.DeleteVolu
 	datasetPath := fmt.Sprintf("%s/%s", pool, name)
 
 	// Check if dataset exists - return success if already deleted (idempotent)
-	_, err = s.driver.Client().GetDataset(ctx, datasetPath)
+	dataset, err := s.driver.Client().GetDataset(ctx, datasetPath)
 	if err != nil {
 		if client.IsNotFoundError(err) {
 			s.driver.Log().V(LogLevelDebug).Info("Volume already deleted", "volumeId", req.VolumeId)
 			return &csi.DeleteVolumeResponse{}, nil
 		}
+		// Without the dataset we cannot tell whether it must be retained
+		return nil, status.Errorf(codes.Internal, "failed to look up volume: %v", err)
 	}
 
-	// Get volume info for resource cleanup
-	volInfo, _ := s.driver.GetVolumeInfo(req.VolumeId)
-
-	// Clean up protocol-specific resources (iSCSI target/extent/auth or NFS share)
-	if volInfo != nil && volInfo.Protocol == ProtocolISCSI {
-		deleteOpts := s.driver.GetISCSIDeleteOptionsFromParameters(volInfo.VolumeContext)
-
-		targetDeleteOpts := &client.ISCSITargetDeleteOptions{
-			Force:         deleteOpts.ForceDelete,
-			DeleteExtents: deleteOpts.DeleteExtentsWithTarget,
-		}
-		extentDeleteOpts := &client.ISCSIExtentDeleteOptions{
-			Force: deleteOpts.ForceDelete,
-		}
-
-		if volInfo.ISCSITargetID > 0 {
-			if err := s.driver.Client().DeleteISCSITarget(ctx, volInfo.ISCSITargetID, targetDeleteOpts); err != nil {
-				s.driver.Log().V(LogLevelDebug).Error(err, "Failed to delete iSCSI target", "targetId", volInfo.ISCSITargetID)
-			}
-		}
-		if volInfo.ISCSIExtentID > 0 && !deleteOpts.DeleteExtentsWithTarget {
-			if err := s.driver.Client().DeleteISCSIExtent(ctx, volInfo.ISCSIExtentID, extentDeleteOpts); err != nil {
-				s.driver.Log().V(LogLevelDebug).Error(err, "Failed to delete iSCSI extent", "extentId", volInfo.ISCSIExtentID)
+	// The delete strategy is recorded on the dataset at creation time, since
+	// DeleteVolume does not receive the StorageClass parameters.
+	retain, err := parseDeleteStrategy(dataset.UserProperties[PropertyDeleteStrategy])
+	if err != nil {
+		s.driver.Log().Error(err, "Ignoring invalid delete strategy on dataset", "dataset", datasetPath)
+		retain = 0
+	}
+
+	// Imported datasets stay in place unless they were explicitly adopted, and so
+	// do datasets CreateVolume did not create. Only the share/target the driver
+	// created for them is removed.
+	if !isDriverOwned(dataset) {
+		if dataset.UserProperties[PropertyExportManaged] == "true" {
+			s.removeVolumeExports(ctx, req.VolumeId, datasetPath)
+			updates := &client.DatasetUpdateOptions{
+				UserPropertiesUpdate: []client.UserPropertyUpdate{{Key: PropertyExportManaged, Remove: true}},
 			}
-		}
-		if volInfo.ISCSIAuthID > 0 {
-			if err := s.driver.Client().DeleteISCSIAuth(ctx, volInfo.ISCSIAuthID); err != nil {
-				s.driver.Log().V(LogLevelDebug).Error(err, "Failed to delete iSCSI auth", "authId", volInfo.ISCSIAuthID)
-			}
-		}
-		if volInfo.ISCSIInitiatorID > 0 {
-			if err := s.driver.Client().DeleteISCSIInitiator(ctx, volInfo.ISCSIInitiatorID); err != nil {
-				s.driver.Log().V(LogLevelDebug).Error(err, "Failed to delete iSCSI initiator", "initiatorId", volInfo.ISCSIInitiatorID)
+			if err := s.driver.Client().UpdateDataset(ctx, datasetPath, updates); err != nil {
+				s.driver.Log().Error(err, "Failed to clear export ownership on imported dataset", "dataset", datasetPath)
 			}
 		}
+		s.driver.Log().V(LogLevelInfo).Info("Volume is not owned by the driver, keeping dataset", "volumeId", req.VolumeId,
+			"imported", dataset.UserProperties[PropertyImported] == "true")
+		return &csi.DeleteVolumeResponse{}, nil
 	}
 
-	// Always try to delete NFS share by path to ensure cleanup before dataset deletion
-	// This handles cases where volInfo is nil or NFSShareID wasn't stored
-	nfsPath := fmt.Sprintf("%s/%s", DefaultMountpoint, datasetPath)
-	if share, err := s.driver.Client().GetNFSShareByPath(ctx, nfsPath); err == nil && share != nil {
-		s.driver.Log().V(LogLevelDebug).Info("Deleting NFS share before dataset", "shareId", share.ID, "path", nfsPath)
-		if err := s.driver.Client().DeleteNFSShare(ctx, share.ID); err != nil {
-			s.driver.Log().V(LogLevelDebug).Error(err, "Failed to delete NFS share", "shareId", share.ID)
-		} else {
-			// Allow NFS server time to release client state before dataset deletion
-			// Similar to csi-driver-nfs's timeout-based cleanup approach
-			time.Sleep(nfsShareCleanupDelay)
+	// Held snapshots back VolumeSnapshots, which would go with the dataset
+	if err := s.driver.checkSnapshotsHeld(ctx, datasetPath); err != nil {
+		if errors.Is(err, errSnapshotsHeld) {
+			return nil, status.Errorf(codes.FailedPrecondition, "cannot delete volume %s: %v", req.VolumeId, err)
 		}
+		return nil, status.Errorf(codes.Internal, "failed to check snapshots of volume: %v", err)
 	}
 
+	s.removeVolumeExports(ctx, req.VolumeId, datasetPath)
+
 	// Delete snapshot tasks
 	s.deleteSnapshotTaskForDataset(ctx, datasetPath)
 
+	if retain > 0 {
+		trashPath, err := s.moveToTrash(ctx, datasetPath, retain)
+		if err != nil {
+			if trashPath == "" {
+				return nil, status.Errorf(codes.Internal, "failed to move volume to trash: %v", err)
+			}
+			s.driver.Log().Error(err, "Volume moved to trash without expiry", "trashPath", trashPath)
+		}
+		s.driver.Log().V(LogLevelInfo).Info("Volume moved to trash", "volumeId", req.VolumeId, "trashPath", trashPath, "retainFor", retain)
+		return &csi.DeleteVolumeResponse{}, nil
+	}
+
 	// Delete the dataset
-	err = s.driver.Client().DeleteDataset(ctx, datasetPath, &client.DatasetDeleteOptions{Recursive: true, Force: true})
-	if err != nil && !client.IsNotFoundError(err) {
+	if err := s.destroyDataset(ctx, datasetPath); err != nil {
+		if errors.Is(err, errSnapshotsHeld) {
+			return nil, status.Errorf(codes.FailedPrecondition, "cannot delete volume %s: %v", req.VolumeId, err)
+		}
 		return nil, status.Errorf(codes.Internal, "failed to delete volume: %v", err)
 	}
 
@@ -1079,7 +1132,30 @@ func (s *ControllerServer) DeleteVolume(ctx context.Context, req *csi.DeleteVolu
 	return &csi.DeleteVolumeResponse{}, nil
 }
 
-// ControllerPublishVolume returns the connection info needed for node staging (portal, IQN, or NFS path).
+// removeVolumeExports removes the iSCSI target/extent/auth/initiator, NVMe-oF subsystem, or NFS and SMB shares of a volume.
+// Failures are logged; dataset deletion reports any remaining problem.
+func (s *ControllerServer) removeVolumeExports(ctx context.Context, volumeID, datasetPath string) {
+	// Get volume info for resource cleanup
+	volInfo, _ := s.driver.GetVolumeInfoWithContext(ctx, volumeID)
+
+	if volInfo != nil {
+		if protocol, ok := lookupProtocol(volInfo.Protocol); ok {
+			protocol.newProvisioner(s).RemoveExport(ctx, datasetPath, volInfo)
+		}
+	}
+
+	// Shares and namespaces are found by path, so also try the other protocols to
+	// ensure cleanup before dataset deletion. This handles cases where volInfo is
+	// nil or incomplete.
+	for _, protocol := range registeredProtocols() {
+		if volInfo != nil && volInfo.Protocol == protocol.name {
+			continue
+		}
+		protocol.newProvisioner(s).RemoveExport(ctx, datasetPath, nil)
+	}
+}
+
+// ControllerPublishVolume returns the connection info needed for node staging (portal, IQN, NQN, or NFS path/SMB share).
 func (s *ControllerServer) ControllerPublishVolume(ctx context.Context, req *csi.ControllerPublishVolumeRequest) (*csi.ControllerPublishVolumeResponse, error) {
 	ctx, cancel := withTimeout(ctx, shortOperationTimeout)
 	defer cancel()
@@ -1096,6 +1172,9 @@ func (s *ControllerServer) ControllerPublishVolume(ctx context.Context, req *csi
 	if req.VolumeCapability == nil {
 		return nil, status.Error(codes.InvalidArgument, "volume capability is required")
 	}
+	if _, ok := s.rollbacks.Load(req.VolumeId); ok {
+		return nil, status.Errorf(codes.Aborted, "volume %s is being rolled back to a snapshot", req.VolumeId)
+	}
 
 	// No node validation - publish context (nfsServer/nfsPath or portal/IQN/LUN) is identical for all nodes.
 	// The node plugin performs the actual mount at NodeStageVolume; invalid nodes would fail there.
@@ -1119,6 +1198,16 @@ func (s *ControllerServer) ControllerPublishVolume(ctx context.Context, req *csi
 		return nil, status.Error(codes.InvalidArgument, "either block or mount volume capability is required")
 	}
 
+	// Statically provisioned volumes get their share/target on first publish
+	if isImportedVolumeContext(req.VolumeContext) {
+		if err := validateImportedVolume(dataset, req.VolumeContext, isBlockVolume); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid imported volume %s: %v", req.VolumeId, err)
+		}
+		if err := s.prepareImportedVolume(ctx, req.VolumeId, datasetPath, dataset, req.VolumeContext); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to prepare imported volume %s: %v", req.VolumeId, err)
+		}
+	}
+
 	publishContext := make(map[string]string)
 
 	// Try to get volume info from TrueNAS for complete publish context
@@ -1129,30 +1218,25 @@ func (s *ControllerServer) ControllerPublishVolume(ctx context.Context, req *csi
 		s.driver.Log().Info("GetVolumeInfo returned", "volumeId", req.VolumeId, "protocol", volInfo.Protocol, "targetIQN", volInfo.TargetIQN, "nfsPath", volInfo.NFSPath)
 	}
 
-	// Check if we got valid volume info with complete iSCSI details
-	// (reconstructVolumeFromTrueNAS may return volInfo with empty TargetIQN if extent lookup failed)
-	hasValidISCSIInfo := volInfo != nil && volInfo.Protocol == ProtocolISCSI && volInfo.TargetIQN != ""
-	hasValidNFSInfo := volInfo != nil && volInfo.Protocol == ProtocolNFS && volInfo.NFSPath != ""
-
-	if hasValidISCSIInfo {
-		// Block volumes only supported for iSCSI
-		if isBlockVolume && volInfo.Protocol != ProtocolISCSI {
-			return nil, status.Error(codes.InvalidArgument, "block volume capability only supported for iSCSI")
-		}
-		publishContext[PublishContextProtocol] = volInfo.Protocol
-		publishContext[PublishContextTargetPortal] = volInfo.TargetPortal
-		publishContext[PublishContextTargetIQN] = volInfo.TargetIQN
-		publishContext[PublishContextLUN] = fmt.Sprintf("%d", volInfo.LUN)
-	} else if hasValidNFSInfo {
-		publishContext[PublishContextProtocol] = volInfo.Protocol
-		publishContext[PublishContextNFSServer] = volInfo.VolumeContext["nfsServer"]
-		publishContext[PublishContextNFSPath] = volInfo.NFSPath
+	// Use the export details of the volume's protocol if they are complete
+	var protocolContext map[string]string
+	if volInfo != nil {
+		if protocol, ok := lookupProtocol(volInfo.Protocol); ok {
+			if isBlockVolume && !protocol.block {
+				return nil, status.Errorf(codes.InvalidArgument, "block volume capability not supported by %s (valid: %s)", protocol.name, strings.Join(protocolNamesFor(true), ", "))
+			}
+			protocolContext, _ = protocol.newProvisioner(s).PublishContext(ctx, volInfo, req.VolumeContext)
+		}
+	}
+
+	if protocolContext != nil {
+		publishContext = protocolContext
 	} else {
 		// Volume exists in TrueNAS but not in cache - determine protocol from dataset type
 		if dataset.Type == "VOLUME" {
 			// iSCSI ZVOL - reconstruct iSCSI info from TrueNAS
 			publishContext[PublishContextProtocol] = ProtocolISCSI
-			publishContext[PublishContextTargetPortal] = s.driver.ISCSIPortal()
+			publishContext[PublishContextTargetPortal] = s.driver.GetISCSIPortalFromParameters(req.VolumeContext)
 
 			// Query TrueNAS for iSCSI target info
 			zvolPath := fmt.Sprintf("zvol/%s", datasetPath)
@@ -1174,6 +1258,8 @@ func (s *ControllerServer) ControllerPublishVolume(ctx context.Context, req *csi
 						// Successfully reconstructed iSCSI info
 						fullIQN := fmt.Sprintf("%s:%s", s.driver.ISCSIIQNBase(), target.Name)
 						publishContext[PublishContextTargetIQN] = fullIQN
+						publishContext[PublishContextTargetPortals] = strings.Join(
+							s.driver.iscsiTargetPortals(ctx, target.ID, publishContext[PublishContextTargetPortal]), ",")
 						publishContext[PublishContextLUN] = fmt.Sprintf("%d", targetExtent.LunID)
 						s.driver.Log().Info("Reconstructed iSCSI info from TrueNAS", "volumeId", req.VolumeId, "targetIQN", fullIQN, "lun", targetExtent.LunID)
 					}
@@ -1182,14 +1268,14 @@ func (s *ControllerServer) ControllerPublishVolume(ctx context.Context, req *csi
 		} else {
 			// NFS filesystem - block volumes not supported
 			if isBlockVolume {
-				return nil, status.Error(codes.InvalidArgument, "block volume capability only supported for iSCSI")
+				return nil, status.Errorf(codes.InvalidArgument, "block volume capability not supported by %s (valid: %s)", ProtocolNFS, strings.Join(protocolNamesFor(true), ", "))
 			}
 			publishContext[PublishContextProtocol] = ProtocolNFS
 			mountpoint := dataset.Mountpoint
 			if mountpoint == "" {
 				mountpoint = filepath.Join(DefaultMountpoint, datasetPath)
 			}
-			publishContext[PublishContextNFSServer] = s.driver.NFSServer()
+			publishContext[PublishContextNFSServer] = s.driver.GetNFSServerFromParameters(req.VolumeContext)
 			publishContext[PublishContextNFSPath] = mountpoint
 		}
 	}
@@ -1229,13 +1315,19 @@ func (s *ControllerServer) ValidateVolumeCapabilities(ctx context.Context, req *
 	}
 
 	datasetPath := fmt.Sprintf("%s/%s", pool, name)
-	_, err = s.driver.Client().GetDataset(ctx, datasetPath)
+	dataset, err := s.driver.Client().GetDataset(ctx, datasetPath)
 	if err != nil {
 		return nil, status.Errorf(codes.NotFound, "volume not found: %v", err)
 	}
 
-	// Validate the requested capabilities
-	if err := s.validateVolumeCapabilities(req.VolumeCapabilities); err != nil {
+	// Validate the requested capabilities against the volume's protocol
+	protocol, err := protocolForDataset(dataset, req.VolumeContext["protocol"])
+	if err != nil {
+		return &csi.ValidateVolumeCapabilitiesResponse{
+			Message: err.Error(),
+		}, nil
+	}
+	if err := s.validateVolumeCapabilities(req.VolumeCapabilities, protocol); err != nil {
 		return &csi.ValidateVolumeCapabilitiesResponse{
 			Message: err.Error(),
 		}, nil
@@ -1251,7 +1343,7 @@ func (s *ControllerServer) ValidateVolumeCapabilities(ctx context.Context, req *
 	}, nil
 }
 
-// ListVolumes returns all volumes in the default pool.
+// ListVolumes returns all volumes in the default pool with their condition.
 func (s *ControllerServer) ListVolumes(ctx context.Context, req *csi.ListVolumesRequest) (*csi.ListVolumesResponse, error) {
 	ctx, cancel := withTimeout(ctx, shortOperationTimeout)
 	defer cancel()
@@ -1270,6 +1362,11 @@ func (s *ControllerServer) ListVolumes(ctx context.Context, req *csi.ListVolumes
 		return nil, status.Errorf(codes.Internal, "failed to list volumes: %v", err)
 	}
 
+	sources, err := s.loadVolumeHealthSources(ctx)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to get volume health: %v", err)
+	}
+
 	entries := make([]*csi.ListVolumesResponse_Entry, 0, len(datasets))
 	for _, dataset := range datasets {
 		// Skip the pool itself
@@ -1282,6 +1379,11 @@ func (s *ControllerServer) ListVolumes(ctx context.Context, req *csi.ListVolumes
 			continue
 		}
 
+		// Skip the trash dataset holding retained volumes
+		if isTrashPath(dataset.Name) {
+			continue
+		}
+
 		// Determine capacity based on dataset type
 		var capacityBytes int64
 		if dataset.Type == "VOLUME" {
@@ -1297,6 +1399,9 @@ func (s *ControllerServer) ListVolumes(ctx context.Context, req *csi.ListVolumes
 				VolumeId:      dataset.Name,
 				CapacityBytes: capacityBytes,
 			},
+			Status: &csi.ListVolumesResponse_VolumeStatus{
+				VolumeCondition: s.volumeCondition(ctx, sources, &dataset),
+			},
 		}
 		entries = append(entries, entry)
 	}
@@ -1363,6 +1468,11 @@ func (s *ControllerServer) CreateSnapshot(ctx context.Context, req *csi.CreateSn
 		return nil, status.Error(codes.InvalidArgument, "source volume ID is required")
 	}
 
+	hold, err := parseSnapshotHold(req.Parameters)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid snapshot class parameters: %v", err)
+	}
+
 	volInfo, err := s.driver.GetVolumeInfo(req.SourceVolumeId)
 	if err != nil {
 		return nil, status.Errorf(codes.NotFound, "volume not found: %v", err)
@@ -1382,13 +1492,13 @@ func (s *ControllerServer) CreateSnapshot(ctx context.Context, req *csi.CreateSn
 		if existingSnapshot.ID == expectedSnapshotID {
 			// Snapshot exists on the requested source volume - return it (idempotent)
 			s.driver.Log().V(LogLevelDebug).Info("Snapshot already exists on source volume", "snapshotId", existingSnapshot.ID)
+			if hold {
+				if err := s.driver.holdSnapshot(ctx, existingSnapshot); err != nil {
+					return nil, status.Errorf(codes.Internal, "failed to hold snapshot: %v", err)
+				}
+			}
 			return &csi.CreateSnapshotResponse{
-				Snapshot: &csi.Snapshot{
-					SnapshotId:     existingSnapshot.ID,
-					SourceVolumeId: req.SourceVolumeId,
-					CreationTime:   timestamppb.Now(),
-					ReadyToUse:     true,
-				},
+				Snapshot: csiSnapshot(existingSnapshot, req.SourceVolumeId),
 			}, nil
 		}
 		// Snapshot with this name exists on a DIFFERENT volume
@@ -1412,16 +1522,46 @@ func (s *ControllerServer) CreateSnapshot(ctx context.Context, req *csi.CreateSn
 		return nil, status.Errorf(codes.Internal, "failed to create snapshot: %v", err)
 	}
 
+	if hold {
+		if err := s.driver.holdSnapshot(ctx, snapshot); err != nil {
+			s.driver.Client().DeleteSnapshot(ctx, snapshot.ID)
+			return nil, status.Errorf(codes.Internal, "failed to hold snapshot: %v", err)
+		}
+	}
+
+	// The create response may lack the properties creation time and size come from
+	if snapshot.CreatedAt().IsZero() {
+		if created, err := s.driver.Client().GetSnapshot(ctx, snapshot.ID); err == nil {
+			snapshot = created
+		} else {
+			s.driver.Log().V(LogLevelDebug).Info("Failed to read created snapshot", "snapshotId", snapshot.ID, "error", err)
+		}
+	}
+
 	return &csi.CreateSnapshotResponse{
-		Snapshot: &csi.Snapshot{
-			SnapshotId:     snapshot.ID,
-			SourceVolumeId: req.SourceVolumeId,
-			CreationTime:   timestamppb.Now(),
-			ReadyToUse:     true,
-		},
+		Snapshot: csiSnapshot(snapshot, req.SourceVolumeId),
 	}, nil
 }
 
+// csiSnapshot describes a snapshot for CSI. SizeBytes is what a volume restored
+// from it needs. The creation time falls back to now if TrueNAS did not report it.
+func csiSnapshot(snap *client.Snapshot, sourceVolumeID string) *csi.Snapshot {
+	creationTime := timestamppb.Now()
+	if created := snap.CreatedAt(); !created.IsZero() {
+		creationTime = timestamppb.New(created)
+	}
+	if sourceVolumeID == "" {
+		sourceVolumeID = snap.Dataset
+	}
+	return &csi.Snapshot{
+		SnapshotId:     snap.ID,
+		SourceVolumeId: sourceVolumeID,
+		SizeBytes:      snap.SizeBytes(),
+		CreationTime:   creationTime,
+		ReadyToUse:     true,
+	}
+}
+
 // DeleteSnapshot deletes a ZFS snapshot.
 func (s *ControllerServer) DeleteSnapshot(ctx context.Context, req *csi.DeleteSnapshotRequest) (*csi.DeleteSnapshotResponse, error) {
 	ctx, cancel := withTimeout(ctx, shortOperationTimeout)
@@ -1440,20 +1580,19 @@ func (s *ControllerServer) DeleteSnapshot(ctx context.Context, req *csi.DeleteSn
 		return &csi.DeleteSnapshotResponse{}, nil
 	}
 
-	err := s.driver.Client().DeleteSnapshot(ctx, req.SnapshotId)
-	if err != nil {
-		if client.IsNotFoundError(err) {
-			return &csi.DeleteSnapshotResponse{}, nil
+	if err := s.driver.deleteSnapshot(ctx, req.SnapshotId); err != nil {
+		if errors.Is(err, errSnapshotHasClones) {
+			return nil, status.Errorf(codes.FailedPrecondition, "%v", err)
 		}
-		// For other errors, also return success for idempotency
-		s.driver.Log().V(LogLevelDebug).Info("Snapshot delete error, treating as already deleted", "snapshotId", req.SnapshotId, "error", err)
-		return &csi.DeleteSnapshotResponse{}, nil
+		return nil, status.Errorf(codes.Internal, "%v", err)
 	}
 
 	return &csi.DeleteSnapshotResponse{}, nil
 }
 
 // ListSnapshots returns snapshots, optionally filtered by source volume or snapshot ID.
+// Snapshots are ordered by ID and the pagination token is the ID of the last
+// snapshot returned, so pages stay stable while snapshots come and go.
 func (s *ControllerServer) ListSnapshots(ctx context.Context, req *csi.ListSnapshotsRequest) (*csi.ListSnapshotsResponse, error) {
 	ctx, cancel := withTimeout(ctx, shortOperationTimeout)
 	defer cancel()
@@ -1463,63 +1602,38 @@ func (s *ControllerServer) ListSnapshots(ctx context.Context, req *csi.ListSnaps
 
 	entries := []*csi.ListSnapshotsResponse_Entry{}
 
-	// Parse starting token for pagination (format: "offset")
-	startOffset := 0
-	if req.StartingToken != "" {
-		var err error
-		startOffset, err = strconv.Atoi(req.StartingToken)
-		if err != nil || startOffset < 0 {
-			return nil, status.Error(codes.Aborted, "invalid starting_token")
-		}
+	// Starting token format: dataset@snapshotname of the last snapshot returned
+	if req.StartingToken != "" && !strings.Contains(req.StartingToken, "@") {
+		return nil, status.Error(codes.Aborted, "invalid starting_token")
+	}
+	if req.MaxEntries < 0 {
+		return nil, status.Error(codes.InvalidArgument, "max_entries must not be negative")
 	}
 
 	// If snapshot ID is specified, look up that specific snapshot
 	if req.SnapshotId != "" {
 		// Snapshot ID format: dataset@snapshotname (e.g., tank/pvc-123@snap-456)
-		parts := strings.SplitN(req.SnapshotId, "@", 2)
-		if len(parts) == 2 {
-			datasetPath := parts[0]
-			snapshotName := parts[1]
-
-			snapshots, err := s.driver.Client().ListSnapshots(ctx, datasetPath)
-			if err != nil {
-				// Return empty list if dataset doesn't exist
-				s.driver.Log().V(LogLevelDebug).Info("Failed to list snapshots for dataset", "dataset", datasetPath, "error", err)
-				return &csi.ListSnapshotsResponse{Entries: entries}, nil
-			}
-
-			s.driver.Log().V(LogLevelDebug).Info("Looking for snapshot", "requestedId", req.SnapshotId, "datasetPath", datasetPath,
-				"snapshotName", snapshotName, "foundSnapshots", len(snapshots))
-
-			for _, snap := range snapshots {
-				s.driver.Log().V(LogLevelDebug).Info("Comparing snapshot", "snapId", snap.ID, "snapName", snap.Name,
-					"requestedId", req.SnapshotId, "requestedName", snapshotName)
-
-				// Compare by ID or by name (TrueNAS may format ID differently)
-				if snap.ID == req.SnapshotId || snap.Name == snapshotName {
-					// Derive source volume ID from dataset path
-					sourceVolumeId := datasetPath
-					entry := &csi.ListSnapshotsResponse_Entry{
-						Snapshot: &csi.Snapshot{
-							SnapshotId:     snap.ID,
-							SourceVolumeId: sourceVolumeId,
-							CreationTime:   timestamppb.Now(),
-							ReadyToUse:     true,
-						},
-					}
-					entries = append(entries, entry)
-					s.driver.Log().V(LogLevelDebug).Info("Found matching snapshot", "snapshotId", snap.ID)
-					break
-				}
-			}
+		if !strings.Contains(req.SnapshotId, "@") {
+			return &csi.ListSnapshotsResponse{Entries: entries}, nil
+		}
+		snap, err := s.driver.Client().GetSnapshot(ctx, req.SnapshotId)
+		if err != nil {
+			// Return empty list if the snapshot doesn't exist
+			s.driver.Log().V(LogLevelDebug).Info("Failed to get snapshot", "snapshotId", req.SnapshotId, "error", err)
+			return &csi.ListSnapshotsResponse{Entries: entries}, nil
+		}
+		// Snapshots awaiting deferred destroy were deleted as far as CSI is concerned
+		if snap.DeferDestroy() {
+			return &csi.ListSnapshotsResponse{Entries: entries}, nil
 		}
+		entries = append(entries, &csi.ListSnapshotsResponse_Entry{Snapshot: csiSnapshot(snap, "")})
 		return &csi.ListSnapshotsResponse{Entries: entries}, nil
 	}
 
-	// If source volume ID is specified, list all snapshots for that volume
+	// If source volume ID is specified, list only the snapshots of that volume
+	var datasetPath string
 	if req.SourceVolumeId != "" {
 		// Try cache first, then parse volume ID directly
-		var datasetPath string
 		volInfo, err := s.driver.GetVolumeInfo(req.SourceVolumeId)
 		if err == nil {
 			datasetPath = volInfo.DatasetPath
@@ -1532,81 +1646,33 @@ func (s *ControllerServer) ListSnapshots(ctx context.Context, req *csi.ListSnaps
 			}
 			datasetPath = fmt.Sprintf("%s/%s", pool, name)
 		}
-
-		snapshots, err := s.driver.Client().ListSnapshots(ctx, datasetPath)
-		if err != nil {
-			// Return empty list if dataset doesn't exist
-			s.driver.Log().V(LogLevelDebug).Info("Failed to list snapshots for volume", "volumeId", req.SourceVolumeId, "error", err)
-			return &csi.ListSnapshotsResponse{Entries: entries}, nil
-		}
-
-		// Apply pagination
-		totalSnapshots := len(snapshots)
-		if startOffset > totalSnapshots {
-			return nil, status.Error(codes.Aborted, "invalid starting_token: offset exceeds total snapshots")
-		}
-
-		paginatedSnapshots := snapshots[startOffset:]
-		maxEntries := int(req.MaxEntries)
-		var nextToken string
-		if maxEntries > 0 && len(paginatedSnapshots) > maxEntries {
-			paginatedSnapshots = paginatedSnapshots[:maxEntries]
-			nextToken = strconv.Itoa(startOffset + maxEntries)
-		}
-
-		for _, snap := range paginatedSnapshots {
-			entry := &csi.ListSnapshotsResponse_Entry{
-				Snapshot: &csi.Snapshot{
-					SnapshotId:     snap.ID,
-					SourceVolumeId: req.SourceVolumeId,
-					CreationTime:   timestamppb.Now(),
-					ReadyToUse:     true,
-				},
-			}
-			entries = append(entries, entry)
-		}
-		return &csi.ListSnapshotsResponse{Entries: entries, NextToken: nextToken}, nil
 	}
 
-	// Neither snapshot ID nor source volume ID specified - list all snapshots
-	s.driver.Log().V(LogLevelDebug).Info("Listing all snapshots")
-	allSnapshots, err := s.driver.Client().ListAllSnapshots(ctx)
+	// Fetch one snapshot more than requested to know whether another page follows
+	limit := 0
+	if req.MaxEntries > 0 {
+		limit = int(req.MaxEntries) + 1
+	}
+	snapshots, err := s.driver.Client().ListSnapshotsPage(ctx, datasetPath, req.StartingToken, limit)
 	if err != nil {
-		s.driver.Log().V(LogLevelDebug).Info("Failed to list all snapshots", "error", err)
+		// Return empty list if dataset doesn't exist
+		s.driver.Log().V(LogLevelDebug).Info("Failed to list snapshots", "dataset", datasetPath, "error", err)
 		return &csi.ListSnapshotsResponse{Entries: entries}, nil
 	}
 
-	// Apply pagination
-	totalSnapshots := len(allSnapshots)
-
-	// Validate starting offset
-	if startOffset > totalSnapshots {
-		return nil, status.Error(codes.Aborted, "invalid starting_token: offset exceeds total snapshots")
+	var nextToken string
+	if req.MaxEntries > 0 && len(snapshots) > int(req.MaxEntries) {
+		snapshots = snapshots[:req.MaxEntries]
+		nextToken = snapshots[len(snapshots)-1].ID
 	}
 
-	// Slice from offset
-	paginatedSnapshots := allSnapshots[startOffset:]
-
-	// Apply max_entries limit
-	maxEntries := int(req.MaxEntries)
-	var nextToken string
-	if maxEntries > 0 && len(paginatedSnapshots) > maxEntries {
-		paginatedSnapshots = paginatedSnapshots[:maxEntries]
-		nextToken = strconv.Itoa(startOffset + maxEntries)
-	}
-
-	for _, snap := range paginatedSnapshots {
-		// Use the dataset as the source volume ID
-		sourceVolumeID := snap.Dataset
-		entry := &csi.ListSnapshotsResponse_Entry{
-			Snapshot: &csi.Snapshot{
-				SnapshotId:     snap.ID,
-				SourceVolumeId: sourceVolumeID,
-				CreationTime:   timestamppb.Now(),
-				ReadyToUse:     true,
-			},
+	for i := range snapshots {
+		if snapshots[i].DeferDestroy() {
+			continue
 		}
-		entries = append(entries, entry)
+		entries = append(entries, &csi.ListSnapshotsResponse_Entry{
+			Snapshot: csiSnapshot(&snapshots[i], req.SourceVolumeId),
+		})
 	}
 
 	return &csi.ListSnapshotsResponse{
@@ -1644,7 +1710,7 @@ func (s *ControllerServer) ControllerExpandVolume(ctx context.Context, req *csi.
 	}
 
 	updates := &client.DatasetUpdateOptions{}
-	if volInfo.Protocol == ProtocolISCSI {
+	if isBlockProtocol(volInfo.Protocol) {
 		updates.Volsize = &newSize
 		updates.RefReservation = &newSize // Must update reservation to match volsize
 	} else {
@@ -1658,19 +1724,22 @@ func (s *ControllerServer) ControllerExpandVolume(ctx context.Context, req *csi.
 
 	return &csi.ControllerExpandVolumeResponse{
 		CapacityBytes:         newSize,
-		NodeExpansionRequired: volInfo.Protocol == ProtocolISCSI,
+		NodeExpansionRequired: isBlockProtocol(volInfo.Protocol),
 	}, nil
 }
 
 // ControllerGetVolume returns volume information including health status.
 func (s *ControllerServer) ControllerGetVolume(ctx context.Context, req *csi.ControllerGetVolumeRequest) (*csi.ControllerGetVolumeResponse, error) {
+	ctx, cancel := withTimeout(ctx, shortOperationTimeout)
+	defer cancel()
+
 	s.driver.Log().V(LogLevelDebug).Info("ControllerGetVolume called", "volumeId", req.VolumeId)
 
 	if req.VolumeId == "" {
 		return nil, status.Error(codes.InvalidArgument, "volume ID is required")
 	}
 
-	volInfo, err := s.driver.GetVolumeInfo(req.VolumeId)
+	volInfo, err := s.driver.GetVolumeInfoWithContext(ctx, req.VolumeId)
 	if err != nil {
 		return nil, status.Errorf(codes.NotFound, "volume not found: %v", err)
 	}
@@ -1680,12 +1749,9 @@ func (s *ControllerServer) ControllerGetVolume(ctx context.Context, req *csi.Con
 		return nil, status.Errorf(codes.Internal, "failed to get volume info: %v", err)
 	}
 
-	abnormal := false
-	message := "Volume is healthy"
-
-	if dataset.Used > dataset.Available {
-		abnormal = true
-		message = "Volume is running out of space"
+	sources, err := s.loadVolumeHealthSources(ctx)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to get volume health: %v", err)
 	}
 
 	return &csi.ControllerGetVolumeResponse{
@@ -1695,10 +1761,7 @@ func (s *ControllerServer) ControllerGetVolume(ctx context.Context, req *csi.Con
 			VolumeContext: volInfo.VolumeContext,
 		},
 		Status: &csi.ControllerGetVolumeResponse_VolumeStatus{
-			VolumeCondition: &csi.VolumeCondition{
-				Abnormal: abnormal,
-				Message:  message,
-			},
+			VolumeCondition: s.volumeCondition(ctx, sources, dataset),
 		},
 	}, nil
 }
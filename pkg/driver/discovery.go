@@ -0,0 +1,510 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/go-logr/logr"
+	"github.com/truenas/truenas-csi/pkg/client"
+)
+
+// Where a data-path address came from.
+const (
+	AddressSourceConfig     = "config"     // Set with TRUENAS_NFS_SERVER, TRUENAS_SMB_SERVER, TRUENAS_ISCSI_PORTAL or TRUENAS_NVME_PORTAL
+	AddressSourceDiscovered = "discovered" // Read from the TrueNAS service and interface configuration
+	AddressSourceURL        = "url"        // Host of the TrueNAS API URL
+)
+
+// defaultISCSIPort is the iSCSI port used when TrueNAS does not report one.
+const defaultISCSIPort = 3260
+
+// defaultISCSIPortalID is the portal group targets are created in.
+const defaultISCSIPortalID = 1
+
+// defaultNVMePort is the NVMe/TCP port used when TrueNAS does not report one.
+const defaultNVMePort = 4420
+
+// DataPaths holds the addresses nodes use to reach NFS and SMB shares, iSCSI
+// targets and NVMe-oF subsystems, and where each address came from.
+type DataPaths struct {
+	NFSServer         string
+	NFSServerSource   string
+	SMBServer         string
+	SMBServerSource   string
+	ISCSIPortal       string
+	ISCSIPortalSource string
+	NVMePortal        string
+	NVMePortalSource  string
+}
+
+// parseSubnets parses a list of CIDRs, such as the preferred data subnets.
+func parseSubnets(cidrs []string) ([]*net.IPNet, error) {
+	subnets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, subnet, err := net.ParseCIDR(strings.TrimSpace(cidr))
+		if err != nil {
+			return nil, fmt.Errorf("invalid preferred subnet %q: %w", cidr, err)
+		}
+		subnets = append(subnets, subnet)
+	}
+	return subnets, nil
+}
+
+// resolveDataPaths picks the NFS server and iSCSI portal addresses. Explicitly
+// configured addresses win. Otherwise the addresses the NFS and iSCSI services
+// listen on are discovered from TrueNAS, and the TrueNAS URL host is the last resort.
+func resolveDataPaths(ctx context.Context, c *client.Client, config *DriverConfig, log logr.Logger) (DataPaths, error) {
+	subnets, err := parseSubnets(config.PreferredSubnets)
+	if err != nil {
+		return DataPaths{}, err
+	}
+
+	var urlHost string
+	if parsedURL, err := url.Parse(config.TrueNASURL); err == nil {
+		urlHost = parsedURL.Hostname()
+	}
+
+	disc := &dataPathDiscovery{client: c, subnets: subnets}
+	if ip := net.ParseIP(urlHost); ip != nil {
+		disc.urlIPs = []net.IP{ip}
+	} else if urlHost != "" {
+		// The URL may name TrueNAS by DNS; prefer whatever it resolves to
+		if addrs, err := net.DefaultResolver.LookupIPAddr(ctx, urlHost); err == nil {
+			for _, addr := range addrs {
+				disc.urlIPs = append(disc.urlIPs, addr.IP)
+			}
+		}
+	}
+
+	var paths DataPaths
+
+	switch {
+	case config.NFSServer != "":
+		paths.NFSServer, paths.NFSServerSource = config.NFSServer, AddressSourceConfig
+	default:
+		if addr, err := disc.nfsServer(ctx); err != nil {
+			log.Info("NFS server discovery failed, falling back to the TrueNAS URL host", "error", err.Error())
+		} else if addr != "" {
+			paths.NFSServer, paths.NFSServerSource = addr, AddressSourceDiscovered
+		}
+		if paths.NFSServer == "" && urlHost != "" {
+			paths.NFSServer, paths.NFSServerSource = urlHost, AddressSourceURL
+		}
+	}
+
+	switch {
+	case config.SMBServer != "":
+		paths.SMBServer, paths.SMBServerSource = config.SMBServer, AddressSourceConfig
+	default:
+		if addr, err := disc.smbServer(ctx); err != nil {
+			log.Info("SMB server discovery failed, falling back to the TrueNAS URL host", "error", err.Error())
+		} else if addr != "" {
+			paths.SMBServer, paths.SMBServerSource = addr, AddressSourceDiscovered
+		}
+		if paths.SMBServer == "" && urlHost != "" {
+			paths.SMBServer, paths.SMBServerSource = urlHost, AddressSourceURL
+		}
+	}
+
+	switch {
+	case config.ISCSIPortal != "":
+		paths.ISCSIPortal, paths.ISCSIPortalSource = config.ISCSIPortal, AddressSourceConfig
+	default:
+		if portal, err := disc.iscsiPortal(ctx); err != nil {
+			log.Info("iSCSI portal discovery failed, falling back to the TrueNAS URL host", "error", err.Error())
+		} else if portal != "" {
+			paths.ISCSIPortal, paths.ISCSIPortalSource = portal, AddressSourceDiscovered
+		}
+		if paths.ISCSIPortal == "" && urlHost != "" {
+			paths.ISCSIPortal = net.JoinHostPort(urlHost, strconv.Itoa(defaultISCSIPort))
+			paths.ISCSIPortalSource = AddressSourceURL
+		}
+	}
+
+	switch {
+	case config.NVMePortal != "":
+		paths.NVMePortal, paths.NVMePortalSource = config.NVMePortal, AddressSourceConfig
+	default:
+		// Most systems do not use NVMe-oF, and older TrueNAS releases lack the API
+		if portal, err := disc.nvmePortal(ctx); err != nil {
+			log.V(LogLevelDebug).Info("NVMe-oF port discovery failed, falling back to the TrueNAS URL host", "error", err.Error())
+		} else if portal != "" {
+			paths.NVMePortal, paths.NVMePortalSource = portal, AddressSourceDiscovered
+		}
+		if paths.NVMePortal == "" && urlHost != "" {
+			paths.NVMePortal = net.JoinHostPort(urlHost, strconv.Itoa(defaultNVMePort))
+			paths.NVMePortalSource = AddressSourceURL
+		}
+	}
+
+	return paths, nil
+}
+
+// urlDataPaths derives all addresses from the TrueNAS URL host, unless they are
+// configured explicitly. Used where discovery is not worth the API calls.
+func urlDataPaths(config *DriverConfig) DataPaths {
+	paths := DataPaths{
+		NFSServer:         config.NFSServer,
+		NFSServerSource:   AddressSourceConfig,
+		SMBServer:         config.SMBServer,
+		SMBServerSource:   AddressSourceConfig,
+		ISCSIPortal:       config.ISCSIPortal,
+		ISCSIPortalSource: AddressSourceConfig,
+		NVMePortal:        config.NVMePortal,
+		NVMePortalSource:  AddressSourceConfig,
+	}
+
+	parsedURL, err := url.Parse(config.TrueNASURL)
+	if err != nil || parsedURL.Hostname() == "" {
+		return paths
+	}
+	host := parsedURL.Hostname()
+	if paths.NFSServer == "" {
+		paths.NFSServer, paths.NFSServerSource = host, AddressSourceURL
+	}
+	if paths.SMBServer == "" {
+		paths.SMBServer, paths.SMBServerSource = host, AddressSourceURL
+	}
+	if paths.ISCSIPortal == "" {
+		paths.ISCSIPortal = net.JoinHostPort(host, strconv.Itoa(defaultISCSIPort))
+		paths.ISCSIPortalSource = AddressSourceURL
+	}
+	if paths.NVMePortal == "" {
+		paths.NVMePortal = net.JoinHostPort(host, strconv.Itoa(defaultNVMePort))
+		paths.NVMePortalSource = AddressSourceURL
+	}
+	return paths
+}
+
+// dataPathDiscovery reads candidate data-path addresses from TrueNAS and picks one.
+type dataPathDiscovery struct {
+	client  *client.Client
+	subnets []*net.IPNet
+	urlIPs  []net.IP
+
+	addrs       []net.IP
+	addrsLoaded bool
+}
+
+// interfaceAddresses returns the usable addresses of all TrueNAS interfaces,
+// HA virtual IPs first. Loopback and link-local addresses are skipped.
+func (disc *dataPathDiscovery) interfaceAddresses(ctx context.Context) ([]net.IP, error) {
+	if disc.addrsLoaded {
+		return disc.addrs, nil
+	}
+
+	interfaces, err := disc.client.ListNetworkInterfaces(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var addrs []net.IP
+	seen := make(map[string]struct{})
+	add := func(aliases []client.InterfaceAlias) {
+		for _, alias := range aliases {
+			if alias.Type != "INET" && alias.Type != "INET6" {
+				continue
+			}
+			ip := net.ParseIP(alias.Address)
+			if ip == nil || ip.IsLoopback() || ip.IsLinkLocalUnicast() {
+				continue
+			}
+			if _, ok := seen[ip.String()]; ok {
+				continue
+			}
+			seen[ip.String()] = struct{}{}
+			addrs = append(addrs, ip)
+		}
+	}
+	for _, iface := range interfaces {
+		add(iface.FailoverVirtualAliases)
+	}
+	for _, iface := range interfaces {
+		add(iface.Aliases)
+		add(iface.State.Aliases)
+	}
+
+	disc.addrs, disc.addrsLoaded = addrs, true
+	return addrs, nil
+}
+
+// nfsServer returns the address NFS clients should mount from: one of the NFS
+// bind addresses, or any interface address if NFS listens on all of them.
+func (disc *dataPathDiscovery) nfsServer(ctx context.Context) (string, error) {
+	nfsConfig, err := disc.client.GetNFSConfig(ctx)
+	if err != nil {
+		return "", err
+	}
+	return disc.serverAddress(ctx, nfsConfig.BindIP)
+}
+
+// smbServer returns the address SMB clients should mount from: one of the SMB
+// bind addresses, or any interface address if SMB listens on all of them.
+func (disc *dataPathDiscovery) smbServer(ctx context.Context) (string, error) {
+	smbConfig, err := disc.client.GetSMBConfig(ctx)
+	if err != nil {
+		return "", err
+	}
+	return disc.serverAddress(ctx, smbConfig.BindIP)
+}
+
+// serverAddress picks one of a service's bind addresses, or any interface
+// address if it has none.
+func (disc *dataPathDiscovery) serverAddress(ctx context.Context, bindIPs []string) (string, error) {
+	var candidates []net.IP
+	for _, addr := range bindIPs {
+		if ip := net.ParseIP(addr); ip != nil {
+			candidates = append(candidates, ip)
+		}
+	}
+	if len(candidates) == 0 {
+		var err error
+		if candidates, err = disc.interfaceAddresses(ctx); err != nil {
+			return "", err
+		}
+	}
+
+	ip := disc.choose(candidates)
+	if ip == nil {
+		return "", nil
+	}
+	return ip.String(), nil
+}
+
+// iscsiPortal returns host:port of the portal group targets are created in.
+// Wildcard listen addresses expand to the interface addresses.
+func (disc *dataPathDiscovery) iscsiPortal(ctx context.Context) (string, error) {
+	portals, err := disc.client.ListISCSIPortals(ctx)
+	if err != nil {
+		return "", err
+	}
+	if len(portals) == 0 {
+		return "", nil
+	}
+
+	portal := portals[0]
+	for _, p := range portals {
+		if p.ID == defaultISCSIPortalID {
+			portal = p
+			break
+		}
+	}
+
+	port := defaultISCSIPort
+	if global, err := disc.client.GetISCSIGlobalConfig(ctx); err == nil && global.ListenPort > 0 {
+		port = global.ListenPort
+	}
+
+	var candidates []net.IP
+	ports := make(map[string]int)
+	for _, listen := range portal.Listen {
+		if listen.IP == "0.0.0.0" || listen.IP == "::" {
+			addrs, err := disc.interfaceAddresses(ctx)
+			if err != nil {
+				return "", err
+			}
+			candidates = append(candidates, addrs...)
+			continue
+		}
+		if ip := net.ParseIP(listen.IP); ip != nil {
+			candidates = append(candidates, ip)
+			if listen.Port > 0 {
+				ports[ip.String()] = listen.Port
+			}
+		}
+	}
+
+	ip := disc.choose(candidates)
+	if ip == nil {
+		return "", nil
+	}
+	if p, ok := ports[ip.String()]; ok {
+		port = p
+	}
+	return net.JoinHostPort(ip.String(), strconv.Itoa(port)), nil
+}
+
+// nvmePortal returns host:port of an enabled NVMe/TCP port. Wildcard listen
+// addresses expand to the interface addresses.
+func (disc *dataPathDiscovery) nvmePortal(ctx context.Context) (string, error) {
+	ports, err := disc.client.ListNVMetPorts(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	var candidates []net.IP
+	svcPorts := make(map[string]string)
+	for _, port := range tcpNVMetPorts(ports) {
+		svc := nvmetPortService(port)
+		if port.AddrTraddr == "0.0.0.0" || port.AddrTraddr == "::" {
+			addrs, err := disc.interfaceAddresses(ctx)
+			if err != nil {
+				return "", err
+			}
+			for _, ip := range addrs {
+				candidates = append(candidates, ip)
+				if _, ok := svcPorts[ip.String()]; !ok {
+					svcPorts[ip.String()] = svc
+				}
+			}
+			continue
+		}
+		if ip := net.ParseIP(port.AddrTraddr); ip != nil {
+			candidates = append(candidates, ip)
+			svcPorts[ip.String()] = svc
+		}
+	}
+
+	ip := disc.choose(candidates)
+	if ip == nil {
+		return "", nil
+	}
+	return net.JoinHostPort(ip.String(), svcPorts[ip.String()]), nil
+}
+
+// tcpNVMetPorts returns the enabled NVMe-oF ports that use the TCP transport.
+func tcpNVMetPorts(ports []client.NVMetPort) []client.NVMetPort {
+	var tcp []client.NVMetPort
+	for _, port := range ports {
+		if port.Enabled && strings.EqualFold(port.AddrTrtype, "TCP") {
+			tcp = append(tcp, port)
+		}
+	}
+	return tcp
+}
+
+// nvmetPortService returns the TCP port (trsvcid) of an NVMe-oF port.
+func nvmetPortService(port client.NVMetPort) string {
+	switch svc := port.AddrTrsvcid.(type) {
+	case float64:
+		return strconv.Itoa(int(svc))
+	case string:
+		if svc != "" {
+			return svc
+		}
+	}
+	return strconv.Itoa(defaultNVMePort)
+}
+
+// choose picks a candidate address: the first one in a preferred subnet (in the
+// order the subnets are configured), else the TrueNAS URL host if it is a
+// candidate, else the first IPv4 address, else the first address.
+func (disc *dataPathDiscovery) choose(candidates []net.IP) net.IP {
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	for _, subnet := range disc.subnets {
+		for _, ip := range candidates {
+			if subnet.Contains(ip) {
+				return ip
+			}
+		}
+	}
+
+	for _, urlIP := range disc.urlIPs {
+		for _, ip := range candidates {
+			if ip.Equal(urlIP) {
+				return ip
+			}
+		}
+	}
+
+	for _, ip := range candidates {
+		if ip.To4() != nil {
+			return ip
+		}
+	}
+	return candidates[0]
+}
+
+// iscsiTargetPortals returns host:port for every listen address of the portal
+// groups a target belongs to, with primary first. Nodes log in to all of them
+// when multipath is enabled. Wildcard listeners expand to the TrueNAS interface
+// addresses, restricted to the preferred subnets if any are configured. On
+// errors only primary is returned.
+func (d *Driver) iscsiTargetPortals(ctx context.Context, targetID int, primary string) []string {
+	portals := []string{primary}
+
+	target, err := d.client.GetISCSITargetByID(ctx, targetID)
+	if err != nil {
+		d.log.V(LogLevelDebug).Info("Could not look up target portal groups", "targetId", targetID, "error", err)
+		return portals
+	}
+	groups := make(map[int]struct{}, len(target.Groups))
+	for _, group := range target.Groups {
+		groups[group.Portal] = struct{}{}
+	}
+
+	allPortals, err := d.client.ListISCSIPortals(ctx)
+	if err != nil {
+		d.log.V(LogLevelDebug).Info("Could not list iSCSI portals", "error", err)
+		return portals
+	}
+
+	port := defaultISCSIPort
+	if global, err := d.client.GetISCSIGlobalConfig(ctx); err == nil && global.ListenPort > 0 {
+		port = global.ListenPort
+	}
+
+	disc := &dataPathDiscovery{client: d.client, subnets: d.preferredSubnets}
+	seen := map[string]struct{}{primary: {}}
+	add := func(ip net.IP, listenPort int) {
+		// csi-lib-iscsi splits portals on ':', so IPv6 portals cannot be logged in to
+		if ip.To4() == nil {
+			return
+		}
+		if listenPort == 0 {
+			listenPort = port
+		}
+		addr := net.JoinHostPort(ip.String(), strconv.Itoa(listenPort))
+		if _, ok := seen[addr]; !ok {
+			seen[addr] = struct{}{}
+			portals = append(portals, addr)
+		}
+	}
+
+	for _, portal := range allPortals {
+		if _, ok := groups[portal.ID]; !ok {
+			continue
+		}
+		for _, listen := range portal.Listen {
+			if listen.IP != "0.0.0.0" && listen.IP != "::" {
+				if ip := net.ParseIP(listen.IP); ip != nil {
+					add(ip, listen.Port)
+				}
+				continue
+			}
+			addrs, err := disc.interfaceAddresses(ctx)
+			if err != nil {
+				d.log.V(LogLevelDebug).Info("Could not list TrueNAS interfaces for wildcard portal", "portalId", portal.ID, "error", err)
+				continue
+			}
+			for _, ip := range addrs {
+				if disc.inPreferredSubnet(ip) {
+					add(ip, listen.Port)
+				}
+			}
+		}
+	}
+
+	return portals
+}
+
+// inPreferredSubnet reports whether ip is in one of the preferred subnets, or true
+// if none are configured.
+func (disc *dataPathDiscovery) inPreferredSubnet(ip net.IP) bool {
+	if len(disc.subnets) == 0 {
+		return true
+	}
+	for _, subnet := range disc.subnets {
+		if subnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,469 @@
+package driver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/go-logr/logr"
+	"github.com/truenas/truenas-csi/pkg/client"
+	"k8s.io/utils/exec"
+)
+
+// PreflightMode controls how the driver reacts to failed doctor checks at startup.
+type PreflightMode string
+
+const (
+	// PreflightOff skips the checks.
+	PreflightOff PreflightMode = "off"
+	// PreflightWarn logs failed checks and starts anyway (default).
+	PreflightWarn PreflightMode = "warn"
+	// PreflightStrict refuses to start when a check fails.
+	PreflightStrict PreflightMode = "strict"
+)
+
+// CheckStatus is the outcome of a doctor check.
+type CheckStatus string
+
+const (
+	CheckPass CheckStatus = "PASS"
+	// CheckWarn marks a problem that only matters for some setups, e.g. a stopped
+	// iSCSI service on a cluster that only uses NFS.
+	CheckWarn CheckStatus = "WARN"
+	CheckFail CheckStatus = "FAIL"
+	// CheckInferred marks a check that found no problem but could not verify
+	// the result directly, e.g. write access judged from the API key's roles.
+	CheckInferred CheckStatus = "INFERRED"
+)
+
+// CheckResult is the outcome of a single doctor check.
+type CheckResult struct {
+	Name    string
+	Status  CheckStatus
+	Message string
+	// Hint suggests how to fix a failed or warning check.
+	Hint string
+}
+
+const (
+	serviceNFS   = "nfs"
+	serviceISCSI = "iscsitarget"
+
+	serviceStateRunning = "RUNNING"
+
+	// roleFullAdmin grants every API method.
+	roleFullAdmin = "FULL_ADMIN"
+
+	// iscsiadm exit status when there are no sessions (ISCSI_ERR_NO_OBJS_FOUND)
+	iscsiadmExitNoSessions = 21
+
+	iscsiInitiatorNameFile = "/etc/iscsi/initiatorname.iscsi"
+
+	nvmeHostNQNFile  = "/etc/nvme/hostnqn"
+	nvmeTCPModuleDir = "/sys/module/nvme_tcp"
+)
+
+// requiredWriteRoles are the TrueNAS roles needed by the controller's create,
+// update and delete calls.
+var requiredWriteRoles = []string{
+	"DATASET_WRITE",
+	"SNAPSHOT_WRITE",
+	"SNAPSHOT_TASK_WRITE",
+	"SHARING_NFS_WRITE",
+	"SHARING_ISCSI_WRITE",
+	"FILESYSTEM_ATTRS_WRITE",
+}
+
+// writeAccessHint explains how to confirm write access the roles suggest
+const writeAccessHint = "Roles do not cover every method; create and delete a test PVC to confirm provisioning works"
+
+func pass(name, message string) CheckResult {
+	return CheckResult{Name: name, Status: CheckPass, Message: message}
+}
+
+func inferred(name, message, hint string) CheckResult {
+	return CheckResult{Name: name, Status: CheckInferred, Message: message, Hint: hint}
+}
+
+func warn(name, message, hint string) CheckResult {
+	return CheckResult{Name: name, Status: CheckWarn, Message: message, Hint: hint}
+}
+
+func fail(name, message, hint string) CheckResult {
+	return CheckResult{Name: name, Status: CheckFail, Message: message, Hint: hint}
+}
+
+// failOrWarn fails a check when the feature it belongs to is in use and only warns otherwise.
+func failOrWarn(inUse bool, name, message, hint string) CheckResult {
+	if inUse {
+		return fail(name, message, hint)
+	}
+	return warn(name, message, hint)
+}
+
+// HasFailures reports whether any check failed.
+func HasFailures(results []CheckResult) bool {
+	return slices.ContainsFunc(results, func(r CheckResult) bool { return r.Status == CheckFail })
+}
+
+// newCheckClient creates an unconnected TrueNAS client from the driver configuration.
+func newCheckClient(config *DriverConfig) *client.Client {
+	return client.New(client.Config{
+		URL:                config.TrueNASURL,
+		APIKey:             config.TrueNASAPIKey,
+		InsecureSkipVerify: config.TrueNASInsecure,
+		Logger:             config.Logger,
+	})
+}
+
+// CheckConnectivity connects to TrueNAS with the given configuration and reports
+// whether the API is reachable, the API key is accepted and the default pool is
+// usable. It does not need a running driver.
+func CheckConnectivity(ctx context.Context, config *DriverConfig) []CheckResult {
+	c := newCheckClient(config)
+	defer c.Close()
+
+	results, _ := checkConnection(ctx, c, config)
+	return results
+}
+
+// RunDoctor runs the preflight checks for the configured mode: TrueNAS checks for
+// the controller and node prerequisites for the node. It does not need a running driver.
+func RunDoctor(ctx context.Context, config *DriverConfig) []CheckResult {
+	applyConfigDefaults(config)
+
+	mode := config.Mode
+	if mode == "" {
+		mode = DriverModeAll
+	}
+
+	var results []CheckResult
+	if mode == DriverModeController || mode == DriverModeAll {
+		c := newCheckClient(config)
+		defer c.Close()
+
+		connResults, connected := checkConnection(ctx, c, config)
+		results = append(results, connResults...)
+		if connected {
+			log := config.Logger
+			if log.GetSink() == nil {
+				log = logr.Discard()
+			}
+			paths, err := resolveDataPaths(ctx, c, config, log)
+			if err != nil {
+				results = append(results, fail("data paths", err.Error(), "Fix TRUENAS_PREFERRED_SUBNETS"))
+			} else {
+				results = append(results, pass("data paths", fmt.Sprintf("NFS server %s (%s), SMB server %s (%s), iSCSI portal %s (%s), NVMe portal %s (%s)",
+					paths.NFSServer, paths.NFSServerSource, paths.SMBServer, paths.SMBServerSource, paths.ISCSIPortal, paths.ISCSIPortalSource, paths.NVMePortal, paths.NVMePortalSource)))
+				results = append(results, checkTrueNAS(ctx, c, paths.ISCSIPortal, config.ISCSIIQNBase)...)
+			}
+		}
+	}
+	if mode == DriverModeNode || mode == DriverModeAll {
+		results = append(results, checkNode(ctx, exec.New())...)
+	}
+	return results
+}
+
+// runPreflight runs the doctor checks for the services this driver instance serves
+// and logs the report. In strict mode a failed check aborts startup.
+func (d *Driver) runPreflight(ctx context.Context) error {
+	if d.preflight == PreflightOff {
+		return nil
+	}
+
+	var results []CheckResult
+	if d.controllerServer != nil {
+		results = append(results, checkTrueNAS(ctx, d.client, d.iscsiPortal, d.iscsiIQNBase)...)
+	}
+	if d.nodeServer != nil {
+		results = append(results, checkNode(ctx, exec.New())...)
+	}
+
+	for _, r := range results {
+		switch r.Status {
+		case CheckPass, CheckInferred:
+			d.log.V(LogLevelInfo).Info("Preflight check passed", "check", r.Name, "status", r.Status, "details", r.Message)
+		case CheckWarn:
+			d.log.Info("Preflight check warning", "check", r.Name, "details", r.Message, "hint", r.Hint)
+		default:
+			d.log.Error(nil, "Preflight check failed", "check", r.Name, "details", r.Message, "hint", r.Hint)
+		}
+	}
+
+	if d.preflight == PreflightStrict && HasFailures(results) {
+		return fmt.Errorf("preflight checks failed; fix the reported problems or set TRUENAS_PREFLIGHT=warn")
+	}
+	return nil
+}
+
+// checkConnection connects c and checks authentication, ping and the default pool.
+// It returns false if the API cannot be used.
+func checkConnection(ctx context.Context, c *client.Client, config *DriverConfig) ([]CheckResult, bool) {
+	var results []CheckResult
+
+	if err := c.Connect(ctx); err != nil {
+		if client.IsConnectionError(err) {
+			return append(results, fail("connection", fmt.Sprintf("cannot reach %s: %v", config.TrueNASURL, err),
+				"Check TRUENAS_URL (wss://<host>/api/current), firewalls, and TRUENAS_INSECURE_SKIP_VERIFY for self-signed certificates")), false
+		}
+		results = append(results, pass("connection", config.TrueNASURL))
+		return append(results, fail("authentication", fmt.Sprintf("API key rejected: %v", err),
+			"Create a new API key in the TrueNAS UI (Credentials > API Keys) and update TRUENAS_API_KEY")), false
+	}
+	results = append(results,
+		pass("connection", config.TrueNASURL),
+		pass("authentication", "API key accepted"),
+	)
+
+	if err := c.Ping(ctx); err != nil {
+		return append(results, fail("ping", err.Error(), "TrueNAS middleware is not responding; check the system on the TrueNAS console")), false
+	}
+	results = append(results, pass("ping", "core.ping succeeded"))
+
+	pool, err := c.GetPool(ctx, config.DefaultPool)
+	switch {
+	case err != nil:
+		results = append(results, fail("pool", err.Error(),
+			"Create the pool in the TrueNAS UI (Storage > Create Pool) or fix TRUENAS_DEFAULT_POOL"))
+	case !pool.Healthy:
+		results = append(results, fail("pool", fmt.Sprintf("pool %s is %s", pool.Name, pool.Status),
+			"Check the pool status and alerts in the TrueNAS UI"))
+	default:
+		results = append(results, pass("pool", fmt.Sprintf("pool %s is %s, %d bytes free", pool.Name, pool.Status, pool.Free)))
+	}
+
+	return results, true
+}
+
+// checkTrueNAS checks the sharing services, the iSCSI portal and IQN base, and the
+// privileges of the API key.
+func checkTrueNAS(ctx context.Context, c *client.Client, iscsiPortal, iqnBase string) []CheckResult {
+	var results []CheckResult
+
+	results = append(results, checkService(ctx, c, serviceNFS, "NFS"))
+
+	iscsiService := checkService(ctx, c, serviceISCSI, "iSCSI")
+	results = append(results, iscsiService)
+	iscsiInUse := iscsiService.Status == CheckPass
+
+	results = append(results, checkISCSIPortal(ctx, c, iscsiPortal, iscsiInUse))
+	results = append(results, checkISCSIBasename(ctx, c, iqnBase, iscsiInUse))
+	results = append(results, checkAPIPrivileges(ctx, c)...)
+
+	return results
+}
+
+// checkService checks that a sharing service is running. A stopped service only
+// warns, since a cluster may use a single protocol.
+func checkService(ctx context.Context, c *client.Client, service, label string) CheckResult {
+	name := "service " + service
+	hint := fmt.Sprintf("Enable and start the %s service in the TrueNAS UI (System > Services); ignore if no StorageClass uses %s", label, label)
+
+	svc, err := c.GetService(ctx, service)
+	if err != nil {
+		return warn(name, err.Error(), hint)
+	}
+	if svc.State != serviceStateRunning {
+		return warn(name, fmt.Sprintf("%s service is %s", label, svc.State), hint)
+	}
+	if !svc.Enable {
+		return warn(name, fmt.Sprintf("%s service is running but not started on boot", label), hint)
+	}
+	return pass(name, fmt.Sprintf("%s service is running", label))
+}
+
+// checkISCSIPortal checks that a TrueNAS portal listens on the configured portal address.
+func checkISCSIPortal(ctx context.Context, c *client.Client, iscsiPortal string, inUse bool) CheckResult {
+	const name = "iscsi portal"
+	hint := "Add a portal listening on this address in the TrueNAS UI (Shares > iSCSI > Portals) or fix TRUENAS_ISCSI_PORTAL"
+
+	portals, err := c.ListISCSIPortals(ctx)
+	if err != nil {
+		return failOrWarn(inUse, name, err.Error(), hint)
+	}
+	if len(portals) == 0 {
+		return failOrWarn(inUse, name, "no iSCSI portals are configured", hint)
+	}
+
+	host, port, err := net.SplitHostPort(iscsiPortal)
+	if err != nil {
+		host, port = iscsiPortal, "3260"
+	}
+	addrs := []string{host}
+	if net.ParseIP(host) == nil {
+		if resolved, err := net.DefaultResolver.LookupHost(ctx, host); err == nil {
+			addrs = append(addrs, resolved...)
+		}
+	}
+
+	globalPort := 0
+	if global, err := c.GetISCSIGlobalConfig(ctx); err == nil {
+		globalPort = global.ListenPort
+	}
+
+	var listening []string
+	for _, portal := range portals {
+		for _, listen := range portal.Listen {
+			listenPort := listen.Port
+			if listenPort == 0 {
+				listenPort = globalPort
+			}
+			listening = append(listening, net.JoinHostPort(listen.IP, strconv.Itoa(listenPort)))
+
+			if listenPort != 0 && strconv.Itoa(listenPort) != port {
+				continue
+			}
+			if listen.IP == "0.0.0.0" || listen.IP == "::" || slices.Contains(addrs, listen.IP) {
+				return pass(name, fmt.Sprintf("portal %d listens on %s", portal.ID, net.JoinHostPort(listen.IP, port)))
+			}
+		}
+	}
+	return failOrWarn(inUse, name, fmt.Sprintf("no portal listens on %s (portals listen on %s)", iscsiPortal, strings.Join(listening, ", ")), hint)
+}
+
+// checkISCSIBasename checks that the configured IQN base matches the TrueNAS base name,
+// since nodes log in to <IQN base>:<target name>.
+func checkISCSIBasename(ctx context.Context, c *client.Client, iqnBase string, inUse bool) CheckResult {
+	const name = "iscsi iqn base"
+
+	global, err := c.GetISCSIGlobalConfig(ctx)
+	if err != nil {
+		return failOrWarn(inUse, name, err.Error(), "Check that the API key can read the iSCSI configuration")
+	}
+	if global.Basename != iqnBase {
+		return failOrWarn(inUse, name, fmt.Sprintf("driver uses %s but TrueNAS uses %s", iqnBase, global.Basename),
+			fmt.Sprintf("Set TRUENAS_ISCSI_IQN_BASE=%s", global.Basename))
+	}
+	return pass(name, iqnBase)
+}
+
+// checkAPIPrivileges probes every query method the driver uses and compares the
+// roles of the API key's user with those needed for provisioning. Write methods
+// are not called, so write access is only ever reported as inferred.
+func checkAPIPrivileges(ctx context.Context, c *client.Client) []CheckResult {
+	var results []CheckResult
+
+	if failures := c.CheckQueryAccess(ctx); len(failures) > 0 {
+		methods := make([]string, 0, len(failures))
+		for method := range failures {
+			methods = append(methods, method)
+		}
+		sort.Strings(methods)
+		results = append(results, fail("api read access", "denied: "+strings.Join(methods, ", "),
+			"Give the API key's user a privilege with the READONLY_ADMIN role or higher (Credentials > Groups > Privileges)"))
+	} else {
+		results = append(results, pass("api read access", "all query methods allowed"))
+	}
+
+	roles, err := c.GetSessionRoles(ctx)
+	switch {
+	case err != nil:
+		results = append(results, warn("api write access", err.Error(), "Check the privileges of the API key's user in the TrueNAS UI"))
+	case roles == nil:
+		results = append(results, warn("api write access", "TrueNAS did not report the roles of the API key",
+			"Make sure the API key's user has the FULL_ADMIN role or the dataset, snapshot and sharing write roles"))
+	case slices.Contains(roles, roleFullAdmin):
+		results = append(results, inferred("api write access", "inferred from role "+roleFullAdmin, writeAccessHint))
+	default:
+		var missing []string
+		for _, role := range requiredWriteRoles {
+			if !slices.Contains(roles, role) {
+				missing = append(missing, role)
+			}
+		}
+		if len(missing) > 0 {
+			results = append(results, warn("api write access", "missing roles: "+strings.Join(missing, ", "),
+				"Add the missing roles to the API key user's privilege, or use FULL_ADMIN; provisioning calls may be denied"))
+		} else {
+			results = append(results, inferred("api write access", "inferred from roles: "+strings.Join(requiredWriteRoles, ", "), writeAccessHint))
+		}
+	}
+
+	return results
+}
+
+// checkNode checks the host tools the node service runs for NFS, SMB, NVMe/TCP and iSCSI.
+func checkNode(ctx context.Context, executor exec.Interface) []CheckResult {
+	var results []CheckResult
+
+	if path, err := executor.LookPath("mount.nfs"); err != nil {
+		results = append(results, fail("mount.nfs", "mount.nfs not found in PATH",
+			"Install nfs-utils (RHEL, Alpine) or nfs-common (Debian, Ubuntu) in the node image or on the host"))
+	} else {
+		results = append(results, pass("mount.nfs", path))
+	}
+
+	if path, err := executor.LookPath("mount.cifs"); err != nil {
+		results = append(results, warn("mount.cifs", "mount.cifs not found in PATH",
+			"Install cifs-utils in the node image or on the host; ignore if no StorageClass uses smb"))
+	} else {
+		results = append(results, pass("mount.cifs", path))
+	}
+
+	results = append(results, checkNVMe(executor)...)
+
+	iscsiHint := "Install open-iscsi (Debian, Ubuntu) or iscsi-initiator-utils (RHEL) and run 'systemctl enable --now iscsid' on the host; ignore if no StorageClass uses iSCSI"
+	path, err := executor.LookPath("iscsiadm")
+	if err != nil {
+		return append(results, warn("iscsiadm", "iscsiadm not found in PATH", iscsiHint))
+	}
+	results = append(results, pass("iscsiadm", path))
+
+	out, err := executor.CommandContext(ctx, "iscsiadm", "-m", "session").CombinedOutput()
+	var exitErr exec.ExitError
+	switch {
+	case err == nil:
+		results = append(results, pass("iscsid", "iscsid is reachable"))
+	case errors.As(err, &exitErr) && exitErr.ExitStatus() == iscsiadmExitNoSessions:
+		results = append(results, pass("iscsid", "iscsid is reachable (no sessions)"))
+	default:
+		results = append(results, warn("iscsid", fmt.Sprintf("iscsiadm -m session failed: %v: %s", err, strings.TrimSpace(string(out))), iscsiHint))
+	}
+
+	if _, err := os.Stat(iscsiInitiatorNameFile); err != nil {
+		results = append(results, warn("initiator name", fmt.Sprintf("%s: %v", iscsiInitiatorNameFile, err),
+			"Generate an initiator name with 'iscsi-iname' and write it as InitiatorName=<iqn> to "+iscsiInitiatorNameFile))
+	} else {
+		results = append(results, pass("initiator name", iscsiInitiatorNameFile))
+	}
+
+	multipathHint := "Install multipath-tools (Debian, Ubuntu) or device-mapper-multipath (RHEL) and run 'systemctl enable --now multipathd' on the host; ignore if no StorageClass sets iscsi.multipathEnabled"
+	if path, err := executor.LookPath("multipath"); err != nil {
+		results = append(results, warn("multipath", "multipath not found in PATH", multipathHint))
+	} else {
+		results = append(results, pass("multipath", path))
+	}
+
+	return results
+}
+
+// checkNVMe checks nvme-cli, the nvme-tcp kernel module and the host NQN.
+func checkNVMe(executor exec.Interface) []CheckResult {
+	nvmeHint := "Install nvme-cli and run 'modprobe nvme-tcp' on the host; ignore if no StorageClass uses nvme"
+	path, err := executor.LookPath("nvme")
+	if err != nil {
+		return []CheckResult{warn("nvme", "nvme not found in PATH", nvmeHint)}
+	}
+	results := []CheckResult{pass("nvme", path)}
+
+	if _, err := os.Stat(nvmeTCPModuleDir); err != nil {
+		results = append(results, warn("nvme-tcp", "nvme-tcp kernel module is not loaded", nvmeHint))
+	} else {
+		results = append(results, pass("nvme-tcp", "nvme-tcp kernel module is loaded"))
+	}
+
+	if _, err := os.Stat(nvmeHostNQNFile); err != nil {
+		results = append(results, warn("host NQN", fmt.Sprintf("%s: %v", nvmeHostNQNFile, err),
+			"Generate a host NQN with 'nvme gen-hostnqn > "+nvmeHostNQNFile+"' on the host"))
+	} else {
+		results = append(results, pass("host NQN", nvmeHostNQNFile))
+	}
+	return results
+}
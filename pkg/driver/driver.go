@@ -8,7 +8,9 @@ import (
 	"os"
 	"os/signal"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"syscall"
 	"time"
@@ -29,6 +31,8 @@ const (
 	// Protocol identifiers
 	ProtocolISCSI = "iscsi"
 	ProtocolNFS   = "nfs"
+	ProtocolNVMe  = "nvme"
+	ProtocolSMB   = "smb"
 
 	// Compression defaults
 	CompressionLZ4 = "LZ4"
@@ -67,11 +71,33 @@ const (
 	PublishContextProtocol     = "protocol"
 	PublishContextTargetIQN    = "targetIQN"
 	PublishContextTargetPortal = "targetPortal"
-	PublishContextLUN          = "lun"
-	PublishContextNFSServer    = "nfsServer"
-	PublishContextNFSPath      = "nfsPath"
-	PublishContextCHAPUser     = "chapUser"
-	PublishContextCHAPSecret   = "chapSecret"
+	// PublishContextTargetPortals lists every portal of the target, comma-separated,
+	// for multipath logins. targetPortal is always first.
+	PublishContextTargetPortals = "targetPortals"
+	PublishContextLUN           = "lun"
+	PublishContextNFSServer     = "nfsServer"
+	PublishContextNFSPath       = "nfsPath"
+	PublishContextSMBServer     = "smbServer"
+	PublishContextSMBShare      = "smbShare"
+	PublishContextCHAPUser      = "chapUser"
+	PublishContextCHAPSecret    = "chapSecret"
+	PublishContextSubsystemNQN  = "subsystemNQN"
+	PublishContextNVMePortal    = "nvmePortal"
+	PublishContextNSID          = "nsid"
+
+	// ZFS user properties stored on datasets managed by the driver. They travel
+	// with the dataset, so DeleteVolume and background tasks can act on them
+	// without access to the original StorageClass parameters.
+	PropertyManaged        = "csi.truenas.io:managed"
+	PropertyPVName         = "csi.truenas.io:pv-name"
+	PropertyDeleteStrategy = "csi.truenas.io:delete-strategy"
+	PropertyTrashOrigin    = "csi.truenas.io:trash-origin"
+	PropertyTrashExpiry    = "csi.truenas.io:trash-expiry"
+	PropertyImported       = "csi.truenas.io:imported"
+	PropertyAdopted        = "csi.truenas.io:adopted"
+	PropertyExportManaged  = "csi.truenas.io:export-managed"
+	PropertyMigratedFrom   = "csi.truenas.io:migrated-from"
+	PropertyCloneStrategy  = "csi.truenas.io:clone-strategy"
 )
 
 // VolumeInfo holds metadata about a provisioned volume
@@ -85,11 +111,14 @@ type VolumeInfo struct {
 
 	DatasetPath string
 	PoolName    string
-	Protocol    string // "nfs" or "iscsi"
+	Protocol    string // "nfs", "smb", "iscsi" or "nvme"
 
 	NFSPath    string
 	NFSShareID int
 
+	SMBShareName string
+	SMBShareID   int
+
 	TargetIQN        string
 	TargetPortal     string
 	LUN              int
@@ -97,6 +126,14 @@ type VolumeInfo struct {
 	ISCSIExtentID    int
 	ISCSIAuthID      int // CHAP auth credential ID
 	ISCSIInitiatorID int // Initiator group ID
+	// ISCSISharedTarget is set when the volume is one LUN of a shared target
+	ISCSISharedTarget bool
+
+	SubsystemNQN    string
+	NVMePortal      string
+	NSID            int
+	NVMeSubsysID    int
+	NVMeNamespaceID int
 }
 
 // ISCSIDeleteOptions holds parsed delete options from StorageClass parameters.
@@ -121,6 +158,7 @@ type StageRequest struct {
 type UnstageRequest struct {
 	VolumeID    string
 	StagingPath string
+	Record      *StagingRecord // nil if the volume has no staging record
 }
 
 // PublishRequest contains all information needed to publish a volume
@@ -134,7 +172,9 @@ type PublishRequest struct {
 	VolumeCapability *csi.VolumeCapability
 	PublishContext   map[string]string
 	VolumeContext    map[string]string
-	IsBlockVolume    bool // true for raw block volumes
+	Secrets          map[string]string // node-publish secrets (SMB credentials)
+	IsBlockVolume    bool              // true for raw block volumes
+	Record           *StagingRecord    // nil if the volume has no staging record
 }
 
 // UnpublishRequest contains all information needed to unpublish a volume
@@ -148,11 +188,14 @@ type ExpandRequest struct {
 	VolumeID      string
 	VolumePath    string
 	CapacityBytes int64
+	Record        *StagingRecord // nil if the volume has no staging record
 }
 
 // StageResult contains the result of staging a volume
 type StageResult struct {
 	DevicePath string
+	// Connection is recorded in the staging record for unstage and expand
+	Connection StagingConnection
 }
 
 // ExpandResult contains the result of expanding a volume
@@ -181,6 +224,26 @@ type ProtocolHandler interface {
 	Expand(ctx context.Context, req *ExpandRequest) (*ExpandResult, error)
 }
 
+// ProtocolProvisioner defines the interface for the controller side of a protocol
+type ProtocolProvisioner interface {
+	// CreateVolume creates the dataset or zvol of a new volume and exports it
+	CreateVolume(ctx context.Context, volumeID, datasetPath string, capacityBytes int64, parameters map[string]string) (*VolumeInfo, error)
+
+	// ExportVolume exports an existing dataset or zvol (clones, restores and imports)
+	ExportVolume(ctx context.Context, volumeID, datasetPath string, dataset *client.Dataset, capacityBytes int64, parameters map[string]string) (*VolumeInfo, error)
+
+	// IsExported reports whether the dataset already has an export of this protocol
+	IsExported(ctx context.Context, datasetPath string, dataset *client.Dataset) (bool, error)
+
+	// RemoveExport removes the export of a volume. volInfo is nil if the volume
+	// could not be reconstructed; exports found by path are removed anyway.
+	RemoveExport(ctx context.Context, datasetPath string, volInfo *VolumeInfo)
+
+	// PublishContext returns what nodes need to attach the volume, or false if
+	// volInfo lacks the export details
+	PublishContext(ctx context.Context, volInfo *VolumeInfo, volumeContext map[string]string) (map[string]string, bool)
+}
+
 type Driver struct {
 	name     string
 	version  string
@@ -192,19 +255,49 @@ type Driver struct {
 
 	defaultPool  string
 	nfsServer    string
+	smbServer    string
 	iscsiPortal  string
+	nvmePortal   string
 	iscsiIQNBase string
+	dataPaths    DataPaths
+	preflight    PreflightMode
+	stateDir     string
+	metricsAddr  string
+
+	// volumeUsageThreshold is the usage percentage above which volumes are abnormal
+	volumeUsageThreshold int
 
-	identityServer   csi.IdentityServer
-	controllerServer csi.ControllerServer
-	nodeServer       csi.NodeServer
+	// snapshotDeletePolicy decides how snapshots with dependent clones are deleted
+	snapshotDeletePolicy SnapshotDeletePolicy
+
+	// snapshotSync publishes the snapshots of periodic snapshot tasks as VolumeSnapshots
+	snapshotSync bool
+
+	// volumeRollback carries out the rollbacks requested with PVC annotations
+	volumeRollback bool
+
+	// snapshotMetadataService serves the CSI SnapshotMetadata service
+	snapshotMetadataService bool
+
+	// preferredSubnets restricts wildcard portal addresses published for multipath
+	preferredSubnets []*net.IPNet
+
+	// sharedTargetMu serializes LUN allocation on shared iSCSI targets
+	sharedTargetMu sync.Mutex
+
+	identityServer        csi.IdentityServer
+	controllerServer      csi.ControllerServer
+	groupControllerServer csi.GroupControllerServer
+	snapshotMetadata      csi.SnapshotMetadataServer
+	nodeServer            csi.NodeServer
 
 	server *grpc.Server
 
-	controllerCaps []*csi.ControllerServiceCapability
-	nodeCaps       []*csi.NodeServiceCapability
-	pluginCaps     []*csi.PluginCapability
-	volumeCaps     []*csi.VolumeCapability_AccessMode
+	controllerCaps      []*csi.ControllerServiceCapability
+	groupControllerCaps []*csi.GroupControllerServiceCapability
+	nodeCaps            []*csi.NodeServiceCapability
+	pluginCaps          []*csi.PluginCapability
+	volumeCaps          []*csi.VolumeCapability_AccessMode
 }
 
 // DriverMode represents the operating mode of the CSI driver
@@ -234,9 +327,49 @@ type DriverConfig struct {
 
 	DefaultPool  string
 	NFSServer    string
+	SMBServer    string
 	ISCSIPortal  string
+	NVMePortal   string
 	ISCSIIQNBase string
 
+	// PreferredSubnets are CIDRs, in order of preference, used to choose among the
+	// addresses TrueNAS serves NFS and iSCSI on when none are set explicitly.
+	PreferredSubnets []string
+
+	// Preflight controls the doctor checks run when the driver starts.
+	// Defaults to PreflightWarn.
+	Preflight PreflightMode
+
+	// VolumeUsageThreshold is the percentage of its capacity a filesystem volume
+	// may use before the controller reports it abnormal. Defaults to 90.
+	VolumeUsageThreshold int
+
+	// SnapshotDeletePolicy decides what DeleteSnapshot does with a snapshot that
+	// clones depend on. Defaults to SnapshotDeleteDefer.
+	SnapshotDeletePolicy SnapshotDeletePolicy
+
+	// SnapshotSync makes the controller create VolumeSnapshots for the snapshots
+	// periodic snapshot tasks take of volumes, and remove them when the
+	// snapshots are pruned. Off by default.
+	SnapshotSync bool
+
+	// VolumeRollback makes the controller roll volumes back in place to the
+	// snapshot named by the csi.truenas.io/rollback-to annotation of their PVC.
+	// Off by default.
+	VolumeRollback bool
+
+	// SnapshotMetadata makes the controller serve the CSI SnapshotMetadata
+	// service. Its ranges are coarse (see SnapshotMetadataServer). Off by default.
+	SnapshotMetadata bool
+
+	// StateDir is the host directory where nodes keep staging records and
+	// connection state. Defaults to /var/lib/truenas-csi.
+	StateDir string
+
+	// MetricsAddress is the address to serve Prometheus metrics on (e.g. ":9809").
+	// Metrics are not served if empty.
+	MetricsAddress string
+
 	// Logger is the structured logger for the driver and client.
 	// If not set, logging for the client will be disabled.
 	Logger logr.Logger
@@ -272,34 +405,15 @@ func NewDriver(config *DriverConfig) (*Driver, error) {
 		return nil, fmt.Errorf("default pool is required")
 	}
 
-	if config.ISCSIIQNBase == "" {
-		config.ISCSIIQNBase = DEFAULT_IQN_BASE
-	}
+	applyConfigDefaults(config)
 
 	if err := validateIQNFormat(config.ISCSIIQNBase); err != nil {
 		return nil, fmt.Errorf("invalid iSCSI IQN base format: %w", err)
 	}
 
-	// Derive NFS server from TrueNAS URL if not explicitly set
-	if config.NFSServer == "" {
-		if parsedURL, err := url.Parse(config.TrueNASURL); err == nil {
-			host := parsedURL.Hostname()
-			if host != "" {
-				config.NFSServer = host
-				log.V(LogLevelInfo).Info("Derived NFS server from TrueNAS URL", "nfsServer", host)
-			}
-		}
-	}
-
-	// Derive iSCSI portal from TrueNAS URL if not explicitly set (default port 3260)
-	if config.ISCSIPortal == "" {
-		if parsedURL, err := url.Parse(config.TrueNASURL); err == nil {
-			host := parsedURL.Hostname()
-			if host != "" {
-				config.ISCSIPortal = host + ":3260"
-				log.V(LogLevelInfo).Info("Derived iSCSI portal from TrueNAS URL", "iscsiPortal", config.ISCSIPortal)
-			}
-		}
+	preferredSubnets, err := parseSubnets(config.PreferredSubnets)
+	if err != nil {
+		return nil, err
 	}
 
 	ctx := context.Background()
@@ -336,6 +450,24 @@ func NewDriver(config *DriverConfig) (*Driver, error) {
 		mode = DriverModeAll
 	}
 
+	// Only the controller hands out data-path addresses; nodes read them from the
+	// publish context, so they skip the discovery calls
+	var dataPaths DataPaths
+	if mode == DriverModeController || mode == DriverModeAll {
+		dataPaths, err = resolveDataPaths(ctx, truenasClient, config, log)
+		if err != nil {
+			truenasClient.Close()
+			return nil, err
+		}
+	} else {
+		dataPaths = urlDataPaths(config)
+	}
+	log.Info("Using data-path addresses",
+		"nfsServer", dataPaths.NFSServer, "nfsServerSource", dataPaths.NFSServerSource,
+		"smbServer", dataPaths.SMBServer, "smbServerSource", dataPaths.SMBServerSource,
+		"iscsiPortal", dataPaths.ISCSIPortal, "iscsiPortalSource", dataPaths.ISCSIPortalSource,
+		"nvmePortal", dataPaths.NVMePortal, "nvmePortalSource", dataPaths.NVMePortalSource)
+
 	log.V(LogLevelInfo).Info("Initializing driver", "mode", mode)
 
 	d := &Driver{
@@ -346,9 +478,23 @@ func NewDriver(config *DriverConfig) (*Driver, error) {
 		log:          log,
 		client:       truenasClient,
 		defaultPool:  config.DefaultPool,
-		nfsServer:    config.NFSServer,
-		iscsiPortal:  config.ISCSIPortal,
+		nfsServer:    dataPaths.NFSServer,
+		smbServer:    dataPaths.SMBServer,
+		iscsiPortal:  dataPaths.ISCSIPortal,
+		nvmePortal:   dataPaths.NVMePortal,
 		iscsiIQNBase: config.ISCSIIQNBase,
+		dataPaths:    dataPaths,
+		preflight:    config.Preflight,
+		stateDir:     config.StateDir,
+		metricsAddr:  config.MetricsAddress,
+
+		preferredSubnets:     preferredSubnets,
+		volumeUsageThreshold: config.VolumeUsageThreshold,
+		snapshotDeletePolicy: config.SnapshotDeletePolicy,
+		snapshotSync:         config.SnapshotSync,
+		volumeRollback:       config.VolumeRollback,
+
+		snapshotMetadataService: config.SnapshotMetadata,
 	}
 
 	d.initializeCapabilities()
@@ -360,6 +506,10 @@ func NewDriver(config *DriverConfig) (*Driver, error) {
 	if mode == DriverModeController || mode == DriverModeAll {
 		log.V(LogLevelInfo).Info("Creating controller server")
 		d.controllerServer = NewControllerServer(d)
+		d.groupControllerServer = NewGroupControllerServer(d)
+		if d.snapshotMetadataService {
+			d.snapshotMetadata = NewSnapshotMetadataServer(d)
+		}
 	}
 
 	// Create node server only in node or all mode
@@ -392,6 +542,10 @@ func (d *Driver) Run(ctx context.Context) error {
 	ctx, cancel := signal.NotifyContext(ctx, syscall.SIGINT, syscall.SIGTERM)
 	defer cancel()
 
+	if err := d.runPreflight(ctx); err != nil {
+		return err
+	}
+
 	u, err := url.Parse(d.endpoint)
 	if err != nil {
 		return fmt.Errorf("failed to parse endpoint: %w", err)
@@ -429,6 +583,38 @@ func (d *Driver) Run(ctx context.Context) error {
 	csi.RegisterIdentityServer(d.server, d.identityServer)
 	csi.RegisterControllerServer(d.server, d.controllerServer)
 	csi.RegisterNodeServer(d.server, d.nodeServer)
+	if d.groupControllerServer != nil {
+		csi.RegisterGroupControllerServer(d.server, d.groupControllerServer)
+	}
+	if d.snapshotMetadata != nil {
+		csi.RegisterSnapshotMetadataServer(d.server, d.snapshotMetadata)
+	}
+
+	// Expired trash and deferred snapshots are purged by the controller service only.
+	if cs, ok := d.controllerServer.(*ControllerServer); ok {
+		go cs.runTrashPurger(ctx)
+		go cs.runSnapshotSweeper(ctx)
+		if d.snapshotSync {
+			go cs.runSnapshotSync(ctx)
+		}
+		if d.volumeRollback {
+			go cs.runRollbackReconciler(ctx)
+		}
+	}
+
+	// Nodes reconcile their iSCSI sessions and staging records.
+	if ns, ok := d.nodeServer.(*NodeServer); ok {
+		go ns.runReconciler(ctx)
+	}
+
+	if d.metricsAddr != "" {
+		metricsListener, err := listenMetrics(d.metricsAddr)
+		if err != nil {
+			listener.Close()
+			return err
+		}
+		go d.serveMetrics(ctx, metricsListener)
+	}
 
 	serverErr := make(chan error, 1)
 
@@ -615,6 +801,24 @@ func (d *Driver) initializeCapabilities() {
 				},
 			},
 		},
+		{
+			Type: &csi.ControllerServiceCapability_Rpc{
+				Rpc: &csi.ControllerServiceCapability_RPC{
+					Type: csi.ControllerServiceCapability_RPC_VOLUME_CONDITION,
+				},
+			},
+		},
+	}
+
+	// Group controller capabilities
+	d.groupControllerCaps = []*csi.GroupControllerServiceCapability{
+		{
+			Type: &csi.GroupControllerServiceCapability_Rpc{
+				Rpc: &csi.GroupControllerServiceCapability_RPC{
+					Type: csi.GroupControllerServiceCapability_RPC_CREATE_DELETE_GET_VOLUME_GROUP_SNAPSHOT,
+				},
+			},
+		},
 	}
 
 	// Node capabilities
@@ -640,6 +844,13 @@ func (d *Driver) initializeCapabilities() {
 				},
 			},
 		},
+		{
+			Type: &csi.NodeServiceCapability_Rpc{
+				Rpc: &csi.NodeServiceCapability_RPC{
+					Type: csi.NodeServiceCapability_RPC_VOLUME_CONDITION,
+				},
+			},
+		},
 	}
 
 	// Plugin capabilities
@@ -651,6 +862,13 @@ func (d *Driver) initializeCapabilities() {
 				},
 			},
 		},
+		{
+			Type: &csi.PluginCapability_Service_{
+				Service: &csi.PluginCapability_Service{
+					Type: csi.PluginCapability_Service_GROUP_CONTROLLER_SERVICE,
+				},
+			},
+		},
 		{
 			Type: &csi.PluginCapability_Service_{
 				Service: &csi.PluginCapability_Service{
@@ -666,17 +884,18 @@ func (d *Driver) initializeCapabilities() {
 			},
 		},
 	}
-
-	// Volume access modes - only advertise modes we actually support
-	// SINGLE_NODE_MULTI_WRITER requires cluster-aware filesystem which we don't provide
-	d.volumeCaps = []*csi.VolumeCapability_AccessMode{
-		{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
-		{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY},
-		{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_SINGLE_WRITER},
-		{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY},
-		{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_SINGLE_WRITER},
-		{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER},
+	if d.snapshotMetadataService {
+		d.pluginCaps = append(d.pluginCaps, &csi.PluginCapability{
+			Type: &csi.PluginCapability_Service_{
+				Service: &csi.PluginCapability_Service{
+					Type: csi.PluginCapability_Service_SNAPSHOT_METADATA_SERVICE,
+				},
+			},
+		})
 	}
+
+	// Volume access modes - only advertise modes at least one protocol supports
+	d.volumeCaps = registeredAccessModes()
 }
 
 // Client returns the TrueNAS client
@@ -699,16 +918,36 @@ func (d *Driver) NFSServer() string {
 	return d.nfsServer
 }
 
+// SMBServer returns the configured SMB server address
+func (d *Driver) SMBServer() string {
+	return d.smbServer
+}
+
 // ISCSIPortal returns the configured iSCSI portal address
 func (d *Driver) ISCSIPortal() string {
 	return d.iscsiPortal
 }
 
+// NVMePortal returns the configured NVMe/TCP address (host:port)
+func (d *Driver) NVMePortal() string {
+	return d.nvmePortal
+}
+
+// DataPaths returns the NFS and SMB servers, iSCSI portal and NVMe/TCP addresses and their sources
+func (d *Driver) DataPaths() DataPaths {
+	return d.dataPaths
+}
+
 // DefaultPool returns the default storage pool
 func (d *Driver) DefaultPool() string {
 	return d.defaultPool
 }
 
+// StateDir returns the node's state directory
+func (d *Driver) StateDir() string {
+	return d.stateDir
+}
+
 // ISCSIIQNBase returns the base IQN for iSCSI targets
 func (d *Driver) ISCSIIQNBase() string {
 	return d.iscsiIQNBase
@@ -734,12 +973,26 @@ func (d *Driver) GenerateVolumeID(pool, name string) string {
 	return fmt.Sprintf("%s/%s", pool, name)
 }
 
-// ParseVolumeID extracts pool and name from a volume ID
+// ParseVolumeID extracts pool and name from a volume ID.
+// The name may be a nested dataset path (e.g. "tank/legacy/app-data" yields
+// pool "tank" and name "legacy/app-data"), as used by statically provisioned volumes.
 func (d *Driver) ParseVolumeID(volumeID string) (pool, name string, err error) {
-	parts := strings.SplitN(volumeID, "/", 2)
-	if len(parts) != 2 {
+	parts := strings.SplitN(volumeID, volumeIDSeparator, 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
 		return "", "", fmt.Errorf("invalid volume ID format: %s", volumeID)
 	}
+
+	// Snapshot (@) and bookmark (#) names are not volumes
+	if strings.ContainsAny(volumeID, "@#") {
+		return "", "", fmt.Errorf("invalid volume ID format: %s (snapshots and bookmarks are not volumes)", volumeID)
+	}
+
+	for _, component := range strings.Split(parts[1], volumeIDSeparator) {
+		if component == "" || component == "." || component == ".." {
+			return "", "", fmt.Errorf("invalid volume ID format: %s (empty or relative path component)", volumeID)
+		}
+	}
+
 	return parts[0], parts[1], nil
 }
 
@@ -770,6 +1023,54 @@ func (d *Driver) GetISCSIIQNBaseFromParameters(parameters map[string]string) str
 	return d.iscsiIQNBase
 }
 
+// GetNFSServerFromParameters returns the NFS server address from StorageClass
+// parameters, falling back to the configured or discovered address
+func (d *Driver) GetNFSServerFromParameters(parameters map[string]string) string {
+	if server, ok := parameters["nfs.server"]; ok && server != "" {
+		return server
+	}
+	return d.nfsServer
+}
+
+// GetSMBServerFromParameters returns the SMB server address from StorageClass
+// parameters, falling back to the configured or discovered server
+func (d *Driver) GetSMBServerFromParameters(parameters map[string]string) string {
+	if server, ok := parameters[paramSMBServer]; ok && server != "" {
+		return server
+	}
+	return d.smbServer
+}
+
+// GetISCSIPortalFromParameters returns the iSCSI portal (host:port) from StorageClass
+// parameters, falling back to the configured or discovered portal
+func (d *Driver) GetISCSIPortalFromParameters(parameters map[string]string) string {
+	if portal, ok := parameters["iscsi.portal"]; ok && portal != "" {
+		if _, _, err := net.SplitHostPort(portal); err != nil {
+			return net.JoinHostPort(portal, strconv.Itoa(defaultISCSIPort))
+		}
+		return portal
+	}
+	return d.iscsiPortal
+}
+
+// GetNVMePortalFromParameters returns the NVMe/TCP address (host:port) from
+// StorageClass parameters, falling back to the configured or discovered address
+func (d *Driver) GetNVMePortalFromParameters(parameters map[string]string) string {
+	if portal, ok := parameters[paramNVMePortal]; ok && portal != "" {
+		if _, _, err := net.SplitHostPort(portal); err != nil {
+			return net.JoinHostPort(portal, strconv.Itoa(defaultNVMePort))
+		}
+		return portal
+	}
+	return d.nvmePortal
+}
+
+// isBlockProtocol reports whether a protocol exports zvols as block devices.
+func isBlockProtocol(protocol string) bool {
+	p, ok := lookupProtocol(protocol)
+	return ok && p.block
+}
+
 // GetISCSIDeleteOptionsFromParameters parses iSCSI delete options from StorageClass parameters.
 func (d *Driver) GetISCSIDeleteOptionsFromParameters(parameters map[string]string) *ISCSIDeleteOptions {
 	opts := &ISCSIDeleteOptions{}
@@ -848,63 +1149,52 @@ func (d *Driver) reconstructVolumeFromTrueNAS(ctx context.Context, volumeID stri
 		return nil, fmt.Errorf("volume %s not found in TrueNAS: %w", volumeID, err)
 	}
 
-	// Reconstruct volume info based on dataset type
-	volInfo := &VolumeInfo{
-		ID:            volumeID,
-		Name:          volumeID,
-		DatasetPath:   datasetPath,
-		PoolName:      pool,
-		VolumeContext: make(map[string]string),
+	// Each protocol of the dataset's kind looks for its export; without one the
+	// volume is reported under the default protocol for the dataset type
+	fallback, err := protocolForDataset(dataset, "")
+	if err != nil {
+		return nil, err
 	}
-
-	// Determine protocol and capacity based on dataset type
-	if dataset.Type == "VOLUME" {
-		volInfo.Protocol = ProtocolISCSI
-		volInfo.CapacityBytes = dataset.Volsize
-		if volInfo.CapacityBytes == 0 {
-			volInfo.CapacityBytes = dataset.Used
+	newVolumeInfo := func(protocol string) *VolumeInfo {
+		volInfo := &VolumeInfo{
+			ID:            volumeID,
+			Name:          volumeID,
+			DatasetPath:   datasetPath,
+			PoolName:      pool,
+			Protocol:      protocol,
+			CapacityBytes: dataset.RefQuota,
+			VolumeContext: make(map[string]string),
 		}
-
-		// Query iSCSI target details from TrueNAS
-		zvolPath := "zvol/" + datasetPath
-		extent, err := d.client.GetISCSIExtentByDisk(ctx, zvolPath)
-		if err == nil && extent != nil {
-			volInfo.ISCSIExtentID = extent.ID
-
-			// Find the target-extent association
-			assoc, err := d.client.GetISCSITargetExtentByExtent(ctx, extent.ID)
-			if err == nil && assoc != nil {
-				volInfo.LUN = assoc.LunID
-
-				// Get the target details
-				target, err := d.client.GetISCSITargetByID(ctx, assoc.Target)
-				if err == nil && target != nil {
-					volInfo.ISCSITargetID = target.ID
-					// Construct the full IQN
-					volInfo.TargetIQN = d.iscsiIQNBase + ":" + target.Name
-					volInfo.TargetPortal = d.iscsiPortal
-					volInfo.VolumeContext["targetPortal"] = d.iscsiPortal
-					volInfo.VolumeContext["targetIQN"] = volInfo.TargetIQN
-					volInfo.VolumeContext["lun"] = fmt.Sprintf("%d", volInfo.LUN)
-				}
+		if fallback.block {
+			volInfo.CapacityBytes = dataset.Volsize
+			if volInfo.CapacityBytes == 0 {
+				volInfo.CapacityBytes = dataset.Used
 			}
 		}
-		d.log.V(LogLevelDebug).Info("Reconstructed iSCSI volume", "volumeId", volumeID, "capacityBytes", volInfo.CapacityBytes,
-			"targetIQN", volInfo.TargetIQN, "lun", volInfo.LUN)
-	} else {
-		// NFS filesystem
-		volInfo.Protocol = ProtocolNFS
-		volInfo.CapacityBytes = dataset.RefQuota
-		volInfo.NFSPath = dataset.Mountpoint
+		return volInfo
+	}
 
-		if d.nfsServer != "" {
-			volInfo.VolumeContext["nfsServer"] = d.nfsServer
+	var volInfo, fallbackInfo *VolumeInfo
+	for _, protocol := range registeredProtocols() {
+		if protocol.block != fallback.block || protocol.reconstruct == nil {
+			continue
 		}
-		volInfo.VolumeContext["nfsPath"] = dataset.Mountpoint
-
-		d.log.V(LogLevelDebug).Info("Reconstructed NFS volume", "volumeId", volumeID, "capacityBytes", volInfo.CapacityBytes, "path", dataset.Mountpoint)
+		candidate := newVolumeInfo(protocol.name)
+		if protocol.reconstruct(ctx, d, dataset, candidate) {
+			volInfo = candidate
+			break
+		}
+		if protocol == fallback {
+			fallbackInfo = candidate
+		}
+	}
+	if volInfo == nil {
+		volInfo = fallbackInfo
+	}
+	if volInfo == nil {
+		volInfo = newVolumeInfo(fallback.name)
 	}
 
-	d.log.V(LogLevelInfo).Info("Successfully reconstructed volume from TrueNAS", "volumeId", volumeID)
+	d.log.V(LogLevelInfo).Info("Successfully reconstructed volume from TrueNAS", "volumeId", volumeID, "protocol", volInfo.Protocol)
 	return volInfo, nil
 }
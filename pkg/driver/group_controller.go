@@ -0,0 +1,343 @@
+package driver
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/truenas/truenas-csi/pkg/client"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// groupSnapshotIDPrefix starts group snapshot IDs, which have the form
+// group:<pool>@<snapshot name>. Every volume of the group has a snapshot of
+// that name, with the usual <dataset>@<snapshot name> ID.
+const groupSnapshotIDPrefix = "group:"
+
+// GroupControllerServer implements the CSI GroupController service: crash
+// consistent snapshots of several volumes of a pool.
+type GroupControllerServer struct {
+	driver *Driver
+	csi.UnimplementedGroupControllerServer
+}
+
+// NewGroupControllerServer creates a new CSI group controller service.
+func NewGroupControllerServer(d *Driver) *GroupControllerServer {
+	return &GroupControllerServer{
+		driver: d,
+	}
+}
+
+// GroupControllerGetCapabilities returns the group controller capabilities.
+func (s *GroupControllerServer) GroupControllerGetCapabilities(ctx context.Context, req *csi.GroupControllerGetCapabilitiesRequest) (*csi.GroupControllerGetCapabilitiesResponse, error) {
+	s.driver.Log().V(LogLevelDebug).Info("GroupControllerGetCapabilities called")
+
+	return &csi.GroupControllerGetCapabilitiesResponse{
+		Capabilities: s.driver.groupControllerCaps,
+	}, nil
+}
+
+// CreateVolumeGroupSnapshot snapshots the source volumes atomically: one
+// recursive ZFS snapshot of their common parent dataset that excludes every
+// other dataset below it.
+func (s *GroupControllerServer) CreateVolumeGroupSnapshot(ctx context.Context, req *csi.CreateVolumeGroupSnapshotRequest) (*csi.CreateVolumeGroupSnapshotResponse, error) {
+	ctx, cancel := withTimeout(ctx, defaultOperationTimeout)
+	defer cancel()
+
+	s.driver.Log().V(LogLevelDebug).Info("CreateVolumeGroupSnapshot called", "name", req.Name, "sourceVolumeIds", req.SourceVolumeIds)
+
+	if req.Name == "" {
+		return nil, status.Error(codes.InvalidArgument, "group snapshot name is required")
+	}
+	if len(req.SourceVolumeIds) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "source volume IDs are required")
+	}
+	hold, err := parseSnapshotHold(req.Parameters)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid group snapshot class parameters: %v", err)
+	}
+
+	var pool string
+	var members []string
+	for _, volumeID := range req.SourceVolumeIds {
+		volPool, _, err := s.driver.ParseVolumeID(volumeID)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid source volume ID: %v", err)
+		}
+		if pool != "" && volPool != pool {
+			return nil, status.Errorf(codes.InvalidArgument,
+				"all volumes of a group snapshot must be in one pool: %s is in %s, not %s", volumeID, volPool, pool)
+		}
+		pool = volPool
+		if _, err := s.driver.Client().GetDataset(ctx, volumeID); err != nil {
+			if client.IsNotFoundError(err) {
+				return nil, status.Errorf(codes.NotFound, "source volume %s not found", volumeID)
+			}
+			return nil, status.Errorf(codes.Internal, "failed to get source volume %s: %v", volumeID, err)
+		}
+		if !slices.Contains(members, volumeID) {
+			members = append(members, volumeID)
+		}
+	}
+
+	snapshotName := SanitizeVolumeName(req.Name)
+	groupSnapshotID := groupSnapshotIDPrefix + pool + "@" + snapshotName
+
+	// A retry finds the snapshots of the first attempt
+	existing, err := s.driver.Client().FindSnapshotsByName(ctx, snapshotName)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to look up existing snapshots: %v", err)
+	}
+	if len(existing) > 0 {
+		for _, member := range members {
+			if !slices.ContainsFunc(existing, func(snap client.Snapshot) bool { return snap.Dataset == member }) {
+				return nil, status.Errorf(codes.AlreadyExists,
+					"snapshot name %s already exists for other volumes (existing: %s)", req.Name, existing[0].ID)
+			}
+		}
+		s.driver.Log().V(LogLevelDebug).Info("Group snapshot already exists", "groupSnapshotId", groupSnapshotID)
+		if hold {
+			for i := range existing {
+				if !slices.Contains(members, existing[i].Dataset) {
+					continue
+				}
+				if err := s.driver.holdSnapshot(ctx, &existing[i]); err != nil {
+					return nil, status.Errorf(codes.Internal, "failed to hold snapshot %s of group snapshot: %v", existing[i].ID, err)
+				}
+			}
+		}
+		return &csi.CreateVolumeGroupSnapshotResponse{
+			GroupSnapshot: newVolumeGroupSnapshot(groupSnapshotID, memberSnapshots(existing, members)),
+		}, nil
+	}
+
+	parent := commonParentDataset(members)
+	datasets, err := s.driver.Client().ListDatasets(ctx, pool)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to list datasets: %v", err)
+	}
+
+	// Keep the members and the datasets between them and the parent, which the
+	// recursion has to pass through; everything else below the parent is left out
+	var exclude, ancestors []string
+	for _, dataset := range datasets {
+		if dataset.Name == parent || !strings.HasPrefix(dataset.Name, parent+"/") || slices.Contains(members, dataset.Name) {
+			continue
+		}
+		if slices.ContainsFunc(members, func(member string) bool { return strings.HasPrefix(member, dataset.Name+"/") }) {
+			ancestors = append(ancestors, dataset.Name)
+			continue
+		}
+		exclude = append(exclude, dataset.Name)
+	}
+	if !slices.Contains(members, parent) {
+		ancestors = append(ancestors, parent)
+	}
+
+	s.driver.Log().V(LogLevelDebug).Info("Creating group snapshot", "groupSnapshotId", groupSnapshotID, "parent", parent, "excluded", len(exclude))
+	if _, err := s.driver.Client().CreateRecursiveSnapshot(ctx, parent, snapshotName, exclude); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to create group snapshot: %v", err)
+	}
+
+	// The snapshots of the datasets the recursion passed through are not part of the group
+	for _, ancestor := range ancestors {
+		if err := s.driver.Client().DeleteSnapshot(ctx, ancestor+"@"+snapshotName); err != nil && !client.IsNotFoundError(err) {
+			s.driver.Log().Info("Failed to delete snapshot of group snapshot parent", "snapshotId", ancestor+"@"+snapshotName, "error", err)
+		}
+	}
+
+	if hold {
+		for _, member := range members {
+			if err := s.driver.holdSnapshot(ctx, &client.Snapshot{ID: member + "@" + snapshotName}); err != nil {
+				return nil, status.Errorf(codes.Internal, "failed to hold snapshot %s of group snapshot: %v", member+"@"+snapshotName, err)
+			}
+		}
+	}
+
+	created, err := s.driver.Client().FindSnapshotsByName(ctx, snapshotName)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to get group snapshot: %v", err)
+	}
+	snapshots := memberSnapshots(created, members)
+	if len(snapshots) != len(members) {
+		return nil, status.Errorf(codes.Internal, "group snapshot %s has %d of %d member snapshots", groupSnapshotID, len(snapshots), len(members))
+	}
+
+	return &csi.CreateVolumeGroupSnapshotResponse{
+		GroupSnapshot: newVolumeGroupSnapshot(groupSnapshotID, snapshots),
+	}, nil
+}
+
+// DeleteVolumeGroupSnapshot deletes the snapshots of all volumes of the group.
+func (s *GroupControllerServer) DeleteVolumeGroupSnapshot(ctx context.Context, req *csi.DeleteVolumeGroupSnapshotRequest) (*csi.DeleteVolumeGroupSnapshotResponse, error) {
+	ctx, cancel := withTimeout(ctx, shortOperationTimeout)
+	defer cancel()
+
+	s.driver.Log().V(LogLevelDebug).Info("DeleteVolumeGroupSnapshot called", "groupSnapshotId", req.GroupSnapshotId, "snapshotIds", req.SnapshotIds)
+
+	if req.GroupSnapshotId == "" {
+		return nil, status.Error(codes.InvalidArgument, "group snapshot ID is required")
+	}
+
+	pool, snapshotName, ok := parseGroupSnapshotID(req.GroupSnapshotId)
+	if !ok {
+		// Not one of ours - treat as already deleted (idempotent)
+		s.driver.Log().V(LogLevelDebug).Info("Invalid group snapshot ID format, treating as already deleted", "groupSnapshotId", req.GroupSnapshotId)
+		return &csi.DeleteVolumeGroupSnapshotResponse{}, nil
+	}
+
+	snapshots, err := s.groupSnapshotMembers(ctx, pool, snapshotName)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to list group snapshot: %v", err)
+	}
+	snapshotIDs := make([]string, 0, len(snapshots))
+	for _, snap := range snapshots {
+		snapshotIDs = append(snapshotIDs, snap.ID)
+	}
+	for _, snapshotID := range req.SnapshotIds {
+		if !strings.HasSuffix(snapshotID, "@"+snapshotName) {
+			return nil, status.Errorf(codes.InvalidArgument, "snapshot %s is not part of group snapshot %s", snapshotID, req.GroupSnapshotId)
+		}
+		if !slices.Contains(snapshotIDs, snapshotID) {
+			snapshotIDs = append(snapshotIDs, snapshotID)
+		}
+	}
+
+	for _, snapshotID := range snapshotIDs {
+		if err := s.driver.deleteSnapshot(ctx, snapshotID); err != nil {
+			if errors.Is(err, errSnapshotHasClones) {
+				return nil, status.Errorf(codes.FailedPrecondition, "failed to delete group snapshot %s: %v", req.GroupSnapshotId, err)
+			}
+			return nil, status.Errorf(codes.Internal, "failed to delete group snapshot %s: %v", req.GroupSnapshotId, err)
+		}
+	}
+
+	return &csi.DeleteVolumeGroupSnapshotResponse{}, nil
+}
+
+// GetVolumeGroupSnapshot returns the snapshots of the group.
+func (s *GroupControllerServer) GetVolumeGroupSnapshot(ctx context.Context, req *csi.GetVolumeGroupSnapshotRequest) (*csi.GetVolumeGroupSnapshotResponse, error) {
+	ctx, cancel := withTimeout(ctx, shortOperationTimeout)
+	defer cancel()
+
+	s.driver.Log().V(LogLevelDebug).Info("GetVolumeGroupSnapshot called", "groupSnapshotId", req.GroupSnapshotId)
+
+	if req.GroupSnapshotId == "" {
+		return nil, status.Error(codes.InvalidArgument, "group snapshot ID is required")
+	}
+
+	pool, snapshotName, ok := parseGroupSnapshotID(req.GroupSnapshotId)
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "group snapshot %s not found", req.GroupSnapshotId)
+	}
+
+	snapshots, err := s.groupSnapshotMembers(ctx, pool, snapshotName)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to list group snapshot: %v", err)
+	}
+	if len(snapshots) == 0 {
+		return nil, status.Errorf(codes.NotFound, "group snapshot %s not found", req.GroupSnapshotId)
+	}
+	for _, snapshotID := range req.SnapshotIds {
+		if !slices.ContainsFunc(snapshots, func(snap client.Snapshot) bool { return snap.ID == snapshotID }) {
+			return nil, status.Errorf(codes.NotFound, "snapshot %s of group snapshot %s not found", snapshotID, req.GroupSnapshotId)
+		}
+	}
+
+	return &csi.GetVolumeGroupSnapshotResponse{
+		GroupSnapshot: newVolumeGroupSnapshot(req.GroupSnapshotId, snapshots),
+	}, nil
+}
+
+// groupSnapshotMembers returns the snapshots of a group in the pool. A leftover
+// snapshot of a parent dataset is skipped, since it covers others.
+func (s *GroupControllerServer) groupSnapshotMembers(ctx context.Context, pool, snapshotName string) ([]client.Snapshot, error) {
+	snapshots, err := s.driver.Client().FindSnapshotsByName(ctx, snapshotName)
+	if err != nil {
+		return nil, err
+	}
+
+	var inPool []client.Snapshot
+	for _, snap := range snapshots {
+		if snap.Dataset == pool || strings.HasPrefix(snap.Dataset, pool+"/") {
+			inPool = append(inPool, snap)
+		}
+	}
+
+	var members []client.Snapshot
+	for _, snap := range inPool {
+		if slices.ContainsFunc(inPool, func(other client.Snapshot) bool { return strings.HasPrefix(other.Dataset, snap.Dataset+"/") }) {
+			continue
+		}
+		members = append(members, snap)
+	}
+	return members, nil
+}
+
+// newVolumeGroupSnapshot describes a group snapshot made of the given snapshots.
+// Snapshot IDs are those CreateSnapshot returns, so each restores like one. The
+// group was created when its earliest snapshot was.
+func newVolumeGroupSnapshot(groupSnapshotID string, members []client.Snapshot) *csi.VolumeGroupSnapshot {
+	snapshots := make([]*csi.Snapshot, 0, len(members))
+	var creationTime *timestamppb.Timestamp
+	for i := range members {
+		snapshot := csiSnapshot(&members[i], "")
+		snapshot.GroupSnapshotId = groupSnapshotID
+		snapshots = append(snapshots, snapshot)
+		if creationTime == nil || snapshot.CreationTime.AsTime().Before(creationTime.AsTime()) {
+			creationTime = snapshot.CreationTime
+		}
+	}
+	if creationTime == nil {
+		creationTime = timestamppb.Now()
+	}
+	return &csi.VolumeGroupSnapshot{
+		GroupSnapshotId: groupSnapshotID,
+		Snapshots:       snapshots,
+		CreationTime:    creationTime,
+		ReadyToUse:      true,
+	}
+}
+
+// memberSnapshots returns the snapshots of the given volumes, in their order.
+func memberSnapshots(snapshots []client.Snapshot, volumeIDs []string) []client.Snapshot {
+	var members []client.Snapshot
+	for _, volumeID := range volumeIDs {
+		if i := slices.IndexFunc(snapshots, func(snap client.Snapshot) bool { return snap.Dataset == volumeID }); i >= 0 {
+			members = append(members, snapshots[i])
+		}
+	}
+	return members
+}
+
+// parseGroupSnapshotID splits a group snapshot ID into its pool and snapshot name.
+func parseGroupSnapshotID(groupSnapshotID string) (pool, snapshotName string, ok bool) {
+	rest, ok := strings.CutPrefix(groupSnapshotID, groupSnapshotIDPrefix)
+	if !ok {
+		return "", "", false
+	}
+	pool, snapshotName, ok = strings.Cut(rest, "@")
+	if !ok || pool == "" || snapshotName == "" || strings.Contains(pool, "/") {
+		return "", "", false
+	}
+	return pool, snapshotName, true
+}
+
+// commonParentDataset returns the deepest dataset that is, or is an ancestor
+// of, every one of the datasets. They must share a pool.
+func commonParentDataset(datasets []string) string {
+	parent := strings.Split(datasets[0], "/")
+	for _, dataset := range datasets[1:] {
+		components := strings.Split(dataset, "/")
+		n := 0
+		for n < len(parent) && n < len(components) && parent[n] == components[n] {
+			n++
+		}
+		parent = parent[:n]
+	}
+	return strings.Join(parent, "/")
+}
@@ -0,0 +1,65 @@
+package driver
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/truenas/truenas-csi/pkg/client"
+)
+
+func TestCommonParentDataset(t *testing.T) {
+	tests := []struct {
+		name     string
+		datasets []string
+		expected string
+	}{
+		{name: "single", datasets: []string{"tank/k8s/pvc-1"}, expected: "tank/k8s/pvc-1"},
+		{name: "siblings", datasets: []string{"tank/k8s/pvc-1", "tank/k8s/pvc-2"}, expected: "tank/k8s"},
+		{name: "name prefix", datasets: []string{"tank/k8s/pvc-1", "tank/k8s/pvc-10"}, expected: "tank/k8s"},
+		{name: "ancestor", datasets: []string{"tank/k8s", "tank/k8s/pvc-1"}, expected: "tank/k8s"},
+		{name: "different depths", datasets: []string{"tank/a/b/pvc-1", "tank/a/pvc-2", "tank/a/b/c/pvc-3"}, expected: "tank/a"},
+		{name: "only the pool", datasets: []string{"tank/a/pvc-1", "tank/b/pvc-2"}, expected: "tank"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := commonParentDataset(tc.datasets); got != tc.expected {
+				t.Errorf("commonParentDataset(%v) = %q, want %q", tc.datasets, got, tc.expected)
+			}
+		})
+	}
+}
+
+func TestNewVolumeGroupSnapshot(t *testing.T) {
+	const groupSnapshotID = groupSnapshotIDPrefix + "tank@group-1"
+	earlier := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	later := earlier.Add(time.Second)
+
+	snapshot := func(dataset string, created time.Time) client.Snapshot {
+		return client.Snapshot{
+			ID:         dataset + "@group-1",
+			Dataset:    dataset,
+			CreateTime: strconv.FormatInt(created.Unix(), 10),
+		}
+	}
+	group := newVolumeGroupSnapshot(groupSnapshotID, []client.Snapshot{
+		snapshot("tank/k8s/pvc-1", later),
+		snapshot("tank/k8s/pvc-2", earlier),
+	})
+
+	if len(group.Snapshots) != 2 {
+		t.Fatalf("group has %d snapshots, want 2", len(group.Snapshots))
+	}
+	for _, snap := range group.Snapshots {
+		if snap.GroupSnapshotId != groupSnapshotID {
+			t.Errorf("snapshot %s has group snapshot ID %q, want %q", snap.SnapshotId, snap.GroupSnapshotId, groupSnapshotID)
+		}
+	}
+	if got := group.Snapshots[0].CreationTime.AsTime(); !got.Equal(later) {
+		t.Errorf("first snapshot created at %v, want %v", got, later)
+	}
+	if got := group.CreationTime.AsTime(); !got.Equal(earlier) {
+		t.Errorf("group created at %v, want the earliest snapshot time %v", got, earlier)
+	}
+}
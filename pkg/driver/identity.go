@@ -50,7 +50,12 @@ func (s *IdentityServer) GetPluginCapabilities(ctx context.Context, req *csi.Get
 
 // Probe checks if the driver is healthy by testing the TrueNAS connection.
 func (s *IdentityServer) Probe(ctx context.Context, req *csi.ProbeRequest) (*csi.ProbeResponse, error) {
-	s.driver.Log().V(LogLevelDebug).Info("Probe called")
+	paths := s.driver.DataPaths()
+	s.driver.Log().V(LogLevelDebug).Info("Probe called",
+		"nfsServer", paths.NFSServer, "nfsServerSource", paths.NFSServerSource,
+		"smbServer", paths.SMBServer, "smbServerSource", paths.SMBServerSource,
+		"iscsiPortal", paths.ISCSIPortal, "iscsiPortalSource", paths.ISCSIPortalSource,
+		"nvmePortal", paths.NVMePortal, "nvmePortalSource", paths.NVMePortalSource)
 
 	if err := s.driver.client.Ping(ctx); err != nil {
 		s.driver.Log().Error(err, "Health check failed")
@@ -4,10 +4,14 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"net"
 	"os"
 	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/go-logr/logr"
 	iscsilib "github.com/kubernetes-csi/csi-lib-iscsi/iscsi"
@@ -24,8 +28,8 @@ const (
 	paramMultipathEnabled   = "iscsi.multipathEnabled"
 	paramPersistentSessions = "iscsi.persistentSessions"
 
-	// Directory for storing csi-lib-iscsi connector files
-	connectorDir = "/var/lib/truenas-csi/connectors"
+	// Subdirectory of the state directory for csi-lib-iscsi connector files
+	connectorDirName = "connectors"
 
 	// iSCSI connection settings
 	iscsiRetryCount    = 10 // number of login attempts
@@ -34,14 +38,17 @@ const (
 
 // ISCSIHandler implements the ProtocolHandler interface for iSCSI volumes
 type ISCSIHandler struct {
-	mounter *mount.SafeFormatAndMount
-	resizer *mount.ResizeFs
-	log     logr.Logger
+	mounter  *mount.SafeFormatAndMount
+	resizer  *mount.ResizeFs
+	stateDir string
+	log      logr.Logger
 }
 
 // ISCSIConfig holds iSCSI-specific configuration parsed from volume/publish contexts
 type ISCSIConfig struct {
-	TargetPortal       string
+	TargetPortal string
+	// TargetPortals holds every portal of the target, TargetPortal first
+	TargetPortals      []string
 	TargetIQN          string
 	LUN                int32
 	CHAPUsername       string
@@ -50,19 +57,23 @@ type ISCSIConfig struct {
 	CHAPPasswordIn     string
 	MultipathEnabled   bool
 	PersistentSessions bool
+	// SharedTarget is set when the LUN belongs to a target shared with other volumes
+	SharedTarget bool
 }
 
 // NewISCSIHandler creates a new iSCSI protocol handler
-func NewISCSIHandler(mounter *mount.SafeFormatAndMount, log logr.Logger) (*ISCSIHandler, error) {
+func NewISCSIHandler(mounter *mount.SafeFormatAndMount, stateDir string, log logr.Logger) (*ISCSIHandler, error) {
 	// Ensure connector directory exists
-	if err := os.MkdirAll(connectorDir, 0o750); err != nil {
-		return nil, fmt.Errorf("failed to create connector directory %s: %w", connectorDir, err)
+	dir := filepath.Join(stateDir, connectorDirName)
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, fmt.Errorf("failed to create connector directory %s: %w", dir, err)
 	}
 
 	return &ISCSIHandler{
-		mounter: mounter,
-		resizer: mount.NewResizeFs(mounter.Exec),
-		log:     log,
+		mounter:  mounter,
+		resizer:  mount.NewResizeFs(mounter.Exec),
+		stateDir: stateDir,
+		log:      log,
 	}, nil
 }
 
@@ -72,15 +83,49 @@ func (h *ISCSIHandler) Protocol() string {
 }
 
 // connectorPath returns the path for storing connector info for a volume
-func connectorPath(volumeID string) string {
-	return filepath.Join(connectorDir, fmt.Sprintf("%s.connector", sanitizeISCSIVolumeID(volumeID)))
+func connectorPath(stateDir, volumeID string) string {
+	return filepath.Join(stateDir, connectorDirName, fmt.Sprintf("%s.connector", sanitizeISCSIVolumeID(volumeID)))
+}
+
+// legacyISCSIStagingRecord rebuilds the staging record of a volume staged before
+// staging records existed from its connector file. Whether the volume was staged
+// as a block device is not known and assumed false.
+func legacyISCSIStagingRecord(stateDir, volumeID string) *StagingRecord {
+	connector, err := readConnectorFile(connectorPath(stateDir, volumeID))
+	if err != nil && stateDir != defaultStateDir {
+		// Drivers without a configurable state directory kept connectors here
+		connector, err = readConnectorFile(connectorPath(defaultStateDir, volumeID))
+	}
+	if err != nil || connector.TargetIqn == "" {
+		return nil
+	}
+	return &StagingRecord{
+		VolumeID:   volumeID,
+		Protocol:   ProtocolISCSI,
+		DevicePath: mountTargetPath(connector),
+		Connection: StagingConnection{
+			TargetPortals: connector.TargetPortals,
+			TargetIQN:     connector.TargetIqn,
+			LUN:           connector.Lun,
+		},
+	}
 }
 
 // parseISCSIConfig extracts iSCSI configuration from publish and volume contexts
 func parseISCSIConfig(publishContext, volumeContext map[string]string) (*ISCSIConfig, error) {
 	config := &ISCSIConfig{
-		TargetPortal: publishContext["targetPortal"],
-		TargetIQN:    publishContext["targetIQN"],
+		TargetPortal: publishContext[PublishContextTargetPortal],
+		TargetIQN:    publishContext[PublishContextTargetIQN],
+	}
+
+	// Older controllers only publish targetPortal
+	if config.TargetPortal != "" {
+		config.TargetPortals = []string{config.TargetPortal}
+	}
+	for _, portal := range strings.Split(publishContext[PublishContextTargetPortals], ",") {
+		if portal = strings.TrimSpace(portal); portal != "" && !slices.Contains(config.TargetPortals, portal) {
+			config.TargetPortals = append(config.TargetPortals, portal)
+		}
 	}
 
 	// Parse LUN
@@ -105,16 +150,24 @@ func parseISCSIConfig(publishContext, volumeContext map[string]string) (*ISCSICo
 	if val := volumeContext[paramPersistentSessions]; strings.EqualFold(val, "true") {
 		config.PersistentSessions = true
 	}
+	config.SharedTarget = isSharedTargetMode(volumeContext)
 
 	return config, nil
 }
 
-// buildConnector creates a csi-lib-iscsi Connector from our config
+// buildConnector creates a csi-lib-iscsi Connector from our config. With multipath
+// enabled it logs in to every portal; otherwise only to the primary portal, since
+// several paths without dm-multipath would expose the LUN as separate disks.
 func (h *ISCSIHandler) buildConnector(volumeID string, config *ISCSIConfig) *iscsilib.Connector {
+	portals := []string{config.TargetPortal}
+	if config.MultipathEnabled && len(config.TargetPortals) > 0 {
+		portals = config.TargetPortals
+	}
+
 	connector := &iscsilib.Connector{
 		VolumeName:    volumeID,
 		TargetIqn:     config.TargetIQN,
-		TargetPortals: []string{config.TargetPortal},
+		TargetPortals: portals,
 		Lun:           config.LUN,
 		RetryCount:    iscsiRetryCount,
 		CheckInterval: iscsiCheckInterval,
@@ -153,28 +206,55 @@ func (h *ISCSIHandler) Stage(ctx context.Context, req *StageRequest) (*StageResu
 	// Build connector for csi-lib-iscsi
 	connector := h.buildConnector(req.VolumeID, config)
 
-	// Connect to iSCSI target
-	h.log.V(LogLevelDebug).Info("Connecting to iSCSI target", "portal", config.TargetPortal, "iqn", config.TargetIQN, "lun", config.LUN)
-	devicePath, err := iscsilib.Connect(*connector)
+	// Connect to iSCSI target. Connect fills in the path devices and, with
+	// multipath, the dm-multipath device the connector mounts.
+	// LUNs of a shared target usually arrive over sessions that are already logged in.
+	var devicePath string
+	attached := false
+	unlock := lockISCSITarget(connector.TargetIqn, connector.TargetPortals)
+	if config.SharedTarget {
+		devicePath, attached = h.attachSharedLUN(connector)
+	}
+	if !attached {
+		h.log.V(LogLevelDebug).Info("Connecting to iSCSI target", "portals", connector.TargetPortals, "iqn", config.TargetIQN, "lun", config.LUN)
+		devicePath, err = connector.Connect()
+	}
+	unlock()
 	if err != nil {
-		return nil, fmt.Errorf("failed to connect to iSCSI target %s at %s: %w", config.TargetIQN, config.TargetPortal, err)
+		return nil, fmt.Errorf("failed to connect to iSCSI target %s at %s: %w", config.TargetIQN, strings.Join(connector.TargetPortals, ","), err)
+	}
+	if config.MultipathEnabled && !connector.IsMultipathEnabled() {
+		// A single path may still be claimed by multipathd; mount the map, not the path
+		if mpath := multipathChild(connector.Devices); mpath != nil {
+			connector.MountTargetDevice = mpath
+			devicePath = mpath.GetPath()
+		} else {
+			h.log.Info("Multipath requested but only one path is active and it has no dm-multipath device",
+				"volumeId", req.VolumeID, "device", devicePath, "portals", connector.TargetPortals)
+		}
 	}
 
-	h.log.V(LogLevelDebug).Info("iSCSI connected", "device", devicePath)
+	h.log.V(LogLevelDebug).Info("iSCSI connected", "device", devicePath, "paths", len(connector.Devices))
 
-	// Persist connector info for cleanup on unstage
-	// Note: csi-lib-iscsi Connect() takes a value copy, so device info isn't
-	// populated in our connector. We only need TargetIqn and TargetPortals for
-	// disconnection, which we already have.
-	cpath := connectorPath(req.VolumeID)
+	// Persist connector info for publish, expand and cleanup on unstage
+	cpath := connectorPath(h.stateDir, req.VolumeID)
 	if err := iscsilib.PersistConnector(connector, cpath); err != nil {
 		h.log.Info("Failed to persist connector info", "error", err)
 	}
 
+	result := &StageResult{
+		DevicePath: devicePath,
+		Connection: StagingConnection{
+			TargetPortals: connector.TargetPortals,
+			TargetIQN:     connector.TargetIqn,
+			LUN:           connector.Lun,
+		},
+	}
+
 	// For block volumes, skip formatting and mounting - just return the device path
 	if req.IsBlockVolume {
 		h.log.V(LogLevelDebug).Info("iSCSI block volume staged (no filesystem)", "volumeId", req.VolumeID, "device", devicePath)
-		return &StageResult{DevicePath: devicePath}, nil
+		return result, nil
 	}
 
 	// Get filesystem type for mount volumes
@@ -195,7 +275,7 @@ func (h *ISCSIHandler) Stage(ctx context.Context, req *StageRequest) (*StageResu
 	}
 
 	h.log.V(LogLevelDebug).Info("iSCSI volume staged", "volumeId", req.VolumeID, "stagingPath", req.StagingPath)
-	return &StageResult{DevicePath: devicePath}, nil
+	return result, nil
 }
 
 // Unstage implements iSCSI volume unstaging (logout and cleanup)
@@ -208,8 +288,7 @@ func (h *ISCSIHandler) Unstage(ctx context.Context, req *UnstageRequest) error {
 		if os.IsNotExist(err) {
 			h.log.V(LogLevelDebug).Info("Staging path does not exist, considering unstaged", "stagingPath", req.StagingPath)
 			// Still try to disconnect iSCSI and cleanup connector
-			h.cleanupISCSISession(req.VolumeID)
-			return nil
+			return h.cleanupISCSISession(req.VolumeID, req.Record)
 		}
 		return fmt.Errorf("failed to check mount point: %w", err)
 	}
@@ -222,7 +301,9 @@ func (h *ISCSIHandler) Unstage(ctx context.Context, req *UnstageRequest) error {
 	}
 
 	// Disconnect iSCSI session and cleanup
-	h.cleanupISCSISession(req.VolumeID)
+	if err := h.cleanupISCSISession(req.VolumeID, req.Record); err != nil {
+		return err
+	}
 
 	// Remove staging directory
 	os.Remove(req.StagingPath)
@@ -231,11 +312,24 @@ func (h *ISCSIHandler) Unstage(ctx context.Context, req *UnstageRequest) error {
 	return nil
 }
 
-// cleanupISCSISession disconnects the iSCSI session and removes the connector file
-func (h *ISCSIHandler) cleanupISCSISession(volumeID string) {
-	cpath := connectorPath(volumeID)
+// cleanupISCSISession disconnects the iSCSI sessions and removes the connector file.
+// A multipath map is flushed first; if that fails the sessions and connector file
+// are kept so the next unstage can retry. Without a connector file the target in
+// the staging record is logged out, so a lost file does not leak the session.
+func (h *ISCSIHandler) cleanupISCSISession(volumeID string, record *StagingRecord) error {
+	cpath := connectorPath(h.stateDir, volumeID)
 	if _, err := os.Stat(cpath); err != nil {
-		return // No connector file, nothing to clean up
+		if record != nil && record.Connection.TargetIQN != "" {
+			conn := record.Connection
+			h.log.V(LogLevelDebug).Info("No connector file, disconnecting target from staging record", "volumeId", volumeID, "targetIqn", conn.TargetIQN)
+			unlock := lockISCSITarget(conn.TargetIQN, conn.TargetPortals)
+			disconnectISCSITarget(h.log, conn.TargetIQN, conn.TargetPortals, conn.LUN)
+			unlock()
+		}
+		if h.stateDir != defaultStateDir {
+			os.Remove(connectorPath(defaultStateDir, volumeID))
+		}
+		return nil
 	}
 
 	// Try to load connector - GetConnectorFromFile may fail validation if
@@ -247,31 +341,211 @@ func (h *ISCSIHandler) cleanupISCSISession(volumeID string) {
 		// Read file directly and unmarshal to get IQN and portals
 		connector = h.readConnectorDirect(cpath)
 	}
+	if connector == nil {
+		os.Remove(cpath)
+		return nil
+	}
+
+	// Another volume of a shared target may be logging in or scanning its LUN
+	unlock := lockISCSITarget(connector.TargetIqn, connector.TargetPortals)
+	defer unlock()
+
+	// A directly read connector only has the IQN and portals
+	if err == nil {
+		if connector.IsMultipathEnabled() {
+			// Logging out under an active map would leave it with failed paths
+			if err := connector.DisconnectVolume(); err != nil {
+				return fmt.Errorf("failed to remove multipath device %s: %w", connector.MountTargetDevice.GetPath(), err)
+			}
+		} else if err := connector.DisconnectVolume(); err != nil {
+			// Logout removes the device too, unless other LUNs keep the session
+			h.log.V(LogLevelDebug).Info("Failed to remove iSCSI device", "device", connector.MountTargetDevice.GetPath(), "error", err)
+		}
+	}
 
-	if connector != nil && connector.TargetIqn != "" {
-		iscsilib.Disconnect(connector.TargetIqn, connector.TargetPortals)
-		h.log.V(LogLevelDebug).Info("Disconnected from iSCSI target", "targetIqn", connector.TargetIqn)
+	if connector.TargetIqn != "" {
+		disconnectISCSITarget(h.log, connector.TargetIqn, connector.TargetPortals, connector.Lun)
+		h.log.V(LogLevelDebug).Info("Disconnected from iSCSI target", "targetIqn", connector.TargetIqn, "portals", connector.TargetPortals)
 	}
 
 	// Remove connector file
 	os.Remove(cpath)
+	return nil
+}
+
+// iscsiTargetLocks serializes logins, LUN scans and logouts per target IQN and
+// portal. Node operations are only locked per volume, and the volumes of a
+// shared target use the same sessions: without it, unstaging one LUN could log
+// out the session another LUN is being attached over.
+var iscsiTargetLocks sync.Map // map[string]*sync.Mutex
+
+// lockISCSITarget locks the sessions of a target on the given portals and
+// returns the function that unlocks them. Portals are locked in sorted order.
+func lockISCSITarget(targetIQN string, portals []string) func() {
+	keys := make([]string, 0, len(portals))
+	for _, portal := range portals {
+		keys = append(keys, targetIQN+","+portal)
+	}
+	slices.Sort(keys)
+	keys = slices.Compact(keys)
+
+	locked := make([]*sync.Mutex, 0, len(keys))
+	for _, key := range keys {
+		mu, _ := iscsiTargetLocks.LoadOrStore(key, &sync.Mutex{})
+		mu.(*sync.Mutex).Lock()
+		locked = append(locked, mu.(*sync.Mutex))
+	}
+	return func() {
+		for i := len(locked) - 1; i >= 0; i-- {
+			locked[i].Unlock()
+		}
+	}
+}
+
+// disconnectISCSITarget logs out of every portal and deletes the node records.
+// Sessions that still carry LUNs other than lun belong to other volumes of a
+// shared target and stay logged in. Unlike iscsilib.Disconnect it does not stop
+// at the first portal that fails, which would leave multipath sessions behind.
+func disconnectISCSITarget(log logr.Logger, targetIQN string, portals []string, lun int32) {
+	sessions, err := listISCSISessions()
+	if err != nil {
+		log.V(LogLevelDebug).Info("Could not read iSCSI sessions, logging out", "error", err)
+	}
+
+	allLoggedOut := true
+	for _, portal := range portals {
+		if session := findISCSISession(sessions, targetIQN, portal); session != nil {
+			if others := slices.DeleteFunc(session.LUNs(), func(l int) bool { return l == int(lun) }); len(others) > 0 {
+				log.V(LogLevelDebug).Info("Keeping iSCSI session used by other LUNs", "targetIqn", targetIQN, "portal", portal, "luns", others)
+				allLoggedOut = false
+				continue
+			}
+		}
+		host, _, err := net.SplitHostPort(portal)
+		if err != nil {
+			host = portal
+		}
+		if err := iscsilib.Logout(targetIQN, host); err != nil {
+			log.V(LogLevelDebug).Info("iSCSI logout failed", "targetIqn", targetIQN, "portal", portal, "error", err)
+		}
+	}
+	if !allLoggedOut {
+		return
+	}
+	if err := iscsilib.DeleteDBEntry(targetIQN); err != nil {
+		log.V(LogLevelDebug).Info("Failed to delete iSCSI node records", "targetIqn", targetIQN, "error", err)
+	}
+}
+
+// attachSharedLUN makes a LUN of a shared target visible over the sessions the
+// node already has by scanning just that LUN. It returns false when a portal
+// has no session yet or the device does not show up; the caller then logs in.
+func (h *ISCSIHandler) attachSharedLUN(connector *iscsilib.Connector) (string, bool) {
+	sessions, err := listISCSISessions()
+	if err != nil {
+		h.log.V(LogLevelDebug).Info("Could not read iSCSI sessions", "error", err)
+		return "", false
+	}
+
+	var paths []string
+	for _, portal := range connector.TargetPortals {
+		session := findISCSISession(sessions, connector.TargetIqn, portal)
+		if session == nil {
+			return "", false
+		}
+		if err := session.scanLUN(connector.Lun); err != nil {
+			h.log.V(LogLevelDebug).Info("LUN scan failed", "session", session.Name, "error", err)
+			return "", false
+		}
+		paths = append(paths, iscsiByPathDevice(portal, connector.TargetIqn, connector.Lun))
+	}
+	for _, path := range paths {
+		if err := waitForPath(path, iscsiRetryCount, iscsiCheckInterval*time.Second); err != nil {
+			h.log.V(LogLevelDebug).Info("LUN did not appear after scan", "error", err)
+			return "", false
+		}
+	}
+
+	// With several paths, multipathd assembles the map shortly after they appear
+	for i := 0; i < iscsiRetryCount; i++ {
+		devices, err := iscsilib.GetISCSIDevices(paths, true)
+		if err != nil || len(devices) == 0 {
+			h.log.V(LogLevelDebug).Info("Could not resolve scanned LUN devices", "paths", paths, "error", err)
+			return "", false
+		}
+		connector.Devices = devices
+		if len(devices) == 1 {
+			connector.MountTargetDevice = &connector.Devices[0]
+			break
+		}
+		if mpath := multipathChild(connector.Devices); mpath != nil {
+			connector.MountTargetDevice = mpath
+			break
+		}
+		time.Sleep(iscsiCheckInterval * time.Second)
+	}
+	if connector.MountTargetDevice == nil {
+		return "", false
+	}
+
+	h.log.V(LogLevelDebug).Info("Attached LUN on existing iSCSI sessions", "targetIqn", connector.TargetIqn, "lun", connector.Lun, "device", connector.MountTargetDevice.GetPath())
+	return connector.MountTargetDevice.GetPath(), true
+}
+
+// multipathChild returns the dm-multipath device that all path devices map to,
+// or nil if there is none.
+func multipathChild(devices []iscsilib.Device) *iscsilib.Device {
+	var mpath *iscsilib.Device
+	for i := range devices {
+		if len(devices[i].Children) != 1 || devices[i].Children[0].Type != "mpath" {
+			return nil
+		}
+		child := &devices[i].Children[0]
+		if mpath != nil && mpath.Name != child.Name {
+			return nil
+		}
+		mpath = child
+	}
+	return mpath
+}
+
+// mountTargetPath returns the device a staged volume is used through: the
+// dm-multipath device when there is one, otherwise the single path device.
+func mountTargetPath(connector *iscsilib.Connector) string {
+	if connector.MountTargetDevice != nil && connector.MountTargetDevice.Name != "" {
+		return connector.MountTargetDevice.GetPath()
+	}
+	if mpath := multipathChild(connector.Devices); mpath != nil {
+		return mpath.GetPath()
+	}
+	if len(connector.Devices) > 0 {
+		return connector.Devices[0].GetPath()
+	}
+	return ""
 }
 
 // readConnectorDirect reads a connector file without validation
 func (h *ISCSIHandler) readConnectorDirect(path string) *iscsilib.Connector {
-	data, err := os.ReadFile(path)
+	connector, err := readConnectorFile(path)
 	if err != nil {
+		h.log.V(LogLevelDebug).Info("Failed to read connector", "path", path, "error", err)
 		return nil
 	}
+	return connector
+}
 
-	// The connector file is JSON, decode just the fields we need
+// readConnectorFile decodes a connector file. Unlike iscsilib.GetConnectorFromFile
+// it does not require the devices to exist.
+func readConnectorFile(path string) (*iscsilib.Connector, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
 	var connector iscsilib.Connector
 	if err := json.Unmarshal(data, &connector); err != nil {
-		h.log.V(LogLevelDebug).Info("Failed to unmarshal connector", "error", err)
-		return nil
+		return nil, fmt.Errorf("failed to parse connector file %s: %w", path, err)
 	}
-
-	return &connector
+	return &connector, nil
 }
 
 // Publish implements iSCSI volume publishing (bind mount from staging)
@@ -314,25 +588,21 @@ func (h *ISCSIHandler) Publish(ctx context.Context, req *PublishRequest) error {
 
 // publishBlockVolume handles publishing raw block volumes
 func (h *ISCSIHandler) publishBlockVolume(ctx context.Context, req *PublishRequest) error {
-	// Get device path from connector file
-	cpath := connectorPath(req.VolumeID)
+	// Get device path from connector file, or from the staging record without one
+	var devicePath string
+	cpath := connectorPath(h.stateDir, req.VolumeID)
 	connector, err := iscsilib.GetConnectorFromFile(cpath)
-	if err != nil {
+	switch {
+	case err == nil:
+		// Use the multipath device if there is one; /dev/mapper for dm maps
+		devicePath = mountTargetPath(connector)
+	case req.Record != nil:
+		devicePath = req.Record.DevicePath
+	default:
 		return fmt.Errorf("failed to load connector for block volume: %w", err)
 	}
-
-	if len(connector.Devices) == 0 {
-		return fmt.Errorf("no devices found in connector for volume %s", req.VolumeID)
-	}
-
-	// Determine device path
-	var devicePath string
-	if connector.MountTargetDevice != nil && connector.MountTargetDevice.Name != "" {
-		// Use multipath device if available
-		devicePath = fmt.Sprintf("/dev/%s", connector.MountTargetDevice.Name)
-	} else {
-		// Use first device
-		devicePath = fmt.Sprintf("/dev/%s", connector.Devices[0].Name)
+	if devicePath == "" {
+		return fmt.Errorf("no device recorded for block volume %s", req.VolumeID)
 	}
 
 	h.log.V(LogLevelDebug).Info("Publishing block volume", "volumeId", req.VolumeID, "devicePath", devicePath, "targetPath", req.TargetPath)
@@ -396,48 +666,62 @@ func (h *ISCSIHandler) Unpublish(ctx context.Context, req *UnpublishRequest) err
 	return nil
 }
 
-// Expand implements iSCSI volume expansion
+// Expand implements iSCSI volume expansion. Only the SCSI devices and sessions
+// of the volume are rescanned, so unrelated devices on the node are left alone.
 func (h *ISCSIHandler) Expand(ctx context.Context, req *ExpandRequest) (*ExpandResult, error) {
 	h.log.V(LogLevelDebug).Info("iSCSI Expand", "volumeId", req.VolumeID, "volumePath", req.VolumePath)
 
-	// Load connector to get device info
-	cpath := connectorPath(req.VolumeID)
-	connector, err := iscsilib.GetConnectorFromFile(cpath)
+	// Load connector to get device info; the staging record covers a lost file
+	cpath := connectorPath(h.stateDir, req.VolumeID)
+	connector, err := readConnectorFile(cpath)
 	if err != nil {
 		h.log.Info("Failed to load connector for expand", "error", err)
-	}
-
-	if connector != nil {
-		// Rescan the devices to pick up new size
-		for i := range connector.Devices {
-			if err := connector.Devices[i].Rescan(); err != nil {
-				h.log.V(LogLevelTrace).Info("Failed to rescan device", "device", connector.Devices[i].Name, "error", err)
-			}
+		if req.Record == nil {
+			return nil, fmt.Errorf("no connector or staging record for volume %s", req.VolumeID)
 		}
-		// For multipath, resize the multipath device
-		if connector.IsMultipathEnabled() && connector.MountTargetDevice != nil {
-			if err := iscsilib.ResizeMultipathDevice(connector.MountTargetDevice); err != nil {
-				h.log.V(LogLevelTrace).Info("Failed to resize multipath device", "error", err)
-			}
+		connector = &iscsilib.Connector{
+			VolumeName:    req.VolumeID,
+			TargetIqn:     req.Record.Connection.TargetIQN,
+			TargetPortals: req.Record.Connection.TargetPortals,
+			Lun:           req.Record.Connection.LUN,
 		}
 	}
 
-	// Rescan SCSI devices to pick up new size
-	h.rescanSCSIHosts()
+	// Every path must see the new size before the multipath map can grow
+	unlock := lockISCSITarget(connector.TargetIqn, connector.TargetPortals)
+	err = h.rescanVolumePaths(ctx, connector)
+	unlock()
+	if err != nil {
+		return nil, err
+	}
 
-	// Get device path from connector
-	var devicePath string
-	if connector != nil && len(connector.Devices) > 0 {
-		devicePath = fmt.Sprintf("/dev/%s", connector.Devices[0].Name)
-		// Rescan this device specifically
-		rescanPath := fmt.Sprintf("/sys/block/%s/device/rescan", connector.Devices[0].Name)
-		if err := os.WriteFile(rescanPath, []byte("1\n"), 0o200); err != nil {
-			h.log.V(LogLevelTrace).Info("Failed to rescan device", "error", err)
+	// Resize the filesystem on the device it is mounted from, not on a path
+	devicePath := mountTargetPath(connector)
+	if devicePath == "" && req.Record != nil {
+		devicePath = req.Record.DevicePath
+	}
+	if devicePath == "" {
+		return nil, fmt.Errorf("no device recorded for volume %s", req.VolumeID)
+	}
+
+	if mpath := multipathDevice(connector, devicePath); mpath != nil {
+		h.log.V(LogLevelDebug).Info("Reloading multipath map", "device", mpath.GetPath())
+		if err := iscsilib.ResizeMultipathDevice(mpath); err != nil {
+			return nil, fmt.Errorf("failed to resize multipath device %s: %w", mpath.GetPath(), err)
 		}
 	}
 
-	// Resize filesystem
-	if devicePath != "" && req.VolumePath != "" {
+	// Raw block volumes have no filesystem; report the size the device now has
+	if req.Record != nil && req.Record.Block {
+		size, err := blockDeviceSize(devicePath)
+		if err != nil {
+			return nil, err
+		}
+		h.log.V(LogLevelDebug).Info("Block device expanded", "device", devicePath, "sizeBytes", size)
+		return &ExpandResult{CapacityBytes: size}, nil
+	}
+
+	if req.VolumePath != "" {
 		h.log.V(LogLevelDebug).Info("Resizing filesystem", "device", devicePath, "volumePath", req.VolumePath)
 		resized, err := h.resizer.Resize(devicePath, req.VolumePath)
 		if err != nil {
@@ -451,21 +735,51 @@ func (h *ISCSIHandler) Expand(ctx context.Context, req *ExpandRequest) (*ExpandR
 	return &ExpandResult{CapacityBytes: req.CapacityBytes}, nil
 }
 
-// rescanSCSIHosts triggers a rescan of all SCSI hosts
-func (h *ISCSIHandler) rescanSCSIHosts() {
-	hostDir := "/sys/class/scsi_host"
-	entries, err := os.ReadDir(hostDir)
+// rescanVolumePaths rescans the SCSI devices of the volume's LUN on each of its
+// sessions, then the sessions themselves.
+func (h *ISCSIHandler) rescanVolumePaths(ctx context.Context, connector *iscsilib.Connector) error {
+	sessions, err := listISCSISessions()
 	if err != nil {
-		h.log.V(LogLevelTrace).Info("Failed to read SCSI hosts", "error", err)
-		return
+		return err
 	}
 
-	for _, entry := range entries {
-		scanPath := filepath.Join(hostDir, entry.Name(), "scan")
-		if err := os.WriteFile(scanPath, []byte("- - -"), 0o200); err != nil {
-			h.log.V(LogLevelTrace).Info("Failed to scan SCSI host", "host", entry.Name(), "error", err)
+	rescanned := 0
+	for _, portal := range connector.TargetPortals {
+		session := findISCSISession(sessions, connector.TargetIqn, portal)
+		if session == nil {
+			h.log.V(LogLevelDebug).Info("No iSCSI session on portal, skipping rescan", "targetIqn", connector.TargetIqn, "portal", portal)
+			continue
+		}
+		rescanned++
+
+		for _, hctl := range session.lunDevices(connector.Lun) {
+			h.log.V(LogLevelDebug).Info("Rescanning SCSI device", "session", session.Name, "hctl", hctl)
+			if err := rescanSCSIDevice(hctl); err != nil {
+				h.log.Info("Failed to rescan SCSI device", "hctl", hctl, "error", err)
+			}
+		}
+
+		sid := strings.TrimPrefix(session.Name, "session")
+		if out, err := h.mounter.Exec.CommandContext(ctx, "iscsiadm", "-m", "session", "-r", sid, "-R").CombinedOutput(); err != nil {
+			h.log.Info("Failed to rescan iSCSI session", "session", session.Name, "error", err, "output", strings.TrimSpace(string(out)))
 		}
 	}
+	if rescanned == 0 {
+		return fmt.Errorf("no iSCSI session to %s on %s", connector.TargetIqn, strings.Join(connector.TargetPortals, ","))
+	}
+	return nil
+}
+
+// multipathDevice returns the dm-multipath map the volume is mounted from, or
+// nil if it uses a single path.
+func multipathDevice(connector *iscsilib.Connector, devicePath string) *iscsilib.Device {
+	if connector.MountTargetDevice != nil && connector.MountTargetDevice.Type == "mpath" {
+		return connector.MountTargetDevice
+	}
+	if name, ok := strings.CutPrefix(devicePath, "/dev/mapper/"); ok {
+		return &iscsilib.Device{Name: name, Type: "mpath"}
+	}
+	return nil
 }
 
 // sanitizeISCSIVolumeID creates a safe filename from volume ID
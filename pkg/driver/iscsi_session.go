@@ -0,0 +1,267 @@
+package driver
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"k8s.io/mount-utils"
+)
+
+// sysfs directories, variables so tests can point them at a fake tree
+var (
+	iscsiSessionSysfs    = "/sys/class/iscsi_session"
+	iscsiConnectionSysfs = "/sys/class/iscsi_connection"
+	scsiHostSysfs        = "/sys/class/scsi_host"
+	scsiDeviceSysfs      = "/sys/class/scsi_device"
+	blockSysfs           = "/sys/class/block"
+)
+
+// iscsiSession is a logged-in iSCSI session as seen in sysfs.
+type iscsiSession struct {
+	Name      string // sessionN
+	TargetIQN string
+	Address   string
+	Port      string
+	Host      int    // SCSI host the session's LUNs appear on
+	State     string // LOGGED_IN, FAILED or FREE
+}
+
+// listISCSISessions reads the iSCSI sessions of this node from sysfs.
+func listISCSISessions() ([]iscsiSession, error) {
+	entries, err := os.ReadDir(iscsiSessionSysfs)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read iSCSI sessions: %w", err)
+	}
+
+	var sessions []iscsiSession
+	for _, entry := range entries {
+		name := entry.Name()
+		sid, ok := strings.CutPrefix(name, "session")
+		if !ok {
+			continue
+		}
+
+		iqn, err := readSysfsString(filepath.Join(iscsiSessionSysfs, name, "targetname"))
+		if err != nil {
+			continue
+		}
+		session := iscsiSession{Name: name, TargetIQN: iqn, Host: -1}
+		session.State, _ = readSysfsString(filepath.Join(iscsiSessionSysfs, name, "state"))
+
+		// Connections are named connection<sid>:<cid>; sessions from iscsiadm have one
+		if conns, _ := filepath.Glob(filepath.Join(iscsiConnectionSysfs, "connection"+sid+":*")); len(conns) > 0 {
+			session.Address, _ = readSysfsString(filepath.Join(conns[0], "persistent_address"))
+			session.Port, _ = readSysfsString(filepath.Join(conns[0], "persistent_port"))
+		}
+
+		// The session device lives under its SCSI host: .../hostN/sessionM
+		if devPath, err := filepath.EvalSymlinks(filepath.Join(iscsiSessionSysfs, name, "device")); err == nil {
+			if host, ok := strings.CutPrefix(filepath.Base(filepath.Dir(devPath)), "host"); ok {
+				if n, err := strconv.Atoi(host); err == nil {
+					session.Host = n
+				}
+			}
+		}
+
+		sessions = append(sessions, session)
+	}
+	return sessions, nil
+}
+
+// findISCSISession returns the session for a target on a portal (host:port), or nil.
+func findISCSISession(sessions []iscsiSession, targetIQN, portal string) *iscsiSession {
+	host, port, err := net.SplitHostPort(portal)
+	if err != nil {
+		host, port = portal, strconv.Itoa(defaultISCSIPort)
+	}
+	for i := range sessions {
+		if sessions[i].TargetIQN == targetIQN && sessions[i].Address == host && sessions[i].Port == port {
+			return &sessions[i]
+		}
+	}
+	return nil
+}
+
+// LUNs returns the LUN IDs the session currently exposes.
+func (s *iscsiSession) LUNs() []int {
+	// Devices are named host:channel:target:lun under device/target*/
+	matches, _ := filepath.Glob(filepath.Join(iscsiSessionSysfs, s.Name, "device", "target*", "*:*:*:*"))
+	var luns []int
+	for _, match := range matches {
+		fields := strings.Split(filepath.Base(match), ":")
+		if lun, err := strconv.Atoi(fields[len(fields)-1]); err == nil {
+			luns = append(luns, lun)
+		}
+	}
+	return luns
+}
+
+// lunDevices returns the SCSI addresses (host:channel:target:lun) of a LUN on the session.
+func (s *iscsiSession) lunDevices(lun int32) []string {
+	matches, _ := filepath.Glob(filepath.Join(iscsiSessionSysfs, s.Name, "device", "target*", fmt.Sprintf("*:*:*:%d", lun)))
+	var hctls []string
+	for _, match := range matches {
+		hctls = append(hctls, filepath.Base(match))
+	}
+	return hctls
+}
+
+// blockDevices returns the names of the block devices (sdX) of all LUNs on the session.
+func (s *iscsiSession) blockDevices() []string {
+	var names []string
+	for _, lun := range s.LUNs() {
+		for _, hctl := range s.lunDevices(int32(lun)) {
+			entries, _ := os.ReadDir(filepath.Join(scsiDeviceSysfs, hctl, "device", "block"))
+			for _, entry := range entries {
+				names = append(names, entry.Name())
+			}
+		}
+	}
+	return names
+}
+
+// blockDeviceInUse reports whether a block device is mounted, by its device
+// number or its path, or held by another device such as a multipath map.
+func blockDeviceInUse(name string, mounts []mount.MountInfo) bool {
+	if holders, err := os.ReadDir(filepath.Join(blockSysfs, name, "holders")); err == nil && len(holders) > 0 {
+		return true
+	}
+	major, minor := -1, -1
+	if dev, err := readSysfsString(filepath.Join(blockSysfs, name, "dev")); err == nil {
+		if maj, min, ok := strings.Cut(dev, ":"); ok {
+			major, _ = strconv.Atoi(maj)
+			minor, _ = strconv.Atoi(min)
+		}
+	}
+	for _, m := range mounts {
+		if major >= 0 && m.Major == major && m.Minor == minor {
+			return true
+		}
+		if m.Source == "/dev/"+name {
+			return true
+		}
+	}
+	return false
+}
+
+// rescanSCSIDevice makes the kernel re-read the capacity of one SCSI device.
+func rescanSCSIDevice(hctl string) error {
+	if err := os.WriteFile(filepath.Join(scsiDeviceSysfs, hctl, "device", "rescan"), []byte("1"), 0o200); err != nil {
+		return fmt.Errorf("failed to rescan SCSI device %s: %w", hctl, err)
+	}
+	return nil
+}
+
+// blockDeviceSize returns the size of a block device in bytes from sysfs.
+func blockDeviceSize(devicePath string) (int64, error) {
+	resolved, err := filepath.EvalSymlinks(devicePath)
+	if err != nil {
+		return 0, fmt.Errorf("failed to resolve %s: %w", devicePath, err)
+	}
+	sectors, err := readSysfsString(filepath.Join(blockSysfs, filepath.Base(resolved), "size"))
+	if err != nil {
+		return 0, fmt.Errorf("failed to read size of %s: %w", devicePath, err)
+	}
+	n, err := strconv.ParseInt(sectors, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size of %s: %w", devicePath, err)
+	}
+	// sysfs counts 512-byte sectors regardless of the logical block size
+	return n * 512, nil
+}
+
+// scanLUN asks the session's SCSI host to probe a single LUN. With one host per
+// session this finds a newly mapped LUN without rescanning the whole target.
+func (s *iscsiSession) scanLUN(lun int32) error {
+	if s.Host < 0 {
+		return fmt.Errorf("SCSI host of %s is unknown", s.Name)
+	}
+	scanPath := filepath.Join(scsiHostSysfs, fmt.Sprintf("host%d", s.Host), "scan")
+	if err := os.WriteFile(scanPath, []byte(fmt.Sprintf("- - %d", lun)), 0o200); err != nil {
+		return fmt.Errorf("failed to scan LUN %d on host%d: %w", lun, s.Host, err)
+	}
+	return nil
+}
+
+// iscsiByPathDevice returns the udev by-path link of a LUN reached over TCP.
+func iscsiByPathDevice(portal, targetIQN string, lun int32) string {
+	host, port, err := net.SplitHostPort(portal)
+	if err != nil {
+		host, port = portal, strconv.Itoa(defaultISCSIPort)
+	}
+	return fmt.Sprintf("/dev/disk/by-path/ip-%s:%s-iscsi-%s-lun-%d", host, port, targetIQN, lun)
+}
+
+// waitForPath waits until path exists, checking once per interval.
+func waitForPath(path string, attempts int, interval time.Duration) error {
+	for i := 0; ; i++ {
+		if _, err := os.Stat(path); err == nil {
+			return nil
+		} else if i >= attempts-1 {
+			return fmt.Errorf("device %s did not appear: %w", path, err)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// iscsiDeviceConnection returns the iSCSI target and LUN behind a block device,
+// following a multipath map to its paths. The portals are those of the sessions
+// the paths belong to.
+func iscsiDeviceConnection(device string) (StagingConnection, bool) {
+	name := filepath.Base(device)
+	paths := []string{name}
+	if slaves, err := os.ReadDir(filepath.Join(blockSysfs, name, "slaves")); err == nil && len(slaves) > 0 {
+		paths = paths[:0]
+		for _, slave := range slaves {
+			paths = append(paths, slave.Name())
+		}
+	}
+
+	sessions, err := listISCSISessions()
+	if err != nil {
+		return StagingConnection{}, false
+	}
+
+	var conn StagingConnection
+	for _, path := range paths {
+		// SCSI disks live below their session: .../sessionM/targetH:C:T/H:C:T:L
+		devPath, err := filepath.EvalSymlinks(filepath.Join(blockSysfs, path, "device"))
+		if err != nil {
+			continue
+		}
+		fields := strings.Split(filepath.Base(devPath), ":")
+		lun, err := strconv.Atoi(fields[len(fields)-1])
+		if err != nil || len(fields) != 4 {
+			continue
+		}
+		for _, session := range sessions {
+			if !strings.Contains(devPath, "/"+session.Name+"/") {
+				continue
+			}
+			if conn.TargetIQN != "" && conn.TargetIQN != session.TargetIQN {
+				return StagingConnection{}, false
+			}
+			conn.TargetIQN, conn.LUN = session.TargetIQN, int32(lun)
+			if session.Address != "" {
+				conn.TargetPortals = append(conn.TargetPortals, net.JoinHostPort(session.Address, session.Port))
+			}
+		}
+	}
+	return conn, conn.TargetIQN != ""
+}
+
+func readSysfsString(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
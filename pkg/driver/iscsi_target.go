@@ -0,0 +1,229 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/go-logr/logr"
+	"github.com/truenas/truenas-csi/pkg/client"
+	"k8s.io/mount-utils"
+)
+
+func init() {
+	registerProtocol(&protocolDefinition{
+		name:               ProtocolISCSI,
+		block:              true,
+		accessModes:        defaultAccessModes,
+		validateParameters: validateISCSIParameters,
+		newProvisioner: func(s *ControllerServer) ProtocolProvisioner {
+			return &iscsiProvisioner{s: s}
+		},
+		reconstruct: reconstructISCSIVolume,
+		listExports: listISCSIExports,
+		newHandler: func(mounter *mount.SafeFormatAndMount, stateDir string, log logr.Logger) (ProtocolHandler, error) {
+			handler, err := NewISCSIHandler(mounter, stateDir, log)
+			if err != nil {
+				return nil, err
+			}
+			return handler, nil
+		},
+		legacyRecord: legacyISCSIStagingRecord,
+	})
+}
+
+// reconstructISCSIVolume fills in the target and LUN of a zvol exported as an iSCSI extent.
+func reconstructISCSIVolume(ctx context.Context, d *Driver, dataset *client.Dataset, volInfo *VolumeInfo) bool {
+	extent, err := d.client.GetISCSIExtentByDisk(ctx, "zvol/"+volInfo.DatasetPath)
+	if err != nil || extent == nil {
+		return false
+	}
+	volInfo.ISCSIExtentID = extent.ID
+
+	// Find the target-extent association
+	assoc, err := d.client.GetISCSITargetExtentByExtent(ctx, extent.ID)
+	if err == nil && assoc != nil {
+		volInfo.LUN = assoc.LunID
+
+		// Get the target details
+		target, err := d.client.GetISCSITargetByID(ctx, assoc.Target)
+		if err == nil && target != nil {
+			volInfo.ISCSITargetID = target.ID
+			volInfo.ISCSISharedTarget = isSharedISCSITargetName(target.Name)
+			// Construct the full IQN
+			volInfo.TargetIQN = d.iscsiIQNBase + ":" + target.Name
+			volInfo.TargetPortal = d.iscsiPortal
+			volInfo.VolumeContext["targetPortal"] = d.iscsiPortal
+			volInfo.VolumeContext["targetIQN"] = volInfo.TargetIQN
+			volInfo.VolumeContext["lun"] = fmt.Sprintf("%d", volInfo.LUN)
+		}
+	}
+
+	d.log.V(LogLevelDebug).Info("Reconstructed iSCSI volume", "volumeId", volInfo.ID, "capacityBytes", volInfo.CapacityBytes,
+		"targetIQN", volInfo.TargetIQN, "lun", volInfo.LUN)
+	return true
+}
+
+// validateZvolParameters checks the StorageClass parameters of zvol-backed protocols.
+func validateZvolParameters(parameters map[string]string) error {
+	if val, ok := parameters["volblocksize"]; ok {
+		if _, valid := ValidVolBlockSizes[strings.ToUpper(val)]; !valid {
+			return fmt.Errorf("invalid volblocksize: %s (valid: 512, 1K, 2K, 4K, 8K, 16K, 32K, 64K, 128K)", val)
+		}
+	}
+	return nil
+}
+
+// validateISCSIParameters checks the iSCSI StorageClass parameters.
+func validateISCSIParameters(parameters map[string]string) error {
+	if err := validateZvolParameters(parameters); err != nil {
+		return err
+	}
+
+	if val, ok := parameters["iscsi.blocksize"]; ok {
+		bs, err := strconv.Atoi(val)
+		if err != nil {
+			return fmt.Errorf("invalid iscsi.blocksize: %s (valid: 512, 1024, 2048, 4096)", val)
+		}
+		if _, valid := ValidISCSIBlockSizes[bs]; !valid {
+			return fmt.Errorf("invalid iscsi.blocksize: %s (valid: 512, 1024, 2048, 4096)", val)
+		}
+	}
+
+	return validateSharedTargetParameters(parameters)
+}
+
+// iscsiProvisioner exports zvols as LUNs of iSCSI targets.
+type iscsiProvisioner struct {
+	s *ControllerServer
+}
+
+func (p *iscsiProvisioner) CreateVolume(ctx context.Context, volumeID, datasetPath string, capacityBytes int64, parameters map[string]string) (*VolumeInfo, error) {
+	return p.s.createISCSIVolume(ctx, volumeID, datasetPath, capacityBytes, parameters)
+}
+
+func (p *iscsiProvisioner) ExportVolume(ctx context.Context, volumeID, datasetPath string, dataset *client.Dataset, capacityBytes int64, parameters map[string]string) (*VolumeInfo, error) {
+	volInfo, err := p.s.exportISCSIVolume(ctx, volumeID, datasetPath, capacityBytes, parameters)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create iSCSI target: %w", err)
+	}
+	return volInfo, nil
+}
+
+// IsExported reports whether the zvol has an extent attached to a target. An
+// extent without a target is an error, since creating another one would fail.
+func (p *iscsiProvisioner) IsExported(ctx context.Context, datasetPath string, dataset *client.Dataset) (bool, error) {
+	zvolPath := "zvol/" + datasetPath
+	extent, err := p.s.driver.Client().GetISCSIExtentByDisk(ctx, zvolPath)
+	if err != nil {
+		if client.IsNotFoundError(err) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	if _, err := p.s.driver.Client().GetISCSITargetExtentByExtent(ctx, extent.ID); err != nil {
+		if client.IsNotFoundError(err) {
+			return false, fmt.Errorf("iSCSI extent %d for %s is not attached to a target; attach or remove it", extent.ID, zvolPath)
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// listISCSIExports indexes the iSCSI extents by disk and the extents attached
+// to a target.
+func listISCSIExports(ctx context.Context, c *client.Client) (exportLookup, error) {
+	extents, err := c.ListISCSIExtents(ctx)
+	if err != nil {
+		return nil, err
+	}
+	assocs, err := c.ListISCSITargetExtents(ctx)
+	if err != nil {
+		return nil, err
+	}
+	extentIDs := make(map[string]int, len(extents))
+	for _, extent := range extents {
+		if extent.Disk != "" {
+			extentIDs[extent.Disk] = extent.ID
+		}
+	}
+	attached := make(map[int]bool, len(assocs))
+	for _, assoc := range assocs {
+		attached[assoc.Extent] = true
+	}
+	return func(datasetPath string, dataset *client.Dataset) (bool, error) {
+		zvolPath := "zvol/" + datasetPath
+		id, ok := extentIDs[zvolPath]
+		if !ok {
+			return false, nil
+		}
+		if !attached[id] {
+			return false, fmt.Errorf("iSCSI extent %d for %s is not attached to a target; attach or remove it", id, zvolPath)
+		}
+		return true, nil
+	}, nil
+}
+
+// RemoveExport deletes the volume's iSCSI target, extent, auth and initiator
+// group, or only its LUN on a shared target.
+func (p *iscsiProvisioner) RemoveExport(ctx context.Context, datasetPath string, volInfo *VolumeInfo) {
+	if volInfo == nil {
+		return
+	}
+	if volInfo.ISCSISharedTarget {
+		p.s.removeSharedLUN(ctx, volInfo)
+		return
+	}
+
+	deleteOpts := p.s.driver.GetISCSIDeleteOptionsFromParameters(volInfo.VolumeContext)
+
+	targetDeleteOpts := &client.ISCSITargetDeleteOptions{
+		Force:         deleteOpts.ForceDelete,
+		DeleteExtents: deleteOpts.DeleteExtentsWithTarget,
+	}
+	extentDeleteOpts := &client.ISCSIExtentDeleteOptions{
+		Force: deleteOpts.ForceDelete,
+	}
+
+	if volInfo.ISCSITargetID > 0 {
+		if err := p.s.driver.Client().DeleteISCSITarget(ctx, volInfo.ISCSITargetID, targetDeleteOpts); err != nil {
+			p.s.driver.Log().V(LogLevelDebug).Error(err, "Failed to delete iSCSI target", "targetId", volInfo.ISCSITargetID)
+		}
+	}
+	if volInfo.ISCSIExtentID > 0 && !deleteOpts.DeleteExtentsWithTarget {
+		if err := p.s.driver.Client().DeleteISCSIExtent(ctx, volInfo.ISCSIExtentID, extentDeleteOpts); err != nil {
+			p.s.driver.Log().V(LogLevelDebug).Error(err, "Failed to delete iSCSI extent", "extentId", volInfo.ISCSIExtentID)
+		}
+	}
+	if volInfo.ISCSIAuthID > 0 {
+		if err := p.s.driver.Client().DeleteISCSIAuth(ctx, volInfo.ISCSIAuthID); err != nil {
+			p.s.driver.Log().V(LogLevelDebug).Error(err, "Failed to delete iSCSI auth", "authId", volInfo.ISCSIAuthID)
+		}
+	}
+	if volInfo.ISCSIInitiatorID > 0 {
+		if err := p.s.driver.Client().DeleteISCSIInitiator(ctx, volInfo.ISCSIInitiatorID); err != nil {
+			p.s.driver.Log().V(LogLevelDebug).Error(err, "Failed to delete iSCSI initiator", "initiatorId", volInfo.ISCSIInitiatorID)
+		}
+	}
+}
+
+// PublishContext returns the portals, IQN and LUN of the volume.
+// (reconstructVolumeFromTrueNAS may return volInfo with empty TargetIQN if extent lookup failed)
+func (p *iscsiProvisioner) PublishContext(ctx context.Context, volInfo *VolumeInfo, volumeContext map[string]string) (map[string]string, bool) {
+	if volInfo.TargetIQN == "" {
+		return nil, false
+	}
+
+	// StorageClass overrides are in the volume context; reconstructed volume info
+	// only knows the driver-wide portal
+	portal := p.s.driver.GetISCSIPortalFromParameters(volumeContext)
+	return map[string]string{
+		PublishContextProtocol:      ProtocolISCSI,
+		PublishContextTargetPortal:  portal,
+		PublishContextTargetPortals: strings.Join(p.s.driver.iscsiTargetPortals(ctx, volInfo.ISCSITargetID, portal), ","),
+		PublishContextTargetIQN:     volInfo.TargetIQN,
+		PublishContextLUN:           fmt.Sprintf("%d", volInfo.LUN),
+	}, true
+}
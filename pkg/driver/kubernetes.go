@@ -0,0 +1,324 @@
+package driver
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// serviceAccountDir is where Kubernetes mounts the pod's service account credentials
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// kubeRequestTimeout bounds a single Kubernetes API request
+const kubeRequestTimeout = 30 * time.Second
+
+var (
+	errKubeNotFound      = errors.New("kubernetes object not found")
+	errKubeAlreadyExists = errors.New("kubernetes object already exists")
+)
+
+// kubeClient is a minimal Kubernetes API client for the few objects the
+// controller manages itself. It authenticates with the pod's service account.
+type kubeClient struct {
+	baseURL   string
+	tokenFile string
+	http      *http.Client
+}
+
+// newInClusterKubeClient creates a client for the cluster the pod runs in.
+func newInClusterKubeClient() (*kubeClient, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.New("not running in a Kubernetes cluster (KUBERNETES_SERVICE_HOST is not set)")
+	}
+
+	ca, err := os.ReadFile(filepath.Join(serviceAccountDir, "ca.crt"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read service account CA: %w", err)
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(ca) {
+		return nil, errors.New("service account CA contains no certificates")
+	}
+
+	return &kubeClient{
+		baseURL:   "https://" + net.JoinHostPort(host, port),
+		tokenFile: filepath.Join(serviceAccountDir, "token"),
+		http: &http.Client{
+			Timeout: kubeRequestTimeout,
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{RootCAs: roots, MinVersion: tls.VersionTLS12},
+			},
+		},
+	}, nil
+}
+
+// do sends a request to the API server and decodes the response into out.
+func (k *kubeClient) do(ctx context.Context, method, path string, body, out any) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return fmt.Errorf("failed to encode request: %w", err)
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, k.baseURL+path, reader)
+	if err != nil {
+		return err
+	}
+	// Projected service account tokens are rotated, so the token is read every time
+	token, err := os.ReadFile(k.tokenFile)
+	if err != nil {
+		return fmt.Errorf("failed to read service account token: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	req.Header.Set("Accept", "application/json")
+	switch {
+	case method == http.MethodPatch:
+		req.Header.Set("Content-Type", "application/merge-patch+json")
+	case body != nil:
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := k.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return fmt.Errorf("%s %s: %w", method, path, errKubeNotFound)
+	case resp.StatusCode == http.StatusConflict:
+		return fmt.Errorf("%s %s: %w", method, path, errKubeAlreadyExists)
+	case resp.StatusCode >= 300:
+		var apiStatus struct {
+			Message string `json:"message"`
+		}
+		if json.Unmarshal(data, &apiStatus) == nil && apiStatus.Message != "" {
+			return fmt.Errorf("%s %s: %s (%d)", method, path, apiStatus.Message, resp.StatusCode)
+		}
+		return fmt.Errorf("%s %s: %s", method, path, resp.Status)
+	}
+
+	if out != nil {
+		if err := json.Unmarshal(data, out); err != nil {
+			return fmt.Errorf("failed to decode %s %s: %w", method, path, err)
+		}
+	}
+	return nil
+}
+
+// kubeObjectMeta is the part of object metadata the controller uses
+type kubeObjectMeta struct {
+	Name        string            `json:"name"`
+	Namespace   string            `json:"namespace,omitempty"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// kubeObjectRef refers to a namespaced object
+type kubeObjectRef struct {
+	Name      string `json:"name"`
+	Namespace string `json:"namespace"`
+}
+
+// kubePersistentVolume is a PersistentVolume with the fields that tie it to a CSI volume and its claim
+type kubePersistentVolume struct {
+	Metadata kubeObjectMeta `json:"metadata"`
+	Spec     struct {
+		CSI *struct {
+			Driver           string            `json:"driver"`
+			VolumeHandle     string            `json:"volumeHandle"`
+			VolumeAttributes map[string]string `json:"volumeAttributes,omitempty"`
+		} `json:"csi,omitempty"`
+		ClaimRef   *kubeObjectRef `json:"claimRef,omitempty"`
+		VolumeMode string         `json:"volumeMode,omitempty"`
+	} `json:"spec"`
+}
+
+// kubePersistentVolumeClaim is a PersistentVolumeClaim with the name of its volume
+type kubePersistentVolumeClaim struct {
+	Metadata kubeObjectMeta `json:"metadata"`
+	Spec     struct {
+		VolumeName string `json:"volumeName"`
+	} `json:"spec"`
+}
+
+// kubeVolumeAttachment is a storage.k8s.io/v1 VolumeAttachment
+type kubeVolumeAttachment struct {
+	Metadata kubeObjectMeta `json:"metadata"`
+	Spec     struct {
+		Attacher string `json:"attacher"`
+		NodeName string `json:"nodeName"`
+		Source   struct {
+			PersistentVolumeName string `json:"persistentVolumeName"`
+		} `json:"source"`
+	} `json:"spec"`
+}
+
+// kubeVolumeSnapshotContent is a pre-provisioned snapshot.storage.k8s.io/v1 VolumeSnapshotContent
+type kubeVolumeSnapshotContent struct {
+	APIVersion string         `json:"apiVersion"`
+	Kind       string         `json:"kind"`
+	Metadata   kubeObjectMeta `json:"metadata"`
+	Spec       struct {
+		Driver         string `json:"driver"`
+		DeletionPolicy string `json:"deletionPolicy"`
+		Source         struct {
+			SnapshotHandle string `json:"snapshotHandle"`
+		} `json:"source"`
+		SourceVolumeMode  string        `json:"sourceVolumeMode,omitempty"`
+		VolumeSnapshotRef kubeObjectRef `json:"volumeSnapshotRef"`
+	} `json:"spec"`
+	Status *struct {
+		SnapshotHandle string `json:"snapshotHandle,omitempty"`
+	} `json:"status,omitempty"`
+}
+
+// kubeVolumeSnapshot is a snapshot.storage.k8s.io/v1 VolumeSnapshot bound to a pre-provisioned content
+type kubeVolumeSnapshot struct {
+	APIVersion string         `json:"apiVersion"`
+	Kind       string         `json:"kind"`
+	Metadata   kubeObjectMeta `json:"metadata"`
+	Spec       struct {
+		Source struct {
+			VolumeSnapshotContentName string `json:"volumeSnapshotContentName,omitempty"`
+		} `json:"source"`
+	} `json:"spec"`
+	Status *struct {
+		BoundVolumeSnapshotContentName string `json:"boundVolumeSnapshotContentName,omitempty"`
+	} `json:"status,omitempty"`
+}
+
+const snapshotAPIPath = "/apis/snapshot.storage.k8s.io/v1"
+
+// kubeListLimit is how many objects a list request returns per page
+const kubeListLimit = 500
+
+// kubeList returns all objects of a collection, following the continue token
+// of each page so large clusters are not listed in one response.
+func kubeList[T any](ctx context.Context, k *kubeClient, path string, query url.Values) ([]T, error) {
+	if query == nil {
+		query = url.Values{}
+	}
+	query.Set("limit", strconv.Itoa(kubeListLimit))
+
+	var items []T
+	for {
+		var list struct {
+			Metadata struct {
+				Continue string `json:"continue"`
+			} `json:"metadata"`
+			Items []T `json:"items"`
+		}
+		if err := k.do(ctx, http.MethodGet, path+"?"+query.Encode(), nil, &list); err != nil {
+			return nil, err
+		}
+		items = append(items, list.Items...)
+		if list.Metadata.Continue == "" {
+			return items, nil
+		}
+		query.Set("continue", list.Metadata.Continue)
+	}
+}
+
+// listPersistentVolumes returns all PersistentVolumes
+func (k *kubeClient) listPersistentVolumes(ctx context.Context) ([]kubePersistentVolume, error) {
+	return kubeList[kubePersistentVolume](ctx, k, "/api/v1/persistentvolumes", nil)
+}
+
+// listVolumeSnapshotContents returns the VolumeSnapshotContents matching a label selector
+func (k *kubeClient) listVolumeSnapshotContents(ctx context.Context, selector string) ([]kubeVolumeSnapshotContent, error) {
+	query := url.Values{"labelSelector": {selector}}
+	return kubeList[kubeVolumeSnapshotContent](ctx, k, snapshotAPIPath+"/volumesnapshotcontents", query)
+}
+
+// createVolumeSnapshotContent creates a cluster-scoped VolumeSnapshotContent
+func (k *kubeClient) createVolumeSnapshotContent(ctx context.Context, content *kubeVolumeSnapshotContent) error {
+	content.APIVersion, content.Kind = "snapshot.storage.k8s.io/v1", "VolumeSnapshotContent"
+	return k.do(ctx, http.MethodPost, snapshotAPIPath+"/volumesnapshotcontents", content, nil)
+}
+
+// createVolumeSnapshot creates a VolumeSnapshot in its namespace
+func (k *kubeClient) createVolumeSnapshot(ctx context.Context, snapshot *kubeVolumeSnapshot) error {
+	snapshot.APIVersion, snapshot.Kind = "snapshot.storage.k8s.io/v1", "VolumeSnapshot"
+	path := fmt.Sprintf("%s/namespaces/%s/volumesnapshots", snapshotAPIPath, url.PathEscape(snapshot.Metadata.Namespace))
+	return k.do(ctx, http.MethodPost, path, snapshot, nil)
+}
+
+// deleteVolumeSnapshot deletes a VolumeSnapshot
+func (k *kubeClient) deleteVolumeSnapshot(ctx context.Context, namespace, name string) error {
+	path := fmt.Sprintf("%s/namespaces/%s/volumesnapshots/%s", snapshotAPIPath, url.PathEscape(namespace), url.PathEscape(name))
+	return k.do(ctx, http.MethodDelete, path, nil, nil)
+}
+
+// deleteVolumeSnapshotContent deletes a VolumeSnapshotContent
+func (k *kubeClient) deleteVolumeSnapshotContent(ctx context.Context, name string) error {
+	return k.do(ctx, http.MethodDelete, snapshotAPIPath+"/volumesnapshotcontents/"+url.PathEscape(name), nil, nil)
+}
+
+// getPersistentVolume returns a PersistentVolume by name
+func (k *kubeClient) getPersistentVolume(ctx context.Context, name string) (*kubePersistentVolume, error) {
+	var pv kubePersistentVolume
+	if err := k.do(ctx, http.MethodGet, "/api/v1/persistentvolumes/"+url.PathEscape(name), nil, &pv); err != nil {
+		return nil, err
+	}
+	return &pv, nil
+}
+
+// listPersistentVolumeClaims returns the PersistentVolumeClaims of all namespaces
+func (k *kubeClient) listPersistentVolumeClaims(ctx context.Context) ([]kubePersistentVolumeClaim, error) {
+	return kubeList[kubePersistentVolumeClaim](ctx, k, "/api/v1/persistentvolumeclaims", nil)
+}
+
+// annotatePersistentVolumeClaim sets annotations of a PersistentVolumeClaim.
+// A nil value removes the annotation.
+func (k *kubeClient) annotatePersistentVolumeClaim(ctx context.Context, namespace, name string, annotations map[string]*string) error {
+	patch := map[string]any{"metadata": map[string]any{"annotations": annotations}}
+	path := fmt.Sprintf("/api/v1/namespaces/%s/persistentvolumeclaims/%s", url.PathEscape(namespace), url.PathEscape(name))
+	return k.do(ctx, http.MethodPatch, path, patch, nil)
+}
+
+// listVolumeAttachments returns all VolumeAttachments
+func (k *kubeClient) listVolumeAttachments(ctx context.Context) ([]kubeVolumeAttachment, error) {
+	return kubeList[kubeVolumeAttachment](ctx, k, "/apis/storage.k8s.io/v1/volumeattachments", nil)
+}
+
+// getVolumeSnapshot returns a VolumeSnapshot
+func (k *kubeClient) getVolumeSnapshot(ctx context.Context, namespace, name string) (*kubeVolumeSnapshot, error) {
+	var snapshot kubeVolumeSnapshot
+	path := fmt.Sprintf("%s/namespaces/%s/volumesnapshots/%s", snapshotAPIPath, url.PathEscape(namespace), url.PathEscape(name))
+	if err := k.do(ctx, http.MethodGet, path, nil, &snapshot); err != nil {
+		return nil, err
+	}
+	return &snapshot, nil
+}
+
+// getVolumeSnapshotContent returns a VolumeSnapshotContent
+func (k *kubeClient) getVolumeSnapshotContent(ctx context.Context, name string) (*kubeVolumeSnapshotContent, error) {
+	var content kubeVolumeSnapshotContent
+	if err := k.do(ctx, http.MethodGet, snapshotAPIPath+"/volumesnapshotcontents/"+url.PathEscape(name), nil, &content); err != nil {
+		return nil, err
+	}
+	return &content, nil
+}
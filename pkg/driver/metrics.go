@@ -0,0 +1,83 @@
+package driver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// metricsRegistry holds the driver's metrics, served on the metrics address
+var metricsRegistry = prometheus.NewRegistry()
+
+// Node reconciliation metrics
+var (
+	nodeReconcileRuns = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "truenas_csi_node_reconcile_runs_total",
+		Help: "Number of node reconciliation passes.",
+	})
+	nodeReconcileLastRun = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "truenas_csi_node_reconcile_last_run_timestamp_seconds",
+		Help: "Time the last node reconciliation pass finished.",
+	})
+	nodeReconcileDecisions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "truenas_csi_node_reconcile_decisions_total",
+		Help: "Node reconciliation decisions by action (keep, logout, relogin, remove) and result.",
+	}, []string{"action", "result"})
+	nodeISCSISessions = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "truenas_csi_node_iscsi_sessions",
+		Help: "iSCSI sessions to driver targets seen by the last reconciliation, by whether a staged volume owns them.",
+	}, []string{"state"})
+	nodeStagedVolumes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "truenas_csi_node_staged_volumes",
+		Help: "Volumes with a staging record seen by the last reconciliation, by protocol.",
+	}, []string{"protocol"})
+)
+
+func init() {
+	metricsRegistry.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+		nodeReconcileRuns,
+		nodeReconcileLastRun,
+		nodeReconcileDecisions,
+		nodeISCSISessions,
+		nodeStagedVolumes,
+	)
+}
+
+// serveMetrics serves /metrics on the listener until ctx is done
+func (d *Driver) serveMetrics(ctx context.Context, listener net.Listener) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{}))
+	server := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), GracefulShutdownTimeout)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+
+	d.log.Info("Serving metrics", "address", listener.Addr().String())
+	if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		d.log.Error(err, "Metrics server failed")
+	}
+}
+
+// listenMetrics opens the metrics listener, so a bad address fails startup
+func listenMetrics(addr string) (net.Listener, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on metrics address %s: %w", addr, err)
+	}
+	return listener, nil
+}
@@ -0,0 +1,241 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/truenas/truenas-csi/pkg/client"
+)
+
+// User properties set by democratic-csi on the datasets it provisions.
+const (
+	democraticPropVolumeName   = "democratic-csi:csi_volume_name"
+	democraticPropManaged      = "democratic-csi:managed_resource"
+	democraticPropProvisioned  = "democratic-csi:provision_success"
+	democraticPropDriver       = "democratic-csi:volume_context_provisioner_driver"
+	democraticPropNFSShareID   = "democratic-csi:freenas_nfs_share_id"
+	democraticPropISCSITarget  = "democratic-csi:freenas_iscsi_target_id"
+	democraticPropISCSIExtent  = "democratic-csi:freenas_iscsi_extent_id"
+	democraticPropSnapshotName = "democratic-csi:csi_snapshot_name"
+
+	// migratedFromDemocraticCSI is the PropertyMigratedFrom value for migrated volumes.
+	migratedFromDemocraticCSI = "democratic-csi"
+)
+
+// MigrationOptions controls a migration from democratic-csi.
+type MigrationOptions struct {
+	// Pools restricts the scan; all pools are scanned when empty.
+	Pools []string
+	// Apply updates TrueNAS; otherwise the migration is only planned.
+	Apply bool
+	// Adopt lets DeleteVolume destroy migrated datasets, as democratic-csi did.
+	Adopt bool
+}
+
+// MigrationResult describes one democratic-csi volume and how it maps to this driver.
+type MigrationResult struct {
+	PVName      string
+	DatasetPath string
+	Volume      *VolumeInfo
+	// Actions lists the changes made (or planned) on TrueNAS.
+	Actions []string
+	// Warnings lists problems that need attention before the volume is used.
+	Warnings []string
+	// Skipped is set when the dataset cannot be migrated; Warnings says why.
+	Skipped bool
+}
+
+// MigrateFromDemocraticCSI finds datasets provisioned by democratic-csi and maps them,
+// along with their NFS shares or iSCSI targets, to this driver's naming and metadata.
+// The returned volumes can be written out as static PersistentVolumes. With Apply,
+// it stops at the first change TrueNAS rejects and returns the results so far.
+func (d *Driver) MigrateFromDemocraticCSI(ctx context.Context, opts *MigrationOptions) ([]MigrationResult, error) {
+	pools := opts.Pools
+	if len(pools) == 0 {
+		all, err := d.client.ListPools(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, pool := range all {
+			pools = append(pools, pool.Name)
+		}
+	}
+
+	var results []MigrationResult
+	for _, pool := range pools {
+		datasets, err := d.client.ListDatasets(ctx, pool)
+		if err != nil {
+			return nil, err
+		}
+
+		for i := range datasets {
+			dataset := &datasets[i]
+			pvName := dataset.UserProperties[democraticPropVolumeName]
+			if pvName == "" || dataset.UserProperties[democraticPropSnapshotName] != "" {
+				continue
+			}
+			if dataset.UserProperties[democraticPropManaged] != "true" {
+				continue
+			}
+
+			result, err := d.migrateDemocraticVolume(ctx, dataset, pvName, opts)
+			results = append(results, result)
+			if err != nil {
+				return results, fmt.Errorf("failed to migrate %s: %w", dataset.Name, err)
+			}
+		}
+	}
+
+	return results, nil
+}
+
+// migrateDemocraticVolume maps a single democratic-csi dataset.
+func (d *Driver) migrateDemocraticVolume(ctx context.Context, dataset *client.Dataset, pvName string, opts *MigrationOptions) (MigrationResult, error) {
+	result := MigrationResult{
+		PVName:      pvName,
+		DatasetPath: dataset.Name,
+	}
+
+	if dataset.UserProperties[democraticPropProvisioned] != "true" {
+		result.Skipped = true
+		result.Warnings = append(result.Warnings, "democratic-csi never finished provisioning this volume")
+		return result, nil
+	}
+
+	driverName := dataset.UserProperties[democraticPropDriver]
+	if strings.Contains(driverName, "smb") {
+		result.Skipped = true
+		result.Warnings = append(result.Warnings, fmt.Sprintf("democratic-csi driver %q is not supported", driverName))
+		return result, nil
+	}
+
+	volumeID := dataset.Name
+	volInfo := &VolumeInfo{
+		ID:          volumeID,
+		Name:        volumeID,
+		DatasetPath: dataset.Name,
+		PoolName:    client.ExtractPoolFromPath(dataset.Name),
+	}
+
+	var exportFound bool
+	switch dataset.Type {
+	case "VOLUME":
+		volInfo.Protocol = ProtocolISCSI
+		volInfo.CapacityBytes = dataset.Volsize
+		var err error
+		exportFound, err = d.mapDemocraticISCSI(ctx, dataset, volumeID, opts, &result)
+		if err != nil {
+			return result, err
+		}
+	case "FILESYSTEM":
+		volInfo.Protocol = ProtocolNFS
+		volInfo.CapacityBytes = dataset.RefQuota
+		exportFound = d.mapDemocraticNFS(ctx, dataset, &result)
+	default:
+		result.Skipped = true
+		result.Warnings = append(result.Warnings, fmt.Sprintf("unsupported dataset type %q", dataset.Type))
+		return result, nil
+	}
+	if result.Skipped {
+		return result, nil
+	}
+
+	// Record the migration with the same metadata static provisioning uses
+	updates := []client.UserPropertyUpdate{
+		{Key: PropertyImported, Value: "true"},
+		{Key: PropertyMigratedFrom, Value: migratedFromDemocraticCSI},
+	}
+	if opts.Adopt {
+		updates = append(updates, client.UserPropertyUpdate{Key: PropertyAdopted, Value: "true"})
+	}
+	if exportFound {
+		updates = append(updates, client.UserPropertyUpdate{Key: PropertyExportManaged, Value: "true"})
+	}
+	for _, u := range updates {
+		result.Actions = append(result.Actions, fmt.Sprintf("set %s=%s", u.Key, u.Value))
+	}
+	if opts.Apply {
+		err := d.client.UpdateDataset(ctx, dataset.Name, &client.DatasetUpdateOptions{UserPropertiesUpdate: updates})
+		if err != nil {
+			return result, fmt.Errorf("failed to record migration: %w", err)
+		}
+	}
+
+	volInfo.VolumeContext = map[string]string{
+		volumeContextImported: "true",
+		volumeContextAdopt:    strconv.FormatBool(opts.Adopt),
+		"protocol":            volInfo.Protocol,
+	}
+	result.Volume = volInfo
+	return result, nil
+}
+
+// mapDemocraticNFS locates the NFS share of a democratic-csi filesystem dataset.
+// Shares are looked up by path, so no renaming is needed.
+func (d *Driver) mapDemocraticNFS(ctx context.Context, dataset *client.Dataset, result *MigrationResult) bool {
+	mountpoint := dataset.Mountpoint
+	if mountpoint == "" {
+		mountpoint = filepath.Join(DefaultMountpoint, dataset.Name)
+	}
+
+	if share, err := d.client.GetNFSShareByPath(ctx, mountpoint); err == nil {
+		if idStr := dataset.UserProperties[democraticPropNFSShareID]; idStr != "" && idStr != strconv.Itoa(share.ID) {
+			result.Warnings = append(result.Warnings, fmt.Sprintf("NFS share for %s is %d, democratic-csi recorded %s", mountpoint, share.ID, idStr))
+		}
+		return true
+	}
+
+	result.Warnings = append(result.Warnings, fmt.Sprintf("no NFS share for %s; it will be created on first publish", mountpoint))
+	return false
+}
+
+// mapDemocraticISCSI locates the iSCSI target and extent of a democratic-csi zvol
+// and renames them to this driver's naming scheme. Returns whether an export was found.
+func (d *Driver) mapDemocraticISCSI(ctx context.Context, dataset *client.Dataset, volumeID string, opts *MigrationOptions, result *MigrationResult) (bool, error) {
+	zvolPath := "zvol/" + dataset.Name
+	extent, err := d.client.GetISCSIExtentByDisk(ctx, zvolPath)
+	if err != nil {
+		result.Warnings = append(result.Warnings, fmt.Sprintf("no iSCSI extent for %s; a target will be created on first publish", zvolPath))
+		return false, nil
+	}
+	if idStr := dataset.UserProperties[democraticPropISCSIExtent]; idStr != "" && idStr != strconv.Itoa(extent.ID) {
+		result.Warnings = append(result.Warnings, fmt.Sprintf("iSCSI extent for %s is %d, democratic-csi recorded %s", zvolPath, extent.ID, idStr))
+	}
+
+	assoc, err := d.client.GetISCSITargetExtentByExtent(ctx, extent.ID)
+	if err != nil {
+		result.Skipped = true
+		result.Warnings = append(result.Warnings, fmt.Sprintf("iSCSI extent %d is not attached to a target", extent.ID))
+		return false, nil
+	}
+	target, err := d.client.GetISCSITargetByID(ctx, assoc.Target)
+	if err != nil {
+		result.Skipped = true
+		result.Warnings = append(result.Warnings, fmt.Sprintf("iSCSI target %d not found: %v", assoc.Target, err))
+		return false, nil
+	}
+	if idStr := dataset.UserProperties[democraticPropISCSITarget]; idStr != "" && idStr != strconv.Itoa(target.ID) {
+		result.Warnings = append(result.Warnings, fmt.Sprintf("iSCSI target for %s is %d, democratic-csi recorded %s", zvolPath, target.ID, idStr))
+	}
+	if name := makeISCSITargetSuffix(volumeID); target.Name != name {
+		result.Actions = append(result.Actions, fmt.Sprintf("rename iSCSI target %q to %q (IQN changes; nodes must log in again)", target.Name, name))
+		if opts.Apply {
+			if _, err := d.client.UpdateISCSITarget(ctx, target.ID, &client.ISCSITargetUpdateOptions{Name: name}); err != nil {
+				return true, fmt.Errorf("failed to rename iSCSI target: %w", err)
+			}
+		}
+	}
+	if name := makeISCSIExtentName(volumeID); extent.Name != name {
+		result.Actions = append(result.Actions, fmt.Sprintf("rename iSCSI extent %q to %q", extent.Name, name))
+		if opts.Apply {
+			if _, err := d.client.UpdateISCSIExtent(ctx, extent.ID, &client.ISCSIExtentUpdateOptions{Name: name}); err != nil {
+				return true, fmt.Errorf("failed to rename iSCSI extent: %w", err)
+			}
+		}
+	}
+
+	return true, nil
+}
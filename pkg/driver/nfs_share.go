@@ -0,0 +1,173 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/truenas/truenas-csi/pkg/client"
+	"k8s.io/mount-utils"
+)
+
+func init() {
+	registerProtocol(&protocolDefinition{
+		name:               ProtocolNFS,
+		accessModes:        defaultAccessModes,
+		validateParameters: validateNFSParameters,
+		newProvisioner: func(s *ControllerServer) ProtocolProvisioner {
+			return &nfsProvisioner{s: s}
+		},
+		reconstruct: reconstructNFSVolume,
+		listExports: listNFSExports,
+		newHandler: func(mounter *mount.SafeFormatAndMount, stateDir string, log logr.Logger) (ProtocolHandler, error) {
+			return NewNFSHandler(mounter, log), nil
+		},
+	})
+}
+
+// reconstructNFSVolume fills in the export path of a filesystem dataset and
+// reports whether it has an NFS share. As the default protocol for
+// filesystems, NFS also describes datasets without any share.
+func reconstructNFSVolume(ctx context.Context, d *Driver, dataset *client.Dataset, volInfo *VolumeInfo) bool {
+	volInfo.NFSPath = dataset.Mountpoint
+	if d.nfsServer != "" {
+		volInfo.VolumeContext["nfsServer"] = d.nfsServer
+	}
+	volInfo.VolumeContext["nfsPath"] = dataset.Mountpoint
+
+	if _, err := d.client.GetNFSShareByPath(ctx, datasetMountpoint(volInfo.DatasetPath, dataset)); err != nil {
+		return false
+	}
+	d.log.V(LogLevelDebug).Info("Reconstructed NFS volume", "volumeId", volInfo.ID, "capacityBytes", volInfo.CapacityBytes, "path", dataset.Mountpoint)
+	return true
+}
+
+// validateNFSParameters checks the NFS StorageClass parameters.
+func validateNFSParameters(parameters map[string]string) error {
+	if mode, ok := parameters["nfs.datasetPermissionsMode"]; ok && mode != "" {
+		if len(mode) != 4 || mode[0] != '0' {
+			return fmt.Errorf("invalid nfs.datasetPermissionsMode: %s (must be octal string e.g. 0777, 0755)", mode)
+		}
+		for _, c := range mode[1:] {
+			if c < '0' || c > '7' {
+				return fmt.Errorf("invalid nfs.datasetPermissionsMode: %s (must be octal)", mode)
+			}
+		}
+	}
+	if val, ok := parameters["nfs.datasetPermissionsUser"]; ok && val != "" {
+		if _, err := strconv.Atoi(val); err != nil {
+			return fmt.Errorf("invalid nfs.datasetPermissionsUser: %s (must be numeric)", val)
+		}
+	}
+	if val, ok := parameters["nfs.datasetPermissionsGroup"]; ok && val != "" {
+		if _, err := strconv.Atoi(val); err != nil {
+			return fmt.Errorf("invalid nfs.datasetPermissionsGroup: %s (must be numeric)", val)
+		}
+	}
+	return nil
+}
+
+// nfsProvisioner exports filesystem datasets as NFS shares.
+type nfsProvisioner struct {
+	s *ControllerServer
+}
+
+func (p *nfsProvisioner) CreateVolume(ctx context.Context, volumeID, datasetPath string, capacityBytes int64, parameters map[string]string) (*VolumeInfo, error) {
+	return p.s.createNFSVolume(ctx, volumeID, datasetPath, capacityBytes, parameters)
+}
+
+func (p *nfsProvisioner) ExportVolume(ctx context.Context, volumeID, datasetPath string, dataset *client.Dataset, capacityBytes int64, parameters map[string]string) (*VolumeInfo, error) {
+	volInfo, err := p.s.exportNFSVolume(ctx, volumeID, datasetPath, dataset, parameters)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create NFS share: %w", err)
+	}
+	return volInfo, nil
+}
+
+func (p *nfsProvisioner) IsExported(ctx context.Context, datasetPath string, dataset *client.Dataset) (bool, error) {
+	if _, err := p.s.driver.Client().GetNFSShareByPath(ctx, datasetMountpoint(datasetPath, dataset)); err != nil {
+		if client.IsNotFoundError(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// listNFSExports indexes the NFS shares by path.
+func listNFSExports(ctx context.Context, c *client.Client) (exportLookup, error) {
+	shares, err := c.ListNFSShares(ctx)
+	if err != nil {
+		return nil, err
+	}
+	paths := make(map[string]bool, len(shares))
+	for _, share := range shares {
+		paths[share.Path] = true
+	}
+	return func(datasetPath string, dataset *client.Dataset) (bool, error) {
+		return paths[datasetMountpoint(datasetPath, dataset)], nil
+	}, nil
+}
+
+// RemoveExport deletes the NFS share by its recorded ID or, if none was
+// recorded, by the dataset's mountpoint.
+func (p *nfsProvisioner) RemoveExport(ctx context.Context, datasetPath string, volInfo *VolumeInfo) {
+	share, err := p.s.findNFSShare(ctx, datasetPath, volInfo)
+	if err != nil || share == nil {
+		return
+	}
+
+	p.s.driver.Log().V(LogLevelDebug).Info("Deleting NFS share before dataset", "shareId", share.ID, "path", share.Path)
+	if err := p.s.driver.Client().DeleteNFSShare(ctx, share.ID); err != nil {
+		p.s.driver.Log().V(LogLevelDebug).Error(err, "Failed to delete NFS share", "shareId", share.ID)
+		return
+	}
+	// Allow NFS server time to release client state before dataset deletion
+	// Similar to csi-driver-nfs's timeout-based cleanup approach
+	time.Sleep(nfsShareCleanupDelay)
+}
+
+// findNFSShare returns the NFS share of a volume, by the share ID of volInfo if
+// set and otherwise by the mountpoint of the dataset, which imported and
+// adopted datasets may have outside DefaultMountpoint.
+func (s *ControllerServer) findNFSShare(ctx context.Context, datasetPath string, volInfo *VolumeInfo) (*client.NFSShare, error) {
+	if volInfo != nil && volInfo.NFSShareID != 0 {
+		share, err := s.driver.Client().GetNFSShare(ctx, volInfo.NFSShareID)
+		if err == nil {
+			return share, nil
+		}
+		if !client.IsNotFoundError(err) {
+			return nil, err
+		}
+	}
+
+	dataset, err := s.driver.Client().GetDataset(ctx, datasetPath)
+	if err != nil {
+		s.driver.Log().V(LogLevelDebug).Info("Failed to get dataset, looking up NFS share by default mountpoint", "dataset", datasetPath, "error", err)
+		dataset = nil
+	}
+	return s.driver.Client().GetNFSShareByPath(ctx, datasetMountpoint(datasetPath, dataset))
+}
+
+func (p *nfsProvisioner) PublishContext(ctx context.Context, volInfo *VolumeInfo, volumeContext map[string]string) (map[string]string, bool) {
+	if volInfo.NFSPath == "" {
+		return nil, false
+	}
+	return map[string]string{
+		PublishContextProtocol:  ProtocolNFS,
+		PublishContextNFSServer: p.s.driver.GetNFSServerFromParameters(volumeContext),
+		PublishContextNFSPath:   volInfo.NFSPath,
+	}, true
+}
+
+// datasetMountpoint returns the mountpoint of a filesystem dataset, falling back
+// to the default location under DefaultMountpoint.
+func datasetMountpoint(datasetPath string, dataset *client.Dataset) string {
+	if dataset != nil && dataset.Mountpoint != "" {
+		return dataset.Mountpoint
+	}
+	return filepath.Join(DefaultMountpoint, datasetPath)
+}
@@ -2,10 +2,15 @@ package driver
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io/fs"
 	"os"
+	"path/filepath"
+	"strings"
 	"sync"
 	"syscall"
+	"time"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"google.golang.org/grpc/codes"
@@ -16,11 +21,14 @@ import (
 
 // NodeServer implements the CSI Node service
 type NodeServer struct {
-	driver       *Driver
-	mounter      mount.Interface
-	iscsiHandler *ISCSIHandler
-	nfsHandler   *NFSHandler
-	volumeLocks  sync.Map // map[string]*sync.Mutex - per-operation locks
+	driver      *Driver
+	mounter     mount.Interface
+	handlers    map[string]ProtocolHandler // by protocol name
+	staging     *stagingStore
+	volumeLocks sync.Map // map[string]*sync.Mutex - per-operation locks
+	// stageMu is held shared by stage and unstage and exclusively by the
+	// reconciler, which must not see a volume half staged
+	stageMu sync.RWMutex
 	csi.UnimplementedNodeServer
 }
 
@@ -47,16 +55,29 @@ func NewNodeServer(cfg *NodeServerConfig) (*NodeServer, error) {
 		Exec:      exec.New(),
 	}
 
-	iscsiHandler, err := NewISCSIHandler(safeMounter, cfg.Driver.Log())
+	stateDir := cfg.Driver.StateDir()
+	if stateDir == "" {
+		stateDir = defaultStateDir
+	}
+	staging, err := newStagingStore(stateDir)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create iSCSI handler: %w", err)
+		return nil, err
+	}
+
+	handlers := make(map[string]ProtocolHandler)
+	for _, protocol := range registeredProtocols() {
+		handler, err := protocol.newHandler(safeMounter, stateDir, cfg.Driver.Log())
+		if err != nil {
+			return nil, fmt.Errorf("failed to create %s handler: %w", protocol.name, err)
+		}
+		handlers[protocol.name] = handler
 	}
 
 	return &NodeServer{
-		driver:       cfg.Driver,
-		mounter:      mounter,
-		iscsiHandler: iscsiHandler,
-		nfsHandler:   NewNFSHandler(mounter, cfg.Driver.Log()),
+		driver:   cfg.Driver,
+		mounter:  mounter,
+		handlers: handlers,
+		staging:  staging,
 	}, nil
 }
 
@@ -77,14 +98,101 @@ func (s *NodeServer) ReleaseLock(key string) {
 
 // getHandler returns the appropriate protocol handler for the request
 func (s *NodeServer) getHandler(publishContext map[string]string) (ProtocolHandler, error) {
-	switch publishContext[PublishContextProtocol] {
-	case ProtocolISCSI:
-		return s.iscsiHandler, nil
-	case ProtocolNFS:
-		return s.nfsHandler, nil
-	default:
-		return nil, fmt.Errorf("unknown or missing protocol in publish context: %q", publishContext[PublishContextProtocol])
+	if handler, ok := s.handlers[publishContext[PublishContextProtocol]]; ok {
+		return handler, nil
+	}
+	return nil, fmt.Errorf("unknown or missing protocol in publish context: %q", publishContext[PublishContextProtocol])
+}
+
+// stagingRecord returns the staging record of a volume, or nil if it has none.
+// Volumes staged by drivers that predate staging records get one built from the
+// connection state those drivers left behind, or failing that from the staging
+// mount.
+func (s *NodeServer) stagingRecord(volumeID, stagingPath string) (*StagingRecord, error) {
+	record, err := s.staging.Load(volumeID)
+	if err == nil {
+		return record, nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("failed to read staging record of %s: %w", volumeID, err)
+	}
+
+	for _, protocol := range registeredProtocols() {
+		if protocol.legacyRecord == nil {
+			continue
+		}
+		if record := protocol.legacyRecord(s.driver.StateDir(), volumeID); record != nil {
+			record.StagingPath = stagingPath
+			s.driver.Log().Info("Migrating staging state to a staging record", "volumeId", volumeID, "protocol", record.Protocol)
+			if err := s.staging.Save(record); err != nil {
+				s.driver.Log().Error(err, "Failed to save migrated staging record", "volumeId", volumeID)
+			}
+			return record, nil
+		}
+	}
+	return s.stagingMountRecord(volumeID, stagingPath)
+}
+
+// stagingMountRecord builds a staging record from what is mounted at the staging
+// path, for volumes whose record and legacy state are both gone. It returns nil
+// if nothing is mounted there, and an error if the mount is not one the driver
+// could have made.
+func (s *NodeServer) stagingMountRecord(volumeID, stagingPath string) (*StagingRecord, error) {
+	if stagingPath == "" {
+		return nil, nil
 	}
+	mounts, err := s.mounter.List()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list mounts: %w", err)
+	}
+	for _, mp := range mounts {
+		if filepath.Clean(mp.Path) != filepath.Clean(stagingPath) {
+			continue
+		}
+
+		record := &StagingRecord{
+			VolumeID:    volumeID,
+			StagingPath: stagingPath,
+			DevicePath:  mp.Device,
+			FSType:      mp.Type,
+		}
+		switch {
+		case strings.HasPrefix(mp.Type, "nfs"):
+			record.Protocol = ProtocolNFS
+		case mp.Type == "cifs" || mp.Type == "smb3":
+			record.Protocol = ProtocolSMB
+		case strings.HasPrefix(mp.Device, "/dev/"):
+			device, err := filepath.EvalSymlinks(mp.Device)
+			if err != nil {
+				device = mp.Device
+			}
+			if conn, ok := nvmeDeviceConnection(device); ok {
+				record.Protocol, record.Connection = ProtocolNVMe, conn
+			} else if conn, ok := iscsiDeviceConnection(device); ok {
+				record.Protocol, record.Connection = ProtocolISCSI, conn
+			} else {
+				return nil, fmt.Errorf("staging path %s of %s has no staging record and %s is neither an iSCSI nor an NVMe device", stagingPath, volumeID, mp.Device)
+			}
+		default:
+			return nil, fmt.Errorf("staging path %s of %s has no staging record and an unrecognized %s mount of %s", stagingPath, volumeID, mp.Type, mp.Device)
+		}
+		s.driver.Log().Info("Rebuilt staging record from the staging mount", "volumeId", volumeID, "protocol", record.Protocol, "device", mp.Device)
+		return record, nil
+	}
+	return nil, nil
+}
+
+// stagedHandler returns the handler of a staged volume for requests that carry no
+// publish context. Without a staging record nothing is mounted at the staging
+// path, so the volume needs no unstage and is handled as NFS.
+func (s *NodeServer) stagedHandler(record *StagingRecord) (ProtocolHandler, error) {
+	if record == nil {
+		return s.handlers[ProtocolNFS], nil
+	}
+	if handler, ok := s.handlers[record.Protocol]; ok {
+		return handler, nil
+	}
+	return nil, fmt.Errorf("staging record of %s has unknown protocol %q", record.VolumeID, record.Protocol)
 }
 
 // validateVolumeCapability checks if the requested capability is supported
@@ -113,7 +221,7 @@ func (s *NodeServer) validateVolumeCapability(cap *csi.VolumeCapability) error {
 	return fmt.Errorf("access mode %v not supported", cap.AccessMode.Mode)
 }
 
-// NodeStageVolume mounts the volume to the staging path (iSCSI) or is a no-op (NFS).
+// NodeStageVolume mounts the volume to the staging path (iSCSI, NVMe) or is a no-op (NFS).
 func (s *NodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRequest) (*csi.NodeStageVolumeResponse, error) {
 	s.driver.Log().V(LogLevelDebug).Info("NodeStageVolume called", "volumeId", req.VolumeId, "stagingTargetPath", req.StagingTargetPath)
 
@@ -150,6 +258,9 @@ func (s *NodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolu
 	}
 	defer s.ReleaseLock(lockKey)
 
+	s.stageMu.RLock()
+	defer s.stageMu.RUnlock()
+
 	// Get appropriate handler
 	s.driver.Log().Info("NodeStageVolume received", "volumeId", req.VolumeId, "publishContext", req.PublishContext)
 	handler, err := s.getHandler(req.PublishContext)
@@ -183,10 +294,36 @@ func (s *NodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolu
 	}
 
 	// Stage volume
-	if _, err := handler.Stage(ctx, stageReq); err != nil {
+	result, err := handler.Stage(ctx, stageReq)
+	if err != nil {
 		return nil, status.Errorf(codes.Internal, "failed to stage volume: %v", err)
 	}
 
+	// Record the staging so later calls can find the protocol and connection
+	// without a publish context. A volume that cannot be recorded could not be
+	// unstaged, so it is not left staged.
+	record := &StagingRecord{
+		VolumeID:    req.VolumeId,
+		Protocol:    handler.Protocol(),
+		StagingPath: req.StagingTargetPath,
+		DevicePath:  result.DevicePath,
+		FSType:      fsType,
+		MountFlags:  mountFlags,
+		Block:       isBlockVolume,
+		Connection:  result.Connection,
+		StagedAt:    time.Now().UTC(),
+	}
+	if isBlockVolume {
+		record.FSType = ""
+	}
+	if err := s.staging.Save(record); err != nil {
+		unstageReq := &UnstageRequest{VolumeID: req.VolumeId, StagingPath: req.StagingTargetPath, Record: record}
+		if unstageErr := handler.Unstage(ctx, unstageReq); unstageErr != nil {
+			s.driver.Log().Error(unstageErr, "Failed to roll back staging", "volumeId", req.VolumeId)
+		}
+		return nil, status.Errorf(codes.Internal, "failed to record staged volume: %v", err)
+	}
+
 	s.driver.Log().V(LogLevelDebug).Info("Successfully staged volume", "volumeId", req.VolumeId, "stagingTargetPath", req.StagingTargetPath)
 	return &csi.NodeStageVolumeResponse{}, nil
 }
@@ -210,21 +347,24 @@ func (s *NodeServer) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstage
 	}
 	defer s.ReleaseLock(lockKey)
 
-	// Determine handler by checking if iSCSI connector file exists
-	var handler ProtocolHandler
-	cpath := connectorPath(req.VolumeId)
-	if _, err := os.Stat(cpath); err == nil {
-		// Connector file exists, this is an iSCSI volume
-		handler = s.iscsiHandler
-	} else {
-		// No connector file, assume NFS
-		handler = s.nfsHandler
+	s.stageMu.RLock()
+	defer s.stageMu.RUnlock()
+
+	// Determine handler from the staging record
+	record, err := s.stagingRecord(req.VolumeId, req.StagingTargetPath)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "%v", err)
+	}
+	handler, err := s.stagedHandler(record)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "%v", err)
 	}
 
 	// Build unstage request
 	unstageReq := &UnstageRequest{
 		VolumeID:    req.VolumeId,
 		StagingPath: req.StagingTargetPath,
+		Record:      record,
 	}
 
 	// Unstage volume
@@ -232,6 +372,11 @@ func (s *NodeServer) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstage
 		return nil, status.Errorf(codes.Internal, "failed to unstage volume: %v", err)
 	}
 
+	// The record goes last, so a failed unstage can be retried from it
+	if err := s.staging.Delete(req.VolumeId); err != nil {
+		return nil, status.Errorf(codes.Internal, "%v", err)
+	}
+
 	s.driver.Log().V(LogLevelDebug).Info("Successfully unstaged volume", "volumeId", req.VolumeId, "stagingTargetPath", req.StagingTargetPath)
 	return &csi.NodeUnstageVolumeResponse{}, nil
 }
@@ -298,6 +443,12 @@ func (s *NodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublish
 		mountFlags = req.VolumeCapability.GetMount().GetMountFlags()
 	}
 
+	// Block volumes are published from the device recorded at staging
+	record, err := s.stagingRecord(req.VolumeId, req.StagingTargetPath)
+	if err != nil {
+		s.driver.Log().V(LogLevelDebug).Info("Publishing without staging record", "volumeId", req.VolumeId, "error", err)
+	}
+
 	// Build publish request
 	publishReq := &PublishRequest{
 		VolumeID:         req.VolumeId,
@@ -309,7 +460,9 @@ func (s *NodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublish
 		VolumeCapability: req.VolumeCapability,
 		PublishContext:   req.PublishContext,
 		VolumeContext:    req.VolumeContext,
+		Secrets:          req.Secrets,
 		IsBlockVolume:    isBlockVolume,
+		Record:           record,
 	}
 
 	// Publish volume
@@ -374,7 +527,9 @@ func (s *NodeServer) NodeGetCapabilities(ctx context.Context, req *csi.NodeGetCa
 	}, nil
 }
 
-// NodeGetVolumeStats returns capacity statistics for a mounted volume.
+// NodeGetVolumeStats returns capacity statistics and the condition of a mounted volume.
+// Problems with the volume are reported as an abnormal condition, not as errors,
+// so kubelet can surface them as events.
 func (s *NodeServer) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVolumeStatsRequest) (*csi.NodeGetVolumeStatsResponse, error) {
 	s.driver.Log().V(LogLevelDebug).Info("NodeGetVolumeStats called", "volumeId", req.VolumeId, "volumePath", req.VolumePath)
 
@@ -385,16 +540,46 @@ func (s *NodeServer) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVol
 		return nil, status.Error(codes.InvalidArgument, "volume path is required")
 	}
 
-	_, err := os.Stat(req.VolumePath)
+	info, err := callWithTimeout(req.VolumePath, func() (os.FileInfo, error) { return os.Stat(req.VolumePath) })
 	if err != nil {
 		if os.IsNotExist(err) {
 			return nil, status.Errorf(codes.NotFound, "volume path %s does not exist", req.VolumePath)
 		}
+		if condition := statErrorCondition(req.VolumePath, err); condition != nil {
+			return &csi.NodeGetVolumeStatsResponse{VolumeCondition: condition}, nil
+		}
 		return nil, status.Errorf(codes.Internal, "failed to stat volume path: %v", err)
 	}
 
-	stats, err := s.getFSStats(req.VolumePath)
+	record, err := s.stagingRecord(req.VolumeId, req.StagingTargetPath)
+	if err != nil {
+		s.driver.Log().V(LogLevelDebug).Info("Checking volume without staging record", "volumeId", req.VolumeId, "error", err)
+	}
+
+	// Raw block volumes are published as device files and have no filesystem
+	if info.Mode()&os.ModeDevice != 0 {
+		size, err := blockDeviceFileSize(req.VolumePath)
+		if err != nil {
+			return &csi.NodeGetVolumeStatsResponse{
+				VolumeCondition: abnormalCondition("block device at %s cannot be opened: %v", req.VolumePath, err),
+			}, nil
+		}
+		return &csi.NodeGetVolumeStatsResponse{
+			Usage: []*csi.VolumeUsage{
+				{
+					Unit:  csi.VolumeUsage_BYTES,
+					Total: size,
+				},
+			},
+			VolumeCondition: s.volumeCondition(record, req.VolumePath, true),
+		}, nil
+	}
+
+	stats, err := callWithTimeout(req.VolumePath, func() (*fsStats, error) { return s.getFSStats(req.VolumePath) })
 	if err != nil {
+		if condition := statErrorCondition(req.VolumePath, err); condition != nil {
+			return &csi.NodeGetVolumeStatsResponse{VolumeCondition: condition}, nil
+		}
 		return nil, status.Errorf(codes.Internal, "failed to get filesystem stats: %v", err)
 	}
 
@@ -413,10 +598,11 @@ func (s *NodeServer) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVol
 				Used:      stats.usedInodes,
 			},
 		},
+		VolumeCondition: s.volumeCondition(record, req.VolumePath, false),
 	}, nil
 }
 
-// NodeExpandVolume expands the filesystem on iSCSI volumes after controller expansion.
+// NodeExpandVolume expands the filesystem on iSCSI and NVMe volumes after controller expansion.
 func (s *NodeServer) NodeExpandVolume(ctx context.Context, req *csi.NodeExpandVolumeRequest) (*csi.NodeExpandVolumeResponse, error) {
 	s.driver.Log().V(LogLevelDebug).Info("NodeExpandVolume called", "volumeId", req.VolumeId, "volumePath", req.VolumePath)
 
@@ -445,21 +631,21 @@ func (s *NodeServer) NodeExpandVolume(ctx context.Context, req *csi.NodeExpandVo
 		capacityBytes = req.CapacityRange.RequiredBytes
 	}
 
-	// Determine handler by checking if iSCSI connector file exists
-	var handler ProtocolHandler
-	cpath := connectorPath(req.VolumeId)
-	if _, err := os.Stat(cpath); err == nil {
-		// Connector file exists, this is an iSCSI volume
-		handler = s.iscsiHandler
-	} else {
-		// No connector file, assume NFS (expansion is a no-op for NFS)
-		handler = s.nfsHandler
+	// Determine handler from the staging record (expansion is a no-op for NFS)
+	record, err := s.stagingRecord(req.VolumeId, req.StagingTargetPath)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "%v", err)
+	}
+	handler, err := s.stagedHandler(record)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "%v", err)
 	}
 
 	expandReq := &ExpandRequest{
 		VolumeID:      req.VolumeId,
 		VolumePath:    req.VolumePath,
 		CapacityBytes: capacityBytes,
+		Record:        record,
 	}
 
 	// Expand volume
@@ -484,7 +670,7 @@ type fsStats struct {
 func (s *NodeServer) getFSStats(path string) (*fsStats, error) {
 	var stat syscall.Statfs_t
 	if err := syscall.Statfs(path, &stat); err != nil {
-		return nil, fmt.Errorf("statfs failed: %v", err)
+		return nil, fmt.Errorf("statfs failed: %w", err)
 	}
 
 	blockSize := stat.Frsize
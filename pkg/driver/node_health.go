@@ -0,0 +1,165 @@
+package driver
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"k8s.io/mount-utils"
+)
+
+// volumeStatsTimeout bounds stat calls on a volume. A hung NFS server blocks
+// them indefinitely.
+const volumeStatsTimeout = 10 * time.Second
+
+var errVolumeStatsTimeout = fmt.Errorf("no response within %v", volumeStatsTimeout)
+
+// pendingVolumeStats holds the volume paths with a stat call still running,
+// so a hung mount ties up one goroutine rather than one per kubelet poll.
+var pendingVolumeStats sync.Map // map[string]struct{}
+
+// callWithTimeout runs fn for the volume at volumePath and gives up waiting after
+// volumeStatsTimeout. The call itself cannot be interrupted and finishes in the
+// background; until it does, further calls for the path fail right away with
+// the timeout error instead of starting another.
+func callWithTimeout[T any](volumePath string, fn func() (T, error)) (T, error) {
+	var zero T
+	if _, pending := pendingVolumeStats.LoadOrStore(volumePath, struct{}{}); pending {
+		return zero, errVolumeStatsTimeout
+	}
+
+	type result struct {
+		value T
+		err   error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		value, err := fn()
+		pendingVolumeStats.Delete(volumePath)
+		ch <- result{value, err}
+	}()
+
+	select {
+	case r := <-ch:
+		return r.value, r.err
+	case <-time.After(volumeStatsTimeout):
+		return zero, errVolumeStatsTimeout
+	}
+}
+
+// healthyCondition is reported when no check found a problem
+func healthyCondition() *csi.VolumeCondition {
+	return &csi.VolumeCondition{Abnormal: false, Message: "volume is healthy"}
+}
+
+// abnormalCondition reports a problem with the volume
+func abnormalCondition(format string, args ...any) *csi.VolumeCondition {
+	return &csi.VolumeCondition{Abnormal: true, Message: fmt.Sprintf(format, args...)}
+}
+
+// statErrorCondition turns a failed stat of the volume into a condition, or
+// returns nil for errors that do not say anything about the volume's health.
+func statErrorCondition(volumePath string, err error) *csi.VolumeCondition {
+	switch {
+	case errors.Is(err, errVolumeStatsTimeout):
+		return abnormalCondition("volume at %s did not respond within %v; the NFS or SMB server may be unreachable", volumePath, volumeStatsTimeout)
+	case errors.Is(err, syscall.ESTALE):
+		return abnormalCondition("stale file handle at %s; the share was removed or replaced on TrueNAS and the volume must be remounted", volumePath)
+	case errors.Is(err, syscall.EIO):
+		return abnormalCondition("I/O error at %s", volumePath)
+	}
+	return nil
+}
+
+// blockDeviceFileSize returns the size of the block device at path
+func blockDeviceFileSize(path string) (int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	return file.Seek(0, io.SeekEnd)
+}
+
+// volumeCondition checks what statfs cannot see: the sessions and device behind
+// a staged block protocol volume, and a filesystem the kernel remounted read-only.
+func (s *NodeServer) volumeCondition(record *StagingRecord, volumePath string, block bool) *csi.VolumeCondition {
+	if record != nil {
+		if record.DevicePath != "" {
+			if _, err := os.Stat(record.DevicePath); err != nil {
+				return abnormalCondition("block device %s of the volume is missing: %v", record.DevicePath, err)
+			}
+		}
+		if record.Protocol == ProtocolISCSI {
+			if condition := iscsiSessionCondition(record); condition != nil {
+				return condition
+			}
+		}
+	}
+
+	if !block {
+		if condition := readOnlyCondition(record, volumePath); condition != nil {
+			return condition
+		}
+	}
+	return healthyCondition()
+}
+
+// iscsiSessionCondition reports iSCSI sessions of the volume that are missing or
+// not logged in, or returns nil if all are.
+func iscsiSessionCondition(record *StagingRecord) *csi.VolumeCondition {
+	conn := record.Connection
+	if conn.TargetIQN == "" {
+		return nil
+	}
+	sessions, err := listISCSISessions()
+	if err != nil {
+		return nil
+	}
+
+	// The record holds the portals the node logged in to, so each needs a session
+	var problems []string
+	for _, portal := range conn.TargetPortals {
+		session := findISCSISession(sessions, conn.TargetIQN, portal)
+		switch {
+		case session == nil:
+			problems = append(problems, fmt.Sprintf("no session on %s", portal))
+		case session.State != "" && session.State != "LOGGED_IN":
+			problems = append(problems, fmt.Sprintf("%s on %s is %s", session.Name, portal, session.State))
+		}
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+	return abnormalCondition("iSCSI target %s: %s", conn.TargetIQN, strings.Join(problems, "; "))
+}
+
+// readOnlyCondition reports an ext4 or xfs filesystem whose superblock is
+// read-only although it was not mounted read-only, which is what the kernel
+// does after I/O errors.
+func readOnlyCondition(record *StagingRecord, volumePath string) *csi.VolumeCondition {
+	mounts, err := mount.ParseMountInfo(mountInfoPath)
+	if err != nil {
+		return nil
+	}
+	for _, m := range mounts {
+		if m.MountPoint != volumePath || (m.FsType != "ext4" && m.FsType != "xfs") {
+			continue
+		}
+		if !slices.Contains(m.SuperOptions, "ro") {
+			return nil
+		}
+		if record != nil && slices.Contains(record.MountFlags, "ro") {
+			return nil
+		}
+		return abnormalCondition("%s filesystem of the volume was remounted read-only, likely after I/O errors; check the kernel log", m.FsType)
+	}
+	return nil
+}
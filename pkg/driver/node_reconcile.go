@@ -0,0 +1,314 @@
+package driver
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+	iscsilib "github.com/kubernetes-csi/csi-lib-iscsi/iscsi"
+	"k8s.io/mount-utils"
+)
+
+const (
+	// nodeReconcileInterval is how often the node compares its iSCSI sessions,
+	// mounts and staging records after the pass at startup.
+	nodeReconcileInterval = 5 * time.Minute
+
+	// mountInfoPath lists the mounts the node plugin sees
+	mountInfoPath = "/proc/self/mountinfo"
+)
+
+// Reconciliation decisions, used as the action label of nodeReconcileDecisions
+const (
+	reconcileKeep    = "keep"    // session or record is in use
+	reconcileLogout  = "logout"  // session no staged volume owns
+	reconcileRelogin = "relogin" // mounted volume lost its sessions
+	reconcileRemove  = "remove"  // record and connector of a volume that is gone
+)
+
+// runReconciler reconciles node state at startup and then periodically until
+// ctx is done.
+func (s *NodeServer) runReconciler(ctx context.Context) {
+	ticker := time.NewTicker(nodeReconcileInterval)
+	defer ticker.Stop()
+
+	for {
+		s.reconcile(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// reconcile brings the iSCSI sessions and staging state of the node back in
+// line after a restart of the plugin or the host:
+//   - sessions to driver targets that no staged volume owns are logged out,
+//     unless their devices are mounted or held
+//   - volumes that are still mounted but lost their sessions are logged in again
+//   - records and connector files of volumes that are neither mounted nor
+//     connected are removed
+//
+// Only targets under the driver's IQN base are touched. Staging and unstaging
+// wait while a pass runs, so a session being set up is never seen as orphaned.
+func (s *NodeServer) reconcile(ctx context.Context) {
+	s.stageMu.Lock()
+	defer s.stageMu.Unlock()
+
+	log := s.driver.Log().WithName("reconcile")
+	nodeReconcileRuns.Inc()
+	defer nodeReconcileLastRun.SetToCurrentTime()
+
+	sessions, err := listISCSISessions()
+	if err != nil {
+		log.Error(err, "Skipping node reconciliation")
+		return
+	}
+	mounts, err := mount.ParseMountInfo(mountInfoPath)
+	if err != nil {
+		log.Error(err, "Skipping node reconciliation: failed to read mounts")
+		return
+	}
+	records := s.reconcileRecords(log)
+
+	nodeStagedVolumes.Reset()
+	var iscsiRecords []*StagingRecord
+	for _, record := range records {
+		nodeStagedVolumes.WithLabelValues(record.Protocol).Inc()
+		if record.Protocol == ProtocolISCSI && record.Connection.TargetIQN != "" {
+			iscsiRecords = append(iscsiRecords, record)
+		}
+	}
+
+	// Volumes first: what they own decides which sessions are orphaned
+	for _, record := range iscsiRecords {
+		if ctx.Err() != nil {
+			return
+		}
+		s.reconcileISCSIVolume(log, record, sessions, mounts)
+	}
+
+	iqnPrefix := s.driver.ISCSIIQNBase() + ":"
+	owned, orphaned := 0, 0
+	for _, session := range sessions {
+		if !strings.HasPrefix(session.TargetIQN, iqnPrefix) {
+			continue
+		}
+		if ownsISCSISession(iscsiRecords, session) {
+			owned++
+			continue
+		}
+		if iscsiSessionInUse(session, mounts) {
+			// Staged by a driver whose records this node cannot read
+			owned++
+			nodeReconcileDecisions.WithLabelValues(reconcileKeep, "skipped").Inc()
+			log.Info("Keeping iSCSI session no staging record owns, its devices are in use", "session", session.Name, "targetIqn", session.TargetIQN)
+			continue
+		}
+		orphaned++
+		s.logoutOrphanedSession(log, session, iscsiRecords)
+	}
+	nodeISCSISessions.WithLabelValues("owned").Set(float64(owned))
+	nodeISCSISessions.WithLabelValues("orphaned").Set(float64(orphaned))
+}
+
+// reconcileRecords returns the staging records of the node. Connector files
+// left by drivers that predate staging records are migrated to records first.
+func (s *NodeServer) reconcileRecords(log logr.Logger) []*StagingRecord {
+	records, err := s.staging.List()
+	if err != nil {
+		log.Error(err, "Some staging records could not be read")
+	}
+
+	connectors, _ := filepath.Glob(filepath.Join(s.driver.StateDir(), connectorDirName, "*.connector"))
+	if s.driver.StateDir() != defaultStateDir {
+		legacy, _ := filepath.Glob(filepath.Join(defaultStateDir, connectorDirName, "*.connector"))
+		connectors = append(connectors, legacy...)
+	}
+	for _, cpath := range connectors {
+		connector, err := readConnectorFile(cpath)
+		if err != nil || connector.VolumeName == "" {
+			continue
+		}
+		if slices.ContainsFunc(records, func(r *StagingRecord) bool { return r.VolumeID == connector.VolumeName }) {
+			continue
+		}
+		record, err := s.stagingRecord(connector.VolumeName, "")
+		if err != nil || record == nil {
+			continue
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+// reconcileISCSIVolume logs a mounted volume in again if all its sessions are
+// gone, and forgets a volume that is neither mounted nor connected.
+func (s *NodeServer) reconcileISCSIVolume(log logr.Logger, record *StagingRecord, sessions []iscsiSession, mounts []mount.MountInfo) {
+	conn := record.Connection
+	connected := slices.ContainsFunc(conn.TargetPortals, func(portal string) bool {
+		return findISCSISession(sessions, conn.TargetIQN, portal) != nil
+	})
+	inUse, known := volumeInUse(record, mounts)
+
+	switch {
+	case connected:
+		nodeReconcileDecisions.WithLabelValues(reconcileKeep, "success").Inc()
+		log.V(LogLevelDebug).Info("Keeping iSCSI volume", "volumeId", record.VolumeID, "targetIqn", conn.TargetIQN, "mounted", inUse)
+
+	case inUse:
+		log.Info("Mounted iSCSI volume has no sessions, logging in again", "volumeId", record.VolumeID, "targetIqn", conn.TargetIQN, "portals", conn.TargetPortals)
+		if err := s.reloginISCSIVolume(record); err != nil {
+			nodeReconcileDecisions.WithLabelValues(reconcileRelogin, "failure").Inc()
+			log.Error(err, "Failed to log in to iSCSI target again", "volumeId", record.VolumeID, "targetIqn", conn.TargetIQN)
+			return
+		}
+		nodeReconcileDecisions.WithLabelValues(reconcileRelogin, "success").Inc()
+		log.Info("Logged in to iSCSI target again", "volumeId", record.VolumeID, "targetIqn", conn.TargetIQN)
+
+	case !known:
+		// Records migrated from connector files do not know the staging path
+		nodeReconcileDecisions.WithLabelValues(reconcileKeep, "skipped").Inc()
+		log.Info("iSCSI volume has no sessions, but whether it is mounted is unknown; keeping it", "volumeId", record.VolumeID, "targetIqn", conn.TargetIQN)
+
+	default:
+		log.Info("Removing staging state of iSCSI volume that is neither mounted nor connected", "volumeId", record.VolumeID, "targetIqn", conn.TargetIQN)
+		err := s.staging.Delete(record.VolumeID)
+		if rmErr := os.Remove(connectorPath(s.driver.StateDir(), record.VolumeID)); rmErr != nil && !os.IsNotExist(rmErr) && err == nil {
+			err = rmErr
+		}
+		if err != nil {
+			nodeReconcileDecisions.WithLabelValues(reconcileRemove, "failure").Inc()
+			log.Error(err, "Failed to remove staging state", "volumeId", record.VolumeID)
+			return
+		}
+		nodeReconcileDecisions.WithLabelValues(reconcileRemove, "success").Inc()
+	}
+}
+
+// volumeInUse reports whether a staged volume is still mounted: its staging path
+// or device appears in mountinfo or, for raw block volumes, the staging path
+// still exists. known is false if the record lacks the details to tell.
+func volumeInUse(record *StagingRecord, mounts []mount.MountInfo) (inUse, known bool) {
+	if record.StagingPath == "" && record.DevicePath == "" {
+		return false, false
+	}
+	for _, m := range mounts {
+		if record.StagingPath != "" && m.MountPoint == record.StagingPath {
+			return true, true
+		}
+		if record.DevicePath != "" && m.Source == record.DevicePath {
+			return true, true
+		}
+	}
+	if record.Block && record.StagingPath != "" {
+		if _, err := os.Stat(record.StagingPath); err == nil {
+			return true, true
+		}
+	}
+	return false, record.StagingPath != ""
+}
+
+// reloginISCSIVolume connects the volume's target again from its connector file,
+// which carries the CHAP credentials, or from the staging record without one.
+func (s *NodeServer) reloginISCSIVolume(record *StagingRecord) error {
+	cpath := connectorPath(s.driver.StateDir(), record.VolumeID)
+	connector, err := readConnectorFile(cpath)
+	if err != nil {
+		connector = &iscsilib.Connector{
+			VolumeName:    record.VolumeID,
+			TargetIqn:     record.Connection.TargetIQN,
+			TargetPortals: record.Connection.TargetPortals,
+			Lun:           record.Connection.LUN,
+			RetryCount:    iscsiRetryCount,
+			CheckInterval: iscsiCheckInterval,
+			DoDiscovery:   true,
+		}
+	}
+	connector.Devices = nil
+	connector.MountTargetDevice = nil
+
+	unlock := lockISCSITarget(connector.TargetIqn, connector.TargetPortals)
+	devicePath, err := connector.Connect()
+	unlock()
+	if err != nil {
+		return err
+	}
+	if err := iscsilib.PersistConnector(connector, cpath); err != nil {
+		s.driver.Log().Info("Failed to persist connector info", "volumeId", record.VolumeID, "error", err)
+	}
+
+	// The LUN may come back under a different device name
+	if devicePath != record.DevicePath {
+		record.DevicePath = devicePath
+		if err := s.staging.Save(record); err != nil {
+			s.driver.Log().Info("Failed to update staging record", "volumeId", record.VolumeID, "error", err)
+		}
+	}
+	return nil
+}
+
+// ownsISCSISession reports whether a staged volume uses the session
+func ownsISCSISession(records []*StagingRecord, session iscsiSession) bool {
+	for _, record := range records {
+		if record.Connection.TargetIQN != session.TargetIQN {
+			continue
+		}
+		for _, portal := range record.Connection.TargetPortals {
+			if findISCSISession([]iscsiSession{session}, session.TargetIQN, portal) != nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// iscsiSessionInUse reports whether a session no staging record owns still
+// backs a volume: one of its devices is mounted or held, or a mounted device
+// leads back to its target as when rebuilding a record from the staging mount.
+func iscsiSessionInUse(session iscsiSession, mounts []mount.MountInfo) bool {
+	for _, name := range session.blockDevices() {
+		if blockDeviceInUse(name, mounts) {
+			return true
+		}
+	}
+	for _, m := range mounts {
+		if !strings.HasPrefix(m.Source, "/dev/") {
+			continue
+		}
+		device, err := filepath.EvalSymlinks(m.Source)
+		if err != nil {
+			device = m.Source
+		}
+		if conn, ok := iscsiDeviceConnection(device); ok && conn.TargetIQN == session.TargetIQN {
+			return true
+		}
+	}
+	return false
+}
+
+// logoutOrphanedSession logs out of a session no staged volume owns. The node
+// records of the target are deleted too, unless a volume still uses the target
+// on another portal, so the session does not come back at boot.
+func (s *NodeServer) logoutOrphanedSession(log logr.Logger, session iscsiSession, records []*StagingRecord) {
+	log.Info("Logging out of iSCSI session no staged volume owns", "session", session.Name, "targetIqn", session.TargetIQN, "address", session.Address, "port", session.Port)
+	if err := iscsilib.Logout(session.TargetIQN, session.Address); err != nil {
+		nodeReconcileDecisions.WithLabelValues(reconcileLogout, "failure").Inc()
+		log.Error(err, "Failed to log out of orphaned iSCSI session", "session", session.Name, "targetIqn", session.TargetIQN)
+		return
+	}
+	nodeReconcileDecisions.WithLabelValues(reconcileLogout, "success").Inc()
+
+	if slices.ContainsFunc(records, func(r *StagingRecord) bool { return r.Connection.TargetIQN == session.TargetIQN }) {
+		return
+	}
+	if err := iscsilib.DeleteDBEntry(session.TargetIQN); err != nil {
+		log.V(LogLevelDebug).Info("Failed to delete iSCSI node records", "targetIqn", session.TargetIQN, "error", err)
+	}
+}
@@ -0,0 +1,77 @@
+package driver
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"k8s.io/mount-utils"
+)
+
+// fakeSysfs points the sysfs directories at a temporary tree with one session
+// whose LUN 0 is sdb (8:16). sdc belongs to the session's target but has no
+// SCSI device entry, as a mounted device found only through its sysfs path.
+func fakeSysfs(t *testing.T, holders ...string) {
+	t.Helper()
+	root := t.TempDir()
+	saved := []*string{&iscsiSessionSysfs, &iscsiConnectionSysfs, &scsiHostSysfs, &scsiDeviceSysfs, &blockSysfs}
+	for _, dir := range saved {
+		old := *dir
+		*dir = filepath.Join(root, filepath.Base(old))
+		t.Cleanup(func() { *dir = old })
+	}
+
+	mkdir := func(path string) {
+		if err := os.MkdirAll(path, 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write := func(path, data string) {
+		mkdir(filepath.Dir(path))
+		if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write(filepath.Join(iscsiSessionSysfs, "session1", "targetname"), "iqn.test:pvc-1")
+	mkdir(filepath.Join(iscsiSessionSysfs, "session1", "device", "target1:0:0", "1:0:0:0"))
+	mkdir(filepath.Join(iscsiSessionSysfs, "session1", "device", "target1:0:0", "1:0:0:1"))
+	mkdir(filepath.Join(scsiDeviceSysfs, "1:0:0:0", "device", "block", "sdb"))
+	write(filepath.Join(blockSysfs, "sdb", "dev"), "8:16")
+	mkdir(filepath.Join(blockSysfs, "sdb", "holders"))
+	for _, holder := range holders {
+		mkdir(filepath.Join(blockSysfs, "sdb", "holders", holder))
+	}
+	mkdir(filepath.Join(blockSysfs, "sdc"))
+	if err := os.Symlink(filepath.Join(iscsiSessionSysfs, "session1", "device", "target1:0:0", "1:0:0:1"), filepath.Join(blockSysfs, "sdc", "device")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestISCSISessionInUse(t *testing.T) {
+	session := iscsiSession{Name: "session1", TargetIQN: "iqn.test:pvc-1", Host: 1}
+	stagingPath := "/var/lib/kubelet/plugins/kubernetes.io/csi/csi.truenas.io/abc/globalmount"
+
+	tests := []struct {
+		name     string
+		holders  []string
+		mounts   []mount.MountInfo
+		expected bool
+	}{
+		{name: "unrecorded but mounted", mounts: []mount.MountInfo{{Major: 8, Minor: 16, Source: "/dev/disk/by-path/lun-0", MountPoint: stagingPath}}, expected: true},
+		{name: "mounted by device path", mounts: []mount.MountInfo{{Source: "/dev/sdb", MountPoint: stagingPath}}, expected: true},
+		{name: "held by multipath map", holders: []string{"dm-0"}, expected: true},
+		{name: "other LUN of the target mounted", mounts: []mount.MountInfo{{Major: 8, Minor: 32, Source: "/dev/sdc", MountPoint: stagingPath}}, expected: true},
+		{name: "other device mounted", mounts: []mount.MountInfo{{Major: 8, Minor: 0, Source: "/dev/sda1", MountPoint: "/"}}, expected: false},
+		{name: "unused", expected: false},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			fakeSysfs(t, tc.holders...)
+			if got := iscsiSessionInUse(session, tc.mounts); got != tc.expected {
+				t.Errorf("iscsiSessionInUse() = %v, want %v", got, tc.expected)
+			}
+		})
+	}
+}
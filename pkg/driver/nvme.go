@@ -0,0 +1,428 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+
+	"k8s.io/mount-utils"
+)
+
+const (
+	nvmeSubsystemSysfs = "/sys/class/nvme-subsystem"
+
+	// NVMe/TCP connection settings
+	nvmeDeviceRetryCount    = 10 // checks for the namespace device after connect
+	nvmeDeviceCheckInterval = time.Second
+)
+
+var (
+	nvmeControllerPattern = regexp.MustCompile(`^nvme\d+$`)
+	// Excludes the hidden per-path devices (nvmeXcYnZ) below a multipath head
+	nvmeNamespacePattern = regexp.MustCompile(`^nvme\d+n\d+$`)
+)
+
+// NVMeHandler implements the ProtocolHandler interface for NVMe/TCP volumes
+type NVMeHandler struct {
+	mounter  *mount.SafeFormatAndMount
+	resizer  *mount.ResizeFs
+	stateDir string
+	log      logr.Logger
+}
+
+// NVMeConfig holds the NVMe/TCP connection parsed from the publish context.
+// It is kept in the staging record while the volume is staged.
+type NVMeConfig struct {
+	SubsystemNQN string `json:"subsystemNQN"`
+	Portal       string `json:"portal"`
+	NSID         int    `json:"nsid"`
+}
+
+// NewNVMeHandler creates a new NVMe/TCP protocol handler
+func NewNVMeHandler(mounter *mount.SafeFormatAndMount, stateDir string, log logr.Logger) (*NVMeHandler, error) {
+	return &NVMeHandler{
+		mounter:  mounter,
+		resizer:  mount.NewResizeFs(mounter.Exec),
+		stateDir: stateDir,
+		log:      log,
+	}, nil
+}
+
+// Protocol returns the protocol name
+func (h *NVMeHandler) Protocol() string {
+	return ProtocolNVMe
+}
+
+// recordedNVMeConfig returns the NVMe/TCP connection kept in a staging record
+func recordedNVMeConfig(volumeID string, record *StagingRecord) (*NVMeConfig, error) {
+	if record == nil || record.Connection.SubsystemNQN == "" {
+		return nil, fmt.Errorf("no NVMe connection recorded for volume %s", volumeID)
+	}
+	config := &NVMeConfig{
+		SubsystemNQN: record.Connection.SubsystemNQN,
+		Portal:       record.Connection.NVMePortal,
+		NSID:         record.Connection.NSID,
+	}
+	if config.NSID < 1 {
+		config.NSID = 1
+	}
+	return config, nil
+}
+
+// parseNVMeConfig extracts the NVMe/TCP connection from the publish context
+func parseNVMeConfig(publishContext map[string]string) (*NVMeConfig, error) {
+	config := &NVMeConfig{
+		SubsystemNQN: publishContext[PublishContextSubsystemNQN],
+		Portal:       publishContext[PublishContextNVMePortal],
+		NSID:         1,
+	}
+	if nsid := publishContext[PublishContextNSID]; nsid != "" {
+		n, err := strconv.Atoi(nsid)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("invalid namespace ID: %s", nsid)
+		}
+		config.NSID = n
+	}
+	return config, nil
+}
+
+// Stage implements NVMe/TCP volume staging (connect and device setup)
+func (h *NVMeHandler) Stage(ctx context.Context, req *StageRequest) (*StageResult, error) {
+	h.log.V(LogLevelDebug).Info("NVMe Stage", "volumeId", req.VolumeID, "stagingPath", req.StagingPath, "isBlock", req.IsBlockVolume)
+
+	config, err := parseNVMeConfig(req.PublishContext)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse NVMe config: %w (check publish context from controller)", err)
+	}
+	if config.Portal == "" || config.SubsystemNQN == "" {
+		return nil, fmt.Errorf("NVMe portal and subsystem NQN are required (check StorageClass parameters and controller publish context)")
+	}
+
+	devicePath, err := findNVMeNamespaceDevice(config.SubsystemNQN, config.NSID)
+	if err != nil {
+		if err := h.connect(ctx, config); err != nil {
+			return nil, err
+		}
+		devicePath, err = waitForNVMeNamespaceDevice(config.SubsystemNQN, config.NSID)
+		if err != nil {
+			h.disconnect(ctx, config.SubsystemNQN)
+			return nil, err
+		}
+	}
+
+	h.log.V(LogLevelDebug).Info("NVMe connected", "device", devicePath, "subsystemNQN", config.SubsystemNQN)
+
+	// The connection goes into the staging record for publish, expand and
+	// disconnect on unstage
+	result := &StageResult{
+		DevicePath: devicePath,
+		Connection: StagingConnection{
+			SubsystemNQN: config.SubsystemNQN,
+			NVMePortal:   config.Portal,
+			NSID:         config.NSID,
+		},
+	}
+
+	// For block volumes, skip formatting and mounting - just return the device path
+	if req.IsBlockVolume {
+		h.log.V(LogLevelDebug).Info("NVMe block volume staged (no filesystem)", "volumeId", req.VolumeID, "device", devicePath)
+		return result, nil
+	}
+
+	fsType := req.FSType
+	if fsType == "" {
+		fsType = "ext4"
+	}
+
+	if err := os.MkdirAll(req.StagingPath, 0o750); err != nil {
+		return nil, fmt.Errorf("failed to create staging directory: %w", err)
+	}
+
+	h.log.V(LogLevelDebug).Info("FormatAndMount device", "device", devicePath, "stagingPath", req.StagingPath, "fsType", fsType)
+	if err := h.mounter.FormatAndMount(devicePath, req.StagingPath, fsType, req.MountFlags); err != nil {
+		return nil, fmt.Errorf("failed to format and mount device: %w", err)
+	}
+
+	h.log.V(LogLevelDebug).Info("NVMe volume staged", "volumeId", req.VolumeID, "stagingPath", req.StagingPath)
+	return result, nil
+}
+
+// connect runs nvme connect for the subsystem over TCP
+func (h *NVMeHandler) connect(ctx context.Context, config *NVMeConfig) error {
+	host, port, err := net.SplitHostPort(config.Portal)
+	if err != nil {
+		host, port = config.Portal, strconv.Itoa(defaultNVMePort)
+	}
+
+	h.log.V(LogLevelDebug).Info("Connecting to NVMe subsystem", "portal", config.Portal, "subsystemNQN", config.SubsystemNQN)
+	out, err := h.mounter.Exec.CommandContext(ctx, "nvme", "connect",
+		"--transport=tcp", "--traddr="+host, "--trsvcid="+port, "--nqn="+config.SubsystemNQN).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to connect to NVMe subsystem %s at %s: %w (%s)", config.SubsystemNQN, config.Portal, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// disconnect runs nvme disconnect, which drops every controller of the subsystem
+func (h *NVMeHandler) disconnect(ctx context.Context, subsystemNQN string) error {
+	out, err := h.mounter.Exec.CommandContext(ctx, "nvme", "disconnect", "--nqn="+subsystemNQN).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to disconnect NVMe subsystem %s: %w (%s)", subsystemNQN, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// Unstage implements NVMe/TCP volume unstaging (unmount and disconnect)
+func (h *NVMeHandler) Unstage(ctx context.Context, req *UnstageRequest) error {
+	h.log.V(LogLevelDebug).Info("NVMe Unstage", "volumeId", req.VolumeID, "stagingPath", req.StagingPath)
+
+	notMounted, err := h.mounter.IsLikelyNotMountPoint(req.StagingPath)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to check mount point: %w", err)
+	}
+	if err == nil && !notMounted {
+		if err := h.mounter.Unmount(req.StagingPath); err != nil {
+			return fmt.Errorf("failed to unmount staging path: %w", err)
+		}
+	}
+
+	config, err := recordedNVMeConfig(req.VolumeID, req.Record)
+	if err != nil {
+		h.log.V(LogLevelDebug).Info("No NVMe connection recorded, considering disconnected", "volumeId", req.VolumeID)
+	} else {
+		// Each volume has its own subsystem, so nothing else uses the connection
+		if _, err := findNVMeSubsystem(config.SubsystemNQN); err == nil {
+			if err := h.disconnect(ctx, config.SubsystemNQN); err != nil {
+				return err
+			}
+		}
+	}
+
+	os.Remove(req.StagingPath)
+
+	h.log.V(LogLevelDebug).Info("NVMe volume unstaged", "volumeId", req.VolumeID)
+	return nil
+}
+
+// Publish implements NVMe/TCP volume publishing (bind mount from staging)
+func (h *NVMeHandler) Publish(ctx context.Context, req *PublishRequest) error {
+	h.log.V(LogLevelDebug).Info("NVMe Publish", "volumeId", req.VolumeID, "stagingPath", req.StagingPath, "targetPath", req.TargetPath, "isBlock", req.IsBlockVolume)
+
+	mountOptions := []string{"bind"}
+	if req.ReadOnly {
+		mountOptions = append(mountOptions, "ro")
+	}
+
+	if req.IsBlockVolume {
+		config, err := recordedNVMeConfig(req.VolumeID, req.Record)
+		if err != nil {
+			return fmt.Errorf("failed to load NVMe connection for block volume: %w", err)
+		}
+		devicePath, err := findNVMeNamespaceDevice(config.SubsystemNQN, config.NSID)
+		if err != nil {
+			return err
+		}
+
+		if err := os.MkdirAll(filepath.Dir(req.TargetPath), 0o750); err != nil {
+			return fmt.Errorf("failed to create target directory: %w", err)
+		}
+		file, err := os.OpenFile(req.TargetPath, os.O_CREATE|os.O_RDWR, 0o660)
+		if err != nil {
+			return fmt.Errorf("failed to create target file: %w", err)
+		}
+		file.Close()
+
+		if err := h.mounter.Mount(devicePath, req.TargetPath, "", mountOptions); err != nil {
+			os.Remove(req.TargetPath)
+			return fmt.Errorf("failed to bind mount block device: %w", err)
+		}
+
+		h.log.V(LogLevelDebug).Info("NVMe block volume published", "volumeId", req.VolumeID, "devicePath", devicePath, "targetPath", req.TargetPath)
+		return nil
+	}
+
+	if req.StagingPath == "" {
+		return fmt.Errorf("staging path is required for NVMe mount volumes")
+	}
+
+	notMounted, err := h.mounter.IsLikelyNotMountPoint(req.StagingPath)
+	if err != nil || notMounted {
+		return fmt.Errorf("volume not staged at %s", req.StagingPath)
+	}
+
+	if err := os.MkdirAll(req.TargetPath, 0o750); err != nil {
+		return fmt.Errorf("failed to create target directory: %w", err)
+	}
+
+	if err := h.mounter.Mount(req.StagingPath, req.TargetPath, "", mountOptions); err != nil {
+		return fmt.Errorf("failed to bind mount: %w", err)
+	}
+
+	h.log.V(LogLevelDebug).Info("NVMe volume published", "volumeId", req.VolumeID, "targetPath", req.TargetPath)
+	return nil
+}
+
+// Unpublish implements NVMe/TCP volume unpublishing
+func (h *NVMeHandler) Unpublish(ctx context.Context, req *UnpublishRequest) error {
+	h.log.V(LogLevelDebug).Info("NVMe Unpublish", "volumeId", req.VolumeID, "targetPath", req.TargetPath)
+
+	notMounted, err := h.mounter.IsLikelyNotMountPoint(req.TargetPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to check mount point: %w", err)
+	}
+
+	if notMounted {
+		return nil
+	}
+
+	if err := h.mounter.Unmount(req.TargetPath); err != nil {
+		return fmt.Errorf("failed to unmount: %w", err)
+	}
+
+	os.Remove(req.TargetPath)
+
+	h.log.V(LogLevelDebug).Info("NVMe volume unpublished", "volumeId", req.VolumeID, "targetPath", req.TargetPath)
+	return nil
+}
+
+// Expand implements NVMe/TCP volume expansion
+func (h *NVMeHandler) Expand(ctx context.Context, req *ExpandRequest) (*ExpandResult, error) {
+	h.log.V(LogLevelDebug).Info("NVMe Expand", "volumeId", req.VolumeID, "volumePath", req.VolumePath)
+
+	config, err := recordedNVMeConfig(req.VolumeID, req.Record)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load NVMe connection for expand: %w", err)
+	}
+
+	// The target announces size changes, but a rescan makes sure every controller has seen it
+	subsys, err := findNVMeSubsystem(config.SubsystemNQN)
+	if err != nil {
+		return nil, err
+	}
+	for _, ctrl := range nvmeSubsystemControllers(subsys) {
+		if out, err := h.mounter.Exec.CommandContext(ctx, "nvme", "ns-rescan", "/dev/"+ctrl).CombinedOutput(); err != nil {
+			h.log.V(LogLevelTrace).Info("Failed to rescan NVMe controller", "controller", ctrl, "error", err, "output", strings.TrimSpace(string(out)))
+		}
+	}
+
+	devicePath, err := findNVMeNamespaceDevice(config.SubsystemNQN, config.NSID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Raw block volumes have no filesystem to resize
+	if req.VolumePath != "" && !req.Record.Block {
+		h.log.V(LogLevelDebug).Info("Resizing filesystem", "device", devicePath, "volumePath", req.VolumePath)
+		resized, err := h.resizer.Resize(devicePath, req.VolumePath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resize filesystem: %w", err)
+		}
+		if resized {
+			h.log.V(LogLevelDebug).Info("Filesystem resized successfully")
+		}
+	}
+
+	return &ExpandResult{CapacityBytes: req.CapacityBytes}, nil
+}
+
+// findNVMeSubsystem returns the sysfs directory of the connected subsystem with the given NQN.
+func findNVMeSubsystem(subsystemNQN string) (string, error) {
+	entries, err := os.ReadDir(nvmeSubsystemSysfs)
+	if err != nil && !os.IsNotExist(err) {
+		return "", fmt.Errorf("failed to read NVMe subsystems: %w", err)
+	}
+	for _, entry := range entries {
+		dir := filepath.Join(nvmeSubsystemSysfs, entry.Name())
+		if nqn, err := readSysfsString(filepath.Join(dir, "subsysnqn")); err == nil && nqn == subsystemNQN {
+			return dir, nil
+		}
+	}
+	return "", fmt.Errorf("NVMe subsystem %s is not connected", subsystemNQN)
+}
+
+// nvmeDeviceConnection returns the subsystem and namespace behind an NVMe
+// namespace device. Both a multipath head and a single controller expose the
+// subsystem NQN on the device's parent.
+func nvmeDeviceConnection(device string) (StagingConnection, bool) {
+	name := filepath.Base(device)
+	if !nvmeNamespacePattern.MatchString(name) {
+		return StagingConnection{}, false
+	}
+	nqn, err := readSysfsString(filepath.Join(blockSysfs, name, "device", "subsysnqn"))
+	if err != nil || nqn == "" {
+		return StagingConnection{}, false
+	}
+	conn := StagingConnection{SubsystemNQN: nqn, NSID: 1}
+	if nsid, err := readSysfsString(filepath.Join(blockSysfs, name, "nsid")); err == nil {
+		if n, err := strconv.Atoi(nsid); err == nil {
+			conn.NSID = n
+		}
+	}
+	return conn, true
+}
+
+// nvmeSubsystemControllers returns the controller names (nvmeN) of a subsystem.
+func nvmeSubsystemControllers(subsysDir string) []string {
+	entries, _ := os.ReadDir(subsysDir)
+	var ctrls []string
+	for _, entry := range entries {
+		if nvmeControllerPattern.MatchString(entry.Name()) {
+			ctrls = append(ctrls, entry.Name())
+		}
+	}
+	return ctrls
+}
+
+// findNVMeNamespaceDevice returns the block device of a namespace. With native NVMe
+// multipath the namespace head sits in the subsystem directory; otherwise it is
+// found under the controller.
+func findNVMeNamespaceDevice(subsystemNQN string, nsid int) (string, error) {
+	subsys, err := findNVMeSubsystem(subsystemNQN)
+	if err != nil {
+		return "", err
+	}
+
+	dirs := []string{subsys}
+	for _, ctrl := range nvmeSubsystemControllers(subsys) {
+		dirs = append(dirs, filepath.Join(subsys, ctrl))
+	}
+	for _, dir := range dirs {
+		entries, _ := os.ReadDir(dir)
+		for _, entry := range entries {
+			name := entry.Name()
+			if !nvmeNamespacePattern.MatchString(name) {
+				continue
+			}
+			if id, err := readSysfsString(filepath.Join(dir, name, "nsid")); err == nil && id == strconv.Itoa(nsid) {
+				return "/dev/" + name, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("namespace %d of NVMe subsystem %s not found", nsid, subsystemNQN)
+}
+
+// waitForNVMeNamespaceDevice waits for a namespace to appear after connecting.
+func waitForNVMeNamespaceDevice(subsystemNQN string, nsid int) (string, error) {
+	var err error
+	for i := 0; i < nvmeDeviceRetryCount; i++ {
+		var devicePath string
+		if devicePath, err = findNVMeNamespaceDevice(subsystemNQN, nsid); err == nil {
+			if _, err = os.Stat(devicePath); err == nil {
+				return devicePath, nil
+			}
+		}
+		time.Sleep(nvmeDeviceCheckInterval)
+	}
+	return "", fmt.Errorf("NVMe device did not appear: %w", err)
+}
@@ -0,0 +1,295 @@
+package driver
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/go-logr/logr"
+	"github.com/truenas/truenas-csi/pkg/client"
+	"k8s.io/mount-utils"
+)
+
+const (
+	// paramNVMePortal overrides the NVMe/TCP address (host or host:port) nodes connect to.
+	paramNVMePortal = "nvme.portal"
+	// paramNVMeHosts restricts a subsystem to a comma-separated list of host NQNs.
+	// Without it any host may connect.
+	paramNVMeHosts = "nvme.hosts"
+
+	// maxNVMeSubsysNameLength keeps subsystem names, which become part of the
+	// subsystem NQN, well inside the 223 byte NQN limit.
+	maxNVMeSubsysNameLength = 96
+)
+
+func init() {
+	registerProtocol(&protocolDefinition{
+		name:        ProtocolNVMe,
+		block:       true,
+		accessModes: defaultAccessModes,
+		validateParameters: func(parameters map[string]string) error {
+			if err := validateZvolParameters(parameters); err != nil {
+				return err
+			}
+			return validateNVMeParameters(parameters)
+		},
+		newProvisioner: func(s *ControllerServer) ProtocolProvisioner {
+			return &nvmeProvisioner{s: s}
+		},
+		reconstruct: reconstructNVMeVolume,
+		listExports: listNVMeExports,
+		newHandler: func(mounter *mount.SafeFormatAndMount, stateDir string, log logr.Logger) (ProtocolHandler, error) {
+			handler, err := NewNVMeHandler(mounter, stateDir, log)
+			if err != nil {
+				return nil, err
+			}
+			return handler, nil
+		},
+	})
+}
+
+// reconstructNVMeVolume fills in the subsystem and namespace of a zvol exported over NVMe-oF.
+func reconstructNVMeVolume(ctx context.Context, d *Driver, dataset *client.Dataset, volInfo *VolumeInfo) bool {
+	ns, err := d.client.GetNVMetNamespaceByDevicePath(ctx, "zvol/"+volInfo.DatasetPath)
+	if err != nil || ns.Subsys == nil {
+		return false
+	}
+	volInfo.NVMeNamespaceID = ns.ID
+	volInfo.NVMeSubsysID = ns.Subsys.ID
+	volInfo.NSID = ns.NSID
+	volInfo.SubsystemNQN = ns.Subsys.SubNQN
+	volInfo.NVMePortal = d.nvmePortal
+	volInfo.VolumeContext["nvmePortal"] = d.nvmePortal
+	volInfo.VolumeContext["subsystemNQN"] = volInfo.SubsystemNQN
+	volInfo.VolumeContext["nsid"] = strconv.Itoa(volInfo.NSID)
+
+	d.log.V(LogLevelDebug).Info("Reconstructed NVMe volume", "volumeId", volInfo.ID, "capacityBytes", volInfo.CapacityBytes,
+		"subsystemNQN", volInfo.SubsystemNQN, "nsid", volInfo.NSID)
+	return true
+}
+
+// makeNVMeSubsysName creates a valid NVMe-oF subsystem name from a volume ID.
+// Names that are too long end in a hash of the volume ID, so volumes sharing a
+// long prefix still get distinct subsystems.
+func makeNVMeSubsysName(volumeID string) string {
+	name := strings.ToLower(fmt.Sprintf("csi-%s", strings.ReplaceAll(volumeID, "/", "-")))
+	if len(name) > maxNVMeSubsysNameLength {
+		suffix := fmt.Sprintf("-%x", sha256.Sum256([]byte(volumeID)))[:9]
+		name = name[:maxNVMeSubsysNameLength-len(suffix)] + suffix
+	}
+	return name
+}
+
+// nvmeHostsFromParameters returns the host NQNs allowed to connect, or nil for any host.
+func nvmeHostsFromParameters(parameters map[string]string) []string {
+	var hosts []string
+	for _, host := range strings.Split(parameters[paramNVMeHosts], ",") {
+		if host = strings.TrimSpace(host); host != "" {
+			hosts = append(hosts, host)
+		}
+	}
+	return hosts
+}
+
+// validateNVMeParameters checks the NVMe/TCP StorageClass parameters.
+func validateNVMeParameters(parameters map[string]string) error {
+	for _, host := range nvmeHostsFromParameters(parameters) {
+		if !strings.HasPrefix(host, "nqn.") {
+			return fmt.Errorf("invalid %s: %s is not an NQN", paramNVMeHosts, host)
+		}
+	}
+	return nil
+}
+
+// createNVMeVolume creates a ZVOL and exports it as the namespace of its own NVMe-oF subsystem.
+func (s *ControllerServer) createNVMeVolume(ctx context.Context, volumeID, datasetPath string, capacityBytes int64, parameters map[string]string) (*VolumeInfo, error) {
+	if err := s.createZvol(ctx, datasetPath, capacityBytes, parameters); err != nil {
+		return nil, err
+	}
+
+	volInfo, err := s.exportNVMeVolume(ctx, volumeID, datasetPath, capacityBytes, parameters)
+	if err != nil {
+		s.driver.Client().DeleteDataset(ctx, datasetPath, &client.DatasetDeleteOptions{Recursive: true, Force: true})
+		return nil, err
+	}
+
+	// Create snapshot task if configured in parameters
+	if _, err := s.createSnapshotTaskFromParameters(ctx, datasetPath, parameters); err != nil {
+		s.driver.Log().Error(err, "Failed to create snapshot task for volume", "dataset", datasetPath)
+	}
+
+	return volInfo, nil
+}
+
+// exportNVMeVolume creates a subsystem for a ZVOL, grants the configured hosts
+// access, links it to every TCP port and adds the ZVOL as its namespace. The ZVOL
+// is left in place on failure; the caller removes it.
+func (s *ControllerServer) exportNVMeVolume(ctx context.Context, volumeID, datasetPath string, capacityBytes int64, parameters map[string]string) (*VolumeInfo, error) {
+	ports, err := s.driver.Client().ListNVMetPorts(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list NVMe-oF ports: %w", err)
+	}
+	ports = tcpNVMetPorts(ports)
+	if len(ports) == 0 {
+		return nil, fmt.Errorf("no NVMe-oF TCP port configured in TrueNAS")
+	}
+
+	hosts := nvmeHostsFromParameters(parameters)
+	subsys, err := s.driver.Client().CreateNVMetSubsys(ctx, &client.NVMetSubsysCreateOptions{
+		Name:         makeNVMeSubsysName(volumeID),
+		AllowAnyHost: len(hosts) == 0,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create NVMe-oF subsystem: %w", err)
+	}
+
+	cleanup := func() {
+		s.driver.Client().DeleteNVMetSubsys(ctx, subsys.ID, &client.NVMetSubsysDeleteOptions{Force: true})
+	}
+
+	for _, hostNQN := range hosts {
+		host, err := s.driver.Client().GetNVMetHostByNQN(ctx, hostNQN)
+		if client.IsNotFoundError(err) {
+			host, err = s.driver.Client().CreateNVMetHost(ctx, hostNQN)
+		}
+		if err != nil {
+			cleanup()
+			return nil, fmt.Errorf("failed to get NVMe-oF host %s: %w", hostNQN, err)
+		}
+		if _, err := s.driver.Client().CreateNVMetHostSubsys(ctx, host.ID, subsys.ID); err != nil {
+			cleanup()
+			return nil, fmt.Errorf("failed to allow host %s on subsystem: %w", hostNQN, err)
+		}
+	}
+
+	for _, port := range ports {
+		if _, err := s.driver.Client().CreateNVMetPortSubsys(ctx, port.ID, subsys.ID); err != nil {
+			cleanup()
+			return nil, fmt.Errorf("failed to link subsystem to NVMe-oF port %d: %w", port.ID, err)
+		}
+	}
+
+	ns, err := s.driver.Client().CreateNVMetNamespace(ctx, subsys.ID, "zvol/"+datasetPath)
+	if err != nil {
+		cleanup()
+		return nil, fmt.Errorf("failed to create NVMe-oF namespace: %w", err)
+	}
+
+	s.driver.Log().V(LogLevelDebug).Info("Exported volume over NVMe/TCP", "volumeId", volumeID, "subsystemNQN", subsys.SubNQN, "nsid", ns.NSID)
+
+	pool := client.ExtractPoolFromPath(datasetPath)
+	volInfo := &VolumeInfo{
+		ID:              volumeID,
+		Name:            volumeID,
+		CapacityBytes:   capacityBytes,
+		DatasetPath:     datasetPath,
+		PoolName:        pool,
+		Protocol:        ProtocolNVMe,
+		SubsystemNQN:    subsys.SubNQN,
+		NVMePortal:      s.driver.GetNVMePortalFromParameters(parameters),
+		NSID:            ns.NSID,
+		NVMeSubsysID:    subsys.ID,
+		NVMeNamespaceID: ns.ID,
+		VolumeContext:   parameters,
+		AccessibleTopology: []*csi.Topology{
+			{
+				Segments: map[string]string{
+					"topology.truenas.io/pool": pool,
+				},
+			},
+		},
+	}
+
+	volInfo.VolumeContext["nvmePortal"] = volInfo.NVMePortal
+	volInfo.VolumeContext["subsystemNQN"] = subsys.SubNQN
+	volInfo.VolumeContext["nsid"] = strconv.Itoa(ns.NSID)
+
+	return volInfo, nil
+}
+
+// removeNVMeExport deletes a volume's namespace and subsystem. Host entries are
+// shared between subsystems and stay.
+func (s *ControllerServer) removeNVMeExport(ctx context.Context, volInfo *VolumeInfo) {
+	if volInfo.NVMeNamespaceID > 0 {
+		if err := s.driver.Client().DeleteNVMetNamespace(ctx, volInfo.NVMeNamespaceID); err != nil {
+			s.driver.Log().V(LogLevelDebug).Error(err, "Failed to delete NVMe-oF namespace", "namespaceId", volInfo.NVMeNamespaceID)
+		}
+	}
+	if volInfo.NVMeSubsysID > 0 {
+		if err := s.driver.Client().DeleteNVMetSubsys(ctx, volInfo.NVMeSubsysID, &client.NVMetSubsysDeleteOptions{Force: true}); err != nil {
+			s.driver.Log().V(LogLevelDebug).Error(err, "Failed to delete NVMe-oF subsystem", "subsysId", volInfo.NVMeSubsysID)
+		}
+	}
+}
+
+// nvmeProvisioner exports zvols as namespaces of NVMe-oF subsystems.
+type nvmeProvisioner struct {
+	s *ControllerServer
+}
+
+func (p *nvmeProvisioner) CreateVolume(ctx context.Context, volumeID, datasetPath string, capacityBytes int64, parameters map[string]string) (*VolumeInfo, error) {
+	return p.s.createNVMeVolume(ctx, volumeID, datasetPath, capacityBytes, parameters)
+}
+
+func (p *nvmeProvisioner) ExportVolume(ctx context.Context, volumeID, datasetPath string, dataset *client.Dataset, capacityBytes int64, parameters map[string]string) (*VolumeInfo, error) {
+	return p.s.exportNVMeVolume(ctx, volumeID, datasetPath, capacityBytes, parameters)
+}
+
+func (p *nvmeProvisioner) IsExported(ctx context.Context, datasetPath string, dataset *client.Dataset) (bool, error) {
+	if _, err := p.s.driver.Client().GetNVMetNamespaceByDevicePath(ctx, "zvol/"+datasetPath); err != nil {
+		if client.IsNotFoundError(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// listNVMeExports indexes the NVMe-oF namespaces by device path.
+func listNVMeExports(ctx context.Context, c *client.Client) (exportLookup, error) {
+	namespaces, err := c.ListNVMetNamespaces(ctx)
+	if err != nil {
+		return nil, err
+	}
+	devices := make(map[string]bool, len(namespaces))
+	for _, ns := range namespaces {
+		devices[ns.DevicePath] = true
+	}
+	return func(datasetPath string, dataset *client.Dataset) (bool, error) {
+		return devices["zvol/"+datasetPath], nil
+	}, nil
+}
+
+// RemoveExport deletes the namespace and subsystem of a volume. Without volume
+// info they are found through the namespace backed by the zvol.
+func (p *nvmeProvisioner) RemoveExport(ctx context.Context, datasetPath string, volInfo *VolumeInfo) {
+	if volInfo == nil {
+		ns, err := p.s.driver.Client().GetNVMetNamespaceByDevicePath(ctx, "zvol/"+datasetPath)
+		if err != nil {
+			if !client.IsNotFoundError(err) {
+				p.s.driver.Log().V(LogLevelDebug).Error(err, "Failed to look up NVMe-oF namespace", "dataset", datasetPath)
+			}
+			return
+		}
+		volInfo = &VolumeInfo{NVMeNamespaceID: ns.ID}
+		if ns.Subsys != nil {
+			volInfo.NVMeSubsysID = ns.Subsys.ID
+		}
+	}
+	p.s.removeNVMeExport(ctx, volInfo)
+}
+
+func (p *nvmeProvisioner) PublishContext(ctx context.Context, volInfo *VolumeInfo, volumeContext map[string]string) (map[string]string, bool) {
+	if volInfo.SubsystemNQN == "" {
+		return nil, false
+	}
+	return map[string]string{
+		PublishContextProtocol:     ProtocolNVMe,
+		PublishContextNVMePortal:   p.s.driver.GetNVMePortalFromParameters(volumeContext),
+		PublishContextSubsystemNQN: volInfo.SubsystemNQN,
+		PublishContextNSID:         strconv.Itoa(volInfo.NSID),
+	}, true
+}
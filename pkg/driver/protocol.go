@@ -0,0 +1,175 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/go-logr/logr"
+	"github.com/truenas/truenas-csi/pkg/client"
+	"k8s.io/mount-utils"
+)
+
+// defaultAccessModes are the access modes a protocol supports unless it declares its own.
+// SINGLE_NODE_MULTI_WRITER requires cluster-aware filesystem which we don't provide
+var defaultAccessModes = []csi.VolumeCapability_AccessMode_Mode{
+	csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+	csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY,
+	csi.VolumeCapability_AccessMode_SINGLE_NODE_SINGLE_WRITER,
+	csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY,
+	csi.VolumeCapability_AccessMode_MULTI_NODE_SINGLE_WRITER,
+	csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER,
+}
+
+// protocolDefinition describes a storage protocol: how the controller exports
+// volumes over it and how nodes attach them. Each protocol registers itself from
+// the file that implements it.
+type protocolDefinition struct {
+	// name is the value of the protocol StorageClass parameter
+	name string
+	// block protocols export zvols and support raw block volumes; the others share
+	// filesystem datasets
+	block bool
+	// accessModes are the access modes volumes of this protocol support
+	accessModes []csi.VolumeCapability_AccessMode_Mode
+	// validateParameters checks the protocol's StorageClass parameters (optional)
+	validateParameters func(parameters map[string]string) error
+	// newProvisioner returns the controller side of the protocol
+	newProvisioner func(s *ControllerServer) ProtocolProvisioner
+	// reconstruct fills in the export details of an existing volume from
+	// TrueNAS and reports whether its dataset is exported over this protocol.
+	// Optional.
+	reconstruct func(ctx context.Context, d *Driver, dataset *client.Dataset, volInfo *VolumeInfo) bool
+	// listExports fetches all exports of this protocol at once, for checking many
+	// datasets without a query each
+	listExports func(ctx context.Context, c *client.Client) (exportLookup, error)
+	// newHandler returns the node side of the protocol. stateDir is the node's
+	// state directory.
+	newHandler func(mounter *mount.SafeFormatAndMount, stateDir string, log logr.Logger) (ProtocolHandler, error)
+	// legacyRecord rebuilds the staging record of a volume staged by a driver that
+	// predates staging records from the state that driver left behind, or returns
+	// nil. Optional.
+	legacyRecord func(stateDir, volumeID string) *StagingRecord
+}
+
+// exportLookup reports whether a dataset is exported, like IsExported, from
+// exports fetched in advance.
+type exportLookup func(datasetPath string, dataset *client.Dataset) (bool, error)
+
+// protocolRegistry holds the registered protocols by name.
+var protocolRegistry = make(map[string]*protocolDefinition)
+
+// registerProtocol adds a protocol to the registry. Called from init functions.
+func registerProtocol(p *protocolDefinition) {
+	if _, ok := protocolRegistry[p.name]; ok {
+		panic(fmt.Sprintf("protocol %s registered twice", p.name))
+	}
+	protocolRegistry[p.name] = p
+}
+
+// lookupProtocol returns a registered protocol by name (case-insensitive).
+func lookupProtocol(name string) (*protocolDefinition, bool) {
+	p, ok := protocolRegistry[strings.ToLower(name)]
+	return p, ok
+}
+
+// registeredProtocols returns all protocols sorted by name.
+func registeredProtocols() []*protocolDefinition {
+	protocols := make([]*protocolDefinition, 0, len(protocolRegistry))
+	for _, p := range protocolRegistry {
+		protocols = append(protocols, p)
+	}
+	sort.Slice(protocols, func(i, j int) bool { return protocols[i].name < protocols[j].name })
+	return protocols
+}
+
+// protocolNames returns the sorted names of the registered protocols.
+func protocolNames() []string {
+	var names []string
+	for _, p := range registeredProtocols() {
+		names = append(names, p.name)
+	}
+	return names
+}
+
+// protocolNamesFor returns the sorted names of the block or filesystem protocols.
+func protocolNamesFor(block bool) []string {
+	var names []string
+	for _, p := range registeredProtocols() {
+		if p.block == block {
+			names = append(names, p.name)
+		}
+	}
+	return names
+}
+
+// registeredAccessModes returns the access modes supported by any protocol, in
+// the order of defaultAccessModes followed by any others.
+func registeredAccessModes() []*csi.VolumeCapability_AccessMode {
+	var modes []csi.VolumeCapability_AccessMode_Mode
+	for _, p := range registeredProtocols() {
+		for _, mode := range p.accessModes {
+			if !slices.Contains(modes, mode) {
+				modes = append(modes, mode)
+			}
+		}
+	}
+	sort.SliceStable(modes, func(i, j int) bool {
+		return accessModeOrder(modes[i]) < accessModeOrder(modes[j])
+	})
+
+	caps := make([]*csi.VolumeCapability_AccessMode, 0, len(modes))
+	for _, mode := range modes {
+		caps = append(caps, &csi.VolumeCapability_AccessMode{Mode: mode})
+	}
+	return caps
+}
+
+// accessModeOrder returns the position of a mode in defaultAccessModes; unknown modes sort last.
+func accessModeOrder(mode csi.VolumeCapability_AccessMode_Mode) int {
+	if i := slices.Index(defaultAccessModes, mode); i >= 0 {
+		return i
+	}
+	return len(defaultAccessModes)
+}
+
+// supportsAccessMode reports whether volumes of the protocol support an access mode.
+func (p *protocolDefinition) supportsAccessMode(mode csi.VolumeCapability_AccessMode_Mode) bool {
+	return slices.Contains(p.accessModes, mode)
+}
+
+// protocolForDataset returns the protocol an existing dataset is exported with: the
+// requested one, or NFS for filesystems and iSCSI for zvols if none is requested.
+func protocolForDataset(dataset *client.Dataset, requested string) (*protocolDefinition, error) {
+	var block bool
+	switch dataset.Type {
+	case "VOLUME":
+		block = true
+	case "FILESYSTEM":
+	default:
+		return nil, fmt.Errorf("%s has unsupported dataset type %q", dataset.ID, dataset.Type)
+	}
+
+	if requested == "" {
+		requested = ProtocolNFS
+		if block {
+			requested = ProtocolISCSI
+		}
+	}
+	p, ok := lookupProtocol(requested)
+	if !ok {
+		return nil, fmt.Errorf("invalid protocol: %s (valid: %s)", requested, strings.Join(protocolNames(), ", "))
+	}
+	if p.block != block {
+		kind := "a filesystem dataset"
+		if block {
+			kind = "a zvol"
+		}
+		return nil, fmt.Errorf("%s is %s and can only be published over %s, not %s",
+			dataset.ID, kind, strings.Join(protocolNamesFor(block), " or "), p.name)
+	}
+	return p, nil
+}
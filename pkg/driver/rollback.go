@@ -0,0 +1,281 @@
+package driver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/truenas/truenas-csi/pkg/client"
+)
+
+const (
+	// annotationRollbackTo on a PVC requests an in-place rollback of its volume
+	// to the snapshot of a VolumeSnapshot in the PVC's namespace, given by name,
+	// or to a ZFS snapshot of the volume, given as @<snapshot name>.
+	annotationRollbackTo = "csi.truenas.io/rollback-to"
+
+	// annotationRollbackDestroyNewer set to "true" lets the rollback destroy
+	// the snapshots taken after the one rolled back to (zfs rollback -r).
+	annotationRollbackDestroyNewer = "csi.truenas.io/rollback-destroy-newer"
+
+	// annotationRollbackStatus reports the state of the requested rollback
+	annotationRollbackStatus = "csi.truenas.io/rollback-status"
+)
+
+// rollbackPollInterval is how often PVCs are checked for rollback requests
+const rollbackPollInterval = 30 * time.Second
+
+// errRollbackPending is returned while a rollback has to wait for the volume
+// to be unpublished from all nodes.
+var errRollbackPending = errors.New("volume is published")
+
+// reconcileRollbacks carries out the rollbacks requested on the PVCs of the driver's volumes.
+func (s *ControllerServer) reconcileRollbacks(ctx context.Context, kube *kubeClient) error {
+	pvcs, err := kube.listPersistentVolumeClaims(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list PersistentVolumeClaims: %w", err)
+	}
+
+	for i := range pvcs {
+		pvc := &pvcs[i]
+		if pvc.Metadata.Annotations[annotationRollbackTo] == "" {
+			continue
+		}
+		s.reconcileRollback(ctx, kube, pvc)
+	}
+	return nil
+}
+
+// reconcileRollback rolls back the volume of a PVC and reports the outcome on
+// it. A finished or failed request is removed; a pending one is retried.
+func (s *ControllerServer) reconcileRollback(ctx context.Context, kube *kubeClient, pvc *kubePersistentVolumeClaim) {
+	if pvc.Spec.VolumeName == "" {
+		return
+	}
+	pv, err := kube.getPersistentVolume(ctx, pvc.Spec.VolumeName)
+	if err != nil {
+		s.driver.Log().V(LogLevelDebug).Info("Failed to get volume of PVC to roll back", "namespace", pvc.Metadata.Namespace, "name", pvc.Metadata.Name, "error", err)
+		return
+	}
+	if pv.Spec.CSI == nil || pv.Spec.CSI.Driver != s.driver.name {
+		return
+	}
+	volumeID := pv.Spec.CSI.VolumeHandle
+
+	target := pvc.Metadata.Annotations[annotationRollbackTo]
+	destroyNewer, _ := strconv.ParseBool(pvc.Metadata.Annotations[annotationRollbackDestroyNewer])
+
+	snapshotID, err := s.resolveRollbackTarget(ctx, kube, pvc.Metadata.Namespace, volumeID, target)
+	if err == nil {
+		err = s.rollbackVolume(ctx, kube, pv.Metadata.Name, volumeID, snapshotID, destroyNewer, pv.Spec.CSI.VolumeAttributes)
+	}
+
+	var state string
+	annotations := map[string]*string{}
+	switch {
+	case err == nil:
+		state = fmt.Sprintf("Succeeded: rolled back to %s at %s", snapshotID, time.Now().UTC().Format(time.RFC3339))
+		annotations[annotationRollbackTo] = nil
+		annotations[annotationRollbackDestroyNewer] = nil
+	case errors.Is(err, errRollbackPending):
+		state = "Pending: " + err.Error()
+		if pvc.Metadata.Annotations[annotationRollbackStatus] == state {
+			return
+		}
+	default:
+		state = "Failed: " + err.Error()
+		annotations[annotationRollbackTo] = nil
+		annotations[annotationRollbackDestroyNewer] = nil
+	}
+	annotations[annotationRollbackStatus] = &state
+
+	s.driver.Log().V(LogLevelInfo).Info("Volume rollback", "namespace", pvc.Metadata.Namespace, "name", pvc.Metadata.Name,
+		"volumeId", volumeID, "target", target, "status", state)
+	if err := kube.annotatePersistentVolumeClaim(ctx, pvc.Metadata.Namespace, pvc.Metadata.Name, annotations); err != nil {
+		s.driver.Log().Error(err, "Failed to report rollback status on PVC", "namespace", pvc.Metadata.Namespace, "name", pvc.Metadata.Name)
+	}
+}
+
+// resolveRollbackTarget returns the ID of the snapshot a rollback request names.
+func (s *ControllerServer) resolveRollbackTarget(ctx context.Context, kube *kubeClient, namespace, volumeID, target string) (string, error) {
+	var snapshotID string
+	if name, ok := strings.CutPrefix(target, "@"); ok {
+		snapshotID = volumeID + "@" + name
+	} else {
+		snapshot, err := kube.getVolumeSnapshot(ctx, namespace, target)
+		if err != nil {
+			if errors.Is(err, errKubeNotFound) {
+				return "", fmt.Errorf("VolumeSnapshot %s not found", target)
+			}
+			return "", err
+		}
+		contentName := snapshot.Spec.Source.VolumeSnapshotContentName
+		if snapshot.Status != nil && snapshot.Status.BoundVolumeSnapshotContentName != "" {
+			contentName = snapshot.Status.BoundVolumeSnapshotContentName
+		}
+		if contentName == "" {
+			return "", fmt.Errorf("VolumeSnapshot %s is not bound to a snapshot", target)
+		}
+		content, err := kube.getVolumeSnapshotContent(ctx, contentName)
+		if err != nil {
+			return "", fmt.Errorf("failed to get VolumeSnapshotContent %s: %w", contentName, err)
+		}
+		snapshotID = content.Spec.Source.SnapshotHandle
+		if content.Status != nil && content.Status.SnapshotHandle != "" {
+			snapshotID = content.Status.SnapshotHandle
+		}
+	}
+
+	if dataset, _, _ := strings.Cut(snapshotID, "@"); dataset != volumeID {
+		return "", fmt.Errorf("snapshot %s is not a snapshot of volume %s; restore it into a new PVC instead", snapshotID, volumeID)
+	}
+	return snapshotID, nil
+}
+
+// newerSnapshots returns the snapshots a rollback to target destroys, and those
+// among them that must not go: held ones, origins of clones and those named
+// like the snapshots of VolumeSnapshots, which need not be held.
+func newerSnapshots(snapshots []client.Snapshot, target *client.Snapshot) (newer, protected []string) {
+	for _, snap := range snapshots {
+		if snap.PropertyInt64("createtxg") <= target.PropertyInt64("createtxg") {
+			continue
+		}
+		newer = append(newer, snap.ID)
+		_, name, _ := strings.Cut(snap.ID, "@")
+		if snap.Holds() > 0 || len(snap.Clones()) > 0 || volumeSnapshotNamePattern.MatchString(name) {
+			protected = append(protected, snap.ID)
+		}
+	}
+	return newer, protected
+}
+
+// rollbackVolume rolls a volume back to one of its snapshots in place. The
+// volume must not be published on any node: while the rollback runs,
+// ControllerPublishVolume is refused, and VolumeAttachments of the volume make
+// it wait. Newer snapshots are only destroyed if destroyNewer is set, and
+// never those that back VolumeSnapshots or clones. The capacity and the share
+// or target of the volume are kept.
+func (s *ControllerServer) rollbackVolume(ctx context.Context, kube *kubeClient, pvName, volumeID, snapshotID string, destroyNewer bool, volumeContext map[string]string) error {
+	if _, busy := s.rollbacks.LoadOrStore(volumeID, struct{}{}); busy {
+		return fmt.Errorf("%w: another rollback of %s is running", errRollbackPending, volumeID)
+	}
+	defer s.rollbacks.Delete(volumeID)
+
+	// Checked once publishing is refused, so no attachment can slip in
+	attachments, err := kube.listVolumeAttachments(ctx)
+	if err != nil {
+		return fmt.Errorf("%w: cannot list VolumeAttachments: %v", errRollbackPending, err)
+	}
+	for _, attachment := range attachments {
+		if attachment.Spec.Attacher == s.driver.name && attachment.Spec.Source.PersistentVolumeName == pvName {
+			return fmt.Errorf("%w on node %s; stop the pods using it", errRollbackPending, attachment.Spec.NodeName)
+		}
+	}
+
+	dataset, err := s.driver.Client().GetDataset(ctx, volumeID)
+	if err != nil {
+		return fmt.Errorf("failed to get volume %s: %w", volumeID, err)
+	}
+
+	snapshots, err := s.driver.Client().ListSnapshotsWithProperties(ctx, volumeID, []string{"createtxg", "userrefs", "clones"})
+	if err != nil {
+		return fmt.Errorf("failed to list snapshots of %s: %w", volumeID, err)
+	}
+	var target *client.Snapshot
+	for i := range snapshots {
+		if snapshots[i].ID == snapshotID {
+			target = &snapshots[i]
+		}
+	}
+	if target == nil {
+		return fmt.Errorf("snapshot %s not found", snapshotID)
+	}
+
+	newer, protected := newerSnapshots(snapshots, target)
+	if len(newer) > 0 && !destroyNewer {
+		return fmt.Errorf("rolling back to %s destroys the newer snapshots %s; set %s to \"true\" to allow it",
+			snapshotID, strings.Join(newer, ", "), annotationRollbackDestroyNewer)
+	}
+	if len(protected) > 0 {
+		return fmt.Errorf("newer snapshots %s back VolumeSnapshots or clones; delete those first", strings.Join(protected, ", "))
+	}
+
+	s.driver.Log().V(LogLevelInfo).Info("Rolling back volume", "volumeId", volumeID, "snapshotId", snapshotID, "destroyedSnapshots", newer)
+	opts := &client.SnapshotRollbackOptions{Recursive: len(newer) > 0, Force: true}
+	if err := s.driver.Client().RollbackSnapshot(ctx, snapshotID, opts); err != nil {
+		return err
+	}
+
+	rolledBack, err := s.driver.Client().GetDataset(ctx, volumeID)
+	if err != nil {
+		return fmt.Errorf("failed to get volume %s after rollback: %w", volumeID, err)
+	}
+
+	// ZFS restores the volsize of the snapshot; the PV keeps its capacity
+	if rolledBack.Type == "VOLUME" && rolledBack.Volsize < dataset.Volsize {
+		volsize := dataset.Volsize
+		if err := s.driver.Client().UpdateDataset(ctx, volumeID, &client.DatasetUpdateOptions{Volsize: &volsize}); err != nil {
+			return fmt.Errorf("rolled back, but failed to restore the capacity of %s: %w", volumeID, err)
+		}
+		rolledBack.Volsize = volsize
+	}
+
+	if err := s.ensureExported(ctx, volumeID, rolledBack, volumeContext); err != nil {
+		return fmt.Errorf("rolled back, but failed to re-create the export of %s: %w", volumeID, err)
+	}
+	return nil
+}
+
+// ensureExported re-creates the share or target of a volume if it is gone.
+// Imported volumes are exported on their first publish and left alone.
+func (s *ControllerServer) ensureExported(ctx context.Context, volumeID string, dataset *client.Dataset, volumeContext map[string]string) error {
+	if dataset.UserProperties[PropertyImported] == "true" && dataset.UserProperties[PropertyExportManaged] != "true" {
+		return nil
+	}
+
+	protocol, err := protocolForDataset(dataset, volumeContext["protocol"])
+	if err != nil {
+		return err
+	}
+	provisioner := protocol.newProvisioner(s)
+	if exported, _ := provisioner.IsExported(ctx, volumeID, dataset); exported {
+		return nil
+	}
+
+	capacityBytes := dataset.RefQuota
+	if protocol.block {
+		capacityBytes = dataset.Volsize
+	}
+	s.driver.Log().V(LogLevelInfo).Info("Re-creating export of rolled back volume", "volumeId", volumeID, "protocol", protocol.name)
+	_, err = provisioner.ExportVolume(ctx, volumeID, volumeID, dataset, capacityBytes, volumeContext)
+	return err
+}
+
+// runRollbackReconciler periodically carries out requested rollbacks until ctx is done.
+func (s *ControllerServer) runRollbackReconciler(ctx context.Context) {
+	kube, err := newInClusterKubeClient()
+	if err != nil {
+		s.driver.Log().Error(err, "Volume rollback is enabled but cannot reach the Kubernetes API")
+		return
+	}
+
+	ticker := time.NewTicker(rollbackPollInterval)
+	defer ticker.Stop()
+
+	for {
+		reconcileCtx, cancel := context.WithTimeout(ctx, defaultOperationTimeout)
+		if err := s.reconcileRollbacks(reconcileCtx, kube); err != nil {
+			s.driver.Log().Error(err, "Failed to reconcile volume rollbacks")
+		}
+		cancel()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
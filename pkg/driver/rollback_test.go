@@ -0,0 +1,76 @@
+package driver
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/truenas/truenas-csi/pkg/client"
+)
+
+func TestNewerSnapshots(t *testing.T) {
+	const (
+		target         = "tank/k8s/pvc-1@auto-2026-01-01_00-00"
+		taskSnapshot   = "tank/k8s/pvc-1@auto-2026-01-02_00-00"
+		volumeSnapshot = "tank/k8s/pvc-1@snapshot-0b6f1d2c-3a4e-4f5a-8b9c-0d1e2f3a4b5c"
+		groupSnapshot  = "tank/k8s/pvc-1@groupsnapshot-7c8d9e0f-1a2b-4c3d-9e4f-5a6b7c8d9e0f"
+	)
+	snapshot := func(id string, txg, holds int64, clones ...string) client.Snapshot {
+		props := map[string]any{"createtxg": float64(txg), "userrefs": float64(holds)}
+		if len(clones) > 0 {
+			parsed := make([]any, len(clones))
+			for i, clone := range clones {
+				parsed[i] = clone
+			}
+			props["clones"] = map[string]any{"parsed": parsed}
+		}
+		return client.Snapshot{ID: id, Properties: props}
+	}
+
+	tests := []struct {
+		name      string
+		snapshots []client.Snapshot
+		newer     []string
+		protected []string
+	}{
+		{
+			name:      "latest snapshot",
+			snapshots: []client.Snapshot{snapshot(volumeSnapshot, 5, 0), snapshot(target, 10, 0)},
+		},
+		{
+			name:      "newer task snapshot",
+			snapshots: []client.Snapshot{snapshot(target, 10, 0), snapshot(taskSnapshot, 20, 0)},
+			newer:     []string{taskSnapshot},
+		},
+		{
+			name:      "unheld volume snapshot",
+			snapshots: []client.Snapshot{snapshot(target, 10, 0), snapshot(volumeSnapshot, 20, 0), snapshot(groupSnapshot, 30, 0)},
+			newer:     []string{volumeSnapshot, groupSnapshot},
+			protected: []string{volumeSnapshot, groupSnapshot},
+		},
+		{
+			name:      "held snapshot",
+			snapshots: []client.Snapshot{snapshot(target, 10, 0), snapshot(taskSnapshot, 20, 1)},
+			newer:     []string{taskSnapshot},
+			protected: []string{taskSnapshot},
+		},
+		{
+			name:      "origin of a clone",
+			snapshots: []client.Snapshot{snapshot(target, 10, 0), snapshot(taskSnapshot, 20, 0, "tank/k8s/pvc-2")},
+			newer:     []string{taskSnapshot},
+			protected: []string{taskSnapshot},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			i := slices.IndexFunc(tc.snapshots, func(snap client.Snapshot) bool { return snap.ID == target })
+			newer, protected := newerSnapshots(tc.snapshots, &tc.snapshots[i])
+			if !slices.Equal(newer, tc.newer) {
+				t.Errorf("newerSnapshots() newer = %v, want %v", newer, tc.newer)
+			}
+			if !slices.Equal(protected, tc.protected) {
+				t.Errorf("newerSnapshots() protected = %v, want %v", protected, tc.protected)
+			}
+		})
+	}
+}
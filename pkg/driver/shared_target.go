@@ -0,0 +1,243 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/truenas/truenas-csi/pkg/client"
+)
+
+const (
+	// paramISCSITargetMode selects how iSCSI volumes map to targets.
+	// Supported values: "dedicated" (default, one target per volume) and "shared".
+	paramISCSITargetMode = "iscsi.targetMode"
+	// paramSharedTargetName names the group of shared targets a StorageClass uses.
+	paramSharedTargetName = "iscsi.sharedTargetName"
+	// paramSharedTargetMaxLUNs caps the LUNs per shared target before another is created.
+	paramSharedTargetMaxLUNs = "iscsi.sharedTargetMaxLUNs"
+
+	iscsiTargetModeDedicated = "dedicated"
+	iscsiTargetModeShared    = "shared"
+
+	// sharedTargetPrefix starts the name of every shared target, which tells
+	// DeleteVolume to remove only the LUN and keep the target.
+	sharedTargetPrefix      = "csi-shared-"
+	sharedTargetAlias       = "CSI shared target %s"
+	defaultSharedTargetName = "default"
+
+	defaultSharedTargetMaxLUNs = 256
+	// maxISCSILUNs is the number of LUN IDs TrueNAS allows per target (0-1023).
+	maxISCSILUNs = 1024
+	// maxSharedTargets bounds the search for a shared target with a free LUN.
+	maxSharedTargets = 64
+)
+
+// isSharedTargetMode reports whether StorageClass parameters request shared targets.
+func isSharedTargetMode(parameters map[string]string) bool {
+	return strings.EqualFold(parameters[paramISCSITargetMode], iscsiTargetModeShared)
+}
+
+// isSharedISCSITargetName reports whether a target was created as a shared target.
+func isSharedISCSITargetName(name string) bool {
+	return strings.HasPrefix(name, sharedTargetPrefix)
+}
+
+// validateSharedTargetParameters checks the iSCSI target mode parameters.
+func validateSharedTargetParameters(parameters map[string]string) error {
+	mode, ok := parameters[paramISCSITargetMode]
+	if !ok {
+		return nil
+	}
+	switch strings.ToLower(mode) {
+	case iscsiTargetModeDedicated:
+		return nil
+	case iscsiTargetModeShared:
+	default:
+		return fmt.Errorf("invalid %s: %s (valid: dedicated, shared)", paramISCSITargetMode, mode)
+	}
+
+	// Auth and initiator groups belong to a target, so they cannot differ per volume
+	if parameters["iscsi.chapUser"] != "" || parameters["iscsi.initiators"] != "" {
+		return fmt.Errorf("iscsi.chapUser and iscsi.initiators are not supported with %s: shared; configure them on the shared target in TrueNAS", paramISCSITargetMode)
+	}
+	if name, ok := parameters[paramSharedTargetName]; ok && sanitizeSharedTargetName(name) == "" {
+		return fmt.Errorf("invalid %s: %q", paramSharedTargetName, name)
+	}
+	if _, err := sharedTargetMaxLUNs(parameters); err != nil {
+		return err
+	}
+	return nil
+}
+
+// sharedTargetMaxLUNs returns the LUN limit per shared target.
+func sharedTargetMaxLUNs(parameters map[string]string) (int, error) {
+	val, ok := parameters[paramSharedTargetMaxLUNs]
+	if !ok || val == "" {
+		return defaultSharedTargetMaxLUNs, nil
+	}
+	n, err := strconv.Atoi(val)
+	if err != nil || n < 1 || n > maxISCSILUNs {
+		return 0, fmt.Errorf("invalid %s: %s (valid: 1-%d)", paramSharedTargetMaxLUNs, val, maxISCSILUNs)
+	}
+	return n, nil
+}
+
+// sanitizeSharedTargetName lowercases a shared target group name and keeps only
+// characters valid in an IQN.
+func sanitizeSharedTargetName(name string) string {
+	name = strings.ToLower(strings.TrimSpace(name))
+	var b strings.Builder
+	for _, c := range name {
+		if (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') || c == '-' || c == '.' {
+			b.WriteRune(c)
+		}
+	}
+	return b.String()
+}
+
+// sharedTargetName returns the name of the index-th target of a shared target
+// group: the base name, then base-2, base-3, ... once earlier targets are full.
+func sharedTargetName(group string, index int) string {
+	name := sharedTargetPrefix + group
+	if index > 1 {
+		name = fmt.Sprintf("%s-%d", name, index)
+	}
+	if len(name) > maxISCSITargetNameLength {
+		name = name[:maxISCSITargetNameLength]
+	}
+	return name
+}
+
+// lowestFreeLUN returns the lowest LUN ID not used by assocs.
+func lowestFreeLUN(assocs []client.ISCSITargetExtent) int {
+	used := make(map[int]struct{}, len(assocs))
+	for _, assoc := range assocs {
+		used[assoc.LunID] = struct{}{}
+	}
+	lun := 0
+	for {
+		if _, ok := used[lun]; !ok {
+			return lun
+		}
+		lun++
+	}
+}
+
+// attachToSharedTarget maps an extent as the lowest free LUN of the first shared
+// target in the StorageClass's group that has room, creating targets as needed.
+// LUN allocation is serialized so concurrent CreateVolume calls cannot collide.
+func (s *ControllerServer) attachToSharedTarget(ctx context.Context, extentID int, parameters map[string]string) (*client.ISCSITarget, *client.ISCSITargetExtent, error) {
+	group := defaultSharedTargetName
+	if name := sanitizeSharedTargetName(parameters[paramSharedTargetName]); name != "" {
+		group = name
+	}
+	maxLUNs, err := sharedTargetMaxLUNs(parameters)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	s.driver.sharedTargetMu.Lock()
+	defer s.driver.sharedTargetMu.Unlock()
+
+	for i := 1; i <= maxSharedTargets; i++ {
+		name := sharedTargetName(group, i)
+
+		target, err := s.driver.Client().GetISCSITargetByName(ctx, name)
+		var assocs []client.ISCSITargetExtent
+		switch {
+		case client.IsNotFoundError(err):
+			target, err = s.driver.Client().CreateISCSITarget(ctx, name, fmt.Sprintf(sharedTargetAlias, group))
+			if err != nil {
+				return nil, nil, fmt.Errorf("failed to create shared iSCSI target %s: %w", name, err)
+			}
+			s.driver.Log().V(LogLevelInfo).Info("Created shared iSCSI target", "target", name, "targetId", target.ID)
+		case err != nil:
+			return nil, nil, fmt.Errorf("failed to look up shared iSCSI target %s: %w", name, err)
+		default:
+			assocs, err = s.driver.Client().ListISCSITargetExtentsByTarget(ctx, target.ID)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+
+		if len(assocs) >= maxLUNs {
+			continue
+		}
+
+		lun := lowestFreeLUN(assocs)
+		assoc, err := s.driver.Client().CreateISCSITargetExtent(ctx, target.ID, extentID, lun)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to map extent as LUN %d of shared target %s: %w", lun, name, err)
+		}
+		return target, assoc, nil
+	}
+
+	return nil, nil, fmt.Errorf("all %d shared targets of group %s are full (%s=%d)", maxSharedTargets, group, paramSharedTargetMaxLUNs, maxLUNs)
+}
+
+// exportSharedISCSIVolume creates the extent for a ZVOL and maps it as a LUN of a
+// shared target. The ZVOL is left in place on failure; the caller removes it.
+func (s *ControllerServer) exportSharedISCSIVolume(ctx context.Context, volumeID, datasetPath string, capacityBytes int64, blocksize int, parameters map[string]string) (*VolumeInfo, error) {
+	extent, err := s.driver.Client().CreateISCSIExtent(ctx, makeISCSIExtentName(volumeID), "zvol/"+datasetPath, blocksize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create iSCSI extent: %w", err)
+	}
+
+	target, assoc, err := s.attachToSharedTarget(ctx, extent.ID, parameters)
+	if err != nil {
+		s.driver.Client().DeleteISCSIExtent(ctx, extent.ID, &client.ISCSIExtentDeleteOptions{Force: true})
+		return nil, err
+	}
+
+	fullIQN := fmt.Sprintf("%s:%s", s.driver.GetISCSIIQNBaseFromParameters(parameters), target.Name)
+	s.driver.Log().V(LogLevelDebug).Info("Mapped volume to shared iSCSI target", "volumeId", volumeID, "targetIQN", fullIQN, "lun", assoc.LunID)
+
+	pool := client.ExtractPoolFromPath(datasetPath)
+	volInfo := &VolumeInfo{
+		ID:                volumeID,
+		Name:              volumeID,
+		CapacityBytes:     capacityBytes,
+		DatasetPath:       datasetPath,
+		PoolName:          pool,
+		Protocol:          ProtocolISCSI,
+		TargetIQN:         fullIQN,
+		TargetPortal:      s.driver.GetISCSIPortalFromParameters(parameters),
+		LUN:               assoc.LunID,
+		ISCSITargetID:     target.ID,
+		ISCSIExtentID:     extent.ID,
+		ISCSISharedTarget: true,
+		VolumeContext:     parameters,
+		AccessibleTopology: []*csi.Topology{
+			{
+				Segments: map[string]string{
+					"topology.truenas.io/pool": pool,
+				},
+			},
+		},
+	}
+
+	volInfo.VolumeContext["targetPortal"] = volInfo.TargetPortal
+	volInfo.VolumeContext["targetIQN"] = fullIQN
+	volInfo.VolumeContext["lun"] = strconv.Itoa(assoc.LunID)
+
+	return volInfo, nil
+}
+
+// removeSharedLUN unmaps a volume's LUN from its shared target and deletes the
+// extent. The target stays for the other volumes.
+func (s *ControllerServer) removeSharedLUN(ctx context.Context, volInfo *VolumeInfo) {
+	if volInfo.ISCSIExtentID == 0 {
+		return
+	}
+	if assoc, err := s.driver.Client().GetISCSITargetExtentByExtent(ctx, volInfo.ISCSIExtentID); err == nil {
+		if err := s.driver.Client().DeleteISCSITargetExtent(ctx, assoc.ID, &client.ISCSITargetExtentDeleteOptions{Force: true}); err != nil {
+			s.driver.Log().V(LogLevelDebug).Error(err, "Failed to unmap LUN from shared target", "targetId", assoc.Target, "lun", assoc.LunID)
+		}
+	}
+	if err := s.driver.Client().DeleteISCSIExtent(ctx, volInfo.ISCSIExtentID, &client.ISCSIExtentDeleteOptions{Force: true}); err != nil {
+		s.driver.Log().V(LogLevelDebug).Error(err, "Failed to delete iSCSI extent", "extentId", volInfo.ISCSIExtentID)
+	}
+}
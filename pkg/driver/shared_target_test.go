@@ -0,0 +1,35 @@
+package driver
+
+import (
+	"testing"
+
+	"github.com/truenas/truenas-csi/pkg/client"
+)
+
+func TestLowestFreeLUN(t *testing.T) {
+	tests := []struct {
+		name     string
+		luns     []int
+		expected int
+	}{
+		{name: "no LUNs", luns: nil, expected: 0},
+		{name: "first taken", luns: []int{0}, expected: 1},
+		{name: "contiguous", luns: []int{0, 1, 2}, expected: 3},
+		{name: "gap", luns: []int{0, 2, 3}, expected: 1},
+		{name: "unordered", luns: []int{3, 1, 0}, expected: 2},
+		{name: "zero free", luns: []int{1, 2}, expected: 0},
+		{name: "duplicates", luns: []int{0, 0, 1}, expected: 2},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			assocs := make([]client.ISCSITargetExtent, 0, len(tc.luns))
+			for _, lun := range tc.luns {
+				assocs = append(assocs, client.ISCSITargetExtent{LunID: lun})
+			}
+			if lun := lowestFreeLUN(assocs); lun != tc.expected {
+				t.Errorf("lowestFreeLUN(%v) = %d, want %d", tc.luns, lun, tc.expected)
+			}
+		})
+	}
+}
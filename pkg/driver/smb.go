@@ -0,0 +1,223 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/go-logr/logr"
+	"k8s.io/mount-utils"
+)
+
+// StorageClass parameter keys for SMB configuration
+const (
+	paramSMBMountOptions = "smb.mountOptions"
+)
+
+// Node-publish secret keys holding the SMB credentials
+const (
+	smbSecretUsername = "username"
+	smbSecretPassword = "password"
+	smbSecretDomain   = "domain"
+)
+
+// SMBHandler implements the ProtocolHandler interface for SMB volumes
+type SMBHandler struct {
+	mounter mount.Interface
+	log     logr.Logger
+}
+
+// SMBConfig holds SMB-specific configuration parsed from volume/publish contexts
+type SMBConfig struct {
+	Server       string
+	Share        string
+	MountOptions []string
+}
+
+// NewSMBHandler creates a new SMB protocol handler
+func NewSMBHandler(mounter mount.Interface, log logr.Logger) *SMBHandler {
+	return &SMBHandler{
+		mounter: mounter,
+		log:     log,
+	}
+}
+
+// Protocol returns the protocol name
+func (h *SMBHandler) Protocol() string {
+	return ProtocolSMB
+}
+
+// parseSMBConfig extracts SMB configuration from publish and volume contexts
+func parseSMBConfig(publishContext, volumeContext map[string]string) *SMBConfig {
+	config := &SMBConfig{}
+
+	config.Server = publishContext[PublishContextSMBServer]
+	if config.Server == "" {
+		config.Server = volumeContext[PublishContextSMBServer]
+	}
+
+	config.Share = publishContext[PublishContextSMBShare]
+	if config.Share == "" {
+		config.Share = volumeContext[PublishContextSMBShare]
+	}
+
+	if val, ok := volumeContext[paramSMBMountOptions]; ok && val != "" {
+		for _, opt := range strings.Split(val, ",") {
+			opt = strings.TrimSpace(opt)
+			if opt != "" {
+				config.MountOptions = append(config.MountOptions, opt)
+			}
+		}
+	}
+
+	return config
+}
+
+// smbCredentialOptions builds the sensitive mount options from the node-publish
+// secrets. They are passed to mount.cifs but never logged.
+func smbCredentialOptions(secrets map[string]string) ([]string, error) {
+	username := secrets[smbSecretUsername]
+	if username == "" {
+		return nil, fmt.Errorf("SMB volumes require a node-publish secret with a %q key", smbSecretUsername)
+	}
+
+	options := []string{
+		"username=" + username,
+		"password=" + secrets[smbSecretPassword],
+	}
+	if domain := secrets[smbSecretDomain]; domain != "" {
+		options = append(options, "domain="+domain)
+	}
+	return options, nil
+}
+
+// mountWithTimeout executes a mount with sensitive options with a timeout
+func (h *SMBHandler) mountWithTimeout(ctx context.Context, source, target string, options, sensitiveOptions []string) error {
+	mountCtx, cancel := context.WithTimeout(ctx, defaultMountTimeout)
+	defer cancel()
+
+	h.log.V(LogLevelDebug).Info("Executing mount command", "source", source, "target", target, "fsType", "cifs", "options", options, "timeout", defaultMountTimeout)
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- h.mounter.MountSensitive(source, target, "cifs", options, sensitiveOptions)
+	}()
+
+	select {
+	case <-mountCtx.Done():
+		if mountCtx.Err() == context.DeadlineExceeded {
+			return fmt.Errorf("mount timed out after %v", defaultMountTimeout)
+		}
+		return mountCtx.Err()
+	case err := <-errCh:
+		if err != nil {
+			return fmt.Errorf("mount failed: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// Stage is a no-op for SMB (the share is mounted directly in Publish)
+func (h *SMBHandler) Stage(ctx context.Context, req *StageRequest) (*StageResult, error) {
+	h.log.V(LogLevelDebug).Info("SMB Stage (no-op)", "volumeId", req.VolumeID)
+
+	if req.IsBlockVolume {
+		return nil, fmt.Errorf("SMB does not support raw block volumes")
+	}
+
+	return &StageResult{}, nil
+}
+
+// Unstage is a no-op for SMB
+func (h *SMBHandler) Unstage(ctx context.Context, req *UnstageRequest) error {
+	h.log.V(LogLevelDebug).Info("SMB Unstage (no-op)", "volumeId", req.VolumeID)
+	return nil
+}
+
+// Publish mounts the SMB share at the target path with the credentials from the
+// node-publish secrets
+func (h *SMBHandler) Publish(ctx context.Context, req *PublishRequest) error {
+	h.log.V(LogLevelDebug).Info("SMB Publish", "volumeId", req.VolumeID, "targetPath", req.TargetPath)
+
+	config := parseSMBConfig(req.PublishContext, req.VolumeContext)
+	if config.Server == "" || config.Share == "" {
+		return fmt.Errorf("SMB server and share are required")
+	}
+
+	credentials, err := smbCredentialOptions(req.Secrets)
+	if err != nil {
+		return err
+	}
+
+	source := formatSMBSource(config.Server, config.Share)
+
+	notMounted, err := h.mounter.IsLikelyNotMountPoint(req.TargetPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			if err := os.MkdirAll(req.TargetPath, 0o750); err != nil {
+				return fmt.Errorf("failed to create target directory: %w", err)
+			}
+			notMounted = true
+		} else {
+			return fmt.Errorf("failed to check mount point: %w", err)
+		}
+	}
+
+	if !notMounted {
+		h.log.V(LogLevelDebug).Info("Volume already mounted", "targetPath", req.TargetPath)
+		return nil
+	}
+
+	// Mount flags from the capability win over StorageClass options
+	var mountOptions []string
+	switch {
+	case len(req.MountFlags) > 0:
+		mountOptions = slices.Clone(req.MountFlags)
+	case len(config.MountOptions) > 0:
+		mountOptions = slices.Clone(config.MountOptions)
+	default:
+		mountOptions = []string{"vers=3.0"}
+	}
+	if req.ReadOnly && !slices.Contains(mountOptions, "ro") {
+		mountOptions = append(mountOptions, "ro")
+	}
+
+	h.log.V(LogLevelDebug).Info("Mounting SMB volume", "source", source, "target", req.TargetPath, "options", mountOptions)
+
+	if err := h.mountWithTimeout(ctx, source, req.TargetPath, mountOptions, credentials); err != nil {
+		return fmt.Errorf("failed to mount SMB volume %s: %w", source, err)
+	}
+
+	h.log.V(LogLevelDebug).Info("SMB volume published", "volumeId", req.VolumeID, "targetPath", req.TargetPath)
+	return nil
+}
+
+// Unpublish implements SMB volume unpublishing
+func (h *SMBHandler) Unpublish(ctx context.Context, req *UnpublishRequest) error {
+	h.log.V(LogLevelDebug).Info("SMB Unpublish", "volumeId", req.VolumeID, "targetPath", req.TargetPath)
+
+	if err := mount.CleanupMountPoint(req.TargetPath, h.mounter, true); err != nil {
+		return fmt.Errorf("failed to unmount: %w", err)
+	}
+
+	h.log.V(LogLevelDebug).Info("SMB volume unpublished", "volumeId", req.VolumeID, "targetPath", req.TargetPath)
+	return nil
+}
+
+// Expand is a no-op for SMB (expansion happens on the server)
+func (h *SMBHandler) Expand(ctx context.Context, req *ExpandRequest) (*ExpandResult, error) {
+	h.log.V(LogLevelDebug).Info("SMB Expand (no-op, expansion happens on server)", "volumeId", req.VolumeID)
+	return &ExpandResult{CapacityBytes: req.CapacityBytes}, nil
+}
+
+// formatSMBSource formats a UNC source (//server/share) for mount.cifs. IPv6
+// addresses are enclosed in brackets.
+func formatSMBSource(server, share string) string {
+	if isIPv6Address(server) {
+		server = "[" + server + "]"
+	}
+	return fmt.Sprintf("//%s/%s", server, share)
+}
@@ -0,0 +1,254 @@
+package driver
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/go-logr/logr"
+	"github.com/truenas/truenas-csi/pkg/client"
+	"k8s.io/mount-utils"
+)
+
+const (
+	// paramSMBServer overrides the SMB server address nodes mount from.
+	paramSMBServer = "smb.server"
+	// paramSMBBrowsable makes the share visible when browsing the server.
+	paramSMBBrowsable = "smb.browsable"
+
+	// smbShareTypeSMB is the dataset share type that applies the SMB ACL preset
+	// (NFSv4 ACLs, restricted aclmode, case-insensitive names).
+	smbShareTypeSMB = "SMB"
+
+	// maxSMBShareNameLength is the longest share name TrueNAS accepts.
+	maxSMBShareNameLength = 80
+)
+
+func init() {
+	registerProtocol(&protocolDefinition{
+		name:               ProtocolSMB,
+		accessModes:        defaultAccessModes,
+		validateParameters: validateSMBParameters,
+		newProvisioner: func(s *ControllerServer) ProtocolProvisioner {
+			return &smbProvisioner{s: s}
+		},
+		reconstruct: reconstructSMBVolume,
+		listExports: listSMBExports,
+		newHandler: func(mounter *mount.SafeFormatAndMount, stateDir string, log logr.Logger) (ProtocolHandler, error) {
+			return NewSMBHandler(mounter, log), nil
+		},
+	})
+}
+
+// makeSMBShareName creates a valid SMB share name from a volume ID. Names that
+// are too long end in a hash of the volume ID, so volumes sharing a long
+// prefix still get distinct shares.
+func makeSMBShareName(volumeID string) string {
+	name := fmt.Sprintf("csi-%s", strings.ReplaceAll(volumeID, "/", "-"))
+	if len(name) > maxSMBShareNameLength {
+		suffix := fmt.Sprintf("-%x", sha256.Sum256([]byte(volumeID)))[:9]
+		name = name[:maxSMBShareNameLength-len(suffix)] + suffix
+	}
+	return name
+}
+
+// validateSMBParameters checks the SMB StorageClass parameters.
+func validateSMBParameters(parameters map[string]string) error {
+	if val, ok := parameters[paramSMBBrowsable]; ok {
+		if _, err := strconv.ParseBool(val); err != nil {
+			return fmt.Errorf("invalid %s: %s (must be true or false)", paramSMBBrowsable, val)
+		}
+	}
+	return nil
+}
+
+// createSMBVolume creates a ZFS filesystem dataset with the SMB ACL preset and an
+// SMB share for the volume.
+func (s *ControllerServer) createSMBVolume(ctx context.Context, volumeID, datasetPath string, capacityBytes int64, parameters map[string]string) (*VolumeInfo, error) {
+	dataset, err := s.createFilesystemDataset(ctx, datasetPath, capacityBytes, parameters, smbShareTypeSMB)
+	if err != nil {
+		return nil, err
+	}
+
+	volInfo, err := s.createSMBShareForVolume(ctx, volumeID, datasetPath, dataset, parameters)
+	if err != nil {
+		s.driver.Client().DeleteDataset(ctx, datasetPath, &client.DatasetDeleteOptions{Recursive: true, Force: true})
+		return nil, err
+	}
+	volInfo.CapacityBytes = capacityBytes
+
+	// Create snapshot task if configured in parameters
+	if _, err := s.createSnapshotTaskFromParameters(ctx, datasetPath, parameters); err != nil {
+		s.driver.Log().Error(err, "Failed to create snapshot task for volume", "dataset", datasetPath)
+	}
+
+	return volInfo, nil
+}
+
+// createSMBShareForVolume creates an SMB share for a filesystem dataset. Used for
+// new volumes, clones and imported datasets.
+func (s *ControllerServer) createSMBShareForVolume(ctx context.Context, volumeID, datasetPath string, dataset *client.Dataset, parameters map[string]string) (*VolumeInfo, error) {
+	mountpoint := dataset.Mountpoint
+	if mountpoint == "" {
+		mountpoint = filepath.Join(DefaultMountpoint, datasetPath)
+	}
+
+	browsable, _ := strconv.ParseBool(parameters[paramSMBBrowsable])
+	shareOpts := &client.SMBShareCreateOptions{
+		Name:      makeSMBShareName(volumeID),
+		Path:      mountpoint,
+		Comment:   fmt.Sprintf("CSI volume %s", volumeID),
+		Browsable: browsable,
+		Enabled:   true,
+	}
+
+	s.driver.Log().V(LogLevelDebug).Info("Creating SMB share", "name", shareOpts.Name, "mountpoint", mountpoint)
+	share, err := s.driver.Client().CreateSMBShare(ctx, shareOpts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create SMB share: %w", err)
+	}
+	s.driver.Log().V(LogLevelInfo).Info("Successfully created SMB share", "shareId", share.ID, "name", share.Name, "path", mountpoint)
+
+	pool := client.ExtractPoolFromPath(datasetPath)
+	volInfo := &VolumeInfo{
+		ID:            volumeID,
+		Name:          volumeID,
+		CapacityBytes: dataset.RefQuota,
+		DatasetPath:   datasetPath,
+		PoolName:      pool,
+		Protocol:      ProtocolSMB,
+		SMBShareName:  share.Name,
+		SMBShareID:    share.ID,
+		VolumeContext: parameters,
+		AccessibleTopology: []*csi.Topology{
+			{
+				Segments: map[string]string{
+					"topology.truenas.io/pool": pool,
+				},
+			},
+		},
+	}
+
+	if server := s.driver.GetSMBServerFromParameters(parameters); server != "" {
+		volInfo.VolumeContext["smbServer"] = server
+	}
+	volInfo.VolumeContext["smbShare"] = share.Name
+
+	return volInfo, nil
+}
+
+// removeSMBShare deletes the SMB share of a dataset, if there is one.
+// The share is found by the dataset's mountpoint, as in IsExported.
+func (s *ControllerServer) removeSMBShare(ctx context.Context, datasetPath string) {
+	dataset, err := s.driver.Client().GetDataset(ctx, datasetPath)
+	if err != nil {
+		s.driver.Log().V(LogLevelDebug).Info("Failed to get dataset, looking up SMB share by default mountpoint", "dataset", datasetPath, "error", err)
+		dataset = nil
+	}
+	path := datasetMountpoint(datasetPath, dataset)
+	share, err := s.driver.Client().GetSMBShareByPath(ctx, path)
+	if err != nil {
+		if !client.IsNotFoundError(err) {
+			s.driver.Log().V(LogLevelDebug).Error(err, "Failed to look up SMB share", "path", path)
+		}
+		return
+	}
+
+	s.driver.Log().V(LogLevelDebug).Info("Deleting SMB share before dataset", "shareId", share.ID, "name", share.Name)
+	if err := s.driver.Client().DeleteSMBShare(ctx, share.ID); err != nil {
+		s.driver.Log().V(LogLevelDebug).Error(err, "Failed to delete SMB share", "shareId", share.ID)
+	}
+}
+
+// reconstructSMBVolume fills in the share of a filesystem dataset shared only over SMB.
+func reconstructSMBVolume(ctx context.Context, d *Driver, dataset *client.Dataset, volInfo *VolumeInfo) bool {
+	share, ok := d.lookupSMBOnlyShare(ctx, dataset)
+	if !ok {
+		return false
+	}
+	volInfo.SMBShareName = share.Name
+	volInfo.SMBShareID = share.ID
+
+	if d.smbServer != "" {
+		volInfo.VolumeContext["smbServer"] = d.smbServer
+	}
+	volInfo.VolumeContext["smbShare"] = share.Name
+
+	d.log.V(LogLevelDebug).Info("Reconstructed SMB volume", "volumeId", volInfo.ID, "capacityBytes", volInfo.CapacityBytes, "share", share.Name)
+	return true
+}
+
+// lookupSMBOnlyShare returns the SMB share of a filesystem dataset that has no NFS
+// share. Datasets exported both ways are treated as NFS volumes.
+func (d *Driver) lookupSMBOnlyShare(ctx context.Context, dataset *client.Dataset) (*client.SMBShare, bool) {
+	mountpoint := dataset.Mountpoint
+	if mountpoint == "" {
+		mountpoint = filepath.Join(DefaultMountpoint, dataset.Name)
+	}
+	share, err := d.client.GetSMBShareByPath(ctx, mountpoint)
+	if err != nil {
+		return nil, false
+	}
+	if _, err := d.client.GetNFSShareByPath(ctx, mountpoint); err == nil {
+		return nil, false
+	}
+	return share, true
+}
+
+// smbProvisioner exports filesystem datasets as SMB shares.
+type smbProvisioner struct {
+	s *ControllerServer
+}
+
+func (p *smbProvisioner) CreateVolume(ctx context.Context, volumeID, datasetPath string, capacityBytes int64, parameters map[string]string) (*VolumeInfo, error) {
+	return p.s.createSMBVolume(ctx, volumeID, datasetPath, capacityBytes, parameters)
+}
+
+func (p *smbProvisioner) ExportVolume(ctx context.Context, volumeID, datasetPath string, dataset *client.Dataset, capacityBytes int64, parameters map[string]string) (*VolumeInfo, error) {
+	return p.s.createSMBShareForVolume(ctx, volumeID, datasetPath, dataset, parameters)
+}
+
+func (p *smbProvisioner) IsExported(ctx context.Context, datasetPath string, dataset *client.Dataset) (bool, error) {
+	if _, err := p.s.driver.Client().GetSMBShareByPath(ctx, datasetMountpoint(datasetPath, dataset)); err != nil {
+		if client.IsNotFoundError(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// listSMBExports indexes the SMB shares by path.
+func listSMBExports(ctx context.Context, c *client.Client) (exportLookup, error) {
+	shares, err := c.ListSMBShares(ctx)
+	if err != nil {
+		return nil, err
+	}
+	paths := make(map[string]bool, len(shares))
+	for _, share := range shares {
+		paths[share.Path] = true
+	}
+	return func(datasetPath string, dataset *client.Dataset) (bool, error) {
+		return paths[datasetMountpoint(datasetPath, dataset)], nil
+	}, nil
+}
+
+// RemoveExport deletes the SMB share by path like NFS shares.
+func (p *smbProvisioner) RemoveExport(ctx context.Context, datasetPath string, volInfo *VolumeInfo) {
+	p.s.removeSMBShare(ctx, datasetPath)
+}
+
+func (p *smbProvisioner) PublishContext(ctx context.Context, volInfo *VolumeInfo, volumeContext map[string]string) (map[string]string, bool) {
+	if volInfo.SMBShareName == "" {
+		return nil, false
+	}
+	return map[string]string{
+		PublishContextProtocol:  ProtocolSMB,
+		PublishContextSMBServer: p.s.driver.GetSMBServerFromParameters(volumeContext),
+		PublishContextSMBShare:  volInfo.SMBShareName,
+	}, true
+}
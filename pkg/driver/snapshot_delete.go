@@ -0,0 +1,145 @@
+package driver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/truenas/truenas-csi/pkg/client"
+)
+
+// SnapshotDeletePolicy selects what DeleteSnapshot does with a snapshot that
+// clones depend on.
+type SnapshotDeletePolicy string
+
+const (
+	// SnapshotDeleteDefer marks the snapshot for deferred destroy and hides it;
+	// ZFS destroys it once the last clone is gone (default).
+	SnapshotDeleteDefer SnapshotDeletePolicy = "defer"
+	// SnapshotDeleteFail fails with FailedPrecondition until the clones are gone.
+	SnapshotDeleteFail SnapshotDeletePolicy = "fail"
+)
+
+// snapshotSweepInterval is how often the controller destroys deferred
+// snapshots whose clones are gone.
+const snapshotSweepInterval = 15 * time.Minute
+
+// errSnapshotHasClones is returned when the snapshot delete policy refuses to
+// delete a snapshot that clones depend on.
+var errSnapshotHasClones = errors.New("snapshot has dependent clones")
+
+// deleteSnapshot deletes the snapshot of a VolumeSnapshot under the snapshot
+// delete policy. Deleting a missing snapshot is not an error.
+func (d *Driver) deleteSnapshot(ctx context.Context, snapshotID string) error {
+	snap, err := d.Client().GetSnapshot(ctx, snapshotID)
+	if err != nil {
+		if client.IsNotFoundError(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to look up snapshot %s: %w", snapshotID, err)
+	}
+
+	// ZFS cannot destroy a snapshot that clones depend on
+	clones := snap.Clones()
+	if len(clones) > 0 && d.snapshotDeletePolicy == SnapshotDeleteFail {
+		return fmt.Errorf("%w: snapshot %s has dependent clones %s; delete them first, or restore with cloneStrategy copy or promote",
+			errSnapshotHasClones, snapshotID, strings.Join(clones, ", "))
+	}
+
+	// Nor a held one, not even deferred
+	if snap.HasHold(snapshotHoldTag) {
+		if err := d.releaseSnapshot(ctx, snapshotID); err != nil {
+			return fmt.Errorf("failed to release snapshot %s: %w", snapshotID, err)
+		}
+	}
+
+	if len(clones) > 0 {
+		if err := d.deferSnapshotDelete(ctx, snap); err != nil {
+			return fmt.Errorf("failed to defer deletion of snapshot %s: %w", snapshotID, err)
+		}
+		return nil
+	}
+
+	if err := d.Client().DeleteSnapshot(ctx, snapshotID); err != nil && !client.IsNotFoundError(err) {
+		return fmt.Errorf("failed to delete snapshot %s: %w", snapshotID, err)
+	}
+	return nil
+}
+
+// deferSnapshotDelete marks a snapshot for deferred destroy. Until ZFS destroys
+// it, ListSnapshots does not return it.
+func (d *Driver) deferSnapshotDelete(ctx context.Context, snap *client.Snapshot) error {
+	d.Log().V(LogLevelInfo).Info("Deferring deletion of snapshot with dependent clones", "snapshotId", snap.ID, "clones", strings.Join(snap.Clones(), ","))
+	return d.Client().DeleteSnapshotDeferred(ctx, snap.ID)
+}
+
+// sweepDeferredSnapshots destroys snapshots marked for deferred destroy that
+// no clone depends on anymore. ZFS does this itself when the last clone is
+// destroyed, but not when a hold outlived the clones or the clone was
+// promoted away. Only snapshots the driver deferred are destroyed: those of
+// VolumeSnapshots of the driver's volumes.
+func (s *ControllerServer) sweepDeferredSnapshots(ctx context.Context) {
+	snapshots, err := s.driver.Client().ListAllSnapshots(ctx)
+	if err != nil {
+		s.driver.Log().Error(err, "Failed to list snapshots for deferred deletion")
+		return
+	}
+
+	driverDatasets := make(map[string]bool)
+	for i := range snapshots {
+		snap := &snapshots[i]
+		if !snap.DeferDestroy() || len(snap.Clones()) > 0 {
+			continue
+		}
+		dataset, name, _ := strings.Cut(snap.ID, "@")
+		if !volumeSnapshotNamePattern.MatchString(name) {
+			continue
+		}
+		owned, ok := driverDatasets[dataset]
+		if !ok {
+			owned = s.isDriverDataset(ctx, dataset)
+			driverDatasets[dataset] = owned
+		}
+		if !owned {
+			continue
+		}
+
+		err := s.driver.Client().DeleteSnapshot(ctx, snap.ID)
+		if err != nil && !client.IsNotFoundError(err) {
+			s.driver.Log().V(LogLevelDebug).Info("Deferred snapshot cannot be destroyed yet", "snapshotId", snap.ID, "error", err)
+			continue
+		}
+		s.driver.Log().V(LogLevelInfo).Info("Destroyed deferred snapshot", "snapshotId", snap.ID)
+	}
+}
+
+// isDriverDataset reports whether the driver created or imported a dataset.
+// Datasets that cannot be read are not.
+func (s *ControllerServer) isDriverDataset(ctx context.Context, datasetPath string) bool {
+	dataset, err := s.driver.Client().GetDataset(ctx, datasetPath)
+	if err != nil {
+		return false
+	}
+	props := dataset.UserProperties
+	return props[PropertyManaged] == "true" || props[PropertyImported] == "true" || props[PropertyAdopted] == "true"
+}
+
+// runSnapshotSweeper periodically finishes deferred snapshot deletions until ctx is done.
+func (s *ControllerServer) runSnapshotSweeper(ctx context.Context) {
+	ticker := time.NewTicker(snapshotSweepInterval)
+	defer ticker.Stop()
+
+	for {
+		sweepCtx, cancel := context.WithTimeout(ctx, defaultOperationTimeout)
+		s.sweepDeferredSnapshots(sweepCtx)
+		cancel()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
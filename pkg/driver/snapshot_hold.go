@@ -0,0 +1,81 @@
+package driver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/truenas/truenas-csi/pkg/client"
+)
+
+const (
+	// paramSnapshotHold is the VolumeSnapshotClass (and VolumeGroupSnapshotClass)
+	// parameter that opts out of holding snapshots: "false" leaves them unheld.
+	paramSnapshotHold = "hold"
+
+	// snapshotHoldTag is the tag of the holds the driver places, so that holds
+	// of others are left alone
+	snapshotHoldTag = "csi.truenas.io"
+)
+
+// errSnapshotsHeld is returned when a dataset cannot be destroyed because
+// VolumeSnapshots hold some of its snapshots.
+var errSnapshotsHeld = errors.New("snapshots are held")
+
+// parseSnapshotHold returns whether snapshots of a snapshot class are held. Unset means held.
+func parseSnapshotHold(parameters map[string]string) (bool, error) {
+	val, ok := parameters[paramSnapshotHold]
+	if !ok || val == "" {
+		return true, nil
+	}
+	hold, err := strconv.ParseBool(val)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s: %s (must be true or false)", paramSnapshotHold, val)
+	}
+	return hold, nil
+}
+
+// holdSnapshot places a ZFS user hold on a snapshot created for a
+// VolumeSnapshot, so neither periodic snapshot task retention nor an admin
+// can destroy it while the VolumeSnapshot exists.
+func (d *Driver) holdSnapshot(ctx context.Context, snap *client.Snapshot) error {
+	if snap.HasHold(snapshotHoldTag) {
+		return nil
+	}
+	d.Log().V(LogLevelDebug).Info("Holding snapshot", "snapshotId", snap.ID)
+	return d.Client().HoldSnapshot(ctx, snap.ID, snapshotHoldTag)
+}
+
+// releaseSnapshot releases the driver's hold on a snapshot before it is
+// destroyed. Holds placed by others are kept.
+func (d *Driver) releaseSnapshot(ctx context.Context, snapshotID string) error {
+	err := d.Client().ReleaseSnapshot(ctx, snapshotID, snapshotHoldTag)
+	if err != nil && !client.IsNotFoundError(err) {
+		return err
+	}
+	return nil
+}
+
+// checkSnapshotsHeld fails with errSnapshotsHeld if a snapshot of the dataset
+// is held. Destroying the dataset would destroy its snapshots.
+func (d *Driver) checkSnapshotsHeld(ctx context.Context, datasetPath string) error {
+	snapshots, err := d.Client().ListSnapshotsWithProperties(ctx, datasetPath, []string{"userrefs"})
+	if err != nil {
+		if client.IsNotFoundError(err) {
+			return nil
+		}
+		return err
+	}
+
+	var held []string
+	for _, snap := range snapshots {
+		if snap.Holds() > 0 {
+			held = append(held, snap.ID)
+		}
+	}
+	if len(held) > 0 {
+		return fmt.Errorf("%w: %v; delete their VolumeSnapshots first", errSnapshotsHeld, held)
+	}
+	return nil
+}
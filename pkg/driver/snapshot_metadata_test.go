@@ -0,0 +1,85 @@
+package driver
+
+import (
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+)
+
+func TestVolumeRanges(t *testing.T) {
+	const extent = snapshotMetadataExtentSize
+
+	tests := []struct {
+		name     string
+		start    int64
+		size     int64
+		expected [][2]int64 // offset, size
+	}{
+		{name: "empty volume", start: 0, size: 0, expected: nil},
+		{name: "smaller than an extent", start: 0, size: extent / 2, expected: [][2]int64{{0, extent / 2}}},
+		{name: "one extent", start: 0, size: extent, expected: [][2]int64{{0, extent}}},
+		{name: "partial last extent", start: 0, size: 2*extent + 4096, expected: [][2]int64{{0, extent}, {extent, extent}, {2 * extent, 4096}}},
+		{name: "start inside an extent", start: extent + 512, size: 3 * extent, expected: [][2]int64{{extent, extent}, {2 * extent, extent}}},
+		{name: "start at an extent", start: 2 * extent, size: 3 * extent, expected: [][2]int64{{2 * extent, extent}}},
+		{name: "start past the end", start: 4 * extent, size: 3 * extent, expected: nil},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ranges := volumeRanges(tc.start, tc.size)
+			if len(ranges) != len(tc.expected) {
+				t.Fatalf("volumeRanges(%d, %d) returned %d ranges, want %d", tc.start, tc.size, len(ranges), len(tc.expected))
+			}
+			for i, r := range ranges {
+				if r.ByteOffset != tc.expected[i][0] || r.SizeBytes != tc.expected[i][1] {
+					t.Errorf("range %d = {%d, %d}, want {%d, %d}", i, r.ByteOffset, r.SizeBytes, tc.expected[i][0], tc.expected[i][1])
+				}
+			}
+		})
+	}
+}
+
+func TestPageBlockMetadata(t *testing.T) {
+	ranges := func(n int) []*csi.BlockMetadata {
+		var rs []*csi.BlockMetadata
+		for i := range n {
+			rs = append(rs, &csi.BlockMetadata{ByteOffset: int64(i) * snapshotMetadataExtentSize, SizeBytes: snapshotMetadataExtentSize})
+		}
+		return rs
+	}
+
+	tests := []struct {
+		name       string
+		ranges     int
+		maxResults int32
+		expected   []int // ranges per page
+	}{
+		{name: "no ranges", ranges: 0, maxResults: 10, expected: nil},
+		{name: "one page", ranges: 3, maxResults: 10, expected: []int{3}},
+		{name: "exact pages", ranges: 4, maxResults: 2, expected: []int{2, 2}},
+		{name: "partial last page", ranges: 5, maxResults: 2, expected: []int{2, 2, 1}},
+		{name: "default page size", ranges: defaultSnapshotMetadataResults + 1, maxResults: 0, expected: []int{defaultSnapshotMetadataResults, 1}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			input := ranges(tc.ranges)
+			pages := pageBlockMetadata(input, tc.maxResults)
+			if len(pages) != len(tc.expected) {
+				t.Fatalf("pageBlockMetadata returned %d pages, want %d", len(pages), len(tc.expected))
+			}
+			next := 0
+			for i, page := range pages {
+				if len(page) != tc.expected[i] {
+					t.Errorf("page %d has %d ranges, want %d", i, len(page), tc.expected[i])
+				}
+				for _, r := range page {
+					if r != input[next] {
+						t.Errorf("page %d holds range at %d, want the range at %d", i, r.ByteOffset, input[next].ByteOffset)
+					}
+					next++
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,274 @@
+package driver
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/truenas/truenas-csi/pkg/client"
+)
+
+// snapshotSyncInterval is how often the snapshots of periodic snapshot tasks
+// are synced to VolumeSnapshots.
+const snapshotSyncInterval = 5 * time.Minute
+
+const (
+	// labelTaskSnapshot marks the VolumeSnapshots and VolumeSnapshotContents
+	// the sync created, so it only ever removes its own.
+	labelTaskSnapshot = "csi.truenas.io/task-snapshot"
+
+	// annotationSnapshotID records the TrueNAS snapshot on synced objects
+	annotationSnapshotID = "csi.truenas.io/snapshot-id"
+
+	// maxKubeNameLength is the longest DNS subdomain name
+	maxKubeNameLength = 253
+)
+
+// taskSnapshot is a snapshot a periodic snapshot task took of a volume whose
+// PersistentVolume is bound to a claim.
+type taskSnapshot struct {
+	snapshotID string
+	claim      kubeObjectRef
+	volumeMode string
+}
+
+// syncTaskSnapshots creates a pre-provisioned VolumeSnapshot in the claim's
+// namespace for every snapshot periodic snapshot tasks took of a volume, and
+// removes those whose snapshot TrueNAS pruned. The snapshot handle is the
+// usual <dataset>@<name> ID, so restores go through CreateVolume like those of
+// any other snapshot. A synced VolumeSnapshot that was deleted in Kubernetes
+// is not recreated.
+func (s *ControllerServer) syncTaskSnapshots(ctx context.Context, kube *kubeClient) error {
+	desired, err := s.taskSnapshots(ctx, kube)
+	if err != nil {
+		return err
+	}
+
+	contents, err := kube.listVolumeSnapshotContents(ctx, labelTaskSnapshot+"=true")
+	if err != nil {
+		return fmt.Errorf("failed to list synced VolumeSnapshotContents: %w", err)
+	}
+
+	synced := make(map[string]bool, len(contents))
+	for _, content := range contents {
+		name := content.Metadata.Name
+		if _, ok := desired[name]; ok {
+			synced[name] = true
+			continue
+		}
+
+		// The snapshot was pruned, or its task or volume is gone. The content
+		// retains the snapshot, so deleting it leaves TrueNAS alone.
+		ref := content.Spec.VolumeSnapshotRef
+		if err := kube.deleteVolumeSnapshot(ctx, ref.Namespace, ref.Name); err != nil && !errors.Is(err, errKubeNotFound) {
+			s.driver.Log().Error(err, "Failed to delete VolumeSnapshot of pruned snapshot", "namespace", ref.Namespace, "name", ref.Name)
+			continue
+		}
+		if err := kube.deleteVolumeSnapshotContent(ctx, name); err != nil && !errors.Is(err, errKubeNotFound) {
+			s.driver.Log().Error(err, "Failed to delete VolumeSnapshotContent of pruned snapshot", "name", name)
+			continue
+		}
+		s.driver.Log().V(LogLevelInfo).Info("Removed VolumeSnapshot of pruned snapshot",
+			"snapshotId", content.Spec.Source.SnapshotHandle, "namespace", ref.Namespace, "name", ref.Name)
+	}
+
+	for name, snap := range desired {
+		if synced[name] {
+			continue
+		}
+		if err := s.createTaskVolumeSnapshot(ctx, kube, name, snap); err != nil {
+			s.driver.Log().Error(err, "Failed to create VolumeSnapshot for task snapshot", "snapshotId", snap.snapshotID)
+		}
+	}
+	return nil
+}
+
+// taskSnapshots returns the snapshots of periodic snapshot tasks of volumes
+// bound to a claim, by the name of their VolumeSnapshotContent. It fails
+// rather than return an incomplete set, which would remove VolumeSnapshots.
+func (s *ControllerServer) taskSnapshots(ctx context.Context, kube *kubeClient) (map[string]taskSnapshot, error) {
+	pvs, err := kube.listPersistentVolumes(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list PersistentVolumes: %w", err)
+	}
+	volumes := make(map[string]*kubePersistentVolume)
+	for i := range pvs {
+		pv := &pvs[i]
+		if pv.Spec.CSI != nil && pv.Spec.CSI.Driver == s.driver.name && pv.Spec.ClaimRef != nil {
+			volumes[pv.Spec.CSI.VolumeHandle] = pv
+		}
+	}
+
+	tasks, err := s.driver.Client().ListAllSnapshotTasks(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	desired := make(map[string]taskSnapshot)
+	for _, task := range tasks {
+		var pattern *regexp.Regexp
+		for volumeID, pv := range volumes {
+			if !taskCoversDataset(task, volumeID) {
+				continue
+			}
+			if pattern == nil {
+				if pattern, err = namingSchemaPattern(task.NamingSchema); err != nil {
+					s.driver.Log().V(LogLevelDebug).Info("Skipping snapshot task with unsupported naming schema", "taskId", task.ID, "namingSchema", task.NamingSchema, "error", err)
+					break
+				}
+			}
+
+			snapshots, err := s.driver.Client().ListSnapshots(ctx, volumeID)
+			if err != nil && !client.IsNotFoundError(err) {
+				return nil, err
+			}
+			for _, snap := range snapshots {
+				_, name, _ := strings.Cut(snap.ID, "@")
+				if !pattern.MatchString(name) || snap.DeferDestroy() {
+					continue
+				}
+				desired[taskSnapshotContentName(snap.ID)] = taskSnapshot{
+					snapshotID: snap.ID,
+					claim:      *pv.Spec.ClaimRef,
+					volumeMode: pv.Spec.VolumeMode,
+				}
+			}
+		}
+	}
+	return desired, nil
+}
+
+// taskCoversDataset reports whether a periodic snapshot task snapshots a
+// dataset: its own dataset, or, for a recursive task, any dataset below it
+// that is not excluded along with its children.
+func taskCoversDataset(task client.SnapshotTask, dataset string) bool {
+	if dataset == task.Dataset {
+		return true
+	}
+	if !task.Recursive || !strings.HasPrefix(dataset, task.Dataset+"/") {
+		return false
+	}
+	for _, exclude := range task.Exclude {
+		if dataset == exclude || strings.HasPrefix(dataset, exclude+"/") {
+			return false
+		}
+	}
+	return true
+}
+
+// createTaskVolumeSnapshot creates the VolumeSnapshotContent of a task
+// snapshot and the VolumeSnapshot bound to it.
+func (s *ControllerServer) createTaskVolumeSnapshot(ctx context.Context, kube *kubeClient, contentName string, snap taskSnapshot) error {
+	_, snapshotName, _ := strings.Cut(snap.snapshotID, "@")
+	meta := kubeObjectMeta{
+		Labels:      map[string]string{labelTaskSnapshot: "true"},
+		Annotations: map[string]string{annotationSnapshotID: snap.snapshotID},
+	}
+
+	volumeSnapshot := &kubeVolumeSnapshot{Metadata: meta}
+	volumeSnapshot.Metadata.Name = kubeName(snap.claim.Name + "-" + snapshotName)
+	volumeSnapshot.Metadata.Namespace = snap.claim.Namespace
+	volumeSnapshot.Spec.Source.VolumeSnapshotContentName = contentName
+
+	// Retain: the task's retention decides when the snapshot goes, not Kubernetes
+	content := &kubeVolumeSnapshotContent{Metadata: meta}
+	content.Metadata.Name = contentName
+	content.Spec.Driver = s.driver.name
+	content.Spec.DeletionPolicy = "Retain"
+	content.Spec.Source.SnapshotHandle = snap.snapshotID
+	content.Spec.SourceVolumeMode = snap.volumeMode
+	content.Spec.VolumeSnapshotRef = kubeObjectRef{Name: volumeSnapshot.Metadata.Name, Namespace: snap.claim.Namespace}
+
+	if err := kube.createVolumeSnapshotContent(ctx, content); err != nil && !errors.Is(err, errKubeAlreadyExists) {
+		return err
+	}
+	if err := kube.createVolumeSnapshot(ctx, volumeSnapshot); err != nil && !errors.Is(err, errKubeAlreadyExists) {
+		return err
+	}
+
+	s.driver.Log().V(LogLevelInfo).Info("Created VolumeSnapshot for task snapshot", "snapshotId", snap.snapshotID,
+		"namespace", snap.claim.Namespace, "name", volumeSnapshot.Metadata.Name)
+	return nil
+}
+
+// runSnapshotSync periodically syncs task snapshots to VolumeSnapshots until ctx is done.
+func (s *ControllerServer) runSnapshotSync(ctx context.Context) {
+	kube, err := newInClusterKubeClient()
+	if err != nil {
+		s.driver.Log().Error(err, "Snapshot sync is enabled but cannot reach the Kubernetes API")
+		return
+	}
+
+	ticker := time.NewTicker(snapshotSyncInterval)
+	defer ticker.Stop()
+
+	for {
+		syncCtx, cancel := context.WithTimeout(ctx, defaultOperationTimeout)
+		if err := s.syncTaskSnapshots(syncCtx, kube); err != nil {
+			s.driver.Log().Error(err, "Failed to sync task snapshots")
+		}
+		cancel()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// taskSnapshotContentName names the VolumeSnapshotContent of a snapshot after a hash of its ID
+func taskSnapshotContentName(snapshotID string) string {
+	return fmt.Sprintf("truenas-task-%x", sha256.Sum256([]byte(snapshotID)))[:len("truenas-task-")+32]
+}
+
+// kubeName turns a string into a valid object name (DNS subdomain). Names that
+// are too long end in a hash of the string, so they stay distinct.
+func kubeName(s string) string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '-', r == '.':
+			return r
+		case r >= 'A' && r <= 'Z':
+			return unicode.ToLower(r)
+		}
+		return '-'
+	}, s)
+	if len(name) > maxKubeNameLength {
+		suffix := fmt.Sprintf("-%x", sha256.Sum256([]byte(s)))[:9]
+		name = strings.TrimRight(name[:maxKubeNameLength-len(suffix)], "-.") + suffix
+	}
+	return strings.Trim(name, "-.")
+}
+
+// namingSchemaPattern matches the snapshot names a periodic snapshot task's
+// naming schema produces. The schema is a strftime format such as
+// auto-%Y-%m-%d_%H-%M.
+func namingSchemaPattern(schema string) (*regexp.Regexp, error) {
+	if schema == "" {
+		return nil, errors.New("empty naming schema")
+	}
+
+	var b strings.Builder
+	b.WriteString("^")
+	runes := []rune(schema)
+	for i := 0; i < len(runes); i++ {
+		if runes[i] != '%' || i+1 == len(runes) {
+			b.WriteString(regexp.QuoteMeta(string(runes[i])))
+			continue
+		}
+		i++
+		if runes[i] == '%' {
+			b.WriteString("%")
+		} else {
+			b.WriteString(`[^@/]+?`)
+		}
+	}
+	b.WriteString("$")
+	return regexp.Compile(b.String())
+}
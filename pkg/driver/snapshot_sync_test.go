@@ -0,0 +1,148 @@
+package driver
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/truenas/truenas-csi/pkg/client"
+)
+
+func TestNamingSchemaPattern(t *testing.T) {
+	tests := []struct {
+		name      string
+		schema    string
+		matches   []string
+		unmatched []string
+		wantErr   bool
+	}{
+		{
+			name:      "default schema",
+			schema:    "auto-%Y-%m-%d_%H-%M",
+			matches:   []string{"auto-2026-10-18_12-00"},
+			unmatched: []string{"manual-2026-10-18_12-00", "auto-2026-10-18", "csi-snap"},
+		},
+		{
+			name:      "literal percent",
+			schema:    "daily%%-%Y",
+			matches:   []string{"daily%-2026"},
+			unmatched: []string{"daily-2026"},
+		},
+		{
+			name:      "regexp characters are literal",
+			schema:    "snap.%Y+",
+			matches:   []string{"snap.2026+"},
+			unmatched: []string{"snapx2026+", "snap.2026"},
+		},
+		{
+			name:      "trailing percent",
+			schema:    "auto-%Y%",
+			matches:   []string{"auto-2026%"},
+			unmatched: []string{"auto-2026"},
+		},
+		{name: "empty", schema: "", wantErr: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			pattern, err := namingSchemaPattern(tc.schema)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("namingSchemaPattern(%q) = %v, want error", tc.schema, pattern)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("namingSchemaPattern(%q) returned error: %v", tc.schema, err)
+			}
+			for _, name := range tc.matches {
+				if !pattern.MatchString(name) {
+					t.Errorf("namingSchemaPattern(%q) does not match %q", tc.schema, name)
+				}
+			}
+			for _, name := range tc.unmatched {
+				if pattern.MatchString(name) {
+					t.Errorf("namingSchemaPattern(%q) matches %q", tc.schema, name)
+				}
+			}
+		})
+	}
+}
+
+func TestKubeName(t *testing.T) {
+	long := strings.Repeat("a", maxKubeNameLength+10)
+
+	tests := []struct {
+		name     string
+		value    string
+		expected string
+	}{
+		{name: "valid", value: "data-0-auto-2026", expected: "data-0-auto-2026"},
+		{name: "lowercased", value: "Data_0", expected: "data-0"},
+		{name: "invalid characters replaced", value: "pvc:auto@2026", expected: "pvc-auto-2026"},
+		{name: "ends trimmed", value: "-.pvc.-", expected: "pvc"},
+		{name: "max length kept", value: long[:maxKubeNameLength], expected: long[:maxKubeNameLength]},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := kubeName(tc.value); got != tc.expected {
+				t.Errorf("kubeName(%q) = %q, want %q", tc.value, got, tc.expected)
+			}
+		})
+	}
+
+	t.Run("truncated names are distinct", func(t *testing.T) {
+		a, b := kubeName(long+"-x"), kubeName(long+"-y")
+		for _, name := range []string{a, b} {
+			if len(name) > maxKubeNameLength {
+				t.Errorf("kubeName returned %d characters, want at most %d", len(name), maxKubeNameLength)
+			}
+			if !strings.HasPrefix(name, long[:maxKubeNameLength-9]) {
+				t.Errorf("kubeName(%q) = %q, want truncated prefix", long, name)
+			}
+		}
+		if a == b {
+			t.Errorf("kubeName returned %q for different long names", a)
+		}
+	})
+}
+
+func TestTaskCoversDataset(t *testing.T) {
+	tests := []struct {
+		name     string
+		task     client.SnapshotTask
+		dataset  string
+		expected bool
+	}{
+		{name: "own dataset", task: client.SnapshotTask{Dataset: "tank/k8s/pvc-1"}, dataset: "tank/k8s/pvc-1", expected: true},
+		{name: "child of non-recursive task", task: client.SnapshotTask{Dataset: "tank/k8s"}, dataset: "tank/k8s/pvc-1", expected: false},
+		{name: "child of recursive task", task: client.SnapshotTask{Dataset: "tank/k8s", Recursive: true}, dataset: "tank/k8s/pvc-1", expected: true},
+		{name: "sibling prefix", task: client.SnapshotTask{Dataset: "tank/k8s", Recursive: true}, dataset: "tank/k8s2/pvc-1", expected: false},
+		{
+			name:     "excluded",
+			task:     client.SnapshotTask{Dataset: "tank", Recursive: true, Exclude: []string{"tank/k8s/pvc-1"}},
+			dataset:  "tank/k8s/pvc-1",
+			expected: false,
+		},
+		{
+			name:     "below excluded",
+			task:     client.SnapshotTask{Dataset: "tank", Recursive: true, Exclude: []string{"tank/k8s"}},
+			dataset:  "tank/k8s/pvc-1",
+			expected: false,
+		},
+		{
+			name:     "excluded sibling prefix",
+			task:     client.SnapshotTask{Dataset: "tank", Recursive: true, Exclude: []string{"tank/k8s/pvc-1"}},
+			dataset:  "tank/k8s/pvc-10",
+			expected: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := taskCoversDataset(tc.task, tc.dataset); got != tc.expected {
+				t.Errorf("taskCoversDataset(%q) = %v, want %v", tc.dataset, got, tc.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,178 @@
+package driver
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultStateDir is where the node keeps state that must survive restarts
+	// of the driver. It has to be a host path.
+	defaultStateDir = "/var/lib/truenas-csi"
+
+	// stagingRecordVersion is the format version of staging records written by
+	// this driver. Records with a newer version are refused rather than misread.
+	stagingRecordVersion = 1
+
+	// stagingRecordSuffix is the file extension of staging records
+	stagingRecordSuffix = ".json"
+)
+
+// StagingConnection holds how a staged block volume is attached to the node
+type StagingConnection struct {
+	// iSCSI
+	TargetPortals []string `json:"targetPortals,omitempty"`
+	TargetIQN     string   `json:"targetIQN,omitempty"`
+	LUN           int32    `json:"lun,omitempty"`
+
+	// NVMe/TCP
+	SubsystemNQN string `json:"subsystemNQN,omitempty"`
+	NVMePortal   string `json:"nvmePortal,omitempty"`
+	NSID         int    `json:"nsid,omitempty"`
+}
+
+// StagingRecord is what the node remembers about a staged volume. It is written
+// by NodeStageVolume and read by every later node call for the volume, so
+// unstage and expand work without a publish context.
+type StagingRecord struct {
+	Version     int               `json:"version"`
+	VolumeID    string            `json:"volumeID"`
+	Protocol    string            `json:"protocol"`
+	StagingPath string            `json:"stagingPath,omitempty"`
+	DevicePath  string            `json:"devicePath,omitempty"`
+	FSType      string            `json:"fsType,omitempty"`
+	MountFlags  []string          `json:"mountFlags,omitempty"`
+	Block       bool              `json:"block"`
+	Connection  StagingConnection `json:"connection"`
+	StagedAt    time.Time         `json:"stagedAt"`
+}
+
+// stagingStore keeps one staging record file per volume in a directory
+type stagingStore struct {
+	dir string
+}
+
+// newStagingStore returns the store under stateDir, creating its directory
+func newStagingStore(stateDir string) (*stagingStore, error) {
+	dir := filepath.Join(stateDir, "staging")
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, fmt.Errorf("failed to create staging record directory %s: %w", dir, err)
+	}
+	return &stagingStore{dir: dir}, nil
+}
+
+// path returns the record file of a volume. Volume IDs are escaped rather than
+// sanitized so that distinct volumes never share a file.
+func (st *stagingStore) path(volumeID string) string {
+	return filepath.Join(st.dir, url.PathEscape(volumeID)+stagingRecordSuffix)
+}
+
+// Save writes a record atomically: a crash leaves either the old or the new
+// record, never a partial one.
+func (st *stagingStore) Save(record *StagingRecord) error {
+	record.Version = stagingRecordVersion
+	data, err := json.MarshalIndent(record, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode staging record: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(st.dir, ".tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to create staging record: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write staging record: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to sync staging record: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write staging record: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), st.path(record.VolumeID)); err != nil {
+		return fmt.Errorf("failed to save staging record: %w", err)
+	}
+
+	// Persist the rename itself
+	if dir, err := os.Open(st.dir); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+	return nil
+}
+
+// Load returns the record of a volume. The error wraps fs.ErrNotExist if the
+// volume has no record.
+func (st *stagingStore) Load(volumeID string) (*StagingRecord, error) {
+	data, err := os.ReadFile(st.path(volumeID))
+	if err != nil {
+		return nil, err
+	}
+	return decodeStagingRecord(data)
+}
+
+// Delete removes the record of a volume. Deleting a missing record is not an error.
+func (st *stagingStore) Delete(volumeID string) error {
+	if err := os.Remove(st.path(volumeID)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to delete staging record: %w", err)
+	}
+	return nil
+}
+
+// List returns all records. Records that cannot be read are skipped and
+// reported in the error.
+func (st *stagingStore) List() ([]*StagingRecord, error) {
+	entries, err := os.ReadDir(st.dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list staging records: %w", err)
+	}
+
+	var records []*StagingRecord
+	var errs []error
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || strings.HasPrefix(name, ".") || !strings.HasSuffix(name, stagingRecordSuffix) {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(st.dir, name))
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		record, err := decodeStagingRecord(data)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+			continue
+		}
+		records = append(records, record)
+	}
+	return records, errors.Join(errs...)
+}
+
+// decodeStagingRecord parses a record and checks its version
+func decodeStagingRecord(data []byte) (*StagingRecord, error) {
+	var record StagingRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		return nil, fmt.Errorf("failed to parse staging record: %w", err)
+	}
+	if record.Version < 1 || record.Version > stagingRecordVersion {
+		return nil, fmt.Errorf("staging record of %s has unsupported version %d (supported: 1-%d)",
+			record.VolumeID, record.Version, stagingRecordVersion)
+	}
+	if record.VolumeID == "" || record.Protocol == "" {
+		return nil, fmt.Errorf("staging record is missing the volume ID or protocol")
+	}
+	record.Protocol = strings.ToLower(record.Protocol)
+	return &record, nil
+}
@@ -0,0 +1,189 @@
+package driver
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-logr/logr"
+	"k8s.io/mount-utils"
+)
+
+func TestStagingStore(t *testing.T) {
+	store, err := newStagingStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("newStagingStore returned error: %v", err)
+	}
+
+	// Escaping keeps IDs that sanitize to the same name apart
+	records := []*StagingRecord{
+		{VolumeID: "tank/k8s/pvc-1", Protocol: ProtocolISCSI, Connection: StagingConnection{TargetIQN: "iqn.test:pvc-1", LUN: 3}},
+		{VolumeID: "tank/k8s_pvc-1", Protocol: ProtocolNVMe, Connection: StagingConnection{SubsystemNQN: "nqn.test:pvc-1", NSID: 1}},
+	}
+	for _, record := range records {
+		if err := store.Save(record); err != nil {
+			t.Fatalf("Save(%s) returned error: %v", record.VolumeID, err)
+		}
+	}
+
+	for _, want := range records {
+		got, err := store.Load(want.VolumeID)
+		if err != nil {
+			t.Fatalf("Load(%s) returned error: %v", want.VolumeID, err)
+		}
+		if got.Version != stagingRecordVersion || got.Protocol != want.Protocol || got.Connection.TargetIQN != want.Connection.TargetIQN || got.Connection.SubsystemNQN != want.Connection.SubsystemNQN {
+			t.Errorf("Load(%s) = %+v, want %+v", want.VolumeID, got, want)
+		}
+	}
+
+	listed, err := store.List()
+	if err != nil {
+		t.Fatalf("List returned error: %v", err)
+	}
+	if len(listed) != len(records) {
+		t.Errorf("List returned %d records, want %d", len(listed), len(records))
+	}
+
+	if err := store.Delete(records[0].VolumeID); err != nil {
+		t.Fatalf("Delete returned error: %v", err)
+	}
+	if err := store.Delete(records[0].VolumeID); err != nil {
+		t.Errorf("Delete of a missing record returned error: %v", err)
+	}
+	if _, err := store.Load(records[0].VolumeID); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Load after Delete returned %v, want fs.ErrNotExist", err)
+	}
+	if _, err := store.Load(records[1].VolumeID); err != nil {
+		t.Errorf("Load(%s) after deleting another record returned error: %v", records[1].VolumeID, err)
+	}
+}
+
+// namedHandler is a protocol handler that only reports its protocol.
+type namedHandler struct {
+	ProtocolHandler
+	protocol string
+}
+
+func TestStagedHandler(t *testing.T) {
+	const (
+		volumeID    = "tank/k8s/pvc-1"
+		stagingPath = "/var/lib/kubelet/plugins/kubernetes.io/csi/truenas/staging/pvc-1"
+	)
+
+	tests := []struct {
+		name         string
+		record       *StagingRecord
+		connector    string
+		mounts       []mount.MountPoint
+		wantProtocol string
+		wantRecord   bool
+		wantErr      bool
+	}{
+		{
+			name:         "record",
+			record:       &StagingRecord{VolumeID: volumeID, Protocol: ProtocolNVMe},
+			wantProtocol: ProtocolNVMe,
+			wantRecord:   true,
+		},
+		{
+			name:    "record with unknown protocol",
+			record:  &StagingRecord{VolumeID: volumeID, Protocol: "fc"},
+			wantErr: true,
+		},
+		{
+			name:         "legacy connector",
+			connector:    `{"target_iqn":"iqn.test:pvc-1","target_portal":["192.0.2.1:3260"],"lun":1}`,
+			wantProtocol: ProtocolISCSI,
+			wantRecord:   true,
+		},
+		{
+			name:         "nothing staged",
+			wantProtocol: ProtocolNFS,
+		},
+		{
+			name:         "other mounts only",
+			mounts:       []mount.MountPoint{{Device: "/dev/sda1", Path: "/", Type: "ext4"}},
+			wantProtocol: ProtocolNFS,
+		},
+		{
+			name:         "nfs mount",
+			mounts:       []mount.MountPoint{{Device: "192.0.2.1:/mnt/tank/k8s/pvc-1", Path: stagingPath, Type: "nfs4"}},
+			wantProtocol: ProtocolNFS,
+			wantRecord:   true,
+		},
+		{
+			name:         "smb mount",
+			mounts:       []mount.MountPoint{{Device: "//192.0.2.1/pvc-1", Path: stagingPath + "/", Type: "cifs"}},
+			wantProtocol: ProtocolSMB,
+			wantRecord:   true,
+		},
+		{
+			name:    "unknown device",
+			mounts:  []mount.MountPoint{{Device: "/dev/loop7", Path: stagingPath, Type: "ext4"}},
+			wantErr: true,
+		},
+		{
+			name:    "unknown filesystem",
+			mounts:  []mount.MountPoint{{Device: "tmpfs", Path: stagingPath, Type: "tmpfs"}},
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			stateDir := t.TempDir()
+			store, err := newStagingStore(stateDir)
+			if err != nil {
+				t.Fatalf("newStagingStore returned error: %v", err)
+			}
+			if tc.record != nil {
+				if err := store.Save(tc.record); err != nil {
+					t.Fatalf("Save returned error: %v", err)
+				}
+			}
+			if tc.connector != "" {
+				path := connectorPath(stateDir, volumeID)
+				if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(path, []byte(tc.connector), 0o600); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			handlers := map[string]ProtocolHandler{}
+			for _, protocol := range []string{ProtocolISCSI, ProtocolNFS, ProtocolNVMe, ProtocolSMB} {
+				handlers[protocol] = namedHandler{protocol: protocol}
+			}
+			s := &NodeServer{
+				driver:   &Driver{log: logr.Discard(), stateDir: stateDir},
+				mounter:  mount.NewFakeMounter(tc.mounts),
+				handlers: handlers,
+				staging:  store,
+			}
+
+			record, err := s.stagingRecord(volumeID, stagingPath)
+			var handler ProtocolHandler
+			if err == nil {
+				handler, err = s.stagedHandler(record)
+			}
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("stagedHandler returned %v, want error", handler)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("stagedHandler returned error: %v", err)
+			}
+			if got := handler.(namedHandler).protocol; got != tc.wantProtocol {
+				t.Errorf("stagedHandler returned the %s handler, want %s", got, tc.wantProtocol)
+			}
+			if (record != nil) != tc.wantRecord {
+				t.Errorf("stagingRecord returned %+v, want a record: %v", record, tc.wantRecord)
+			}
+		})
+	}
+}
@@ -0,0 +1,146 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/truenas/truenas-csi/pkg/client"
+)
+
+// Volume attributes (PV spec.csi.volumeAttributes) for statically provisioned volumes.
+const (
+	// volumeContextImported marks the volume handle as a pre-existing dataset or zvol
+	// that was not created by CreateVolume.
+	volumeContextImported = "imported"
+
+	// volumeContextAdopt hands ownership of an imported dataset to the driver, so
+	// DeleteVolume may destroy it like any provisioned volume.
+	volumeContextAdopt = "adopt"
+)
+
+// isImportedVolumeContext reports whether the volume attributes mark an imported dataset.
+func isImportedVolumeContext(volumeContext map[string]string) bool {
+	imported, _ := strconv.ParseBool(volumeContext[volumeContextImported])
+	return imported
+}
+
+// isProtectedImport reports whether a dataset was imported but never adopted.
+// Such datasets are never destroyed by the driver.
+func isProtectedImport(dataset *client.Dataset) bool {
+	return dataset.UserProperties[PropertyImported] == "true" &&
+		dataset.UserProperties[PropertyAdopted] != "true"
+}
+
+// isDriverOwned reports whether DeleteVolume may destroy a dataset: CreateVolume
+// created it, or it was imported and adopted. A static PV can name any dataset,
+// published or not, so datasets without either marker are never destroyed.
+func isDriverOwned(dataset *client.Dataset) bool {
+	if isProtectedImport(dataset) {
+		return false
+	}
+	return dataset.UserProperties[PropertyManaged] == "true" ||
+		dataset.UserProperties[PropertyAdopted] == "true"
+}
+
+// validateImportedVolume checks that an imported dataset can be published with the
+// requested volume attributes and access type.
+func validateImportedVolume(dataset *client.Dataset, volumeContext map[string]string, isBlockVolume bool) error {
+	for _, key := range []string{volumeContextImported, volumeContextAdopt} {
+		if val, ok := volumeContext[key]; ok {
+			if _, err := strconv.ParseBool(val); err != nil {
+				return fmt.Errorf("invalid %s: %s (must be true or false)", key, val)
+			}
+		}
+	}
+
+	if val, ok := volumeContext[paramDeleteStrategy]; ok {
+		if _, err := parseDeleteStrategy(val); err != nil {
+			return err
+		}
+	}
+
+	protocol, err := protocolForDataset(dataset, volumeContext["protocol"])
+	if err != nil {
+		return err
+	}
+	if isBlockVolume && !protocol.block {
+		return fmt.Errorf("block volume capability requires a zvol, %s is a filesystem dataset", dataset.ID)
+	}
+
+	return nil
+}
+
+// prepareImportedVolume records the import on the dataset and creates its NFS or SMB
+// share, iSCSI target or NVMe-oF subsystem if missing. It is safe to call on every publish.
+func (s *ControllerServer) prepareImportedVolume(ctx context.Context, volumeID, datasetPath string, dataset *client.Dataset, volumeContext map[string]string) error {
+	// Record the import before exporting, so the dataset is protected from
+	// DeleteVolume even if a later step fails.
+	var updates []client.UserPropertyUpdate
+	if dataset.UserProperties[PropertyImported] != "true" {
+		updates = append(updates, client.UserPropertyUpdate{Key: PropertyImported, Value: "true"})
+	}
+	if adopt, _ := strconv.ParseBool(volumeContext[volumeContextAdopt]); adopt && dataset.UserProperties[PropertyAdopted] != "true" {
+		updates = append(updates, client.UserPropertyUpdate{Key: PropertyAdopted, Value: "true"})
+	}
+	if strategy := volumeContext[paramDeleteStrategy]; strategy != "" && dataset.UserProperties[PropertyDeleteStrategy] != strategy {
+		updates = append(updates, client.UserPropertyUpdate{Key: PropertyDeleteStrategy, Value: strategy})
+	}
+	if len(updates) > 0 {
+		if err := s.driver.Client().UpdateDataset(ctx, datasetPath, &client.DatasetUpdateOptions{UserPropertiesUpdate: updates}); err != nil {
+			return fmt.Errorf("failed to record import: %w", err)
+		}
+	}
+
+	created, err := s.ensureVolumeExport(ctx, volumeID, datasetPath, dataset, volumeContext)
+	if err != nil {
+		return err
+	}
+
+	// Remember that the share/target belongs to the driver, so DeleteVolume removes
+	// it again without touching exports that existed before the import.
+	if created {
+		updates := &client.DatasetUpdateOptions{
+			UserPropertiesUpdate: []client.UserPropertyUpdate{{Key: PropertyExportManaged, Value: "true"}},
+		}
+		if err := s.driver.Client().UpdateDataset(ctx, datasetPath, updates); err != nil {
+			return fmt.Errorf("failed to record export ownership: %w", err)
+		}
+		s.driver.Log().V(LogLevelInfo).Info("Created export for imported volume", "volumeId", volumeID, "type", dataset.Type)
+	}
+
+	return nil
+}
+
+// ensureVolumeExport creates the NFS or SMB share (filesystem), or the iSCSI target and
+// extent or NVMe-oF subsystem (zvol) for a dataset unless one already exists. Returns true if it created the export.
+func (s *ControllerServer) ensureVolumeExport(ctx context.Context, volumeID, datasetPath string, dataset *client.Dataset, volumeContext map[string]string) (bool, error) {
+	// The share/target helpers add connection details to the parameters they are given
+	parameters := make(map[string]string, len(volumeContext))
+	for k, v := range volumeContext {
+		parameters[k] = v
+	}
+	// Imported data keeps its existing ownership and mode
+	delete(parameters, "nfs.datasetPermissionsMode")
+	delete(parameters, "nfs.datasetPermissionsUser")
+	delete(parameters, "nfs.datasetPermissionsGroup")
+
+	protocol, err := protocolForDataset(dataset, volumeContext["protocol"])
+	if err != nil {
+		return false, err
+	}
+	provisioner := protocol.newProvisioner(s)
+
+	if exported, err := provisioner.IsExported(ctx, datasetPath, dataset); err != nil || exported {
+		return false, err
+	}
+
+	if _, err := provisioner.ExportVolume(ctx, volumeID, datasetPath, dataset, dataset.Volsize, parameters); err != nil {
+		// A concurrent publish to another node may have created it first
+		if exported, _ := provisioner.IsExported(ctx, datasetPath, dataset); exported {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
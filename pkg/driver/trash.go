@@ -0,0 +1,290 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/truenas/truenas-csi/pkg/client"
+)
+
+const (
+	// paramDeleteStrategy selects what DeleteVolume does with the dataset.
+	// Supported values: "delete" (default) and "retain-for=<duration>".
+	paramDeleteStrategy = "deleteStrategy"
+
+	deleteStrategyDelete    = "delete"
+	deleteStrategyRetainFor = "retain-for="
+
+	// trashDatasetName is the per-pool parent dataset holding retained volumes.
+	trashDatasetName = ".csi-trash"
+
+	// trashPurgeInterval is how often the controller looks for expired trash entries.
+	trashPurgeInterval = 15 * time.Minute
+
+	// parameterPVName is set by the external-provisioner with --extra-create-metadata
+	parameterPVName = "csi.storage.k8s.io/pv/name"
+)
+
+// TrashEntry describes a dataset that DeleteVolume moved into the trash.
+type TrashEntry struct {
+	DatasetPath   string
+	OriginalPath  string
+	Type          string
+	CapacityBytes int64
+	ExpiresAt     time.Time
+}
+
+// parseDeleteStrategy parses a deleteStrategy value and returns the retention period.
+// A zero duration means the dataset is destroyed immediately.
+func parseDeleteStrategy(value string) (time.Duration, error) {
+	value = strings.TrimSpace(value)
+	if value == "" || strings.EqualFold(value, deleteStrategyDelete) {
+		return 0, nil
+	}
+
+	durationStr, found := strings.CutPrefix(value, deleteStrategyRetainFor)
+	if !found {
+		return 0, fmt.Errorf("invalid %s: %s (valid: delete, retain-for=<duration>)", paramDeleteStrategy, value)
+	}
+
+	retain, err := time.ParseDuration(durationStr)
+	if err != nil || retain <= 0 {
+		return 0, fmt.Errorf("invalid %s: %s (duration must be positive, e.g. retain-for=72h)", paramDeleteStrategy, value)
+	}
+	return retain, nil
+}
+
+// trashParentPath returns the trash dataset for a pool.
+func trashParentPath(pool string) string {
+	return pool + "/" + trashDatasetName
+}
+
+// isTrashPath reports whether a dataset lives in (or is) a pool's trash dataset.
+func isTrashPath(datasetPath string) bool {
+	pool := client.ExtractPoolFromPath(datasetPath)
+	parent := trashParentPath(pool)
+	return datasetPath == parent || strings.HasPrefix(datasetPath, parent+"/")
+}
+
+// volumeProperties returns the user properties of a dataset CreateVolume creates:
+// the ownership marker, the PV name the external-provisioner passes along and,
+// unless the default applies, the delete strategy.
+func volumeProperties(parameters map[string]string) []client.UserProperty {
+	props := []client.UserProperty{{Key: PropertyManaged, Value: "true"}}
+	if pvName := parameters[parameterPVName]; pvName != "" {
+		props = append(props, client.UserProperty{Key: PropertyPVName, Value: pvName})
+	}
+	if value := parameters[paramDeleteStrategy]; value != "" {
+		props = append(props, client.UserProperty{Key: PropertyDeleteStrategy, Value: value})
+	}
+	return props
+}
+
+// ensureTrashParent creates the pool's trash dataset if it does not exist yet.
+func (s *ControllerServer) ensureTrashParent(ctx context.Context, pool string) error {
+	parent := trashParentPath(pool)
+	if _, err := s.driver.Client().GetDataset(ctx, parent); err == nil {
+		return nil
+	} else if !client.IsNotFoundError(err) {
+		return err
+	}
+
+	_, err := s.driver.Client().CreateDataset(ctx, &client.DatasetCreateOptions{
+		Name:     parent,
+		Type:     "FILESYSTEM",
+		Comments: "Volumes retained by the TrueNAS CSI driver after deletion",
+	})
+	if err != nil && !strings.Contains(err.Error(), "already exists") {
+		return err
+	}
+	return nil
+}
+
+// moveToTrash renames a dataset into the pool's trash and tags it with an expiry.
+// Shares and targets must already be removed, since they reference the old path.
+func (s *ControllerServer) moveToTrash(ctx context.Context, datasetPath string, retain time.Duration) (string, error) {
+	pool := client.ExtractPoolFromPath(datasetPath)
+	if err := s.ensureTrashParent(ctx, pool); err != nil {
+		return "", fmt.Errorf("failed to create trash dataset: %w", err)
+	}
+
+	now := time.Now().UTC()
+	leaf := strings.ReplaceAll(strings.TrimPrefix(datasetPath, pool+"/"), "/", "-")
+	trashPath := fmt.Sprintf("%s/%s-%d", trashParentPath(pool), leaf, now.Unix())
+
+	if err := s.driver.Client().RenameDataset(ctx, datasetPath, trashPath); err != nil {
+		return "", err
+	}
+
+	updates := &client.DatasetUpdateOptions{
+		UserPropertiesUpdate: []client.UserPropertyUpdate{
+			{Key: PropertyTrashOrigin, Value: datasetPath},
+			{Key: PropertyTrashExpiry, Value: now.Add(retain).Format(time.RFC3339)},
+		},
+	}
+	if err := s.driver.Client().UpdateDataset(ctx, trashPath, updates); err != nil {
+		// The dataset is already out of the way; without an expiry the purger
+		// leaves it alone, so it can still be restored or removed by hand.
+		return trashPath, fmt.Errorf("failed to tag trashed dataset %s with expiry: %w", trashPath, err)
+	}
+
+	return trashPath, nil
+}
+
+// listTrash returns the trash entries in all pools.
+func (s *ControllerServer) listTrash(ctx context.Context) ([]TrashEntry, error) {
+	pools, err := s.driver.Client().ListPools(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []TrashEntry
+	for _, pool := range pools {
+		datasets, err := s.driver.Client().ListDatasets(ctx, pool.Name)
+		if err != nil {
+			return nil, err
+		}
+
+		prefix := trashParentPath(pool.Name) + "/"
+		for _, ds := range datasets {
+			name := strings.TrimPrefix(ds.Name, prefix)
+			if name == ds.Name || strings.Contains(name, "/") {
+				continue
+			}
+
+			entry := TrashEntry{
+				DatasetPath:   ds.Name,
+				OriginalPath:  ds.UserProperties[PropertyTrashOrigin],
+				Type:          ds.Type,
+				CapacityBytes: ds.RefQuota,
+			}
+			if ds.Type == "VOLUME" {
+				entry.CapacityBytes = ds.Volsize
+			}
+			if expiry := ds.UserProperties[PropertyTrashExpiry]; expiry != "" {
+				if t, err := time.Parse(time.RFC3339, expiry); err == nil {
+					entry.ExpiresAt = t
+				}
+			}
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+// purgeExpiredTrash destroys trash entries whose retention period has elapsed.
+// Entries without a parseable expiry are never purged automatically.
+func (s *ControllerServer) purgeExpiredTrash(ctx context.Context) {
+	entries, err := s.listTrash(ctx)
+	if err != nil {
+		s.driver.Log().Error(err, "Failed to list trashed volumes")
+		return
+	}
+
+	now := time.Now()
+	for _, entry := range entries {
+		if entry.ExpiresAt.IsZero() || now.Before(entry.ExpiresAt) {
+			continue
+		}
+
+		if err := s.destroyDataset(ctx, entry.DatasetPath); err != nil {
+			s.driver.Log().Error(err, "Failed to purge trashed volume", "dataset", entry.DatasetPath)
+			continue
+		}
+		s.driver.Log().V(LogLevelInfo).Info("Purged expired trashed volume", "dataset", entry.DatasetPath,
+			"originalPath", entry.OriginalPath, "expiredAt", entry.ExpiresAt)
+	}
+}
+
+// runTrashPurger periodically purges expired trash entries until ctx is done.
+func (s *ControllerServer) runTrashPurger(ctx context.Context) {
+	ticker := time.NewTicker(trashPurgeInterval)
+	defer ticker.Stop()
+
+	for {
+		purgeCtx, cancel := context.WithTimeout(ctx, defaultOperationTimeout)
+		s.purgeExpiredTrash(purgeCtx)
+		cancel()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// restoreFromTrash moves a trashed dataset back to pool/name and re-creates its
+// NFS or SMB share, iSCSI target or NVMe-oF subsystem so it can be bound as a static PV.
+func (s *ControllerServer) restoreFromTrash(ctx context.Context, trashPath, name string, parameters map[string]string) (*VolumeInfo, error) {
+	if !isTrashPath(trashPath) || trashPath == trashParentPath(client.ExtractPoolFromPath(trashPath)) {
+		return nil, fmt.Errorf("%s is not a trashed volume", trashPath)
+	}
+
+	pool := client.ExtractPoolFromPath(trashPath)
+	volumeName := SanitizeVolumeName(name)
+	volumeID := s.driver.GenerateVolumeID(pool, volumeName)
+	datasetPath := pool + "/" + volumeName
+
+	if _, err := s.driver.Client().GetDataset(ctx, datasetPath); err == nil {
+		return nil, fmt.Errorf("dataset %s already exists", datasetPath)
+	} else if !client.IsNotFoundError(err) {
+		return nil, fmt.Errorf("failed to check for dataset %s: %w", datasetPath, err)
+	}
+
+	if parameters == nil {
+		parameters = make(map[string]string)
+	}
+
+	// Check the protocol before the dataset leaves the trash
+	trashed, err := s.driver.Client().GetDataset(ctx, trashPath)
+	if err != nil {
+		return nil, err
+	}
+	protocol, err := protocolForDataset(trashed, parameters["protocol"])
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.driver.Client().RenameDataset(ctx, trashPath, datasetPath); err != nil {
+		return nil, err
+	}
+
+	// The restored volume starts over with the default delete strategy
+	updates := &client.DatasetUpdateOptions{
+		UserPropertiesUpdate: []client.UserPropertyUpdate{
+			{Key: PropertyTrashOrigin, Remove: true},
+			{Key: PropertyTrashExpiry, Remove: true},
+			{Key: PropertyDeleteStrategy, Remove: true},
+		},
+	}
+	if err := s.driver.Client().UpdateDataset(ctx, datasetPath, updates); err != nil {
+		return nil, fmt.Errorf("failed to clear trash properties on %s: %w", datasetPath, err)
+	}
+
+	dataset, err := s.driver.Client().GetDataset(ctx, datasetPath)
+	if err != nil {
+		return nil, err
+	}
+
+	volInfo, err := protocol.newProvisioner(s).ExportVolume(ctx, volumeID, datasetPath, dataset, dataset.Volsize, parameters)
+	if err != nil {
+		return nil, fmt.Errorf("failed to export restored volume %s: %w", volumeID, err)
+	}
+
+	s.driver.Log().V(LogLevelInfo).Info("Restored volume from trash", "trashPath", trashPath, "volumeId", volumeID)
+	return volInfo, nil
+}
+
+// ListTrash returns the volumes currently retained in the trash of any pool.
+func (d *Driver) ListTrash(ctx context.Context) ([]TrashEntry, error) {
+	return NewControllerServer(d).listTrash(ctx)
+}
+
+// RestoreFromTrash restores a trashed dataset as pool/name and exports it again.
+// Parameters take the same NFS/iSCSI keys as a StorageClass.
+func (d *Driver) RestoreFromTrash(ctx context.Context, trashPath, name string, parameters map[string]string) (*VolumeInfo, error) {
+	return NewControllerServer(d).restoreFromTrash(ctx, trashPath, name, parameters)
+}
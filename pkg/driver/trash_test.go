@@ -0,0 +1,44 @@
+package driver
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseDeleteStrategy(t *testing.T) {
+	tests := []struct {
+		name     string
+		value    string
+		expected time.Duration
+		wantErr  bool
+	}{
+		{name: "empty", value: "", expected: 0},
+		{name: "delete", value: "delete", expected: 0},
+		{name: "delete mixed case", value: " Delete ", expected: 0},
+		{name: "retain hours", value: "retain-for=72h", expected: 72 * time.Hour},
+		{name: "retain minutes", value: "retain-for=90m", expected: 90 * time.Minute},
+		{name: "retain zero", value: "retain-for=0s", wantErr: true},
+		{name: "retain negative", value: "retain-for=-1h", wantErr: true},
+		{name: "retain without unit", value: "retain-for=72", wantErr: true},
+		{name: "retain empty", value: "retain-for=", wantErr: true},
+		{name: "unknown", value: "keep", wantErr: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			retain, err := parseDeleteStrategy(tc.value)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("parseDeleteStrategy(%q) = %v, want error", tc.value, retain)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseDeleteStrategy(%q) returned error: %v", tc.value, err)
+			}
+			if retain != tc.expected {
+				t.Errorf("parseDeleteStrategy(%q) = %v, want %v", tc.value, retain, tc.expected)
+			}
+		})
+	}
+}
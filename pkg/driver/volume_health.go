@@ -0,0 +1,189 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/truenas/truenas-csi/pkg/client"
+)
+
+// defaultVolumeUsageThreshold is the usage percentage above which a filesystem
+// volume is reported abnormal unless configured otherwise
+const defaultVolumeUsageThreshold = 90
+
+// abnormalAlertLevels are the TrueNAS alert levels that make a volume abnormal
+var abnormalAlertLevels = []string{"WARNING", "ERROR", "CRITICAL", "ALERT", "EMERGENCY"}
+
+// volumeHealthSources is the TrueNAS state shared by the conditions of all
+// volumes, fetched once per ControllerGetVolume or ListVolumes call.
+type volumeHealthSources struct {
+	pools  map[string]*client.Pool
+	alerts []client.Alert
+
+	// exports holds the exports of each protocol, fetched on first use
+	exports map[string]exportLookup
+	// exportErrs holds the protocols whose exports could not be fetched
+	exportErrs map[string]error
+}
+
+// exportLookup returns the exports of a protocol, fetching them on first use.
+func (sources *volumeHealthSources) exportLookup(ctx context.Context, c *client.Client, p *protocolDefinition) (exportLookup, error) {
+	if lookup, ok := sources.exports[p.name]; ok {
+		return lookup, nil
+	}
+	if err, ok := sources.exportErrs[p.name]; ok {
+		return nil, err
+	}
+
+	lookup, err := p.listExports(ctx, c)
+	if err != nil {
+		err = fmt.Errorf("failed to list %s exports: %w", p.name, err)
+		sources.exportErrs[p.name] = err
+		return nil, err
+	}
+	sources.exports[p.name] = lookup
+	return lookup, nil
+}
+
+// loadVolumeHealthSources fetches the pools and active alerts. Alerts are
+// optional: if they cannot be read, conditions are built without them.
+func (s *ControllerServer) loadVolumeHealthSources(ctx context.Context) (*volumeHealthSources, error) {
+	pools, err := s.driver.Client().ListPools(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sources := &volumeHealthSources{
+		pools:      make(map[string]*client.Pool, len(pools)),
+		exports:    make(map[string]exportLookup),
+		exportErrs: make(map[string]error),
+	}
+	for i := range pools {
+		sources.pools[pools[i].Name] = &pools[i]
+	}
+
+	alerts, err := s.driver.Client().ListAlerts(ctx)
+	if err != nil {
+		s.driver.Log().V(LogLevelDebug).Info("Building volume conditions without alerts", "error", err)
+		return sources, nil
+	}
+	for _, alert := range alerts {
+		if !alert.Dismissed && slices.Contains(abnormalAlertLevels, strings.ToUpper(alert.Level)) {
+			sources.alerts = append(sources.alerts, alert)
+		}
+	}
+	return sources, nil
+}
+
+// volumeCondition reports every problem TrueNAS knows of that affects the
+// volume's dataset: an unhealthy pool, scrub errors, active alerts, a locked
+// encrypted dataset, usage above the threshold and a missing export.
+func (s *ControllerServer) volumeCondition(ctx context.Context, sources *volumeHealthSources, dataset *client.Dataset) *csi.VolumeCondition {
+	datasetPath := dataset.ID
+	poolName := dataset.Pool
+	if poolName == "" {
+		poolName, _, _ = strings.Cut(datasetPath, "/")
+	}
+
+	var problems []string
+	if pool, ok := sources.pools[poolName]; !ok {
+		problems = append(problems, fmt.Sprintf("pool %s not found", poolName))
+	} else {
+		switch {
+		case pool.Status != "" && pool.Status != "ONLINE":
+			problems = append(problems, fmt.Sprintf("pool %s is %s", pool.Name, pool.Status))
+		case !pool.Healthy:
+			problems = append(problems, fmt.Sprintf("pool %s is not healthy", pool.Name))
+		}
+		if pool.Scan != nil && pool.Scan.Function == "SCRUB" && pool.Scan.Errors > 0 {
+			problems = append(problems, fmt.Sprintf("last scrub of pool %s found %d errors", pool.Name, pool.Scan.Errors))
+		}
+	}
+
+	for _, alert := range sources.alerts {
+		if alertAffects(alert.Args, datasetPath) {
+			problems = append(problems, fmt.Sprintf("TrueNAS alert: %s", strings.TrimSpace(alert.Formatted)))
+		}
+	}
+
+	if dataset.Locked {
+		problems = append(problems, fmt.Sprintf("encrypted dataset %s is locked; unlock it on TrueNAS", datasetPath))
+	}
+
+	if dataset.Type == "FILESYSTEM" && dataset.RefQuota > 0 {
+		used := dataset.Referenced
+		if used == 0 {
+			used = dataset.Used
+		}
+		if percent := used * 100 / dataset.RefQuota; percent >= int64(s.driver.volumeUsageThreshold) {
+			problems = append(problems, fmt.Sprintf("volume is %d%% full (threshold %d%%)", percent, s.driver.volumeUsageThreshold))
+		}
+	}
+
+	if problem := s.exportProblem(ctx, sources, datasetPath, dataset); problem != "" {
+		problems = append(problems, problem)
+	}
+
+	if len(problems) == 0 {
+		return healthyCondition()
+	}
+	return abnormalCondition("%s", strings.Join(problems, "; "))
+}
+
+// exportProblem describes why no protocol exports the dataset, or returns ""
+// if one does. Imported datasets are exported on their first publish, so they
+// are only checked once the driver created their export.
+func (s *ControllerServer) exportProblem(ctx context.Context, sources *volumeHealthSources, datasetPath string, dataset *client.Dataset) string {
+	if dataset.UserProperties[PropertyImported] == "true" && dataset.UserProperties[PropertyExportManaged] != "true" {
+		return ""
+	}
+
+	block := dataset.Type == "VOLUME"
+	var errs []string
+	for _, p := range registeredProtocols() {
+		if p.block != block {
+			continue
+		}
+		lookup, err := sources.exportLookup(ctx, s.driver.Client(), p)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		exported, err := lookup(datasetPath, dataset)
+		if exported {
+			return ""
+		}
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return strings.Join(errs, "; ")
+	}
+
+	return fmt.Sprintf("%s is not exported over %s; its share or target was removed", datasetPath, strings.Join(protocolNamesFor(block), " or "))
+}
+
+// alertAffects reports whether an alert's arguments name the dataset or one of
+// its ancestors, including its pool.
+func alertAffects(args any, datasetPath string) bool {
+	switch v := args.(type) {
+	case string:
+		return v == datasetPath || strings.HasPrefix(datasetPath, v+"/")
+	case map[string]any:
+		for _, value := range v {
+			if alertAffects(value, datasetPath) {
+				return true
+			}
+		}
+	case []any:
+		for _, value := range v {
+			if alertAffects(value, datasetPath) {
+				return true
+			}
+		}
+	}
+	return false
+}
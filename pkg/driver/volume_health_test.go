@@ -0,0 +1,34 @@
+package driver
+
+import "testing"
+
+func TestAlertAffects(t *testing.T) {
+	const datasetPath = "tank/k8s/pvc-1"
+
+	tests := []struct {
+		name     string
+		args     any
+		expected bool
+	}{
+		{name: "nil", args: nil, expected: false},
+		{name: "dataset", args: datasetPath, expected: true},
+		{name: "pool", args: "tank", expected: true},
+		{name: "parent", args: "tank/k8s", expected: true},
+		{name: "name prefix", args: "tank/k8s/pvc", expected: false},
+		{name: "child", args: "tank/k8s/pvc-1/snap", expected: false},
+		{name: "other pool", args: "tank2", expected: false},
+		{name: "map", args: map[string]any{"volume": "tank", "count": 3.0}, expected: true},
+		{name: "map without dataset", args: map[string]any{"volume": "backup"}, expected: false},
+		{name: "list", args: []any{"backup", datasetPath}, expected: true},
+		{name: "nested", args: map[string]any{"datasets": []any{map[string]any{"name": "tank/k8s"}}}, expected: true},
+		{name: "number", args: 42.0, expected: false},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := alertAffects(tc.args, datasetPath); got != tc.expected {
+				t.Errorf("alertAffects(%v, %q) = %v, want %v", tc.args, datasetPath, got, tc.expected)
+			}
+		})
+	}
+}